@@ -0,0 +1,366 @@
+package gitserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	git "github.com/lhchavez/git2go/v29"
+	"github.com/omegaup/githttp"
+	"github.com/omegaup/gitserver/request"
+	base "github.com/omegaup/go-base"
+	"github.com/pkg/errors"
+)
+
+const (
+	// auditLogFilename is the name of the append-only audit log, stored in
+	// the omegaup/ directory of each repository.
+	auditLogFilename = "audit.log"
+
+	// rotatedAuditLogFilename is the name the audit log is renamed to once it
+	// reaches maxAuditLogSize. Only one rotated log is kept.
+	rotatedAuditLogFilename = "audit.log.1"
+
+	// auditLogChunkSize is the size of the chunks in which the audit log is
+	// read backwards.
+	auditLogChunkSize = 64 * 1024
+
+	// AuditOperationAuthorize is recorded when a request is denied
+	// authorization.
+	AuditOperationAuthorize = "authorize"
+
+	// AuditOperationUpdateRef is recorded for each reference that a push, a
+	// .zip upload or a review operation attempted to update.
+	AuditOperationUpdateRef = "update-ref"
+
+	// AuditOperationUploadZip is recorded for each .zip upload.
+	AuditOperationUploadZip = "upload-zip"
+
+	// AuditResultOK is the result of an operation that succeeded.
+	AuditResultOK = "ok"
+
+	// AuditResultRejected is the result of an operation that failed.
+	AuditResultRejected = "rejected"
+)
+
+var (
+	// auditLogMutex serializes the writes to the audit logs, so that entries
+	// are never interleaved.
+	auditLogMutex sync.Mutex
+
+	// maxAuditLogSize is the size after which the audit log is rotated, so
+	// that the audit logs of a repository never take more than twice this.
+	maxAuditLogSize int64 = 8 * 1024 * 1024
+)
+
+// AuditEntry is a single entry of a repository's audit log.
+type AuditEntry struct {
+	Time          time.Time `json:"time"`
+	Operation     string    `json:"operation"`
+	Username      string    `json:"username,omitempty"`
+	AuthMethod    string    `json:"auth_method,omitempty"`
+	RemoteAddr    string    `json:"remote_addr,omitempty"`
+	ReferenceName string    `json:"ref,omitempty"`
+	OldOid        string    `json:"old_oid,omitempty"`
+	NewOid        string    `json:"new_oid,omitempty"`
+	ReviewRef     string    `json:"review_ref,omitempty"`
+	MergeStrategy string    `json:"merge_strategy,omitempty"`
+	Result        string    `json:"result"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// NewAuditEntry returns an AuditEntry for the operation, filled with the
+// information of the request.
+func NewAuditEntry(ctx context.Context, operation string) *AuditEntry {
+	entry := &AuditEntry{
+		Time:      time.Now(),
+		Operation: operation,
+	}
+	if requestContext := request.FromContext(ctx); requestContext != nil {
+		entry.Username = requestContext.Request.Username
+		entry.AuthMethod = requestContext.Request.AuthMethod
+		entry.RemoteAddr = requestContext.Request.RemoteAddr
+		entry.ReviewRef = requestContext.Request.ReviewRef
+	}
+	return entry
+}
+
+// AppendAuditLog appends an entry to the audit log of the repository. The log
+// is rotated first if the entry would make it larger than maxAuditLogSize.
+func AppendAuditLog(repositoryPath string, entry *AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal the audit log entry")
+	}
+	line = append(line, '\n')
+
+	auditLogMutex.Lock()
+	defer auditLogMutex.Unlock()
+
+	auditLogPath := path.Join(repositoryPath, "omegaup", auditLogFilename)
+	if info, err := os.Stat(auditLogPath); err == nil && info.Size()+int64(len(line)) > maxAuditLogSize {
+		rotatedAuditLogPath := path.Join(repositoryPath, "omegaup", rotatedAuditLogFilename)
+		if err := os.Rename(auditLogPath, rotatedAuditLogPath); err != nil {
+			return errors.Wrapf(err, "failed to rotate the audit log at %s", auditLogPath)
+		}
+	}
+	f, err := os.OpenFile(auditLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open the audit log at %s", auditLogPath)
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "failed to write the audit log at %s", auditLogPath)
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrapf(err, "failed to write the audit log at %s", auditLogPath)
+	}
+	return nil
+}
+
+// ReadAuditLog returns the entries of the audit log of the repository, oldest
+// first, including the ones of the rotated log. If limit is positive, only the
+// last limit entries are returned, and only the tail of the logs is read.
+func ReadAuditLog(repositoryPath string, limit int) ([]AuditEntry, error) {
+	var lines [][]byte
+	for _, filename := range []string{auditLogFilename, rotatedAuditLogFilename} {
+		remaining := 0
+		if limit > 0 {
+			remaining = limit - len(lines)
+			if remaining == 0 {
+				break
+			}
+		}
+		auditLogPath := path.Join(repositoryPath, "omegaup", filename)
+		fileLines, err := readAuditLogLines(auditLogPath, remaining)
+		if err != nil {
+			// readAuditLogLines already wrapped the error correctly.
+			return nil, err
+		}
+		lines = append(fileLines, lines...)
+	}
+
+	entries := make([]AuditEntry, len(lines))
+	for i, line := range lines {
+		if err := json.Unmarshal(line, &entries[i]); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse the audit log at %s", repositoryPath)
+		}
+	}
+	return entries, nil
+}
+
+// readAuditLogLines returns the lines of the audit log, oldest first. If limit
+// is positive, only the last limit lines are returned, and the file is read
+// backwards until they are found.
+func readAuditLogLines(auditLogPath string, limit int) ([][]byte, error) {
+	f, err := os.Open(auditLogPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open the audit log at %s", auditLogPath)
+	}
+	defer f.Close()
+
+	var contents []byte
+	partial := false
+	if limit <= 0 {
+		if contents, err = ioutil.ReadAll(f); err != nil {
+			return nil, errors.Wrapf(err, "failed to read the audit log at %s", auditLogPath)
+		}
+	} else {
+		info, err := f.Stat()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to stat the audit log at %s", auditLogPath)
+		}
+		// The last line ends in a newline, so one more newline than the number
+		// of lines is needed to know where the first of them starts.
+		offset := info.Size()
+		for offset > 0 && bytes.Count(contents, []byte{'\n'}) <= limit {
+			chunkSize := int64(auditLogChunkSize)
+			if chunkSize > offset {
+				chunkSize = offset
+			}
+			offset -= chunkSize
+			chunk := make([]byte, chunkSize, chunkSize+int64(len(contents)))
+			if _, err := f.ReadAt(chunk, offset); err != nil {
+				return nil, errors.Wrapf(err, "failed to read the audit log at %s", auditLogPath)
+			}
+			contents = append(chunk, contents...)
+		}
+		partial = offset > 0
+	}
+
+	lines := bytes.Split(contents, []byte{'\n'})
+	if partial {
+		lines = lines[1:]
+	}
+	var result [][]byte
+	for _, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		result = append(result, line)
+	}
+	if limit > 0 && len(result) > limit {
+		result = result[len(result)-limit:]
+	}
+	return result, nil
+}
+
+// auditUpdateRef records the outcome of the update of a single reference.
+// Failures to write to the audit log are logged, but they never cause the
+// update itself to fail.
+func auditUpdateRef(
+	ctx context.Context,
+	repository *git.Repository,
+	referenceName string,
+	oldOid, newOid *git.Oid,
+	updateErr error,
+	log log15.Logger,
+) {
+	entry := NewAuditEntry(ctx, AuditOperationUpdateRef)
+	entry.ReferenceName = referenceName
+	entry.OldOid = oldOid.String()
+	entry.NewOid = newOid.String()
+	entry.Result = AuditResultOK
+	if updateErr != nil {
+		entry.Result = AuditResultRejected
+		entry.Error = updateErr.Error()
+	}
+	if err := AppendAuditLog(repository.Path(), entry); err != nil {
+		log.Error("Failed to write the audit log", "ref", referenceName, "err", err)
+	}
+}
+
+// auditAppliedRefs records the outcome of the updates of the references once
+// the push is done. The updates are only recorded as successful if the
+// references currently point to the commit they were updated to, since a push
+// can still be rejected after it was preprocessed.
+func auditAppliedRefs(
+	ctx context.Context,
+	repository *git.Repository,
+	updatedRefs []githttp.UpdatedRef,
+	log log15.Logger,
+) {
+	applied := make(map[string]bool)
+	for _, updatedRef := range appliedRefs(repository, updatedRefs) {
+		applied[updatedRef.Name] = true
+	}
+	for _, updatedRef := range updatedRefs {
+		entry := NewAuditEntry(ctx, AuditOperationUpdateRef)
+		entry.ReferenceName = updatedRef.Name
+		entry.OldOid = updatedRef.From
+		entry.NewOid = updatedRef.To
+		entry.Result = AuditResultOK
+		if !applied[updatedRef.Name] {
+			entry.Result = AuditResultRejected
+			entry.Error = "the reference was not updated"
+			if requestContext := request.FromContext(ctx); requestContext != nil && requestContext.Err != nil {
+				entry.Error = requestContext.Err.Error()
+			}
+		}
+		if err := AppendAuditLog(repository.Path(), entry); err != nil {
+			log.Error("Failed to write the audit log", "ref", updatedRef.Name, "err", err)
+		}
+	}
+}
+
+type auditLogHandler struct {
+	rootPath string
+	protocol *githttp.GitProtocol
+	metrics  base.Metrics
+	log      log15.Logger
+}
+
+func (h *auditLogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	splitPath := strings.SplitN(r.URL.Path[1:], "/", 2)
+	if len(splitPath) != 2 || splitPath[1] != "audit-log" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	repositoryName := splitPath[0]
+	if strings.HasPrefix(repositoryName, ".") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 0
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitParam); err != nil || limit < 0 {
+			h.log.Error("invalid limit", "limit", limitParam)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx := request.NewContext(r.Context(), h.metrics)
+	requestContext := request.FromContext(ctx)
+	requestContext.Request.RemoteAddr = r.RemoteAddr
+
+	repositoryPath := path.Join(h.rootPath, repositoryName)
+	h.log.Info(
+		"Request",
+		"Method", r.Method,
+		"path", repositoryPath,
+	)
+	if _, err := os.Stat(repositoryPath); os.IsNotExist(err) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	level, _ := h.protocol.AuthCallback(ctx, w, r, repositoryName, githttp.OperationPull)
+	if level == githttp.AuthorizationDenied {
+		return
+	}
+	if !requestContext.Request.IsAdmin {
+		h.log.Error(
+			"cannot access the audit log due to not having permissions",
+			"request", requestContext.Request,
+		)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	entries, err := ReadAuditLog(repositoryPath, limit)
+	if err != nil {
+		h.log.Error("failed to read the audit log", "path", repositoryPath, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "\t")
+	encoder.Encode(entries)
+}
+
+// AuditLogHandler is the HTTP handler that allows administrators to read the
+// audit log of a repository.
+func AuditLogHandler(
+	rootPath string,
+	protocol *githttp.GitProtocol,
+	metrics base.Metrics,
+	log log15.Logger,
+) http.Handler {
+	return &auditLogHandler{
+		rootPath: rootPath,
+		protocol: protocol,
+		metrics:  metrics,
+		log:      log,
+	}
+}
@@ -0,0 +1,288 @@
+package gitserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	git "github.com/lhchavez/git2go/v29"
+	"github.com/omegaup/githttp"
+	"github.com/omegaup/gitserver/gitservertest"
+	base "github.com/omegaup/go-base"
+)
+
+func getAuditLog(
+	t *testing.T,
+	authorization string,
+	problemAlias string,
+	query string,
+	ts *httptest.Server,
+) (int, []AuditEntry) {
+	req, err := http.NewRequest("GET", ts.URL+"/"+problemAlias+"/audit-log"+query, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", authorization)
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Failed to get the audit log: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return res.StatusCode, nil
+	}
+
+	var entries []AuditEntry
+	if err := json.NewDecoder(res.Body).Decode(&entries); err != nil {
+		t.Fatalf("Failed to unmarshal the audit log: %v", err)
+	}
+	return res.StatusCode, entries
+}
+
+func TestAuditLog(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+
+	log := base.StderrLog()
+	protocol := NewGitProtocol(authorize, nil, true, OverallWallTimeHardLimit, fakeInteractiveSettingsCompiler, log)
+	ts := httptest.NewServer(GitHandler(tmpDir, protocol, &base.NoOpMetrics{}, log))
+	defer ts.Close()
+	zipTs := httptest.NewServer(ZipHandler(tmpDir, protocol, &base.NoOpMetrics{}, log))
+	defer zipTs.Close()
+	auditTs := httptest.NewServer(AuditLogHandler(tmpDir, protocol, &base.NoOpMetrics{}, log))
+	defer auditTs.Close()
+
+	problemAlias := "sumas"
+
+	zipContents, err := gitservertest.CreateZip(
+		map[string]io.Reader{
+			"settings.json":          strings.NewReader(gitservertest.DefaultSettingsJSON),
+			"cases/0.in":             strings.NewReader("1 2\n"),
+			"cases/0.out":            strings.NewReader("3\n"),
+			"statements/es.markdown": strings.NewReader("Sumas\n"),
+		},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create zip: %v", err)
+	}
+	updateResult := postZip(
+		t,
+		adminAuthorization,
+		problemAlias,
+		nil,
+		ZipMergeStrategyTheirs,
+		zipContents,
+		"initial commit",
+		true, // create
+		true, // useMultipartFormData
+		zipTs,
+	)
+
+	newOid, packContents := createCommit(
+		t,
+		tmpDir,
+		problemAlias,
+		&git.Oid{},
+		map[string]io.Reader{
+			"settings.json": strings.NewReader(gitservertest.DefaultSettingsJSON),
+		},
+		"Invalid commit",
+		log,
+	)
+	push(
+		t,
+		tmpDir,
+		editorAuthorization,
+		problemAlias,
+		"refs/heads/arbitrarybranchname",
+		&git.Oid{}, newOid,
+		packContents,
+		[]githttp.PktLineResponse{
+			{Line: "unpack ok\n", Err: nil},
+			{Line: "ng refs/heads/arbitrarybranchname invalid-ref\n", Err: nil},
+		},
+		ts,
+	)
+
+	// Only administrators can read the audit log.
+	if status, _ := getAuditLog(t, editorAuthorization, problemAlias, "", auditTs); status != http.StatusForbidden {
+		t.Errorf("Expected status %d, got %d", http.StatusForbidden, status)
+	}
+
+	status, entries := getAuditLog(t, adminAuthorization, problemAlias, "", auditTs)
+	if status != http.StatusOK {
+		t.Fatalf("Failed to get the audit log: status %d", status)
+	}
+
+	var masterEntry, zipEntry, rejectedEntry *AuditEntry
+	for i, entry := range entries {
+		if entry.Username == "" || entry.RemoteAddr == "" {
+			t.Errorf("Missing request information in entry %v", entry)
+		}
+		if entry.Operation == AuditOperationUpdateRef && entry.ReferenceName == "refs/heads/master" {
+			masterEntry = &entries[i]
+		} else if entry.Operation == AuditOperationUploadZip {
+			zipEntry = &entries[i]
+		} else if entry.Operation == AuditOperationUpdateRef && entry.ReferenceName == "refs/heads/arbitrarybranchname" {
+			rejectedEntry = &entries[i]
+		}
+	}
+
+	var masterUpdatedRef *githttp.UpdatedRef
+	for i, updatedRef := range updateResult.UpdatedRefs {
+		if updatedRef.Name == "refs/heads/master" {
+			masterUpdatedRef = &updateResult.UpdatedRefs[i]
+		}
+	}
+	if masterUpdatedRef == nil {
+		t.Fatalf("master was not updated: %v", updateResult)
+	}
+	if masterEntry == nil ||
+		masterEntry.Username != "admin" ||
+		masterEntry.Result != AuditResultOK ||
+		masterEntry.NewOid != masterUpdatedRef.To {
+		t.Errorf("Unexpected master entry %v", masterEntry)
+	}
+	if zipEntry == nil ||
+		zipEntry.MergeStrategy != ZipMergeStrategyTheirs.String() ||
+		zipEntry.Result != AuditResultOK ||
+		zipEntry.NewOid != masterUpdatedRef.To {
+		t.Errorf("Unexpected zip entry %v", zipEntry)
+	}
+	if rejectedEntry == nil ||
+		rejectedEntry.Username != "editor" ||
+		rejectedEntry.Result != AuditResultRejected ||
+		rejectedEntry.Error == "" ||
+		rejectedEntry.NewOid != newOid.String() {
+		t.Errorf("Unexpected rejected entry %v", rejectedEntry)
+	}
+
+	// The limit returns the most recent entries.
+	status, entries = getAuditLog(t, adminAuthorization, problemAlias, "?limit=1", auditTs)
+	if status != http.StatusOK {
+		t.Fatalf("Failed to get the audit log: status %d", status)
+	}
+	if len(entries) != 1 || entries[0].ReferenceName != "refs/heads/arbitrarybranchname" {
+		t.Errorf("Unexpected entries %v", entries)
+	}
+}
+
+func TestReadAuditLogLimit(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+	if err := os.Mkdir(path.Join(tmpDir, "omegaup"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	// Enough entries so that the log has to be read in several chunks.
+	const entryCount = 2000
+	for i := 0; i < entryCount; i++ {
+		if err := AppendAuditLog(tmpDir, &AuditEntry{
+			Operation:     AuditOperationUpdateRef,
+			ReferenceName: fmt.Sprintf("refs/changes/%d", i),
+			Result:        AuditResultOK,
+		}); err != nil {
+			t.Fatalf("Failed to append to the audit log: %v", err)
+		}
+	}
+
+	for _, limit := range []int{0, 1, 1500, entryCount, entryCount + 1} {
+		entries, err := ReadAuditLog(tmpDir, limit)
+		if err != nil {
+			t.Fatalf("Failed to read the audit log: %v", err)
+		}
+		expectedCount := entryCount
+		if limit > 0 && limit < entryCount {
+			expectedCount = limit
+		}
+		if len(entries) != expectedCount {
+			t.Fatalf("limit %d: expected %d entries, got %d", limit, expectedCount, len(entries))
+		}
+		for i, entry := range entries {
+			expected := fmt.Sprintf("refs/changes/%d", entryCount-expectedCount+i)
+			if entry.ReferenceName != expected {
+				t.Errorf("limit %d: expected entry %d to be %s, got %s", limit, i, expected, entry.ReferenceName)
+				break
+			}
+		}
+	}
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+	if err := os.Mkdir(path.Join(tmpDir, "omegaup"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	originalMaxAuditLogSize := maxAuditLogSize
+	defer func() { maxAuditLogSize = originalMaxAuditLogSize }()
+	maxAuditLogSize = 1024
+
+	const entryCount = 100
+	for i := 0; i < entryCount; i++ {
+		if err := AppendAuditLog(tmpDir, &AuditEntry{
+			Operation:     AuditOperationUpdateRef,
+			ReferenceName: fmt.Sprintf("refs/changes/%d", i),
+			Result:        AuditResultOK,
+		}); err != nil {
+			t.Fatalf("Failed to append to the audit log: %v", err)
+		}
+	}
+
+	for _, filename := range []string{auditLogFilename, rotatedAuditLogFilename} {
+		info, err := os.Stat(path.Join(tmpDir, "omegaup", filename))
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %v", filename, err)
+		}
+		if info.Size() > maxAuditLogSize {
+			t.Errorf("Expected %s to be at most %d bytes, got %d", filename, maxAuditLogSize, info.Size())
+		}
+	}
+
+	// Only the most recent entries are kept, and they span both logs.
+	entries, err := ReadAuditLog(tmpDir, 0)
+	if err != nil {
+		t.Fatalf("Failed to read the audit log: %v", err)
+	}
+	if len(entries) == 0 || len(entries) >= entryCount {
+		t.Fatalf("Expected some of the entries to be dropped, got %d", len(entries))
+	}
+	for i, entry := range entries {
+		expected := fmt.Sprintf("refs/changes/%d", entryCount-len(entries)+i)
+		if entry.ReferenceName != expected {
+			t.Errorf("Expected entry %d to be %s, got %s", i, expected, entry.ReferenceName)
+			break
+		}
+	}
+	limitedEntries, err := ReadAuditLog(tmpDir, len(entries)-1)
+	if err != nil {
+		t.Fatalf("Failed to read the audit log: %v", err)
+	}
+	if !reflect.DeepEqual(entries[1:], limitedEntries) {
+		t.Errorf("Expected %v, got %v", entries[1:], limitedEntries)
+	}
+}
@@ -0,0 +1,161 @@
+package gitserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path"
+	"sync"
+
+	git "github.com/lhchavez/git2go/v29"
+	base "github.com/omegaup/go-base"
+	"github.com/pkg/errors"
+)
+
+const (
+	// changeAuthorsFilename is the name of the file that records who pushed
+	// each of the commits of refs/changes/*, stored in the omegaup/ directory
+	// of each repository.
+	changeAuthorsFilename = "change-authors"
+)
+
+var (
+	// changeAuthorsMutex serializes the accesses to the change authors files.
+	changeAuthorsMutex sync.Mutex
+)
+
+// changeAuthor is a single entry of the change authors file.
+type changeAuthor struct {
+	Commit   string `json:"commit"`
+	Username string `json:"username"`
+}
+
+// readChangeAuthors returns the authenticated users that pushed the commit to
+// refs/changes/*.
+func readChangeAuthors(repositoryPath string, commitID *git.Oid) (map[string]bool, error) {
+	changeAuthorsMutex.Lock()
+	defer changeAuthorsMutex.Unlock()
+
+	return readChangeAuthorsLocked(repositoryPath, commitID)
+}
+
+func readChangeAuthorsLocked(repositoryPath string, commitID *git.Oid) (map[string]bool, error) {
+	changeAuthorsPath := path.Join(repositoryPath, "omegaup", changeAuthorsFilename)
+	authors := make(map[string]bool)
+	f, err := os.Open(changeAuthorsPath)
+	if os.IsNotExist(err) {
+		return authors, nil
+	}
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to open the change authors at %s",
+				changeAuthorsPath,
+			),
+		)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry changeAuthor
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, base.ErrorWithCategory(
+				ErrInternalGit,
+				errors.Wrapf(
+					err,
+					"failed to parse the change authors at %s",
+					changeAuthorsPath,
+				),
+			)
+		}
+		if entry.Commit == commitID.String() {
+			authors[entry.Username] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to read the change authors at %s",
+				changeAuthorsPath,
+			),
+		)
+	}
+	return authors, nil
+}
+
+// recordChangeAuthor records that the authenticated user pushed the commit to
+// refs/changes/*. Neither the author of the commit nor the review ledger can
+// be trusted for this, since anyone can write them.
+func recordChangeAuthor(repositoryPath string, commitID *git.Oid, username string) error {
+	changeAuthorsMutex.Lock()
+	defer changeAuthorsMutex.Unlock()
+
+	authors, err := readChangeAuthorsLocked(repositoryPath, commitID)
+	if err != nil {
+		// readChangeAuthorsLocked already wrapped the error correctly.
+		return err
+	}
+	if authors[username] {
+		return nil
+	}
+
+	line, err := json.Marshal(&changeAuthor{
+		Commit:   commitID.String(),
+		Username: username,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal the change author")
+	}
+	line = append(line, '\n')
+
+	omegaupPath := path.Join(repositoryPath, "omegaup")
+	if err := os.MkdirAll(omegaupPath, 0755); err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to create omegaUp git directory at %s",
+				omegaupPath,
+			),
+		)
+	}
+	changeAuthorsPath := path.Join(omegaupPath, changeAuthorsFilename)
+	f, err := os.OpenFile(changeAuthorsPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to open the change authors at %s",
+				changeAuthorsPath,
+			),
+		)
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to write the change authors at %s",
+				changeAuthorsPath,
+			),
+		)
+	}
+	if err := f.Close(); err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to write the change authors at %s",
+				changeAuthorsPath,
+			),
+		)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path"
+
+	git "github.com/lhchavez/git2go/v29"
+	"github.com/omegaup/gitserver"
+	base "github.com/omegaup/go-base"
+)
+
+var (
+	repositoryPath = flag.String("repository-path", "", "Path of the git repository")
+	outputPath     = flag.String("output-path", "", "Path of the Kattis package .zip file. Defaults to stdout")
+	referenceName  = flag.String("ref", "refs/heads/master", "Reference to export")
+	problemName    = flag.String("problem-name", "", "Name of the problem. Defaults to the name of the repository")
+)
+
+func main() {
+	defer git.Shutdown()
+
+	flag.Parse()
+	log := base.StderrLog()
+
+	if *repositoryPath == "" {
+		log.Crit("repository path cannot be empty. Please specify one with -repository-path")
+		os.Exit(1)
+	}
+	if *problemName == "" {
+		*problemName = path.Base(path.Clean(*repositoryPath))
+	}
+
+	repo, err := git.OpenRepository(*repositoryPath)
+	if err != nil {
+		log.Crit("failed to open the repository", "path", *repositoryPath, "err", err)
+		os.Exit(1)
+	}
+	defer repo.Free()
+
+	ref, err := repo.References.Lookup(*referenceName)
+	if err != nil {
+		log.Crit("failed to lookup the reference", "ref", *referenceName, "err", err)
+		os.Exit(1)
+	}
+	defer ref.Free()
+
+	var w io.Writer = os.Stdout
+	if *outputPath != "" {
+		f, err := os.Create(*outputPath)
+		if err != nil {
+			log.Crit("failed to create the package", "path", *outputPath, "err", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := gitserver.ExportKattisPackage(repo, ref.Target(), *problemName, w, log); err != nil {
+		log.Crit("failed to export the Kattis package", "path", *repositoryPath, "err", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+
+	git "github.com/lhchavez/git2go/v29"
+	"github.com/omegaup/gitserver"
+	base "github.com/omegaup/go-base"
+)
+
+var (
+	repositoryPath     = flag.String("repository-path", "", "Path of the git repository to check")
+	rootPath           = flag.String("root-path", "", "Path of the directory with all the git repositories to check")
+	repair             = flag.Bool("repair", false, "Repair the issues that can be fixed")
+	workers            = flag.Int("workers", runtime.NumCPU(), "Number of repositories to check in parallel")
+	libinteractivePath = flag.String("libinteractive-path", "/usr/share/java/libinteractive.jar", "Path of libinteractive.jar")
+	reportPath         = flag.String(
+		"report-path",
+		"",
+		"path of a json file with the report. Defaults to stdout",
+	)
+	commitDescriptionsPath = flag.String(
+		"commit-descriptions-path",
+		"",
+		"path of a json file with the additional commit descriptions of the server",
+	)
+)
+
+// extendCommitDescriptions adds the paths that are added by the server to the
+// default commit descriptions, so that the split branches are checked against
+// the same descriptions that omegaup-rebuild-split-branches uses.
+func extendCommitDescriptions() error {
+	if *commitDescriptionsPath == "" {
+		return nil
+	}
+	contents, err := ioutil.ReadFile(*commitDescriptionsPath)
+	if err != nil {
+		return err
+	}
+	var configs []gitserver.CommitDescriptionConfig
+	if err := json.Unmarshal(contents, &configs); err != nil {
+		return err
+	}
+	gitserver.DefaultCommitDescriptions, err = gitserver.ExtendCommitDescriptions(
+		gitserver.DefaultCommitDescriptions,
+		configs,
+	)
+	return err
+}
+
+func main() {
+	defer git.Shutdown()
+
+	flag.Parse()
+	log := base.StderrLog()
+
+	if (*repositoryPath == "") == (*rootPath == "") {
+		log.Crit("exactly one of -repository-path or -root-path must be specified")
+		os.Exit(1)
+	}
+
+	if err := extendCommitDescriptions(); err != nil {
+		log.Crit(
+			"failed to read the commit descriptions",
+			"path", *commitDescriptionsPath,
+			"err", err,
+		)
+		os.Exit(1)
+	}
+
+	var w io.Writer = os.Stdout
+	if *reportPath != "" {
+		f, err := os.Create(*reportPath)
+		if err != nil {
+			log.Crit(
+				"failed to create report JSON file",
+				"path", *reportPath,
+				"err", err,
+			)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	compiler := &gitserver.LibinteractiveCompiler{
+		LibinteractiveJarPath: *libinteractivePath,
+		Log:                   log,
+	}
+	protocol := gitserver.NewGitProtocol(
+		nil,
+		nil,
+		true,
+		gitserver.OverallWallTimeHardLimit,
+		compiler,
+		log,
+	)
+
+	var results []*gitserver.FsckResult
+	if *repositoryPath != "" {
+		result, err := gitserver.CheckRepository(
+			context.Background(),
+			*repositoryPath,
+			protocol,
+			compiler,
+			*repair,
+			log,
+		)
+		if result == nil {
+			result = &gitserver.FsckResult{Repository: *repositoryPath, Issues: []*gitserver.FsckIssue{}}
+		}
+		if err != nil {
+			log.Error("Failed to check repository", "path", *repositoryPath, "err", err)
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	} else {
+		var err error
+		results, err = gitserver.CheckAllRepositories(
+			context.Background(),
+			*rootPath,
+			protocol,
+			compiler,
+			*repair,
+			*workers,
+			log,
+		)
+		if err != nil {
+			log.Crit("Failed to check repositories", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(results); err != nil {
+		log.Crit(
+			"failed to marshal report",
+			"path", *reportPath,
+			"err", err,
+		)
+		os.Exit(1)
+	}
+
+	for _, result := range results {
+		if result.HasUnfixedIssues() {
+			os.Exit(1)
+		}
+	}
+}
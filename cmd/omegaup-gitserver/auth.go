@@ -13,12 +13,15 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/o1egl/paseto"
 	"github.com/omegaup/githttp"
+	"github.com/omegaup/gitserver"
 	"github.com/omegaup/gitserver/request"
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/ed25519"
 	"net/http"
 	"net/url"
+	"os"
+	"path"
 	"strings"
 	"time"
 )
@@ -34,6 +37,12 @@ const (
 	basicAuthenticationScheme               = "Basic"
 	bearerAuthenticationScheme              = "Bearer"
 	omegaUpSharedSecretAuthenticationScheme = "OmegaUpSharedSecret"
+
+	// auditDenialBurst is the number of requests with invalid credentials
+	// that are recorded in the audit logs for each remote address in every
+	// auditDenialInterval.
+	auditDenialBurst    = 10
+	auditDenialInterval = time.Minute
 )
 
 type omegaupAuthorization struct {
@@ -41,6 +50,11 @@ type omegaupAuthorization struct {
 	db        *sql.DB
 	publicKey ed25519.PublicKey
 
+	// denialRateLimiter limits how many requests with invalid credentials
+	// are recorded in the audit logs for each remote address, since anyone
+	// can make them.
+	denialRateLimiter *addressRateLimiter
+
 	config *Config
 }
 
@@ -248,12 +262,15 @@ func (a *omegaupAuthorization) authorize(
 	operation githttp.GitOperation,
 ) (githttp.AuthorizationLevel, string) {
 	basicAuthUsername, password, ok := r.BasicAuth()
-	var username, problem string
+	var username, problem, authMethod string
 	if ok {
 		username, problem, ok = a.parseUsernameAndPassword(basicAuthUsername, password, repositoryName)
+		authMethod = basicAuthenticationScheme
 	}
 	if !ok {
-		username, problem, ok = a.parseAuthorizationHeader(r.Header.Get("Authorization"), repositoryName)
+		authorizationHeader := r.Header.Get("Authorization")
+		username, problem, ok = a.parseAuthorizationHeader(authorizationHeader, repositoryName)
+		authMethod = strings.SplitN(authorizationHeader, " ", 2)[0]
 	}
 
 	if basicAuthUsername != "" && basicAuthUsername != username {
@@ -290,6 +307,11 @@ func (a *omegaupAuthorization) authorize(
 			"username", username,
 			"repository", repositoryName,
 		)
+		if authMethod != "" && (a.denialRateLimiter == nil || a.denialRateLimiter.allow(r.RemoteAddr)) {
+			// git clients first try without credentials, so only the requests
+			// that provided the wrong ones are recorded.
+			a.auditDenial(r, repositoryName, username, authMethod, "invalid credentials")
+		}
 		return githttp.AuthorizationDenied, ""
 	}
 
@@ -301,12 +323,14 @@ func (a *omegaupAuthorization) authorize(
 			"repository", repositoryName,
 			"problem", problem,
 		)
+		a.auditDenial(r, repositoryName, username, authMethod, "mismatched problem name")
 		return githttp.AuthorizationDenied, ""
 	}
 
 	requestContext := request.FromContext(ctx)
 	requestContext.Request.ProblemName = problem
 	requestContext.Request.Username = username
+	requestContext.Request.AuthMethod = authMethod
 	if username == "omegaup:system" || *insecureSkipAuthorization {
 		// This is the frontend, and we trust it completely.
 		requestContext.Request.IsAdmin = true
@@ -319,11 +343,17 @@ func (a *omegaupAuthorization) authorize(
 		requestContext.Request.CanView = true
 		requestContext.Request.CanEdit = true
 	} else {
+		frontendStart := time.Now()
 		auth, err := a.getAuthorizationFromFrontend(
 			username,
 			problem,
 		)
+		requestContext.Metrics.SummaryObserve(
+			"gitserver_frontend_authorization_duration_seconds",
+			time.Since(frontendStart).Seconds(),
+		)
 		if err != nil {
+			requestContext.Metrics.CounterAdd("gitserver_frontend_authorization_failures_total", 1)
 			log.Error(
 				"Auth",
 				"username", username,
@@ -331,6 +361,7 @@ func (a *omegaupAuthorization) authorize(
 				"operation", operation,
 				"err", err,
 			)
+			a.auditDenial(r, repositoryName, username, authMethod, err.Error())
 			return githttp.AuthorizationDenied, username
 		}
 		requestContext.Request.HasSolved = auth.HasSolved
@@ -347,10 +378,38 @@ func (a *omegaupAuthorization) authorize(
 	return githttp.AuthorizationAllowed, username
 }
 
+// auditDenial records a denied authorization in the audit log of the
+// repository, if it exists.
+func (a *omegaupAuthorization) auditDenial(
+	r *http.Request,
+	repositoryName string,
+	username string,
+	authMethod string,
+	reason string,
+) {
+	if strings.HasPrefix(repositoryName, ".") || strings.Contains(repositoryName, "/") {
+		return
+	}
+	repositoryPath := path.Join(a.config.Gitserver.RootPath, repositoryName)
+	if _, err := os.Stat(repositoryPath); err != nil {
+		return
+	}
+	entry := gitserver.NewAuditEntry(r.Context(), gitserver.AuditOperationAuthorize)
+	entry.Username = username
+	entry.AuthMethod = authMethod
+	entry.RemoteAddr = r.RemoteAddr
+	entry.Result = gitserver.AuditResultRejected
+	entry.Error = reason
+	if err := gitserver.AppendAuditLog(repositoryPath, entry); err != nil {
+		a.log.Error("Failed to write the audit log", "repository", repositoryName, "err", err)
+	}
+}
+
 func createAuthorizationCallback(config *Config, log log15.Logger) (githttp.AuthorizationCallback, error) {
 	auth := omegaupAuthorization{
-		log:    log,
-		config: config,
+		log:               log,
+		denialRateLimiter: newAddressRateLimiter(auditDenialBurst, auditDenialInterval),
+		config:            config,
 	}
 
 	if config.Gitserver.AllowSecretTokenAuthentication {
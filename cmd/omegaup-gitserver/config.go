@@ -3,6 +3,10 @@ package main
 import (
 	"encoding/json"
 	"io"
+	"time"
+
+	"github.com/omegaup/gitserver"
+	base "github.com/omegaup/go-base"
 )
 
 // DbConfig represents the configuration for the database.
@@ -44,6 +48,12 @@ type GitserverConfig struct {
 	// LibinteractivePath is the path of libinteractive.jar.
 	LibinteractivePath string
 
+	// TrustedProxies are the IP addresses or CIDR networks of the reverse
+	// proxies in front of the server. The X-Forwarded-For header is only
+	// honored for requests that come from them, so that the audit log records
+	// the address of the client.
+	TrustedProxies []string
+
 	// AllowDirectPushToMaster determines whether gitserver allows pushing
 	// directly to master.
 	AllowDirectPushToMaster bool
@@ -51,6 +61,61 @@ type GitserverConfig struct {
 	// FrontendAuthorizationProblemRequestURL is the URL of the frontend API
 	// request to get user's privileges for a problem.
 	FrontendAuthorizationProblemRequestURL string
+
+	// PublishingWorkers is the number of workers that push the published
+	// branch of problems to the remote repositories configured in their
+	// refs/meta/config. Zero disables publishing.
+	PublishingWorkers int
+
+	// PublishingSSHKeyPath is the path of the private SSH key used to
+	// authenticate with ssh:// publishing remotes.
+	PublishingSSHKeyPath string
+
+	// PublishingKnownHostsPath is the path of the known_hosts file used to
+	// verify the host keys of ssh:// publishing remotes. It is required if
+	// PublishingSSHKeyPath is set.
+	PublishingKnownHostsPath string
+
+	// PublishingArchiveRoot is the directory where 'archive' publishing
+	// targets are written to. If empty, 'archive' targets are disabled.
+	PublishingArchiveRoot string
+
+	// Webhooks are notified of the reference updates of every problem, in
+	// addition to the webhooks configured in each problem.
+	Webhooks []gitserver.WebhookConfig
+
+	// WebhookQueuePath is the directory where pending webhook deliveries are
+	// stored. If empty, webhooks are disabled.
+	WebhookQueuePath string
+
+	// WebhookWorkers is the number of workers that deliver webhooks.
+	WebhookWorkers int
+
+	// ZipImportQueuePath is the directory where the asynchronous .zip uploads
+	// are stored until they are imported. If empty, asynchronous uploads are
+	// disabled.
+	ZipImportQueuePath string
+
+	// ZipImportWorkers is the number of workers that import the asynchronous
+	// .zip uploads.
+	ZipImportWorkers int
+
+	// CommitDescriptions are additional paths that go to each of the split
+	// branches, on top of gitserver.DefaultCommitDescriptions.
+	CommitDescriptions []gitserver.CommitDescriptionConfig
+
+	// MaintenanceInterval is the amount of time between scans of the
+	// repositories that need their packfiles consolidated. Zero disables
+	// maintenance.
+	MaintenanceInterval base.Duration
+
+	// MaintenancePackThreshold is the number of packfiles above which a
+	// repository is repacked.
+	MaintenancePackThreshold int
+
+	// MaintenancePruneGracePeriod is the minimum age of the unreachable
+	// objects that are pruned.
+	MaintenancePruneGracePeriod base.Duration
 }
 
 // Config represents the configuration for the whole program.
@@ -78,6 +143,17 @@ var defaultConfig = Config{
 		LibinteractivePath:                     "/usr/share/java/libinteractive.jar",
 		AllowDirectPushToMaster:                false,
 		FrontendAuthorizationProblemRequestURL: "https://omegaup.com/api/authorization/problem/",
+		PublishingWorkers:                      0,
+		PublishingSSHKeyPath:                   "",
+		PublishingKnownHostsPath:               "",
+		PublishingArchiveRoot:                  "",
+		WebhookQueuePath:                       "",
+		WebhookWorkers:                         2,
+		ZipImportQueuePath:                     "",
+		ZipImportWorkers:                       2,
+		MaintenanceInterval:                    base.Duration(time.Hour),
+		MaintenancePackThreshold:               gitserver.DefaultMaintenancePackThreshold,
+		MaintenancePruneGracePeriod:            base.Duration(gitserver.DefaultMaintenancePruneGracePeriod),
 	},
 }
 
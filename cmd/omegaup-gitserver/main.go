@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/pprof"
 	"os"
@@ -20,6 +21,8 @@ import (
 	"github.com/omegaup/gitserver"
 	"github.com/omegaup/gitserver/request"
 	base "github.com/omegaup/go-base"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 var (
@@ -47,6 +50,8 @@ func referenceDiscovery(
 ) bool {
 	requestContext := request.FromContext(ctx)
 	if requestContext.Request.CanEdit {
+		// Editors can view everything, including master and the release tags
+		// under refs/tags/, which always point to commits in master.
 		return true
 	}
 	if requestContext.Request.HasSolved {
@@ -67,22 +72,45 @@ func referenceDiscovery(
 
 type muxGitHandler struct {
 	log            log15.Logger
+	metrics        base.Metrics
 	gitHandler     http.Handler
 	zipHandler     http.Handler
+	reviewHandler  http.Handler
+	auditHandler   http.Handler
 	metricsHandler http.Handler
+	publisher      *gitserver.Publisher
+	trustedProxies trustedProxies
 }
 
 func muxHandler(
 	rootPath string,
 	protocol *githttp.GitProtocol,
+	publisher *gitserver.Publisher,
+	webhookQueue *gitserver.WebhookQueue,
+	zipImportQueue *gitserver.ZipImportQueue,
+	metrics base.Metrics,
+	metricsHandler http.Handler,
+	trustedProxies trustedProxies,
 	log log15.Logger,
 ) http.Handler {
-	metrics, metricsHandler := gitserver.SetupMetrics()
+	gitHandler := gitserver.GitHandler(rootPath, protocol, metrics, log)
+	zipHandler := gitserver.AsyncZipHandler(rootPath, protocol, zipImportQueue, metrics, log)
+	reviewHandler := gitserver.ReviewHandler(rootPath, protocol, metrics, log)
+	if webhookQueue != nil {
+		gitHandler = gitserver.WebhookHandler(rootPath, gitHandler, webhookQueue, metrics, log)
+		zipHandler = gitserver.WebhookHandler(rootPath, zipHandler, webhookQueue, metrics, log)
+		reviewHandler = gitserver.WebhookHandler(rootPath, reviewHandler, webhookQueue, metrics, log)
+	}
 	return &muxGitHandler{
 		log:            log,
-		gitHandler:     gitserver.GitHandler(rootPath, protocol, metrics, log),
-		zipHandler:     gitserver.ZipHandler(rootPath, protocol, metrics, log),
+		metrics:        metrics,
+		publisher:      publisher,
+		gitHandler:     gitHandler,
+		zipHandler:     zipHandler,
+		reviewHandler:  reviewHandler,
+		auditHandler:   gitserver.AuditLogHandler(rootPath, protocol, metrics, log),
 		metricsHandler: metricsHandler,
+		trustedProxies: trustedProxies,
 	}
 }
 
@@ -90,11 +118,42 @@ func (h *muxGitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	splitPath := strings.SplitN(r.URL.Path[1:], "/", 2)
 	if len(splitPath) >= 1 && splitPath[0] == "metrics" {
 		h.metricsHandler.ServeHTTP(w, r)
-	} else if len(splitPath) == 2 && splitPath[1] == "git-upload-zip" {
+		return
+	}
+
+	if len(h.trustedProxies) > 0 {
+		remoteAddr := h.trustedProxies.remoteAddr(r)
+		r = r.WithContext(r.Context())
+		r.RemoteAddr = remoteAddr
+	}
+
+	h.metrics.GaugeAdd("gitserver_requests_in_flight", 1)
+	defer h.metrics.GaugeAdd("gitserver_requests_in_flight", -1)
+	if len(splitPath) == 2 && splitPath[1] == "git-upload-zip" {
+		h.zipHandler.ServeHTTP(w, r)
+		h.notifyPublisher(r, splitPath[0])
+	} else if len(splitPath) == 2 && strings.HasPrefix(splitPath[1], "git-upload-zip/") {
 		h.zipHandler.ServeHTTP(w, r)
+	} else if len(splitPath) == 2 && (splitPath[1] == "git-review" || splitPath[1] == "git-apply-suggestions") {
+		h.reviewHandler.ServeHTTP(w, r)
+	} else if len(splitPath) == 2 && splitPath[1] == "audit-log" {
+		h.auditHandler.ServeHTTP(w, r)
 	} else {
 		h.gitHandler.ServeHTTP(w, r)
+		if len(splitPath) == 2 && splitPath[1] == "git-receive-pack" {
+			h.notifyPublisher(r, splitPath[0])
+		}
+	}
+}
+
+// notifyPublisher lets the publisher know that the repository might have been
+// updated. The publisher itself figures out whether the published branch
+// moved.
+func (h *muxGitHandler) notifyPublisher(r *http.Request, repositoryName string) {
+	if h.publisher == nil || r.Method != "POST" {
+		return
 	}
+	h.publisher.Notify(repositoryName)
 }
 
 func main() {
@@ -137,12 +196,23 @@ func main() {
 	stopChan := make(chan os.Signal)
 	signal.Notify(stopChan, syscall.SIGINT, syscall.SIGTERM)
 
+	metrics, metricsHandler := gitserver.SetupMetrics()
+
 	authCallback, err := createAuthorizationCallback(config, log)
 	if err != nil {
 		log.Error("failed to create the authorization callback", "err", err)
 		os.Exit(1)
 	}
 
+	gitserver.DefaultCommitDescriptions, err = gitserver.ExtendCommitDescriptions(
+		gitserver.DefaultCommitDescriptions,
+		config.Gitserver.CommitDescriptions,
+	)
+	if err != nil {
+		log.Error("invalid commit descriptions", "err", err)
+		os.Exit(1)
+	}
+
 	protocol := gitserver.NewGitProtocol(
 		authCallback,
 		referenceDiscovery,
@@ -151,15 +221,111 @@ func main() {
 		&gitserver.LibinteractiveCompiler{
 			LibinteractiveJarPath: config.Gitserver.LibinteractivePath,
 			Log:                   log,
+			Metrics:               metrics,
 		},
 		log,
 	)
 
+	var publisher *gitserver.Publisher
+	publisherCtx, publisherCancel := context.WithCancel(context.Background())
+	if config.Gitserver.PublishingWorkers > 0 {
+		transport := &gitserver.PublishingTransport{}
+		if config.Gitserver.PublishingSSHKeyPath != "" {
+			contents, err := ioutil.ReadFile(config.Gitserver.PublishingSSHKeyPath)
+			if err != nil {
+				log.Error("failed to read the publishing SSH key", "err", err)
+				os.Exit(1)
+			}
+			if transport.Signer, err = ssh.ParsePrivateKey(contents); err != nil {
+				log.Error("failed to parse the publishing SSH key", "err", err)
+				os.Exit(1)
+			}
+			if config.Gitserver.PublishingKnownHostsPath == "" {
+				log.Error("a known_hosts file is required to publish through SSH")
+				os.Exit(1)
+			}
+			if transport.HostKeyCallback, err = knownhosts.New(config.Gitserver.PublishingKnownHostsPath); err != nil {
+				log.Error("failed to read the publishing known_hosts file", "err", err)
+				os.Exit(1)
+			}
+		}
+		publisher = gitserver.NewPublisher(config.Gitserver.RootPath, transport, log)
+		publisher.ArchiveRoot = config.Gitserver.PublishingArchiveRoot
+		publisher.Start(publisherCtx, config.Gitserver.PublishingWorkers)
+		if err := publisher.ResumePending(); err != nil {
+			log.Error("failed to resume pending publishing jobs", "err", err)
+		}
+	}
+
+	var webhookQueue *gitserver.WebhookQueue
+	webhookCtx, webhookCancel := context.WithCancel(context.Background())
+	if config.Gitserver.WebhookQueuePath != "" {
+		webhookQueue, err = gitserver.NewWebhookQueue(
+			config.Gitserver.WebhookQueuePath,
+			config.Gitserver.Webhooks,
+			log,
+		)
+		if err != nil {
+			log.Error("failed to create the webhook queue", "err", err)
+			os.Exit(1)
+		}
+		// Deliveries that were pending when the server stopped are picked up
+		// by the workers.
+		webhookQueue.Start(webhookCtx, config.Gitserver.WebhookWorkers)
+	}
+
+	var zipImportQueue *gitserver.ZipImportQueue
+	zipImportCtx, zipImportCancel := context.WithCancel(context.Background())
+	if config.Gitserver.ZipImportQueuePath != "" {
+		zipImportQueue, err = gitserver.NewZipImportQueue(
+			config.Gitserver.ZipImportQueuePath,
+			config.Gitserver.RootPath,
+			protocol,
+			metrics,
+			log,
+		)
+		if err != nil {
+			log.Error("failed to create the zip import queue", "err", err)
+			os.Exit(1)
+		}
+		zipImportQueue.Webhooks = webhookQueue
+		zipImportQueue.Publisher = publisher
+		// Jobs that were pending when the server stopped are picked up by the
+		// workers.
+		zipImportQueue.Start(zipImportCtx, config.Gitserver.ZipImportWorkers)
+	}
+
+	var maintainer *gitserver.Maintainer
+	maintenanceCtx, maintenanceCancel := context.WithCancel(context.Background())
+	if config.Gitserver.MaintenanceInterval > 0 {
+		maintainer = gitserver.NewMaintainer(config.Gitserver.RootPath, metrics, log)
+		maintainer.Interval = time.Duration(config.Gitserver.MaintenanceInterval)
+		maintainer.PackThreshold = config.Gitserver.MaintenancePackThreshold
+		maintainer.PruneGracePeriod = time.Duration(config.Gitserver.MaintenancePruneGracePeriod)
+		maintainer.Start(maintenanceCtx)
+	}
+
+	proxies, err := newTrustedProxies(config.Gitserver.TrustedProxies)
+	if err != nil {
+		log.Error("failed to parse the trusted proxies", "err", err)
+		os.Exit(1)
+	}
+
 	var servers []*http.Server
 	var wg sync.WaitGroup
 	gitServer := &http.Server{
-		Addr:    fmt.Sprintf(":%d", config.Gitserver.Port),
-		Handler: muxHandler(config.Gitserver.RootPath, protocol, log),
+		Addr: fmt.Sprintf(":%d", config.Gitserver.Port),
+		Handler: muxHandler(
+			config.Gitserver.RootPath,
+			protocol,
+			publisher,
+			webhookQueue,
+			zipImportQueue,
+			metrics,
+			metricsHandler,
+			proxies,
+			log,
+		),
 	}
 	servers = append(servers, gitServer)
 	wg.Add(1)
@@ -213,5 +379,25 @@ func main() {
 	cancel()
 	wg.Wait()
 
+	// Any pending import jobs are resumed the next time the server starts.
+	// They are stopped first, since they notify the publisher and the webhooks.
+	zipImportCancel()
+	if zipImportQueue != nil {
+		zipImportQueue.Wait()
+	}
+	// Any pending publishing jobs are resumed the next time the server starts.
+	publisherCancel()
+	if publisher != nil {
+		publisher.Close()
+	}
+	webhookCancel()
+	if webhookQueue != nil {
+		webhookQueue.Wait()
+	}
+	maintenanceCancel()
+	if maintainer != nil {
+		maintainer.Wait()
+	}
+
 	log.Info("Server gracefully stopped.")
 }
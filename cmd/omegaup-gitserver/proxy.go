@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// trustedProxies is the list of networks of the reverse proxies whose
+// X-Forwarded-For headers are honored.
+type trustedProxies []*net.IPNet
+
+// newTrustedProxies parses a list of IP addresses or CIDR networks.
+func newTrustedProxies(addresses []string) (trustedProxies, error) {
+	var proxies trustedProxies
+	for _, address := range addresses {
+		if !strings.Contains(address, "/") {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				return nil, errors.Errorf("invalid trusted proxy address '%s'", address)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(address)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid trusted proxy network '%s'", address)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (p trustedProxies) contains(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range p {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteAddr returns the address of the client of the request. If the request
+// came through trusted proxies, the X-Forwarded-For header is walked from the
+// right, and the first address that is not a trusted proxy is returned.
+// Addresses added by untrusted hops cannot be forged this way.
+func (p trustedProxies) remoteAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || !p.contains(host) {
+		return r.RemoteAddr
+	}
+	var forwarded []string
+	for _, header := range r.Header["X-Forwarded-For"] {
+		for _, address := range strings.Split(header, ",") {
+			forwarded = append(forwarded, strings.TrimSpace(address))
+		}
+	}
+	remoteAddr := r.RemoteAddr
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		if net.ParseIP(forwarded[i]) == nil {
+			break
+		}
+		remoteAddr = forwarded[i]
+		if !p.contains(forwarded[i]) {
+			break
+		}
+	}
+	return remoteAddr
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustedProxiesRemoteAddr(t *testing.T) {
+	proxies, err := newTrustedProxies([]string{"10.0.0.1", "192.168.0.0/16"})
+	if err != nil {
+		t.Fatalf("failed to parse the trusted proxies: %v", err)
+	}
+
+	for _, testCase := range []struct {
+		remoteAddr   string
+		forwardedFor string
+		expectedAddr string
+	}{
+		// Untrusted peers cannot forge their address.
+		{"203.0.113.5:1234", "198.51.100.1", "203.0.113.5:1234"},
+		// A trusted proxy without the header is the client itself.
+		{"10.0.0.1:1234", "", "10.0.0.1:1234"},
+		{"10.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		// Addresses prepended by the client are ignored.
+		{"10.0.0.1:1234", "1.2.3.4, 198.51.100.1", "198.51.100.1"},
+		// Chains of trusted proxies are walked.
+		{"10.0.0.1:1234", "198.51.100.1, 192.168.1.1", "198.51.100.1"},
+		// Garbage stops the walk.
+		{"10.0.0.1:1234", "198.51.100.1, garbage", "10.0.0.1:1234"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = testCase.remoteAddr
+		if testCase.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", testCase.forwardedFor)
+		}
+		if got := proxies.remoteAddr(r); got != testCase.expectedAddr {
+			t.Errorf(
+				"remoteAddr(%q, %q): expected %q, got %q",
+				testCase.remoteAddr,
+				testCase.forwardedFor,
+				testCase.expectedAddr,
+				got,
+			)
+		}
+	}
+
+	if _, err := newTrustedProxies([]string{"not-an-address"}); err == nil {
+		t.Errorf("expected an invalid address to be rejected")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// maxTrackedAddresses is the largest number of remote addresses whose
+	// windows are kept at any time. Once it is reached, requests from new
+	// addresses are not allowed until some of the windows expire.
+	maxTrackedAddresses = 10000
+)
+
+// rateLimitWindow is the number of events that a remote address has had since
+// the start of its current window.
+type rateLimitWindow struct {
+	start  time.Time
+	events int
+}
+
+// addressRateLimiter allows up to burst events per remote address in every
+// interval.
+type addressRateLimiter struct {
+	mutex    sync.Mutex
+	burst    int
+	interval time.Duration
+	windows  map[string]*rateLimitWindow
+	now      func() time.Time
+}
+
+func newAddressRateLimiter(burst int, interval time.Duration) *addressRateLimiter {
+	return &addressRateLimiter{
+		burst:    burst,
+		interval: interval,
+		windows:  make(map[string]*rateLimitWindow),
+		now:      time.Now,
+	}
+}
+
+// allow records an event for the remote address, and returns whether it is
+// within the limit. The port of the address is ignored.
+func (l *addressRateLimiter) allow(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	window, ok := l.windows[host]
+	if ok && now.Sub(window.start) >= l.interval {
+		window.start = now
+		window.events = 0
+	}
+	if !ok {
+		if len(l.windows) >= maxTrackedAddresses {
+			for address, window := range l.windows {
+				if now.Sub(window.start) >= l.interval {
+					delete(l.windows, address)
+				}
+			}
+			if len(l.windows) >= maxTrackedAddresses {
+				return false
+			}
+		}
+		window = &rateLimitWindow{start: now}
+		l.windows[host] = window
+	}
+	if window.events >= l.burst {
+		return false
+	}
+	window.events++
+	return true
+}
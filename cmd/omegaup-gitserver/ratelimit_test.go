@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAddressRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := newAddressRateLimiter(2, time.Minute)
+	limiter.now = func() time.Time { return now }
+
+	for i, testCase := range []struct {
+		remoteAddr string
+		allowed    bool
+	}{
+		{"10.0.0.1:1234", true},
+		{"10.0.0.1:1235", true},
+		// The port does not matter.
+		{"10.0.0.1:1236", false},
+		{"10.0.0.2:1234", true},
+		// Addresses that come from X-Forwarded-For have no port.
+		{"10.0.0.2", true},
+		{"10.0.0.2", false},
+	} {
+		if allowed := limiter.allow(testCase.remoteAddr); allowed != testCase.allowed {
+			t.Errorf("%d: allow(%q) = %v, want %v", i, testCase.remoteAddr, allowed, testCase.allowed)
+		}
+	}
+
+	// A new window starts once the interval is over.
+	now = now.Add(time.Minute)
+	if !limiter.allow("10.0.0.1:1234") {
+		t.Errorf("Expected a new window to be started")
+	}
+}
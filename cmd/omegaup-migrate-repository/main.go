@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+
+	git "github.com/lhchavez/git2go/v29"
+	"github.com/omegaup/gitserver"
+	base "github.com/omegaup/go-base"
+)
+
+var (
+	repositoryPath     = flag.String("repository-path", "", "Path of the git repository to migrate")
+	rootPath           = flag.String("root-path", "", "Path of the directory with all the git repositories to migrate")
+	dryRun             = flag.Bool("dry-run", false, "Only report the migrations that would be applied")
+	libinteractivePath = flag.String("libinteractive-path", "/usr/share/java/libinteractive.jar", "Path of libinteractive.jar")
+)
+
+func main() {
+	defer git.Shutdown()
+
+	flag.Parse()
+	log := base.StderrLog()
+
+	if (*repositoryPath == "") == (*rootPath == "") {
+		log.Crit("exactly one of -repository-path or -root-path must be specified")
+		os.Exit(1)
+	}
+
+	compiler := &gitserver.LibinteractiveCompiler{
+		LibinteractiveJarPath: *libinteractivePath,
+		Log:                   log,
+	}
+	protocol := gitserver.NewGitProtocol(
+		nil,
+		nil,
+		true,
+		gitserver.OverallWallTimeHardLimit,
+		compiler,
+		log,
+	)
+
+	var results []*gitserver.MigrationResult
+	if *repositoryPath != "" {
+		result, err := gitserver.MigrateRepository(
+			context.Background(),
+			*repositoryPath,
+			protocol,
+			compiler,
+			*dryRun,
+			log,
+		)
+		if result == nil {
+			result = &gitserver.MigrationResult{Repository: *repositoryPath}
+		}
+		if err != nil {
+			log.Error("Failed to migrate repository", "path", *repositoryPath, "err", err)
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	} else {
+		var err error
+		results, err = gitserver.MigrateAllRepositories(
+			context.Background(),
+			*rootPath,
+			protocol,
+			compiler,
+			*dryRun,
+			log,
+		)
+		if err != nil {
+			log.Crit("Failed to migrate repositories", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "\t")
+	encoder.Encode(results)
+
+	for _, result := range results {
+		if result.Error != "" {
+			os.Exit(1)
+		}
+	}
+}
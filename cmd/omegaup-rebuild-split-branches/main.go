@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+
+	git "github.com/lhchavez/git2go/v29"
+	"github.com/omegaup/githttp"
+	"github.com/omegaup/gitserver"
+	base "github.com/omegaup/go-base"
+)
+
+var (
+	repositoryPath = flag.String("repository-path", "", "Path of the git repository")
+	reportPath     = flag.String(
+		"report-path",
+		"",
+		"path of a json file with the mapping report. Defaults to stdout",
+	)
+	commitDescriptionsPath = flag.String(
+		"commit-descriptions-path",
+		"",
+		"path of a json file with the additional commit descriptions of the server",
+	)
+	verifyOnly = flag.Bool(
+		"verify-only",
+		false,
+		"only report the commits whose split branches drifted, without rewriting them",
+	)
+)
+
+// repositoryCommitDescriptions returns the commit descriptions of the
+// repository, which take into account the paths that are added by the server
+// and the ones that are narrowed in its refs/meta/config.
+func repositoryCommitDescriptions(repositoryPath string) ([]githttp.SplitCommitDescription, error) {
+	if *commitDescriptionsPath != "" {
+		contents, err := ioutil.ReadFile(*commitDescriptionsPath)
+		if err != nil {
+			return nil, err
+		}
+		var configs []gitserver.CommitDescriptionConfig
+		if err := json.Unmarshal(contents, &configs); err != nil {
+			return nil, err
+		}
+		gitserver.DefaultCommitDescriptions, err = gitserver.ExtendCommitDescriptions(
+			gitserver.DefaultCommitDescriptions,
+			configs,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	repository, err := git.OpenRepository(repositoryPath)
+	if err != nil {
+		return nil, err
+	}
+	defer repository.Free()
+	return gitserver.GetCommitDescriptions(repository)
+}
+
+func main() {
+	defer git.Shutdown()
+
+	flag.Parse()
+	log := base.StderrLog()
+
+	if *repositoryPath == "" {
+		log.Crit("repository path cannot be empty. Please specify one with -repository-path")
+		os.Exit(1)
+	}
+
+	var w io.Writer = os.Stdout
+	if *reportPath != "" {
+		f, err := os.Create(*reportPath)
+		if err != nil {
+			log.Crit(
+				"failed to create report JSON file",
+				"path", *reportPath,
+				"err", err,
+			)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	commitDescriptions, err := repositoryCommitDescriptions(*repositoryPath)
+	if err != nil {
+		log.Crit(
+			"failed to get the commit descriptions",
+			"path", *repositoryPath,
+			"err", err,
+		)
+		os.Exit(1)
+	}
+
+	report, err := gitserver.RebuildSplitBranches(
+		*repositoryPath,
+		commitDescriptions,
+		*verifyOnly,
+		log,
+	)
+	if err != nil {
+		log.Crit(
+			"failed to rebuild the split branches",
+			"path", *repositoryPath,
+			"err", err,
+		)
+		os.Exit(1)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		log.Crit(
+			"failed to marshal report",
+			"path", *reportPath,
+			"err", err,
+		)
+		os.Exit(1)
+	}
+
+	if *verifyOnly && report.Drift {
+		log.Error("the split branches drifted", "path", *repositoryPath)
+		os.Exit(1)
+	}
+}
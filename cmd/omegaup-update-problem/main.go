@@ -31,7 +31,7 @@ var (
 	problemSettingsJSON = flag.String("problem-settings", "", "(Optional) JSON-encoded ProblemSettings")
 
 	// Flags that are used when updating a repository with a .zip.
-	zipPath            = flag.String("zip-path", "", "Path of the .zip file")
+	zipPath            = flag.String("zip-path", "", "Path of the .zip file. Polygon and Kattis packages are also accepted")
 	mergeStrategyName  = flag.String("merge-strategy", "theirs", "Merge strategy to use. Valid values are 'ours', 'theirs', 'statement-ours', and 'recursive-theirs'")
 	acceptsSubmissions = flag.Bool("accepts-submissions", true, "Problem accepts submissions")
 	updatePublished    = flag.Bool("update-published", false, "Update the published branch")
@@ -335,9 +335,10 @@ func commitBlobs(
 		log.Error("failed to get updated files", "err", err)
 	}
 	return &gitserver.UpdateResult{
-		Status:       "ok",
-		UpdatedRefs:  updatedRefs,
-		UpdatedFiles: updatedFiles,
+		Status:          "ok",
+		UpdatedRefs:     updatedRefs,
+		UpdatedFiles:    updatedFiles,
+		NormalizedFiles: requestContext.NormalizedFiles,
 	}, nil
 }
 
@@ -382,7 +383,15 @@ func main() {
 			return os.Rename(dir, *repositoryPath)
 		}
 	} else {
-		if _, err := os.Stat(path.Join(*repositoryPath, "omegaup/version")); os.IsNotExist(err) {
+		// Repositories are never migrated implicitly, since some migrations
+		// rewrite master. Unversioned repositories must be brought forward with
+		// omegaup-migrate-repository first.
+		if version, err := gitserver.GetRepositoryVersion(*repositoryPath); err != nil || version == 0 {
+			log.Error(
+				"the repository needs to be migrated with omegaup-migrate-repository",
+				"version", version,
+				"err", err,
+			)
 			encoder := json.NewEncoder(os.Stdout)
 			encoder.SetIndent("", "\t")
 			encoder.Encode(&gitserver.UpdateResult{
@@ -0,0 +1,341 @@
+package gitserver
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"unicode"
+
+	git "github.com/lhchavez/git2go/v29"
+	"github.com/omegaup/githttp"
+	base "github.com/omegaup/go-base"
+	"github.com/pkg/errors"
+)
+
+// CommitDescriptionConfig is the configuration of the paths that go to one of
+// the split branches. It is used both in the server configuration, to add
+// paths to DefaultCommitDescriptions, and in refs/meta/config, to narrow the
+// paths of a single problem.
+type CommitDescriptionConfig struct {
+	ReferenceName string   `json:"ref"`
+	PathRegexps   []string `json:"paths"`
+}
+
+// ExtendCommitDescriptions returns a copy of the descriptions with the paths
+// of the configs added to the reference they name. The set of references
+// cannot be changed, since every commit in master has one parent per split
+// branch. The added paths are validated so that none of them can match a path
+// that belongs to a different branch.
+func ExtendCommitDescriptions(
+	descriptions []githttp.SplitCommitDescription,
+	configs []CommitDescriptionConfig,
+) ([]githttp.SplitCommitDescription, error) {
+	type addedPath struct {
+		index         int
+		referenceName string
+		pathRegexp    *regexp.Regexp
+	}
+	var addedPaths []addedPath
+
+	result := copyCommitDescriptions(descriptions)
+	for i, config := range configs {
+		description := findCommitDescription(result, config.ReferenceName)
+		if description == nil {
+			return nil, base.ErrorWithCategory(
+				ErrConfigInvalidCommitDescriptions,
+				errors.Errorf(
+					"commitDescriptions[%d]: invalid ref '%s'",
+					i,
+					config.ReferenceName,
+				),
+			)
+		}
+		for _, pathRegexp := range config.PathRegexps {
+			compiled, err := regexp.Compile(pathRegexp)
+			if err != nil {
+				return nil, base.ErrorWithCategory(
+					ErrConfigInvalidCommitDescriptions,
+					errors.Wrapf(
+						err,
+						"commitDescriptions[%d]: invalid path '%s'",
+						i,
+						pathRegexp,
+					),
+				)
+			}
+			description.PathRegexps = append(description.PathRegexps, compiled)
+			addedPaths = append(addedPaths, addedPath{
+				index:         i,
+				referenceName: config.ReferenceName,
+				pathRegexp:    compiled,
+			})
+		}
+	}
+
+	// The paths are only validated after all of them have been added so that
+	// the paths that are added to different references are also checked
+	// against each other.
+	for _, added := range addedPaths {
+		for _, description := range result {
+			if description.ReferenceName == added.referenceName {
+				continue
+			}
+			for _, pathRegexp := range description.PathRegexps {
+				overlap, err := regexpsOverlap(added.pathRegexp.String(), pathRegexp.String())
+				if err != nil {
+					return nil, base.ErrorWithCategory(
+						ErrConfigInvalidCommitDescriptions,
+						errors.Wrapf(err, "commitDescriptions[%d]", added.index),
+					)
+				}
+				if overlap {
+					return nil, base.ErrorWithCategory(
+						ErrConfigInvalidCommitDescriptions,
+						errors.Errorf(
+							"commitDescriptions[%d]: path '%s' overlaps with path '%s' of %s",
+							added.index,
+							added.pathRegexp,
+							pathRegexp,
+							description.ReferenceName,
+						),
+					)
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+// GetCommitDescriptions returns the descriptions that are used to split the
+// commits of the repository: DefaultCommitDescriptions, narrowed by the
+// commitDescriptions of refs/meta/config if the problem has any.
+func GetCommitDescriptions(repository *git.Repository) ([]githttp.SplitCommitDescription, error) {
+	metaConfig, err := getMetaConfig(repository)
+	if err != nil {
+		// getMetaConfig already wrapped the error correctly.
+		return nil, err
+	}
+	return narrowCommitDescriptions(DefaultCommitDescriptions, metaConfig.CommitDescriptions)
+}
+
+// narrowCommitDescriptions returns a copy of the descriptions where the
+// references that are mentioned in the configs only keep the paths that are
+// listed there. Every listed path must be one of the paths of the reference,
+// so a problem can only make a branch smaller, never move files between
+// branches.
+func narrowCommitDescriptions(
+	descriptions []githttp.SplitCommitDescription,
+	configs []CommitDescriptionConfig,
+) ([]githttp.SplitCommitDescription, error) {
+	result := copyCommitDescriptions(descriptions)
+	for i, config := range configs {
+		description := findCommitDescription(result, config.ReferenceName)
+		if description == nil {
+			return nil, base.ErrorWithCategory(
+				ErrConfigInvalidCommitDescriptions,
+				errors.Errorf(
+					"commitDescriptions[%d]: invalid ref '%s'",
+					i,
+					config.ReferenceName,
+				),
+			)
+		}
+		var pathRegexps []*regexp.Regexp
+		for _, pathRegexp := range config.PathRegexps {
+			var found *regexp.Regexp
+			for _, candidate := range description.PathRegexps {
+				if candidate.String() == pathRegexp {
+					found = candidate
+					break
+				}
+			}
+			if found == nil {
+				return nil, base.ErrorWithCategory(
+					ErrConfigInvalidCommitDescriptions,
+					errors.Errorf(
+						"commitDescriptions[%d]: path '%s' is not one of the paths of %s",
+						i,
+						pathRegexp,
+						config.ReferenceName,
+					),
+				)
+			}
+			pathRegexps = append(pathRegexps, found)
+		}
+		description.PathRegexps = pathRegexps
+	}
+	return result, nil
+}
+
+// copyCommitDescriptions returns a copy of the descriptions that can be
+// modified without affecting the original ones.
+func copyCommitDescriptions(
+	descriptions []githttp.SplitCommitDescription,
+) []githttp.SplitCommitDescription {
+	result := make([]githttp.SplitCommitDescription, len(descriptions))
+	for i, description := range descriptions {
+		result[i] = githttp.SplitCommitDescription{
+			ReferenceName: description.ReferenceName,
+			PathRegexps:   append([]*regexp.Regexp{}, description.PathRegexps...),
+		}
+	}
+	return result
+}
+
+func findCommitDescription(
+	descriptions []githttp.SplitCommitDescription,
+	referenceName string,
+) *githttp.SplitCommitDescription {
+	for i := range descriptions {
+		if descriptions[i].ReferenceName == referenceName {
+			return &descriptions[i]
+		}
+	}
+	return nil
+}
+
+// compileUnanchoredRegexp compiles the regular expression into a program that
+// matches the whole string if the original expression matches any part of
+// it, which is what regexp.MatchString does.
+func compileUnanchoredRegexp(expr string) (*syntax.Prog, error) {
+	re, err := syntax.Parse("(?s:.*)(?:"+expr+")(?s:.*)", syntax.Perl)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse '%s'", expr)
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to compile '%s'", expr)
+	}
+	return prog, nil
+}
+
+// regexpsOverlap returns whether there is at least one string that is matched
+// by both regular expressions. It walks both programs in lockstep, the same
+// way the intersection of two automata is built, so it terminates after at
+// most one step per pair of instructions. Word boundaries are assumed to
+// always match, so the answer errs on the side of reporting an overlap.
+func regexpsOverlap(a, b string) (bool, error) {
+	progA, err := compileUnanchoredRegexp(a)
+	if err != nil {
+		return false, err
+	}
+	progB, err := compileUnanchoredRegexp(b)
+	if err != nil {
+		return false, err
+	}
+
+	type state struct {
+		pcA, pcB uint32
+		atStart  bool
+	}
+	visited := make(map[state]struct{})
+	queue := []state{{pcA: uint32(progA.Start), pcB: uint32(progB.Start), atStart: true}}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if _, ok := visited[current]; ok {
+			continue
+		}
+		visited[current] = struct{}{}
+
+		if progMatchesAtEnd(progA, current.pcA, current.atStart) &&
+			progMatchesAtEnd(progB, current.pcB, current.atStart) {
+			return true, nil
+		}
+
+		for _, pcA := range progClosure(progA, current.pcA, current.atStart, false) {
+			instA := &progA.Inst[pcA]
+			if instA.Op == syntax.InstMatch {
+				continue
+			}
+			for _, pcB := range progClosure(progB, current.pcB, current.atStart, false) {
+				instB := &progB.Inst[pcB]
+				if instB.Op == syntax.InstMatch || !instsShareRune(instA, instB) {
+					continue
+				}
+				queue = append(queue, state{pcA: instA.Out, pcB: instB.Out})
+			}
+		}
+	}
+	return false, nil
+}
+
+// progMatchesAtEnd returns whether the program reaches a match from the
+// instruction without consuming any more input.
+func progMatchesAtEnd(prog *syntax.Prog, pc uint32, atStart bool) bool {
+	for _, closurePC := range progClosure(prog, pc, atStart, true) {
+		if prog.Inst[closurePC].Op == syntax.InstMatch {
+			return true
+		}
+	}
+	return false
+}
+
+// progClosure returns the rune-consuming and match instructions that can be
+// reached from the instruction without consuming any input.
+func progClosure(prog *syntax.Prog, pc uint32, atStart, atEnd bool) []uint32 {
+	var result []uint32
+	visited := make(map[uint32]struct{})
+	stack := []uint32{pc}
+	for len(stack) > 0 {
+		pc := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if _, ok := visited[pc]; ok {
+			continue
+		}
+		visited[pc] = struct{}{}
+
+		inst := &prog.Inst[pc]
+		switch inst.Op {
+		case syntax.InstAlt, syntax.InstAltMatch:
+			stack = append(stack, inst.Out, inst.Arg)
+		case syntax.InstCapture, syntax.InstNop:
+			stack = append(stack, inst.Out)
+		case syntax.InstEmptyWidth:
+			op := syntax.EmptyOp(inst.Arg)
+			if op&(syntax.EmptyBeginLine|syntax.EmptyBeginText) != 0 && !atStart {
+				continue
+			}
+			if op&(syntax.EmptyEndLine|syntax.EmptyEndText) != 0 && !atEnd {
+				continue
+			}
+			stack = append(stack, inst.Out)
+		case syntax.InstMatch, syntax.InstRune, syntax.InstRune1,
+			syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+			result = append(result, pc)
+		}
+	}
+	return result
+}
+
+// instsShareRune returns whether there is a rune that is matched by both
+// rune-consuming instructions. If the rune sets intersect, the larger of the
+// lower bounds of two intersecting ranges is in both sets, so it is enough to
+// try the lower bounds of every range (and their case foldings).
+func instsShareRune(a, b *syntax.Inst) bool {
+	candidates := []rune{'a'}
+	for _, inst := range []*syntax.Inst{a, b} {
+		for i := 0; i < len(inst.Rune); i += 2 {
+			candidates = append(candidates, inst.Rune[i])
+			for folded := unicode.SimpleFold(inst.Rune[i]); folded != inst.Rune[i]; folded = unicode.SimpleFold(folded) {
+				candidates = append(candidates, folded)
+			}
+		}
+	}
+	for _, r := range candidates {
+		if instMatchesRune(a, r) && instMatchesRune(b, r) {
+			return true
+		}
+	}
+	return false
+}
+
+func instMatchesRune(inst *syntax.Inst, r rune) bool {
+	switch inst.Op {
+	case syntax.InstRuneAny:
+		return true
+	case syntax.InstRuneAnyNotNL:
+		return r != '\n'
+	default:
+		return inst.MatchRune(r)
+	}
+}
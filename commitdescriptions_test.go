@@ -0,0 +1,242 @@
+package gitserver
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	git "github.com/lhchavez/git2go/v29"
+	"github.com/omegaup/githttp"
+	"github.com/omegaup/gitserver/gitservertest"
+	base "github.com/omegaup/go-base"
+)
+
+func TestRegexpsOverlap(t *testing.T) {
+	for _, testCase := range []struct {
+		a, b    string
+		overlap bool
+	}{
+		{"^settings\\.json$", "^settings\\.distrib\\.json$", false},
+		{"^validator\\.[a-z0-9]+$", "^validator\\.distrib\\.[a-z]+$", false},
+		{"^statements/[^/]+\\.svg$", "^statements(/[^/]+\\.(markdown|gif|jpe?g|png))?$", false},
+		{"^solutions/[^/]+\\.rs$", "^cases(/[^/]+\\.(in|out))?$", false},
+		{"^tests/data/.*$", "^tests(/.*)?$", true},
+		{"^statements/[^/]+\\.svg$", "\\.svg$", true},
+		{"(?i)^CASES/", "^cases(/[^/]+\\.(in|out))?$", true},
+		{"foo", "bar", true},
+		{"^a[^/]$", "^a/$", false},
+	} {
+		overlap, err := regexpsOverlap(testCase.a, testCase.b)
+		if err != nil {
+			t.Errorf("regexpsOverlap(%q, %q) failed: %v", testCase.a, testCase.b, err)
+			continue
+		}
+		if overlap != testCase.overlap {
+			t.Errorf("regexpsOverlap(%q, %q) = %v, want %v", testCase.a, testCase.b, overlap, testCase.overlap)
+		}
+	}
+}
+
+func TestExtendCommitDescriptions(t *testing.T) {
+	descriptions, err := ExtendCommitDescriptions(
+		DefaultCommitDescriptions,
+		[]CommitDescriptionConfig{
+			{ReferenceName: "refs/heads/public", PathRegexps: []string{"^statements/[^/]+\\.svg$"}},
+			{ReferenceName: "refs/heads/protected", PathRegexps: []string{"^solutions/[^/]+\\.rs$"}},
+		},
+	)
+	if err != nil {
+		t.Fatalf("Failed to extend the commit descriptions: %v", err)
+	}
+	if !findCommitDescription(descriptions, "refs/heads/public").ContainsPath("statements/figure.svg") {
+		t.Errorf("Expected statements/figure.svg to be public")
+	}
+	if !findCommitDescription(descriptions, "refs/heads/protected").ContainsPath("solutions/es.rs") {
+		t.Errorf("Expected solutions/es.rs to be protected")
+	}
+	if len(findCommitDescription(DefaultCommitDescriptions, "refs/heads/public").PathRegexps) ==
+		len(findCommitDescription(descriptions, "refs/heads/public").PathRegexps) {
+		t.Errorf("DefaultCommitDescriptions should not be modified")
+	}
+
+	for _, configs := range [][]CommitDescriptionConfig{
+		{{ReferenceName: "refs/heads/secret", PathRegexps: []string{"^secret$"}}},
+		{{ReferenceName: "refs/heads/public", PathRegexps: []string{"^statements/[^/]+\\.(svg$"}}},
+		{{ReferenceName: "refs/heads/public", PathRegexps: []string{"^tests/data/.*$"}}},
+		{
+			{ReferenceName: "refs/heads/public", PathRegexps: []string{"^data/.*\\.txt$"}},
+			{ReferenceName: "refs/heads/private", PathRegexps: []string{"^data/secret\\..*$"}},
+		},
+	} {
+		if _, err := ExtendCommitDescriptions(DefaultCommitDescriptions, configs); err == nil {
+			t.Errorf("Expected %v to be rejected", configs)
+		}
+	}
+}
+
+func TestNarrowedCommitDescriptions(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+
+	log := base.StderrLog()
+	ts := httptest.NewServer(GitHandler(
+		tmpDir,
+		NewGitProtocol(authorize, nil, true, OverallWallTimeHardLimit, fakeInteractiveSettingsCompiler, log),
+		&base.NoOpMetrics{},
+		log,
+	))
+	defer ts.Close()
+
+	problemAlias := "sumas"
+
+	{
+		repo, err := InitRepository(path.Join(tmpDir, problemAlias))
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
+
+	for _, invalidConfig := range []struct {
+		config string
+		status string
+	}{
+		{
+			`{"commitDescriptions":[{"ref":"refs/heads/secret","paths":[]}]}`,
+			"ng refs/meta/config config-invalid-commit-descriptions: commitDescriptions[0]: invalid ref 'refs/heads/secret'\n",
+		},
+		{
+			`{"commitDescriptions":[{"ref":"refs/heads/public","paths":["^cases(/[^/]+\\.(in|out))?$"]}]}`,
+			"ng refs/meta/config config-invalid-commit-descriptions: commitDescriptions[0]: path '^cases(/[^/]+\\.(in|out))?$' is not one of the paths of refs/heads/public\n",
+		},
+	} {
+		oldOid := getReference(t, problemAlias, "refs/meta/config", ts)
+		newOid, packContents := createCommit(
+			t,
+			tmpDir,
+			problemAlias,
+			oldOid,
+			map[string]io.Reader{
+				"config.json": strings.NewReader(invalidConfig.config),
+			},
+			"Invalid commit descriptions",
+			log,
+		)
+		push(
+			t,
+			tmpDir,
+			adminAuthorization,
+			problemAlias,
+			"refs/meta/config",
+			oldOid, newOid,
+			packContents,
+			[]githttp.PktLineResponse{
+				{Line: "unpack ok\n", Err: nil},
+				{Line: invalidConfig.status, Err: nil},
+			},
+			ts,
+		)
+	}
+
+	// The examples of this problem are not public.
+	{
+		oldOid := getReference(t, problemAlias, "refs/meta/config", ts)
+		newOid, packContents := createCommit(
+			t,
+			tmpDir,
+			problemAlias,
+			oldOid,
+			map[string]io.Reader{
+				"config.json": strings.NewReader(`{
+					"commitDescriptions":[
+						{
+							"ref":"refs/heads/public",
+							"paths":[
+								"^statements(/[^/]+\\.(markdown|gif|jpe?g|png))?$",
+								"^settings\\.distrib\\.json$"
+							]
+						}
+					]
+				}`),
+			},
+			"Narrow the public branch",
+			log,
+		)
+		push(
+			t,
+			tmpDir,
+			adminAuthorization,
+			problemAlias,
+			"refs/meta/config",
+			oldOid, newOid,
+			packContents,
+			[]githttp.PktLineResponse{
+				{Line: "unpack ok\n", Err: nil},
+				{Line: "ok refs/meta/config\n", Err: nil},
+			},
+			ts,
+		)
+	}
+
+	newOid, packContents := createCommit(
+		t,
+		tmpDir,
+		problemAlias,
+		&git.Oid{},
+		map[string]io.Reader{
+			"settings.json":          strings.NewReader(gitservertest.DefaultSettingsJSON),
+			"cases/0.in":             strings.NewReader("1 2"),
+			"cases/0.out":            strings.NewReader("3"),
+			"examples/sample.in":     strings.NewReader("1 2"),
+			"examples/sample.out":    strings.NewReader("3"),
+			"statements/es.markdown": strings.NewReader("Sumas"),
+		},
+		"Initial commit",
+		log,
+	)
+	push(
+		t,
+		tmpDir,
+		adminAuthorization,
+		problemAlias,
+		"refs/heads/master",
+		&git.Oid{}, newOid,
+		packContents,
+		[]githttp.PktLineResponse{
+			{Line: "unpack ok\n", Err: nil},
+			{Line: "ok refs/heads/master\n", Err: nil},
+		},
+		ts,
+	)
+
+	repo, err := git.OpenRepository(path.Join(tmpDir, problemAlias))
+	if err != nil {
+		t.Fatalf("Failed to open repository: %v", err)
+	}
+	defer repo.Free()
+	publicCommit, err := repo.LookupCommit(getReference(t, problemAlias, "refs/heads/public", ts))
+	if err != nil {
+		t.Fatalf("Failed to lookup the public commit: %v", err)
+	}
+	defer publicCommit.Free()
+	publicTree, err := publicCommit.Tree()
+	if err != nil {
+		t.Fatalf("Failed to lookup the public tree: %v", err)
+	}
+	defer publicTree.Free()
+	if _, err := publicTree.EntryByPath("statements/es.markdown"); err != nil {
+		t.Errorf("Expected statements/es.markdown in the public branch: %v", err)
+	}
+	if _, err := publicTree.EntryByPath("examples/sample.in"); err == nil {
+		t.Errorf("Did not expect examples/sample.in in the public branch")
+	}
+}
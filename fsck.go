@@ -0,0 +1,587 @@
+package gitserver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/inconshreveable/log15"
+	git "github.com/lhchavez/git2go/v29"
+	"github.com/omegaup/githttp"
+	base "github.com/omegaup/go-base"
+	"github.com/pkg/errors"
+)
+
+const (
+	// FsckCheckVersion verifies that omegaup/version exists and is current.
+	FsckCheckVersion = "version"
+
+	// FsckCheckAttributes verifies that info/attributes exists and has the
+	// expected contents.
+	FsckCheckAttributes = "attributes"
+
+	// FsckCheckMetaConfig verifies that refs/meta/config can be parsed.
+	FsckCheckMetaConfig = "meta-config"
+
+	// FsckCheckSplitParents verifies that the split branches have the contents
+	// of the latest commit in master.
+	FsckCheckSplitParents = "split-parents"
+
+	// FsckCheckPublished verifies that refs/heads/published is an ancestor of
+	// master.
+	FsckCheckPublished = "published"
+
+	// FsckCheckSettings verifies that the generated settings files in master
+	// are the ones that a push to master would generate.
+	FsckCheckSettings = "settings"
+)
+
+// FsckIssue is a single inconsistency found in a repository.
+type FsckIssue struct {
+	Check   string `json:"check"`
+	Message string `json:"message"`
+	Fixable bool   `json:"fixable"`
+	Fixed   bool   `json:"fixed,omitempty"`
+
+	// RepairError is the reason why a fixable issue could not be fixed.
+	RepairError string `json:"repair_error,omitempty"`
+}
+
+// FsckResult is the outcome of checking a single repository.
+type FsckResult struct {
+	Repository string       `json:"repository"`
+	Issues     []*FsckIssue `json:"issues"`
+	Repair     bool         `json:"repair,omitempty"`
+	Error      string       `json:"error,omitempty"`
+}
+
+// HasUnfixedIssues returns whether the repository could not be checked or
+// still has issues after any repairs.
+func (r *FsckResult) HasUnfixedIssues() bool {
+	if r.Error != "" {
+		return true
+	}
+	for _, issue := range r.Issues {
+		if !issue.Fixed {
+			return true
+		}
+	}
+	return false
+}
+
+// fsckContext holds the state that is shared by all the checks of a single
+// repository.
+type fsckContext struct {
+	migrationContext *MigrationContext
+	repositoryPath   string
+	result           *FsckResult
+	repair           bool
+}
+
+// addIssue records an issue. If the issue is fixable and the check is running
+// in repair mode, fix is invoked and its outcome is recorded too.
+func (c *fsckContext) addIssue(check, message string, fix func() error) {
+	issue := &FsckIssue{
+		Check:   check,
+		Message: message,
+		Fixable: fix != nil,
+	}
+	c.result.Issues = append(c.result.Issues, issue)
+	if fix == nil || !c.repair {
+		return
+	}
+	if err := fix(); err != nil {
+		c.migrationContext.Log.Error(
+			"Failed to repair repository",
+			"path", c.repositoryPath,
+			"check", check,
+			"err", err,
+		)
+		issue.RepairError = err.Error()
+		return
+	}
+	c.migrationContext.Log.Info(
+		"Repaired repository",
+		"path", c.repositoryPath,
+		"check", check,
+		"message", message,
+	)
+	issue.Fixed = true
+}
+
+// CheckRepository verifies the invariants that the server relies on for a
+// single repository. In repair mode, the issues that can be fixed without
+// losing information are fixed as they are found, so that the checks that
+// come afterwards see the repaired repository.
+func CheckRepository(
+	ctx context.Context,
+	repositoryPath string,
+	protocol *githttp.GitProtocol,
+	interactiveSettingsCompiler InteractiveSettingsCompiler,
+	repair bool,
+	log log15.Logger,
+) (*FsckResult, error) {
+	repo, err := git.OpenRepository(repositoryPath)
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to open repository at %s",
+				repositoryPath,
+			),
+		)
+	}
+	defer repo.Free()
+
+	lockfile := githttp.NewLockfile(repo.Path())
+	if repair {
+		if ok, err := lockfile.TryLock(); !ok {
+			log.Info("Waiting for the lockfile", "path", repositoryPath, "err", err)
+			if err := lockfile.Lock(); err != nil {
+				return nil, errors.Wrap(err, "failed to acquire the lockfile")
+			}
+		}
+	} else {
+		if ok, err := lockfile.TryRLock(); !ok {
+			log.Info("Waiting for the lockfile", "path", repositoryPath, "err", err)
+			if err := lockfile.RLock(); err != nil {
+				return nil, errors.Wrap(err, "failed to acquire the lockfile")
+			}
+		}
+	}
+	defer lockfile.Unlock()
+
+	c := &fsckContext{
+		migrationContext: &MigrationContext{
+			Context:                     ctx,
+			Repository:                  repo,
+			Lockfile:                    lockfile,
+			Protocol:                    protocol,
+			HardOverallWallTimeLimit:    OverallWallTimeHardLimit,
+			InteractiveSettingsCompiler: interactiveSettingsCompiler,
+			Log:                         log,
+		},
+		repositoryPath: repositoryPath,
+		result: &FsckResult{
+			Repository: repositoryPath,
+			Issues:     []*FsckIssue{},
+			Repair:     repair,
+		},
+		repair: repair,
+	}
+
+	for _, check := range []func(c *fsckContext) error{
+		checkVersion,
+		checkAttributes,
+		checkMetaConfig,
+		checkSplitParents,
+		checkPublished,
+		checkSettings,
+	} {
+		if err := check(c); err != nil {
+			return c.result, err
+		}
+	}
+	return c.result, nil
+}
+
+// CheckAllRepositories runs CheckRepository on every repository under
+// rootPath, using the given number of workers. The results are sorted by
+// repository path. Repositories that cannot be checked do not stop the rest
+// from being checked, and have their error in the result.
+func CheckAllRepositories(
+	ctx context.Context,
+	rootPath string,
+	protocol *githttp.GitProtocol,
+	interactiveSettingsCompiler InteractiveSettingsCompiler,
+	repair bool,
+	workers int,
+	log log15.Logger,
+) ([]*FsckResult, error) {
+	entries, err := ioutil.ReadDir(rootPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list repositories at %s", rootPath)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	repositoryPaths := make(chan string)
+	var results []*FsckResult
+	var resultsMutex sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for repositoryPath := range repositoryPaths {
+				result, err := CheckRepository(
+					ctx,
+					repositoryPath,
+					protocol,
+					interactiveSettingsCompiler,
+					repair,
+					log,
+				)
+				if result == nil {
+					result = &FsckResult{Repository: repositoryPath, Issues: []*FsckIssue{}}
+				}
+				if err != nil {
+					log.Error("Failed to check repository", "path", repositoryPath, "err", err)
+					result.Error = err.Error()
+				}
+				resultsMutex.Lock()
+				results = append(results, result)
+				resultsMutex.Unlock()
+			}
+		}()
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		repositoryPath := path.Join(rootPath, entry.Name())
+		if _, err := os.Stat(path.Join(repositoryPath, "objects")); err != nil {
+			// Not a bare git repository.
+			continue
+		}
+		select {
+		case repositoryPaths <- repositoryPath:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(repositoryPaths)
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Repository < results[j].Repository
+	})
+	return results, ctx.Err()
+}
+
+func checkVersion(c *fsckContext) error {
+	version, err := GetRepositoryVersion(c.repositoryPath)
+	if err != nil {
+		c.addIssue(FsckCheckVersion, err.Error(), nil)
+		return nil
+	}
+	if version > CurrentRepositoryVersion {
+		c.addIssue(
+			FsckCheckVersion,
+			fmt.Sprintf("version %d is newer than %d", version, CurrentRepositoryVersion),
+			nil,
+		)
+	} else if version < CurrentRepositoryVersion {
+		c.addIssue(
+			FsckCheckVersion,
+			fmt.Sprintf("version %d is older than %d", version, CurrentRepositoryVersion),
+			func() error {
+				return applyMigrations(
+					c.migrationContext,
+					&MigrationResult{
+						Repository:  c.repositoryPath,
+						FromVersion: version,
+						ToVersion:   version,
+					},
+					false,
+				)
+			},
+		)
+	}
+	return nil
+}
+
+func checkAttributes(c *fsckContext) error {
+	contents, err := ioutil.ReadFile(path.Join(c.repositoryPath, "info/attributes"))
+	if os.IsNotExist(err) {
+		c.addIssue(FsckCheckAttributes, "info/attributes is missing", func() error {
+			return writeGitAttributes(c.repositoryPath)
+		})
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to read info/attributes")
+	}
+	if string(contents) != GitAttributesContents {
+		c.addIssue(FsckCheckAttributes, "info/attributes has unexpected contents", func() error {
+			return writeGitAttributes(c.repositoryPath)
+		})
+	}
+	return nil
+}
+
+func checkMetaConfig(c *fsckContext) error {
+	metaConfig, err := getMetaConfig(c.migrationContext.Repository)
+	if err != nil {
+		c.addIssue(FsckCheckMetaConfig, err.Error(), nil)
+		return nil
+	}
+	if _, err := narrowCommitDescriptions(DefaultCommitDescriptions, metaConfig.CommitDescriptions); err != nil {
+		c.addIssue(FsckCheckMetaConfig, err.Error(), nil)
+	}
+	return nil
+}
+
+// lookupMasterCommit returns the latest commit in master, or nil if master
+// has not been created yet.
+func lookupMasterCommit(repo *git.Repository) (*git.Commit, error) {
+	masterRef, err := repo.References.Lookup("refs/heads/master")
+	if err != nil {
+		if git.IsErrorCode(err, git.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(err, "failed to lookup master"),
+		)
+	}
+	defer masterRef.Free()
+
+	masterCommit, err := repo.LookupCommit(masterRef.Target())
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(err, "failed to lookup the master commit"),
+		)
+	}
+	return masterCommit, nil
+}
+
+func checkSplitParents(c *fsckContext) error {
+	repo := c.migrationContext.Repository
+	masterCommit, err := lookupMasterCommit(repo)
+	if err != nil {
+		// lookupMasterCommit already wrapped the error correctly.
+		return err
+	}
+	if masterCommit == nil {
+		return nil
+	}
+	defer masterCommit.Free()
+
+	// Problems can only narrow the paths of the split branches, so the
+	// references are always the same. An invalid config is reported by
+	// checkMetaConfig.
+	descriptions, err := GetCommitDescriptions(repo)
+	if err != nil {
+		descriptions = DefaultCommitDescriptions
+	}
+	if masterCommit.ParentCount() < uint(len(descriptions)) {
+		c.addIssue(
+			FsckCheckSplitParents,
+			fmt.Sprintf(
+				"master commit %s has %d parents, expected at least %d",
+				masterCommit.Id(),
+				masterCommit.ParentCount(),
+				len(descriptions),
+			),
+			nil,
+		)
+		return nil
+	}
+
+	masterTree, err := masterCommit.Tree()
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(err, "failed to get the tree of commit %s", masterCommit.Id()),
+		)
+	}
+	defer masterTree.Free()
+
+	// The split branches are compared by their contents, since
+	// omegaup-rebuild-split-branches rewrites them without rewriting the
+	// split parents of master. Only the contents that master and the
+	// descriptions say each branch should have are considered correct.
+	expectedTreeIDs, err := splitTrees(repo, masterTree, descriptions, c.migrationContext.Log)
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(err, "failed to split the tree of master"),
+		)
+	}
+	firstSplitParent := masterCommit.ParentCount() - uint(len(descriptions))
+	for i, description := range descriptions {
+		referenceName := description.ReferenceName
+		expectedTreeID := expectedTreeIDs[i]
+
+		// The split parent of master can only be used to repair the branch
+		// if it still has the expected contents. Otherwise the branch needs
+		// to be rebuilt.
+		var fix func() error
+		splitParentOid := masterCommit.ParentId(firstSplitParent + uint(i))
+		splitParent, err := repo.LookupCommit(splitParentOid)
+		if err != nil {
+			return base.ErrorWithCategory(
+				ErrInternalGit,
+				errors.Wrapf(err, "failed to lookup commit %s", splitParentOid),
+			)
+		}
+		if splitParent.TreeId().Equal(expectedTreeID) {
+			fix = func() error {
+				ref, err := repo.References.Create(referenceName, splitParentOid, true, "fsck")
+				if err != nil {
+					return base.ErrorWithCategory(
+						ErrInternalGit,
+						errors.Wrapf(err, "failed to update %s", referenceName),
+					)
+				}
+				ref.Free()
+				return nil
+			}
+		}
+		splitParent.Free()
+
+		ref, err := repo.References.Lookup(referenceName)
+		if err != nil {
+			if !git.IsErrorCode(err, git.ErrNotFound) {
+				return base.ErrorWithCategory(
+					ErrInternalGit,
+					errors.Wrapf(err, "failed to lookup %s", referenceName),
+				)
+			}
+			c.addIssue(
+				FsckCheckSplitParents,
+				fmt.Sprintf("%s is missing, expected tree %s", referenceName, expectedTreeID),
+				fix,
+			)
+			continue
+		}
+		actualCommit, err := repo.LookupCommit(ref.Target())
+		ref.Free()
+		if err != nil {
+			return base.ErrorWithCategory(
+				ErrInternalGit,
+				errors.Wrapf(err, "failed to lookup the commit of %s", referenceName),
+			)
+		}
+		actualTreeID := actualCommit.TreeId()
+		actualCommit.Free()
+		if !actualTreeID.Equal(expectedTreeID) {
+			c.addIssue(
+				FsckCheckSplitParents,
+				fmt.Sprintf(
+					"%s has tree %s, expected %s",
+					referenceName,
+					actualTreeID,
+					expectedTreeID,
+				),
+				fix,
+			)
+		}
+	}
+	return nil
+}
+
+func checkPublished(c *fsckContext) error {
+	repo := c.migrationContext.Repository
+	publishedRef, err := repo.References.Lookup("refs/heads/published")
+	if err != nil {
+		if git.IsErrorCode(err, git.ErrNotFound) {
+			return nil
+		}
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(err, "failed to lookup refs/heads/published"),
+		)
+	}
+	defer publishedRef.Free()
+
+	masterCommit, err := lookupMasterCommit(repo)
+	if err != nil {
+		// lookupMasterCommit already wrapped the error correctly.
+		return err
+	}
+	if masterCommit == nil {
+		c.addIssue(FsckCheckPublished, "refs/heads/published exists without master", nil)
+		return nil
+	}
+	defer masterCommit.Free()
+
+	if masterCommit.Id().Equal(publishedRef.Target()) {
+		return nil
+	}
+	descendant, err := repo.DescendantOf(masterCommit.Id(), publishedRef.Target())
+	if err != nil {
+		c.addIssue(
+			FsckCheckPublished,
+			fmt.Sprintf("failed to compare refs/heads/published with master: %v", err),
+			nil,
+		)
+		return nil
+	}
+	if !descendant {
+		c.addIssue(
+			FsckCheckPublished,
+			fmt.Sprintf(
+				"refs/heads/published (%s) is not an ancestor of master (%s)",
+				publishedRef.Target(),
+				masterCommit.Id(),
+			),
+			nil,
+		)
+	}
+	return nil
+}
+
+func checkSettings(c *fsckContext) error {
+	repo := c.migrationContext.Repository
+	masterCommit, err := lookupMasterCommit(repo)
+	if err != nil {
+		// lookupMasterCommit already wrapped the error correctly.
+		return err
+	}
+	if masterCommit == nil {
+		return nil
+	}
+	defer masterCommit.Free()
+
+	staleFiles, err := getStaleGeneratedFiles(
+		repo,
+		masterCommit,
+		c.migrationContext.HardOverallWallTimeLimit,
+		c.migrationContext.InteractiveSettingsCompiler,
+		[]string{"settings.json", "settings.distrib.json"},
+		c.migrationContext.Log,
+	)
+	if err != nil {
+		c.addIssue(
+			FsckCheckSettings,
+			fmt.Sprintf("master commit %s is not valid: %v", masterCommit.Id(), err),
+			nil,
+		)
+		return nil
+	}
+	if len(staleFiles) == 0 {
+		return nil
+	}
+
+	var filenames []string
+	for filename := range staleFiles {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	c.addIssue(
+		FsckCheckSettings,
+		fmt.Sprintf("%s in master differ from the generated ones", strings.Join(filenames, ", ")),
+		func() error {
+			return pushMasterFiles(
+				c.migrationContext,
+				masterCommit,
+				staleFiles,
+				fmt.Sprintf("Regenerate %s", strings.Join(filenames, ", ")),
+			)
+		},
+	)
+	return nil
+}
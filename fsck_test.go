@@ -0,0 +1,260 @@
+package gitserver
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	git "github.com/lhchavez/git2go/v29"
+	"github.com/omegaup/githttp"
+	"github.com/omegaup/gitserver/gitservertest"
+	base "github.com/omegaup/go-base"
+)
+
+func TestCheckRepository(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+
+	log := base.StderrLog()
+	protocol := NewGitProtocol(authorize, nil, true, OverallWallTimeHardLimit, fakeInteractiveSettingsCompiler, log)
+	ts := httptest.NewServer(GitHandler(tmpDir, protocol, &base.NoOpMetrics{}, log))
+	defer ts.Close()
+
+	problemAlias := "sumas"
+	repositoryPath := path.Join(tmpDir, problemAlias)
+
+	{
+		repo, err := InitRepository(repositoryPath)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
+
+	for _, statement := range []string{"Sumas", "Sumas enteras"} {
+		newOid, packContents := createCommit(
+			t,
+			tmpDir,
+			problemAlias,
+			getReference(t, problemAlias, "refs/heads/master", ts),
+			map[string]io.Reader{
+				"settings.json":          strings.NewReader(gitservertest.DefaultSettingsJSON),
+				"cases/0.in":             strings.NewReader("1 2"),
+				"cases/0.out":            strings.NewReader("3"),
+				"statements/es.markdown": strings.NewReader(statement),
+			},
+			"Update statement",
+			log,
+		)
+		push(
+			t,
+			tmpDir,
+			adminAuthorization,
+			problemAlias,
+			"refs/heads/master",
+			getReference(t, problemAlias, "refs/heads/master", ts),
+			newOid,
+			packContents,
+			[]githttp.PktLineResponse{
+				{Line: "unpack ok\n", Err: nil},
+				{Line: "ok refs/heads/master\n", Err: nil},
+			},
+			ts,
+		)
+	}
+
+	// A freshly pushed repository has no issues.
+	result, err := CheckRepository(context.Background(), repositoryPath, protocol, fakeInteractiveSettingsCompiler, false, log)
+	if err != nil {
+		t.Fatalf("Failed to check repository: %v", err)
+	}
+	if len(result.Issues) != 0 {
+		t.Fatalf("Unexpected issues %v", result.Issues)
+	}
+
+	// Break a couple of the invariants.
+	if err := os.Remove(path.Join(repositoryPath, "info/attributes")); err != nil {
+		t.Fatalf("Failed to remove the attributes file: %v", err)
+	}
+	expectedPublicOid := getReference(t, problemAlias, "refs/heads/public", ts)
+	{
+		repo, err := git.OpenRepository(repositoryPath)
+		if err != nil {
+			t.Fatalf("Failed to open repository: %v", err)
+		}
+		publicCommit, err := repo.LookupCommit(expectedPublicOid)
+		if err != nil {
+			t.Fatalf("Failed to lookup the public commit: %v", err)
+		}
+		ref, err := repo.References.Create("refs/heads/public", publicCommit.ParentId(0), true, "")
+		if err != nil {
+			t.Fatalf("Failed to move the public branch: %v", err)
+		}
+		ref.Free()
+		publicCommit.Free()
+		repo.Free()
+	}
+
+	result, err = CheckRepository(context.Background(), repositoryPath, protocol, fakeInteractiveSettingsCompiler, false, log)
+	if err != nil {
+		t.Fatalf("Failed to check repository: %v", err)
+	}
+	checks := make(map[string]bool)
+	for _, issue := range result.Issues {
+		if !issue.Fixable || issue.Fixed {
+			t.Errorf("Unexpected issue %v", issue)
+		}
+		checks[issue.Check] = true
+	}
+	if len(result.Issues) != 2 || !checks[FsckCheckAttributes] || !checks[FsckCheckSplitParents] {
+		t.Errorf("Unexpected issues %v", result.Issues)
+	}
+	if !result.HasUnfixedIssues() {
+		t.Errorf("Expected unfixed issues")
+	}
+
+	results, err := CheckAllRepositories(context.Background(), tmpDir, protocol, fakeInteractiveSettingsCompiler, true, 2, log)
+	if err != nil {
+		t.Fatalf("Failed to check repositories: %v", err)
+	}
+	if len(results) != 1 || results[0].Repository != repositoryPath {
+		t.Fatalf("Unexpected results %v", results)
+	}
+	if results[0].HasUnfixedIssues() {
+		for _, issue := range results[0].Issues {
+			t.Errorf("Unfixed issue %v", issue)
+		}
+	}
+	if !getReference(t, problemAlias, "refs/heads/public", ts).Equal(expectedPublicOid) {
+		t.Errorf("Expected refs/heads/public to be restored to %s", expectedPublicOid)
+	}
+
+	// After repairing, there are no issues left.
+	result, err = CheckRepository(context.Background(), repositoryPath, protocol, fakeInteractiveSettingsCompiler, false, log)
+	if err != nil {
+		t.Fatalf("Failed to check repository: %v", err)
+	}
+	if len(result.Issues) != 0 {
+		t.Errorf("Unexpected issues after repairing %v", result.Issues)
+	}
+
+	// Rebuilding the split branches rewrites them without rewriting master,
+	// and repairing does not undo that.
+	if _, err := RebuildSplitBranches(repositoryPath, DefaultCommitDescriptions, false, log); err != nil {
+		t.Fatalf("Failed to rebuild the split branches: %v", err)
+	}
+	// The rebuilt commits might be identical to the original ones, so the
+	// public branch is also rewritten with a different message.
+	{
+		repo, err := git.OpenRepository(repositoryPath)
+		if err != nil {
+			t.Fatalf("Failed to open repository: %v", err)
+		}
+		publicCommit, err := repo.LookupCommit(getReference(t, problemAlias, "refs/heads/public", ts))
+		if err != nil {
+			t.Fatalf("Failed to lookup the public commit: %v", err)
+		}
+		rebuiltOid, err := repo.CreateCommitFromIds(
+			"",
+			publicCommit.Author(),
+			publicCommit.Committer(),
+			"Rebuilt",
+			publicCommit.TreeId(),
+			publicCommit.ParentId(0),
+		)
+		if err != nil {
+			t.Fatalf("Failed to rewrite the public commit: %v", err)
+		}
+		ref, err := repo.References.Create("refs/heads/public", rebuiltOid, true, "")
+		if err != nil {
+			t.Fatalf("Failed to move the public branch: %v", err)
+		}
+		ref.Free()
+		publicCommit.Free()
+		repo.Free()
+	}
+	rebuiltPublicOid := getReference(t, problemAlias, "refs/heads/public", ts)
+	if rebuiltPublicOid.Equal(expectedPublicOid) {
+		t.Fatalf("Expected refs/heads/public to be rewritten")
+	}
+	result, err = CheckRepository(context.Background(), repositoryPath, protocol, fakeInteractiveSettingsCompiler, true, log)
+	if err != nil {
+		t.Fatalf("Failed to check repository: %v", err)
+	}
+	if len(result.Issues) != 0 {
+		t.Errorf("Unexpected issues after rebuilding %v", result.Issues)
+	}
+	if !getReference(t, problemAlias, "refs/heads/public", ts).Equal(rebuiltPublicOid) {
+		t.Errorf("Expected refs/heads/public to stay at %s", rebuiltPublicOid)
+	}
+}
+
+func TestCheckRepositoryInteractive(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+
+	log := base.StderrLog()
+	protocol := NewGitProtocol(authorize, nil, true, OverallWallTimeHardLimit, interactiveSettingsCompiler, log)
+	ts := httptest.NewServer(GitHandler(tmpDir, protocol, &base.NoOpMetrics{}, log))
+	defer ts.Close()
+
+	problemAlias := "sumas"
+	repositoryPath := path.Join(tmpDir, problemAlias)
+
+	{
+		repo, err := InitRepository(repositoryPath)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
+
+	newOid, packContents := createCommit(
+		t,
+		tmpDir,
+		problemAlias,
+		&git.Oid{},
+		interactiveProblemContents("Sumas"),
+		"Initial commit",
+		log,
+	)
+	push(
+		t,
+		tmpDir,
+		adminAuthorization,
+		problemAlias,
+		"refs/heads/master",
+		&git.Oid{}, newOid,
+		packContents,
+		[]githttp.PktLineResponse{
+			{Line: "unpack ok\n", Err: nil},
+			{Line: "ok refs/heads/master\n", Err: nil},
+		},
+		ts,
+	)
+
+	// The files within interactive/ are split like githttp does, so a freshly
+	// pushed interactive problem has no issues either.
+	result, err := CheckRepository(context.Background(), repositoryPath, protocol, interactiveSettingsCompiler, false, log)
+	if err != nil {
+		t.Fatalf("Failed to check repository: %v", err)
+	}
+	if len(result.Issues) != 0 {
+		t.Errorf("Unexpected issues %v", result.Issues)
+	}
+}
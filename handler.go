@@ -1,11 +1,14 @@
 package gitserver
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	stderrors "errors"
 	"fmt"
+	"io"
 	"math"
 	"math/big"
 	"net/http"
@@ -14,6 +17,7 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 	"unicode/utf8"
@@ -30,6 +34,15 @@ import (
 const (
 	iterationLabel = "Iteration: "
 	objectLimit    = 10000
+	approveVote    = "approve"
+
+	// systemUsername is the username that omegaUp uses to perform actions on
+	// behalf of other users.
+	systemUsername = "omegaup:system"
+
+	// maxLedgerDateSkew is the maximum difference between the date of a new
+	// ledger entry and the server time.
+	maxLedgerDateSkew = 10 * time.Minute
 
 	// GitAttributesContents is what the .gitattributes and info/attributes files
 	// contain.
@@ -52,22 +65,67 @@ var (
 	// master branch.
 	ErrPublishedNotFromMaster = stderrors.New("published-must-point-to-commit-in-master")
 
+	// ErrTagNotAnnotated is returned if a lightweight tag, or an annotated tag
+	// that does not point to a commit, is pushed to refs/tags/.
+	ErrTagNotAnnotated = stderrors.New("tag-not-annotated")
+
+	// ErrTagNotFromMaster is returned if a tag is pushed and it does not point
+	// to a commit in the master branch.
+	ErrTagNotFromMaster = stderrors.New("tag-must-point-to-commit-in-master")
+
+	// ErrTagImmutable is returned if an existing tag is attempted to be moved.
+	ErrTagImmutable = stderrors.New("tag-immutable")
+
 	// ErrConfigSubdirectoryMissingTarget is returned if a 'subdirectory'
 	// publishing config is missing a 'target' entry.
 	ErrConfigSubdirectoryMissingTarget = stderrors.New("config-subdirectory-missing-target")
 
 	// ErrConfigInvalidPublishingMode is returned if a publishing config is not
-	// 'subdirectory' or 'mirror'.
+	// 'subdirectory', 'mirror', or 'archive'.
 	ErrConfigInvalidPublishingMode = stderrors.New("config-invalid-publishing-mode")
 
+	// ErrConfigArchiveInvalidDirectory is returned if an 'archive' publishing
+	// config does not have a relative directory that stays within the archive
+	// root.
+	ErrConfigArchiveInvalidDirectory = stderrors.New("config-archive-invalid-directory")
+
+	// ErrConfigArchiveInvalidFormat is returned if an 'archive' publishing
+	// config does not have a 'zip' or 'tar.gz' format.
+	ErrConfigArchiveInvalidFormat = stderrors.New("config-archive-invalid-format")
+
 	// ErrConfigRepositoryNotAbsoluteURL is returned if a publishing config does
 	// not have a valid, absolute URL for 'repository'.
 	ErrConfigRepositoryNotAbsoluteURL = stderrors.New("config-repository-not-absolute-url")
 
+	// ErrConfigRepositoryUnsupportedScheme is returned if the 'repository' of a
+	// publishing config is not an ssh:// URL, which is the only transport that
+	// the publisher supports.
+	ErrConfigRepositoryUnsupportedScheme = stderrors.New("config-repository-unsupported-scheme")
+
 	// ErrConfigBadLayout is returned if the refs/meta/config structure does not
 	// contain the correct layout.
 	ErrConfigBadLayout = stderrors.New("config-bad-layout")
 
+	// ErrConfigInvalidPolicy is returned if the policy section of the
+	// refs/meta/config is not valid.
+	ErrConfigInvalidPolicy = stderrors.New("config-invalid-policy")
+
+	// ErrConfigInvalidWebhook is returned if one of the webhooks of the
+	// refs/meta/config does not have an absolute http(s) URL or a secret.
+	ErrConfigInvalidWebhook = stderrors.New("config-invalid-webhook")
+
+	// ErrConfigInvalidCommitDescriptions is returned if the commit descriptions
+	// mention a reference that is not split or a path that is not valid.
+	ErrConfigInvalidCommitDescriptions = stderrors.New("config-invalid-commit-descriptions")
+
+	// ErrPublishingRejected is returned if the remote repository of a
+	// publishing config does not accept the published commit.
+	ErrPublishingRejected = stderrors.New("publishing-rejected")
+
+	// ErrRepositoryVersionTooNew is returned if a repository has a newer
+	// format version than the one this server knows how to handle.
+	ErrRepositoryVersionTooNew = stderrors.New("repository-version-too-new")
+
 	// ErrTestsBadLayout is returned if the tests/ directory does not contain the
 	// correct layout.
 	ErrTestsBadLayout = stderrors.New("tests-bad-layout")
@@ -84,6 +142,11 @@ var (
 	// the correct layout.
 	ErrReviewBadLayout = stderrors.New("review-bad-layout")
 
+	// ErrReviewNotApproved is returned if a change is merged into master
+	// without enough approving votes, or while it still has unresolved comment
+	// threads.
+	ErrReviewNotApproved = stderrors.New("review-not-approved")
+
 	// ErrMismatchedInputFile is returned if there is an .in without an .out.
 	ErrMismatchedInputFile = stderrors.New("mismatched-input-file")
 
@@ -112,7 +175,21 @@ var (
 	// ErrInvalidMarkup is returned if the markup file is not valid.
 	ErrInvalidMarkup = stderrors.New("invalid-markup")
 
+	// ErrInvalidPolygonPackage is returned if a .zip file looks like a Polygon
+	// package, but it cannot be converted into a problem.
+	ErrInvalidPolygonPackage = stderrors.New("invalid-polygon-package")
+
+	// ErrInvalidKattisPackage is returned if a .zip file looks like a Kattis
+	// problem package, but it cannot be converted into a problem.
+	ErrInvalidKattisPackage = stderrors.New("invalid-kattis-package")
+
+	// ErrUnsupportedKattisExport is returned if a problem cannot be exported
+	// as a Kattis problem package without losing its scoring.
+	ErrUnsupportedKattisExport = stderrors.New("unsupported-kattis-export")
+
 	// DefaultCommitDescriptions describes which files go to which branches.
+	// Servers can add paths to it on startup with ExtendCommitDescriptions, and
+	// problems can narrow it with the commitDescriptions of refs/meta/config.
 	DefaultCommitDescriptions = []githttp.SplitCommitDescription{
 		{
 			ReferenceName: "refs/heads/public",
@@ -156,6 +233,7 @@ var (
 // LedgerIteration is an entry in the iteration ledger.
 type LedgerIteration struct {
 	Author  string `json:"author"`
+	Commit  string `json:"commit,omitempty"`
 	Date    int64  `json:"date"`
 	Summary string `json:"summary"`
 	UUID    string `json:"uuid"`
@@ -184,18 +262,127 @@ type Comment struct {
 	UUID                  string  `json:"uuid"`
 }
 
-// PublishingConfig represents the publishing section of config.json in
+// PublishingConfig represents one of the publishing targets of config.json in
 // refs/meta/config.
 type PublishingConfig struct {
 	Mode       string `json:"mode"`
-	Repository string `json:"repository"`
+	Repository string `json:"repository,omitempty"`
 	Target     string `json:"target,omitempty"`
 	Branch     string `json:"branch,omitempty"`
+
+	// Directory is where archives are written to, relative to the server's
+	// archive root. Only used in the 'archive' mode.
+	Directory string `json:"directory,omitempty"`
+
+	// Format is the format of the archive, either 'zip' (the default) or
+	// 'tar.gz'. Only used in the 'archive' mode.
+	Format string `json:"format,omitempty"`
+}
+
+// PublishingConfigs represents the publishing section of config.json in
+// refs/meta/config. For backwards compatibility, a single publishing target
+// can also be provided as an object instead of a list.
+type PublishingConfigs []PublishingConfig
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (c *PublishingConfigs) UnmarshalJSON(data []byte) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var config PublishingConfig
+		if err := json.Unmarshal(trimmed, &config); err != nil {
+			return err
+		}
+		if config == (PublishingConfig{}) {
+			*c = nil
+		} else {
+			*c = PublishingConfigs{config}
+		}
+		return nil
+	}
+	var configs []PublishingConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return err
+	}
+	*c = configs
+	return nil
+}
+
+// ReviewConfig represents the review requirements in the policy section of
+// config.json in refs/meta/config.
+type ReviewConfig struct {
+	RequiredApprovals int `json:"requiredApprovals,omitempty"`
+}
+
+// PolicyConfig represents the policy section of config.json in
+// refs/meta/config. It controls which references can be updated and how.
+type PolicyConfig struct {
+	// AllowDirectPushToMaster overrides the server-wide setting that controls
+	// whether commits that do not come from a review can be pushed to master.
+	AllowDirectPushToMaster *bool `json:"allowDirectPushToMaster,omitempty"`
+
+	// AllowPublishedBackwards controls whether the published branch can be
+	// moved to an ancestor of its current commit. Defaults to true.
+	AllowPublishedBackwards *bool `json:"allowPublishedBackwards,omitempty"`
+
+	// Review contains the requirements for merging changes into master.
+	Review ReviewConfig `json:"review"`
+
+	// ExtraReferences contains additional reference patterns (e.g.
+	// refs/tags/*) that editors can update.
+	ExtraReferences []string `json:"extraReferences,omitempty"`
 }
 
 // MetaConfig represents the contents of config.json in refs/meta/config.
 type MetaConfig struct {
-	Publishing PublishingConfig `json:"publishing"`
+	Publishing PublishingConfigs `json:"publishing,omitempty"`
+	Policy     PolicyConfig      `json:"policy"`
+	Webhooks   []WebhookConfig   `json:"webhooks,omitempty"`
+
+	// CommitDescriptions narrows the paths that go to each of the split
+	// branches for this problem.
+	CommitDescriptions []CommitDescriptionConfig `json:"commitDescriptions,omitempty"`
+
+	// Review is where the review requirements were stored before they were
+	// moved to the policy section. It is only used when the policy does not
+	// have any.
+	Review ReviewConfig `json:"review"`
+}
+
+// requiredApprovals returns the number of approving votes that are needed to
+// merge a change into master.
+func (c *MetaConfig) requiredApprovals() int {
+	if c.Policy.Review.RequiredApprovals != 0 {
+		return c.Policy.Review.RequiredApprovals
+	}
+	return c.Review.RequiredApprovals
+}
+
+// allowsDirectPushToMaster returns whether commits that do not come from a
+// review can be pushed to master, falling back to the server-wide default.
+func (p *PolicyConfig) allowsDirectPushToMaster(serverDefault bool) bool {
+	if p.AllowDirectPushToMaster == nil {
+		return serverDefault
+	}
+	return *p.AllowDirectPushToMaster
+}
+
+// allowsPublishedBackwards returns whether the published branch can be moved
+// to an ancestor of its current commit.
+func (p *PolicyConfig) allowsPublishedBackwards() bool {
+	if p.AllowPublishedBackwards == nil {
+		return true
+	}
+	return *p.AllowPublishedBackwards
+}
+
+// isExtraReference returns whether the reference matches one of the extra
+// reference patterns.
+func (p *PolicyConfig) isExtraReference(referenceName string) bool {
+	for _, pattern := range p.ExtraReferences {
+		if ok, _ := path.Match(pattern, referenceName); ok {
+			return true
+		}
+	}
+	return false
 }
 
 type gitProtocol struct {
@@ -430,9 +617,28 @@ func extractExampleCases(
 			}
 			defer outputBlob.Free()
 
+			// The files will be normalized before being committed, so the
+			// distributable settings need to reflect that.
+			inputContents, err := normalizeContents(
+				path.Join(examplesDirectory, inputEntry.Name),
+				inputBlob.Contents(),
+			)
+			if err != nil {
+				// normalizeContents already wrapped the error correctly.
+				return nil, err
+			}
+			outputContents, err := normalizeContents(
+				path.Join(examplesDirectory, outputEntry.Name),
+				outputBlob.Contents(),
+			)
+			if err != nil {
+				// normalizeContents already wrapped the error correctly.
+				return nil, err
+			}
+
 			exampleCases[inputName] = &common.LiteralCaseSettings{
-				Input:          string(inputBlob.Contents()),
-				ExpectedOutput: string(outputBlob.Contents()),
+				Input:          string(inputContents),
+				ExpectedOutput: string(outputContents),
 				Weight:         big.NewRat(1, 1),
 			}
 		}
@@ -488,7 +694,16 @@ func extractExampleCases(
 			}
 			defer statementBlob.Free()
 
-			exampleCases = extractExampleCasesFromStatement(string(statementBlob.Contents()))
+			statementContents, err := normalizeContents(
+				fmt.Sprintf("statements/%s.markdown", statementLanguage),
+				statementBlob.Contents(),
+			)
+			if err != nil {
+				// normalizeContents already wrapped the error correctly.
+				return nil, err
+			}
+
+			exampleCases = extractExampleCasesFromStatement(string(statementContents))
 			if len(exampleCases) > 0 {
 				break
 			}
@@ -498,11 +713,219 @@ func extractExampleCases(
 	return exampleCases, nil
 }
 
+// getMetaConfig returns the contents of config.json in refs/meta/config. If
+// the problem does not have a configuration, the default one is returned.
+func getMetaConfig(repository *git.Repository) (*MetaConfig, error) {
+	var metaConfig MetaConfig
+
+	ref, err := repository.References.Lookup("refs/meta/config")
+	if err != nil {
+		if git.IsErrorCode(err, git.ErrNotFound) {
+			return &metaConfig, nil
+		}
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(
+				err,
+				"failed to lookup refs/meta/config",
+			),
+		)
+	}
+	defer ref.Free()
+
+	commit, err := repository.LookupCommit(ref.Target())
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to lookup commit %s",
+				ref.Target(),
+			),
+		)
+	}
+	defer commit.Free()
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to get tree for commit %s",
+				commit.Id(),
+			),
+		)
+	}
+	defer tree.Free()
+
+	treeEntry := tree.EntryByName("config.json")
+	if treeEntry == nil {
+		// An empty tree is a valid configuration.
+		return &metaConfig, nil
+	}
+	configBlob, err := repository.LookupBlob(treeEntry.Id)
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to lookup blob for %s",
+				treeEntry.Name,
+			),
+		)
+	}
+	defer configBlob.Free()
+
+	if err := json.Unmarshal(configBlob.Contents(), &metaConfig); err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrJSONParseError,
+			errors.Wrap(
+				err,
+				treeEntry.Name,
+			),
+		)
+	}
+	return &metaConfig, nil
+}
+
+// validateReviewApproval makes sure that the change pointed to by
+// changeCommit has at least requiredApprovals approving votes in the ledger
+// from someone other than the author of the change, and that all the comment
+// threads in the change have been resolved. A thread is resolved if its last
+// comment was marked as done. The authors of the change are the
+// authenticated users that pushed it to refs/changes/*. Changes that were
+// pushed before that was recorded fall back to whoever added the first ledger
+// entry for it.
+func validateReviewApproval(
+	repository *git.Repository,
+	changeCommit *git.Commit,
+	requiredApprovals int,
+) error {
+	ref, err := repository.References.Lookup("refs/meta/review")
+	if err != nil {
+		if !git.IsErrorCode(err, git.ErrNotFound) {
+			return base.ErrorWithCategory(
+				ErrInternalGit,
+				errors.Wrap(
+					err,
+					"failed to lookup refs/meta/review",
+				),
+			)
+		}
+		if requiredApprovals > 0 {
+			return base.ErrorWithCategory(
+				ErrReviewNotApproved,
+				errors.Errorf(
+					"change has 0 approving votes, %d required",
+					requiredApprovals,
+				),
+			)
+		}
+		return nil
+	}
+	defer ref.Free()
+
+	reviewCommit, err := repository.LookupCommit(ref.Target())
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to lookup commit %s",
+				ref.Target(),
+			),
+		)
+	}
+	defer reviewCommit.Free()
+
+	reviewTree, err := reviewCommit.Tree()
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to get tree for review commit %s",
+				reviewCommit.Id(),
+			),
+		)
+	}
+	defer reviewTree.Free()
+
+	changeCommitID := changeCommit.Id().String()
+
+	// Comment threads.
+	comments, err := readReviewComments(repository, reviewTree, changeCommitID)
+	if err != nil {
+		// readReviewComments already wrapped the error correctly.
+		return err
+	}
+	unresolvedThreads := 0
+	for _, thread := range buildReviewThreads(changeCommitID, comments) {
+		if !thread.Resolved {
+			unresolvedThreads++
+		}
+	}
+	if unresolvedThreads > 0 {
+		return base.ErrorWithCategory(
+			ErrReviewNotApproved,
+			errors.Errorf(
+				"change has %d unresolved comment threads",
+				unresolvedThreads,
+			),
+		)
+	}
+
+	// Votes. Only the last vote of each reviewer is taken into account.
+	iterations, err := readReviewLedger(repository, reviewTree)
+	if err != nil {
+		// readReviewLedger already wrapped the error correctly.
+		return err
+	}
+	changeAuthors, err := readChangeAuthors(repository.Path(), changeCommit.Id())
+	if err != nil {
+		// readChangeAuthors already wrapped the error correctly.
+		return err
+	}
+	votes := make(map[string]string)
+	for _, ledgerIteration := range iterations {
+		if ledgerIteration.Commit != changeCommitID {
+			continue
+		}
+		if len(changeAuthors) == 0 {
+			changeAuthors[ledgerIteration.Author] = true
+		}
+		if changeAuthors[ledgerIteration.Author] || ledgerIteration.Vote == "" {
+			continue
+		}
+		votes[ledgerIteration.Author] = ledgerIteration.Vote
+	}
+	approvals := 0
+	for _, vote := range votes {
+		if vote == approveVote {
+			approvals++
+		}
+	}
+	if approvals < requiredApprovals {
+		return base.ErrorWithCategory(
+			ErrReviewNotApproved,
+			errors.Errorf(
+				"change has %d approving votes, %d required",
+				approvals,
+				requiredApprovals,
+			),
+		)
+	}
+
+	return nil
+}
+
 func validateUpdateMaster(
 	ctx context.Context,
 	repository *git.Repository,
 	newCommit *git.Commit,
 	allowDirectPush bool,
+	requiredApprovals int,
 	hardOverallWallTimeLimit base.Duration,
 	interactiveSettingsCompiler InteractiveSettingsCompiler,
 	log log15.Logger,
@@ -541,13 +964,117 @@ func validateUpdateMaster(
 		}
 	}
 
-	if sourceReview == "" && !allowDirectPush {
+	requestContext := request.FromContext(ctx)
+
+	// The system user regenerates files in master on its own, so neither the
+	// policy nor the approvals of the problem apply to it.
+	if sourceReview == "" && !allowDirectPush && !requestContext.Request.IsSystem {
 		return ErrNotAReview
 	}
 
-	requestContext := request.FromContext(ctx)
+	if sourceReview != "" && !requestContext.Request.IsSystem {
+		if err := validateReviewApproval(
+			repository,
+			newCommit,
+			requiredApprovals,
+		); err != nil {
+			// validateReviewApproval already wrapped the error correctly.
+			return err
+		}
+	}
+
 	requestContext.Request.ReviewRef = sourceReview
 
+	return validateProblem(
+		repository,
+		newCommit,
+		hardOverallWallTimeLimit,
+		interactiveSettingsCompiler,
+		requestContext.UpdatedFiles,
+		log,
+	)
+}
+
+// validateCases makes sure that every case referenced by settings.json has a
+// matching .in/.out pair in the cases/ directory, and that there are no case
+// files that are not referenced by any group.
+func validateCases(
+	repository *git.Repository,
+	commit *git.Commit,
+	problemSettings *common.ProblemSettings,
+) error {
+	commitFiles, err := getAllFilesForCommit(repository, commit.Id())
+	if err != nil {
+		// getAllFilesForCommit already wrapped the error correctly.
+		return err
+	}
+
+	// Group names in settings.json are not necessarily derived from the case
+	// names, so all cases are compared within a single group.
+	settingsCases := map[string]map[string]*big.Rat{"": {}}
+	for _, group := range problemSettings.Cases {
+		for _, caseSettings := range group.Cases {
+			settingsCases[""][caseSettings.Name] = caseSettings.Weight
+		}
+	}
+
+	treeCases := map[string]map[string]*big.Rat{"": {}}
+	for filename := range commitFiles {
+		if !strings.HasPrefix(filename, "cases/") {
+			continue
+		}
+		if strings.HasSuffix(filename, ".in") {
+			caseName := strings.TrimSuffix(strings.TrimPrefix(filename, "cases/"), ".in")
+			if _, ok := commitFiles[fmt.Sprintf("cases/%s.out", caseName)]; !ok {
+				return base.ErrorWithCategory(
+					ErrMismatchedInputFile,
+					errors.Errorf(
+						"failed to find the output file for cases/%s",
+						caseName,
+					),
+				)
+			}
+			treeCases[""][caseName] = big.NewRat(1, 1)
+		} else if strings.HasSuffix(filename, ".out") {
+			caseName := strings.TrimSuffix(strings.TrimPrefix(filename, "cases/"), ".out")
+			if _, ok := commitFiles[fmt.Sprintf("cases/%s.in", caseName)]; !ok {
+				return base.ErrorWithCategory(
+					ErrMismatchedInputFile,
+					errors.Errorf(
+						"failed to find the input file for cases/%s",
+						caseName,
+					),
+				)
+			}
+		}
+	}
+
+	if err := symmetricDiffSettings(settingsCases, treeCases, "cases/"); err != nil {
+		// symmetricDiffSettings already wrapped the error correctly.
+		return err
+	}
+	if err := symmetricDiffSettings(treeCases, settingsCases, "settings.json"); err != nil {
+		// symmetricDiffSettings already wrapped the error correctly.
+		return err
+	}
+
+	return nil
+}
+
+// validateProblem performs all the validations of the problem layout in the
+// tree of the provided commit and regenerates settings.json and
+// settings.distrib.json, which are written into updatedFiles. Callers that
+// only want to know whether the commit is valid (like pushes to
+// refs/changes/*) can pass a scratch map so that the generated files are
+// discarded.
+func validateProblem(
+	repository *git.Repository,
+	newCommit *git.Commit,
+	hardOverallWallTimeLimit base.Duration,
+	interactiveSettingsCompiler InteractiveSettingsCompiler,
+	updatedFiles map[string]io.Reader,
+	log log15.Logger,
+) error {
 	tree, err := newCommit.Tree()
 	if err != nil {
 		return base.ErrorWithCategory(
@@ -567,6 +1094,10 @@ func validateUpdateMaster(
 		// getProblemSettings already wrapped the error correctly.
 		return err
 	}
+	if err := validateCases(repository, newCommit, problemSettings); err != nil {
+		// validateCases already wrapped the error correctly.
+		return err
+	}
 
 	// Tests.
 	testsTreeEntry := tree.EntryByName("tests")
@@ -775,7 +1306,7 @@ func validateUpdateMaster(
 
 			mainDistribSourceContents = mainSourceBlob.Contents()
 			distribPath := fmt.Sprintf("interactive/Main.distrib.%s", parentLang)
-			requestContext.UpdatedFiles[distribPath] = bytes.NewReader(
+			updatedFiles[distribPath] = bytes.NewReader(
 				mainDistribSourceContents,
 			)
 		} else if parentLang != distribLang {
@@ -894,7 +1425,7 @@ func validateUpdateMaster(
 			),
 		)
 	}
-	requestContext.UpdatedFiles["settings.json"] = bytes.NewReader(problemSettingsBytes)
+	updatedFiles["settings.json"] = bytes.NewReader(problemSettingsBytes)
 
 	// Generate the distributable problem settings (that can be used by the
 	// ephemeral grader).
@@ -955,12 +1486,16 @@ func validateUpdateMaster(
 		)
 	}
 
-	requestContext.UpdatedFiles["settings.distrib.json"] = bytes.NewReader(problemDistribSettingsBytes)
+	updatedFiles["settings.distrib.json"] = bytes.NewReader(problemDistribSettingsBytes)
 
 	return nil
 }
 
-func validateUpdatePublished(repository *git.Repository, newCommit *git.Commit) error {
+func validateUpdatePublished(
+	repository *git.Repository,
+	oldCommit, newCommit *git.Commit,
+	allowBackwards bool,
+) error {
 	head, err := repository.Head()
 	if err != nil {
 		// The master branch has not been yet created.
@@ -983,17 +1518,166 @@ func validateUpdatePublished(repository *git.Repository, newCommit *git.Commit)
 		return ErrPublishedNotFromMaster
 	}
 
-	return nil
-}
-
-func (p *gitProtocol) validateUpdateConfig(repository *git.Repository, oldCommit, newCommit *git.Commit) error {
-	newTree, err := newCommit.Tree()
-	if err != nil {
-		return base.ErrorWithCategory(
-			ErrInternalGit,
-			errors.Wrapf(
-				err,
-				"failed to get tree for new commit %s",
+	if !allowBackwards && oldCommit != nil && !oldCommit.Id().Equal(newCommit.Id()) {
+		backwards, err := repository.DescendantOf(oldCommit.Id(), newCommit.Id())
+		if err != nil {
+			return base.ErrorWithCategory(
+				ErrInternalGit,
+				errors.Wrapf(
+					err,
+					"failed to determine whether %s is a descendant of %s",
+					oldCommit.Id(),
+					newCommit.Id(),
+				),
+			)
+		}
+		if backwards {
+			return githttp.ErrNonFastForward
+		}
+	}
+
+	return nil
+}
+
+// validateUpdateTag makes sure that the new tag is an annotated tag that points
+// to a commit that is already part of master. Tags cannot be moved once they
+// are created.
+func validateUpdateTag(
+	repository *git.Repository,
+	command *githttp.GitCommand,
+) error {
+	if !command.IsCreate() {
+		return ErrTagImmutable
+	}
+
+	obj, err := repository.Lookup(command.New)
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to lookup object %s",
+				command.New,
+			),
+		)
+	}
+	defer obj.Free()
+	if obj.Type() != git.ObjectTag {
+		return base.ErrorWithCategory(
+			ErrTagNotAnnotated,
+			errors.Errorf(
+				"%s is not an annotated tag",
+				command.New,
+			),
+		)
+	}
+	tag, err := obj.AsTag()
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to lookup tag %s",
+				command.New,
+			),
+		)
+	}
+	defer tag.Free()
+
+	if tag.TargetType() != git.ObjectCommit {
+		return base.ErrorWithCategory(
+			ErrTagNotAnnotated,
+			errors.Errorf(
+				"tag %s points to a %s instead of a commit",
+				command.New,
+				tag.TargetType(),
+			),
+		)
+	}
+
+	head, err := repository.Head()
+	if err != nil {
+		// The master branch has not been yet created.
+		return ErrTagNotFromMaster
+	}
+	defer head.Free()
+
+	if head.Target().Equal(tag.TargetId()) {
+		return nil
+	}
+	descendant, err := repository.DescendantOf(head.Target(), tag.TargetId())
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to determine whether %s is a descendant of %s",
+				head.Target(),
+				tag.TargetId(),
+			),
+		)
+	}
+	if !descendant {
+		return ErrTagNotFromMaster
+	}
+
+	return nil
+}
+
+// validatePolicyConfig makes sure that the policy does not contain negative
+// requirements, and that the extra references are valid patterns that do not
+// overlap with any of the references that are managed by the server.
+func validatePolicyConfig(policy *PolicyConfig) error {
+	if policy.Review.RequiredApprovals < 0 {
+		return base.ErrorWithCategory(
+			ErrConfigInvalidPolicy,
+			errors.New("review.requiredApprovals cannot be negative"),
+		)
+	}
+	for _, pattern := range policy.ExtraReferences {
+		if _, err := path.Match(pattern, "refs/"); err != nil {
+			return base.ErrorWithCategory(
+				ErrConfigInvalidPolicy,
+				errors.Wrapf(
+					err,
+					"invalid reference pattern %s",
+					pattern,
+				),
+			)
+		}
+		if !strings.HasPrefix(pattern, "refs/") {
+			return base.ErrorWithCategory(
+				ErrConfigInvalidPolicy,
+				errors.Errorf(
+					"reference pattern %s must start with refs/",
+					pattern,
+				),
+			)
+		}
+		for _, reservedPrefix := range []string{"refs/heads/", "refs/meta/", "refs/changes/"} {
+			if strings.HasPrefix(pattern, reservedPrefix) {
+				return base.ErrorWithCategory(
+					ErrConfigInvalidPolicy,
+					errors.Errorf(
+						"reference pattern %s overlaps with %s*",
+						pattern,
+						reservedPrefix,
+					),
+				)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *gitProtocol) validateUpdateConfig(repository *git.Repository, oldCommit, newCommit *git.Commit) error {
+	newTree, err := newCommit.Tree()
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to get tree for new commit %s",
 				newCommit.Id(),
 			),
 		)
@@ -1041,22 +1725,199 @@ func (p *gitProtocol) validateUpdateConfig(repository *git.Repository, oldCommit
 			),
 		)
 	}
-	if metaConfig.Publishing.Mode == "mirror" {
+	if metaConfig.Review.RequiredApprovals < 0 {
+		return base.ErrorWithCategory(
+			ErrConfigInvalidPolicy,
+			errors.New("review.requiredApprovals cannot be negative"),
+		)
+	}
+	if err := validatePolicyConfig(&metaConfig.Policy); err != nil {
+		// validatePolicyConfig already wrapped the error correctly.
+		return err
+	}
+	// Publishing is optional, so an empty list is valid.
+	for i := range metaConfig.Publishing {
+		if err := validatePublishingConfig(i, &metaConfig.Publishing[i]); err != nil {
+			// validatePublishingConfig already wrapped the error correctly.
+			return err
+		}
+	}
+	for i := range metaConfig.Webhooks {
+		if err := validateWebhookConfig(i, &metaConfig.Webhooks[i]); err != nil {
+			// validateWebhookConfig already wrapped the error correctly.
+			return err
+		}
+	}
+	if _, err := narrowCommitDescriptions(DefaultCommitDescriptions, metaConfig.CommitDescriptions); err != nil {
+		// narrowCommitDescriptions already wrapped the error correctly.
+		return err
+	}
+	return nil
+}
+
+// validateWebhookConfig makes sure that a single webhook is valid.
+func validateWebhookConfig(index int, webhookConfig *WebhookConfig) error {
+	parsed, err := url.Parse(webhookConfig.URL)
+	if err != nil || !parsed.IsAbs() || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return base.ErrorWithCategory(
+			ErrConfigInvalidWebhook,
+			errors.Errorf(
+				"webhooks[%d]: invalid url '%s'",
+				index,
+				webhookConfig.URL,
+			),
+		)
+	}
+	if webhookConfig.Secret == "" {
+		return base.ErrorWithCategory(
+			ErrConfigInvalidWebhook,
+			errors.Errorf("webhooks[%d]: missing secret", index),
+		)
+	}
+	return nil
+}
+
+// validatePublishingConfig makes sure that a single publishing target is
+// valid. The error mentions the index of the target so that it is easy to
+// find.
+func validatePublishingConfig(index int, publishingConfig *PublishingConfig) error {
+	if publishingConfig.Mode == "mirror" {
 		// No additional checks needed.
-	} else if metaConfig.Publishing.Mode == "subdirectory" {
-		if metaConfig.Publishing.Target == "" {
-			return ErrConfigSubdirectoryMissingTarget
+	} else if publishingConfig.Mode == "subdirectory" {
+		if publishingConfig.Target == "" {
+			return base.ErrorWithCategory(
+				ErrConfigSubdirectoryMissingTarget,
+				errors.Errorf("publishing[%d]: missing target", index),
+			)
+		}
+	} else if publishingConfig.Mode == "archive" {
+		if publishingConfig.Format != "" &&
+			publishingConfig.Format != "zip" &&
+			publishingConfig.Format != "tar.gz" {
+			return base.ErrorWithCategory(
+				ErrConfigArchiveInvalidFormat,
+				errors.Errorf(
+					"publishing[%d]: invalid format '%s'",
+					index,
+					publishingConfig.Format,
+				),
+			)
 		}
+		cleanDirectory := path.Clean(publishingConfig.Directory)
+		if path.IsAbs(cleanDirectory) ||
+			cleanDirectory == ".." ||
+			strings.HasPrefix(cleanDirectory, "../") {
+			return base.ErrorWithCategory(
+				ErrConfigArchiveInvalidDirectory,
+				errors.Errorf(
+					"publishing[%d]: directory '%s' is not within the archive root",
+					index,
+					publishingConfig.Directory,
+				),
+			)
+		}
+		// Archives are written locally, so there is no repository.
+		return nil
 	} else {
-		return ErrConfigInvalidPublishingMode
+		return base.ErrorWithCategory(
+			ErrConfigInvalidPublishingMode,
+			errors.Errorf(
+				"publishing[%d]: invalid mode '%s'",
+				index,
+				publishingConfig.Mode,
+			),
+		)
+	}
+	parsed, err := url.Parse(publishingConfig.Repository)
+	if err != nil || !parsed.IsAbs() {
+		return base.ErrorWithCategory(
+			ErrConfigRepositoryNotAbsoluteURL,
+			errors.Errorf(
+				"publishing[%d]: invalid repository '%s'",
+				index,
+				publishingConfig.Repository,
+			),
+		)
 	}
-	if parsed, err := url.Parse(metaConfig.Publishing.Repository); err != nil || !parsed.IsAbs() {
-		return ErrConfigRepositoryNotAbsoluteURL
+	// Any other scheme (file:// in particular) would let the publisher write
+	// to repositories in this server without going through validateUpdate,
+	// and the publisher cannot push through the smart HTTP protocol.
+	if parsed.Scheme != "ssh" {
+		return base.ErrorWithCategory(
+			ErrConfigRepositoryUnsupportedScheme,
+			errors.Errorf(
+				"publishing[%d]: unsupported scheme in repository '%s'",
+				index,
+				publishingConfig.Repository,
+			),
+		)
+	}
+	return nil
+}
+
+// validateCommentRange makes sure that the range is contained within the
+// contents of the text file pointed to by treeEntry. Lines and columns are
+// zero-based, and columns are counted in Unicode code points. ColEnd is
+// exclusive, so it can point one past the last character of the line.
+func validateCommentRange(
+	repository *git.Repository,
+	treeEntry *git.TreeEntry,
+	commentRange *Range,
+) error {
+	if treeEntry.Type != git.ObjectBlob {
+		return errors.New("not a file")
+	}
+	blob, err := repository.LookupBlob(treeEntry.Id)
+	if err != nil {
+		return errors.Wrap(err, "failed to lookup file")
+	}
+	defer blob.Free()
+
+	contents := blob.Contents()
+	if !utf8.Valid(contents) || bytes.IndexByte(contents, 0) != -1 {
+		return errors.New("not a text file")
+	}
+	lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+
+	if commentRange.LineStart < 0 || commentRange.ColStart < 0 || commentRange.ColEnd < 0 {
+		return errors.New("negative line or column")
+	}
+	if commentRange.LineEnd >= len(lines) {
+		return errors.Errorf(
+			"line %d out of bounds, file has %d lines",
+			commentRange.LineEnd,
+			len(lines),
+		)
+	}
+	if commentRange.LineStart > commentRange.LineEnd ||
+		(commentRange.LineStart == commentRange.LineEnd && commentRange.ColStart > commentRange.ColEnd) {
+		return errors.New("start is after end")
+	}
+	if lineLength := utf8.RuneCountInString(lines[commentRange.LineStart]); commentRange.ColStart > lineLength {
+		return errors.Errorf(
+			"column %d out of bounds, line %d has %d columns",
+			commentRange.ColStart,
+			commentRange.LineStart,
+			lineLength,
+		)
+	}
+	if lineLength := utf8.RuneCountInString(lines[commentRange.LineEnd]); commentRange.ColEnd > lineLength {
+		return errors.Errorf(
+			"column %d out of bounds, line %d has %d columns",
+			commentRange.ColEnd,
+			commentRange.LineEnd,
+			lineLength,
+		)
 	}
+
 	return nil
 }
 
-func validateUpdateReview(repository *git.Repository, oldCommit, newCommit *git.Commit) error {
+func validateUpdateReview(
+	repository *git.Repository,
+	username string,
+	oldCommit, newCommit *git.Commit,
+) error {
 	iterationUUID := ""
 
 	for _, line := range strings.Split(newCommit.Message(), "\n") {
@@ -1264,7 +2125,48 @@ func validateUpdateReview(repository *git.Repository, oldCommit, newCommit *git.
 			errors.New("invalid iteration uuid in ledger entry"),
 		)
 	}
-	// TODO(lhchavez): Validate author.
+	if username != systemUsername && ledgerIteration.Author != username {
+		return base.ErrorWithCategory(
+			ErrReviewBadLayout,
+			errors.Errorf(
+				"invalid author in ledger entry, expected %s",
+				username,
+			),
+		)
+	}
+	ledgerDate := time.Unix(ledgerIteration.Date, 0)
+	if skew := time.Since(ledgerDate); skew > maxLedgerDateSkew || skew < -maxLedgerDateSkew {
+		return base.ErrorWithCategory(
+			ErrReviewBadLayout,
+			errors.Errorf(
+				"invalid date in ledger entry, %s is too far from server time",
+				ledgerDate.UTC().Format(time.RFC3339),
+			),
+		)
+	}
+	if ledgerIteration.Commit != "" {
+		changeCommitOid, err := git.NewOid(ledgerIteration.Commit)
+		if err != nil {
+			return base.ErrorWithCategory(
+				ErrReviewBadLayout,
+				errors.Wrap(
+					err,
+					"invalid commit in ledger entry, should be a git commit id",
+				),
+			)
+		}
+		changeCommit, err := repository.LookupCommit(changeCommitOid)
+		if err != nil {
+			return base.ErrorWithCategory(
+				ErrReviewBadLayout,
+				errors.Wrap(
+					err,
+					"invalid commit in ledger entry, should point to a valid git commit id",
+				),
+			)
+		}
+		changeCommit.Free()
+	}
 
 	for commentHash, entry := range newEntries {
 		previousUUIDs := make(map[string]struct{})
@@ -1337,7 +2239,8 @@ func validateUpdateReview(repository *git.Repository, oldCommit, newCommit *git.
 					)
 				}
 			}
-			if _, err := entry.masterTree.EntryByPath(comment.Filename); err != nil {
+			fileEntry, err := entry.masterTree.EntryByPath(comment.Filename)
+			if err != nil {
 				return base.ErrorWithCategory(
 					ErrReviewBadLayout,
 					errors.Wrapf(
@@ -1348,6 +2251,25 @@ func validateUpdateReview(repository *git.Repository, oldCommit, newCommit *git.
 					),
 				)
 			}
+			if comment.ReplacementSuggestion && comment.Range == nil {
+				return base.ErrorWithCategory(
+					ErrReviewBadLayout,
+					fmt.Errorf("replacement suggestion without range in %s", commentHash),
+				)
+			}
+			if comment.Range != nil {
+				if err := validateCommentRange(repository, fileEntry, comment.Range); err != nil {
+					return base.ErrorWithCategory(
+						ErrReviewBadLayout,
+						errors.Wrapf(
+							err,
+							"invalid range for '%s' in %s",
+							comment.Filename,
+							commentHash,
+						),
+					)
+				}
+			}
 			if comment.Message == "" && !comment.Done {
 				return base.ErrorWithCategory(
 					ErrReviewBadLayout,
@@ -1400,33 +2322,18 @@ func (p *gitProtocol) validateChange(
 	if treeEntry == nil || treeEntry.Type != git.ObjectBlob {
 		return ErrChangeMissingSettingsJSON
 	}
-	settingsBlob, err := repository.LookupBlob(treeEntry.Id)
-	if err != nil {
-		return base.ErrorWithCategory(
-			ErrInternalGit,
-			errors.Wrapf(
-				err,
-				"failed to lookup file %s",
-				treeEntry.Name,
-			),
-		)
-	}
-	contents := settingsBlob.Contents()
-	settingsBlob.Free()
 
-	var settings common.ProblemSettings
-	if err := json.Unmarshal([]byte(contents), &settings); err != nil {
-		return base.ErrorWithCategory(
-			ErrJSONParseError,
-			errors.Wrap(
-				err,
-				treeEntry.Name,
-			),
-		)
-	}
-
-	// TODO(lhchavez): Really validate the change.
-	return nil
+	// Perform the same validations that would be done when merging the change
+	// into master, but without touching the request's UpdatedFiles, since
+	// changes are stored as-is.
+	return validateProblem(
+		repository,
+		newCommit,
+		p.hardOverallWallTimeLimit,
+		p.interactiveSettingsCompiler,
+		make(map[string]io.Reader),
+		p.log,
+	)
 }
 
 func (p *gitProtocol) validateUpdate(
@@ -1435,6 +2342,25 @@ func (p *gitProtocol) validateUpdate(
 	level githttp.AuthorizationLevel,
 	command *githttp.GitCommand,
 	oldCommit, newCommit *git.Commit,
+) error {
+	err := p.validateUpdateCommand(ctx, repository, level, command, oldCommit, newCommit)
+	if err != nil {
+		// Successful updates are recorded once the push is done, since that is
+		// when the final references are known.
+		auditUpdateRef(ctx, repository, command.ReferenceName, command.Old, command.New, err, p.log)
+		if requestContext := request.FromContext(ctx); requestContext.Err == nil {
+			requestContext.Err = err
+		}
+	}
+	return err
+}
+
+func (p *gitProtocol) validateUpdateCommand(
+	ctx context.Context,
+	repository *git.Repository,
+	level githttp.AuthorizationLevel,
+	command *githttp.GitCommand,
+	oldCommit, newCommit *git.Commit,
 ) error {
 	requestContext := request.FromContext(ctx)
 
@@ -1452,6 +2378,42 @@ func (p *gitProtocol) validateUpdate(
 		return githttp.ErrDeleteDisallowed
 	}
 
+	// The stored configuration is not needed to update refs/meta/config
+	// itself, and skipping it allows fixing a configuration that no longer
+	// parses.
+	metaConfig := &MetaConfig{}
+	if command.ReferenceName != "refs/meta/config" {
+		var err error
+		metaConfig, err = getMetaConfig(repository)
+		if err != nil {
+			// getMetaConfig already wrapped the error correctly.
+			return err
+		}
+	}
+
+	// Tags are handled separately, since they do not point directly to
+	// commits. Like any other extra reference, they are only accepted if the
+	// policy of the problem allows them.
+	if strings.HasPrefix(command.ReferenceName, "refs/tags/") {
+		if !metaConfig.Policy.isExtraReference(command.ReferenceName) {
+			p.log.Error(
+				"invalid reference",
+				"ref", command.ReferenceName,
+				"request", requestContext.Request,
+			)
+			return githttp.ErrInvalidRef
+		}
+		if !requestContext.Request.CanEdit {
+			p.log.Error(
+				"cannot modify reference due to not having permissions",
+				"ref", command.ReferenceName,
+				"request", requestContext.Request,
+			)
+			return githttp.ErrForbidden
+		}
+		return validateUpdateTag(repository, command)
+	}
+
 	// Since we allow non-fast-forward refs globally, we need to check if the
 	// published branch is the one being updated.
 	if command.ReferenceName != "refs/heads/published" &&
@@ -1472,7 +2434,8 @@ func (p *gitProtocol) validateUpdate(
 		command.ReferenceName != "refs/heads/published" &&
 		command.ReferenceName != "refs/meta/config" &&
 		command.ReferenceName != "refs/meta/review" &&
-		!strings.HasPrefix(command.ReferenceName, "refs/changes/") {
+		!strings.HasPrefix(command.ReferenceName, "refs/changes/") &&
+		!metaConfig.Policy.isExtraReference(command.ReferenceName) {
 		p.log.Error(
 			"invalid reference",
 			"ref", command.ReferenceName,
@@ -1507,7 +2470,8 @@ func (p *gitProtocol) validateUpdate(
 			ctx,
 			repository,
 			newCommit,
-			p.allowDirectPushToMaster,
+			metaConfig.Policy.allowsDirectPushToMaster(p.allowDirectPushToMaster),
+			metaConfig.requiredApprovals(),
 			p.hardOverallWallTimeLimit,
 			p.interactiveSettingsCompiler,
 			p.log,
@@ -1521,7 +2485,12 @@ func (p *gitProtocol) validateUpdate(
 			)
 			return githttp.ErrForbidden
 		}
-		return validateUpdatePublished(repository, newCommit)
+		return validateUpdatePublished(
+			repository,
+			oldCommit,
+			newCommit,
+			metaConfig.Policy.allowsPublishedBackwards(),
+		)
 	} else if command.ReferenceName == "refs/meta/config" {
 		if !requestContext.Request.IsAdmin {
 			p.log.Error(
@@ -1541,7 +2510,24 @@ func (p *gitProtocol) validateUpdate(
 			)
 			return githttp.ErrForbidden
 		}
-		return validateUpdateReview(repository, oldCommit, newCommit)
+		return validateUpdateReview(
+			repository,
+			requestContext.Request.Username,
+			oldCommit,
+			newCommit,
+		)
+	} else if metaConfig.Policy.isExtraReference(command.ReferenceName) {
+		// Extra references are opaque to the server, so there is nothing to
+		// validate other than the permissions.
+		if !requestContext.Request.CanEdit {
+			p.log.Error(
+				"cannot modify reference due to not having permissions",
+				"ref", command.ReferenceName,
+				"request", requestContext.Request,
+			)
+			return githttp.ErrForbidden
+		}
+		return nil
 	}
 
 	if !requestContext.Request.CanEdit && !requestContext.Request.HasSolved {
@@ -1552,7 +2538,120 @@ func (p *gitProtocol) validateUpdate(
 		)
 		return githttp.ErrForbidden
 	}
-	return p.validateChange(repository, oldCommit, newCommit)
+	if err := p.validateChange(repository, oldCommit, newCommit); err != nil {
+		return err
+	}
+	return recordChangeAuthor(repository.Path(), newCommit.Id(), requestContext.Request.Username)
+}
+
+// normalizeCommitFiles passes all the files in the commit that need it through
+// the normalizer, and adds the ones that changed to updatedFiles so that git
+// pushes and .zip uploads produce the same trees. Files that are identical to
+// the ones in the parent commit are skipped, since they were already
+// normalized when they were introduced. It returns the sorted list of paths
+// that were rewritten.
+func normalizeCommitFiles(
+	repository *git.Repository,
+	commit *git.Commit,
+	parentCommit *git.Commit,
+	updatedFiles map[string]io.Reader,
+) ([]string, error) {
+	parentFiles := make(map[string]*git.Oid)
+	if parentCommit != nil {
+		var err error
+		parentFiles, err = getAllFilesForCommit(repository, parentCommit.Id())
+		if err != nil {
+			// getAllFilesForCommit already wrapped the error correctly.
+			return nil, err
+		}
+	}
+	commitFiles, err := getAllFilesForCommit(repository, commit.Id())
+	if err != nil {
+		// getAllFilesForCommit already wrapped the error correctly.
+		return nil, err
+	}
+
+	var normalizedFiles []string
+	for filename, oid := range commitFiles {
+		if !needsNormalization(filename) {
+			continue
+		}
+		if _, ok := updatedFiles[filename]; ok {
+			continue
+		}
+		if parentOid, ok := parentFiles[filename]; ok && parentOid.Equal(oid) {
+			continue
+		}
+
+		blob, err := repository.LookupBlob(oid)
+		if err != nil {
+			return nil, base.ErrorWithCategory(
+				ErrInternalGit,
+				errors.Wrapf(
+					err,
+					"failed to lookup blob for %s",
+					filename,
+				),
+			)
+		}
+		normalizedContents, err := normalizeContents(filename, blob.Contents())
+		unchanged := err == nil && bytes.Equal(normalizedContents, blob.Contents())
+		blob.Free()
+		if err != nil {
+			// normalizeContents already wrapped the error correctly.
+			return nil, err
+		}
+		if unchanged {
+			continue
+		}
+
+		updatedFiles[filename] = bytes.NewReader(normalizedContents)
+		normalizedFiles = append(normalizedFiles, filename)
+	}
+	sort.Strings(normalizedFiles)
+
+	return normalizedFiles, nil
+}
+
+// addSkippedFileWarnings adds a warning for each one of the files in the
+// commit that will be dropped when it is split, since they don't belong to any
+// of the split branches.
+func addSkippedFileWarnings(
+	ctx context.Context,
+	repository *git.Repository,
+	commit *git.Commit,
+	commitDescriptions []githttp.SplitCommitDescription,
+) error {
+	commitFiles, err := getAllFilesForCommit(repository, commit.Id())
+	if err != nil {
+		// getAllFilesForCommit already wrapped the error correctly.
+		return err
+	}
+	filenames := make([]string, 0, len(commitFiles))
+	for filename := range commitFiles {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	for _, filename := range filenames {
+		isValidFile := false
+		for _, description := range commitDescriptions {
+			if description.ContainsPath(filename) {
+				isValidFile = true
+				break
+			}
+		}
+		if isValidFile {
+			continue
+		}
+		addWarning(
+			ctx,
+			WarningSkippedFile,
+			filename,
+			"the file is not part of any of the problem's branches and was dropped",
+		)
+	}
+	return nil
 }
 
 func (p *gitProtocol) preprocessMaster(
@@ -1575,8 +2674,14 @@ func (p *gitProtocol) preprocessMaster(
 	}
 	defer originalCommit.Free()
 
+	repositoryCommitDescriptions, err := GetCommitDescriptions(originalRepository)
+	if err != nil {
+		// GetCommitDescriptions already wrapped the error correctly.
+		return originalPackPath, originalCommands, err
+	}
+
 	var commitDescriptions []githttp.SplitCommitDescription
-	for _, originalDescription := range DefaultCommitDescriptions {
+	for _, originalDescription := range repositoryCommitDescriptions {
 		commitDescriptions = append(commitDescriptions, githttp.SplitCommitDescription{
 			ReferenceName: originalDescription.ReferenceName,
 			PathRegexps:   originalDescription.PathRegexps,
@@ -1645,6 +2750,30 @@ func (p *gitProtocol) preprocessMaster(
 	p.log.Info("Updating ref", "ref", masterRef, "err", err, "masterCommit", masterCommit)
 
 	requestContext := request.FromContext(ctx)
+	requestContext.NormalizedFiles, err = normalizeCommitFiles(
+		originalRepository,
+		originalCommit,
+		masterCommit,
+		requestContext.UpdatedFiles,
+	)
+	if err != nil {
+		return originalPackPath, originalCommands, err
+	}
+	if len(requestContext.NormalizedFiles) > 0 {
+		p.log.Info("Normalized files", "files", requestContext.NormalizedFiles)
+	}
+	for _, filename := range requestContext.NormalizedFiles {
+		addWarning(
+			ctx,
+			WarningNormalizedFile,
+			filename,
+			"the encoding, line endings or trailing whitespace of the file were normalized",
+		)
+	}
+	if err := addSkippedFileWarnings(ctx, originalRepository, originalCommit, commitDescriptions); err != nil {
+		return originalPackPath, originalCommands, err
+	}
+
 	reviewRef := requestContext.Request.ReviewRef
 	commitMessageTag := ""
 	if reviewRef != "" {
@@ -1686,19 +2815,128 @@ func (p *gitProtocol) preprocess(
 	originalCommands []*githttp.GitCommand,
 ) (string, []*githttp.GitCommand, error) {
 	p.log.Info("Updating", "reference", originalCommands)
+	requestContext := request.FromContext(ctx)
+	observePackfile(requestContext.Metrics, originalPackPath, p.log)
+
+	packPath, commands := originalPackPath, originalCommands
 	if originalCommands[0].ReferenceName == "refs/heads/master" {
-		return p.preprocessMaster(ctx, originalRepository, tmpDir, originalPackPath, originalCommands)
+		var err error
+		packPath, commands, err = p.preprocessMaster(ctx, originalRepository, tmpDir, originalPackPath, originalCommands)
+		if err != nil {
+			for _, command := range originalCommands {
+				auditUpdateRef(ctx, originalRepository, command.ReferenceName, command.Old, command.New, err, p.log)
+			}
+			if requestContext.Err == nil {
+				requestContext.Err = err
+			}
+			return packPath, commands, err
+		}
+	}
+
+	for _, command := range commands {
+		requestContext.UpdatedRefs = append(requestContext.UpdatedRefs, githttp.UpdatedRef{
+			Name: command.ReferenceName,
+			From: command.Old.String(),
+			To:   command.New.String(),
+		})
 	}
-	return originalPackPath, originalCommands, nil
+	return packPath, commands, nil
 }
 
 type gitHandler struct {
-	handler http.Handler
-	log     log15.Logger
+	rootPath string
+	handler  http.Handler
+	metrics  base.Metrics
+	log      log15.Logger
 }
 
 func (g *gitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	g.handler.ServeHTTP(w, r)
+	ctx := request.NewContext(r.Context(), g.metrics)
+	requestContext := request.FromContext(ctx)
+	requestContext.Request.RemoteAddr = r.RemoteAddr
+
+	isPush := r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/git-receive-pack")
+	if r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/info/refs") &&
+		r.URL.Query().Get("service") == "git-receive-pack" {
+		advertisementWriter := &sideBandAdvertisementWriter{ResponseWriter: w}
+		defer advertisementWriter.Close()
+		w = advertisementWriter
+	} else if isPush {
+		// The warnings can only be shown to the user if the client asked for
+		// the progress messages. Compressed requests are not inspected.
+		br := bufio.NewReaderSize(r.Body, maxPktLineLength)
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{br, r.Body}
+		if requestsSideBand(br) {
+			sideBandWriter := &sideBandWarningWriter{
+				ResponseWriter: w,
+				requestContext: requestContext,
+			}
+			defer sideBandWriter.Close()
+			w = sideBandWriter
+		}
+	}
+
+	start := time.Now()
+	g.handler.ServeHTTP(w, r.WithContext(ctx))
+	if isPush {
+		g.auditPush(ctx, r)
+		if len(requestContext.Warnings) > 0 {
+			g.log.Info("Push had warnings", "warnings", requestContext.Warnings)
+		}
+		summaryObserveWithLabels(
+			g.metrics,
+			"gitserver_push_duration_seconds",
+			time.Since(start).Seconds(),
+			outcomeLabels(requestContext.Err),
+		)
+	}
+}
+
+// auditPush records the outcome of the reference updates of a push, once
+// they have been applied.
+func (g *gitHandler) auditPush(ctx context.Context, r *http.Request) {
+	requestContext := request.FromContext(ctx)
+	if len(requestContext.UpdatedRefs) == 0 {
+		return
+	}
+	repositoryName := strings.SplitN(r.URL.Path[1:], "/", 2)[0]
+	repository, err := git.OpenRepository(path.Join(g.rootPath, repositoryName))
+	if err != nil {
+		g.log.Error("Failed to open repository", "repository", repositoryName, "err", err)
+		return
+	}
+	defer repository.Free()
+	auditAppliedRefs(ctx, repository, requestContext.UpdatedRefs, g.log)
+}
+
+// observePackfile records the size and the number of objects of a pushed
+// packfile.
+func observePackfile(metrics base.Metrics, packPath string, log log15.Logger) {
+	f, err := os.Open(packPath)
+	if err != nil {
+		log.Error("Failed to open the packfile", "path", packPath, "err", err)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		log.Error("Failed to stat the packfile", "path", packPath, "err", err)
+		return
+	}
+	metrics.SummaryObserve("gitserver_packfile_size_bytes", float64(info.Size()))
+
+	// The header of a packfile is the 'PACK' signature, followed by the
+	// version and the number of objects as 32-bit big-endian integers.
+	var header [12]byte
+	if _, err := io.ReadFull(f, header[:]); err != nil || string(header[:4]) != "PACK" {
+		log.Error("Failed to read the packfile header", "path", packPath, "err", err)
+		return
+	}
+	metrics.SummaryObserve("gitserver_packfile_objects", float64(binary.BigEndian.Uint32(header[8:])))
 }
 
 // GitHandler is the HTTP handler for the omegaUp git server.
@@ -1709,6 +2947,7 @@ func GitHandler(
 	log log15.Logger,
 ) http.Handler {
 	return &gitHandler{
+		rootPath: rootPath,
 		handler: githttp.GitServer(
 			rootPath,
 			"",
@@ -1719,7 +2958,8 @@ func GitHandler(
 			},
 			log,
 		),
-		log: log,
+		metrics: metrics,
+		log:     log,
 	}
 }
 
@@ -1740,10 +2980,29 @@ func InitRepository(
 		)
 	}
 
+	if err := setRepositoryConfigDefaults(repo, repositoryPath); err != nil {
+		// setRepositoryConfigDefaults already wrapped the error correctly.
+		return nil, err
+	}
+	if err := WriteRepositoryVersion(repositoryPath, CurrentRepositoryVersion); err != nil {
+		// WriteRepositoryVersion already wrapped the error correctly.
+		return nil, err
+	}
+	if err := writeGitAttributes(repositoryPath); err != nil {
+		// writeGitAttributes already wrapped the error correctly.
+		return nil, err
+	}
+
+	return repo, nil
+}
+
+// setRepositoryConfigDefaults sets the git config values that all omegaUp
+// repositories need.
+func setRepositoryConfigDefaults(repo *git.Repository, repositoryPath string) error {
 	// Disable delta.
 	repoConfig, err := repo.Config()
 	if err != nil {
-		return nil, base.ErrorWithCategory(
+		return base.ErrorWithCategory(
 			ErrInternalGit,
 			errors.Wrapf(
 				err,
@@ -1755,7 +3014,7 @@ func InitRepository(
 	defer repoConfig.Free()
 
 	if err := repoConfig.SetBool("core.multiPackIndex", true); err != nil {
-		return nil, base.ErrorWithCategory(
+		return base.ErrorWithCategory(
 			ErrInternalGit,
 			errors.Wrapf(
 				err,
@@ -1765,7 +3024,7 @@ func InitRepository(
 		)
 	}
 	if err := repoConfig.SetInt32("pack.deltaCacheSize", 0); err != nil {
-		return nil, base.ErrorWithCategory(
+		return base.ErrorWithCategory(
 			ErrInternalGit,
 			errors.Wrapf(
 				err,
@@ -1775,7 +3034,7 @@ func InitRepository(
 		)
 	}
 	if err := repoConfig.SetInt32("pack.deltaCacheLimit", 0); err != nil {
-		return nil, base.ErrorWithCategory(
+		return base.ErrorWithCategory(
 			ErrInternalGit,
 			errors.Wrapf(
 				err,
@@ -1785,7 +3044,7 @@ func InitRepository(
 		)
 	}
 	if err := repoConfig.SetInt32("pack.windowMemory", 1024); err != nil {
-		return nil, base.ErrorWithCategory(
+		return base.ErrorWithCategory(
 			ErrInternalGit,
 			errors.Wrapf(
 				err,
@@ -1795,9 +3054,15 @@ func InitRepository(
 		)
 	}
 
+	return nil
+}
+
+// WriteRepositoryVersion writes the version of the omegaUp repository format
+// to the omegaup/version file, creating the omegaup/ directory if needed.
+func WriteRepositoryVersion(repositoryPath string, version int) error {
 	omegaupPath := path.Join(repositoryPath, "omegaup")
-	if err := os.Mkdir(omegaupPath, 0755); err != nil {
-		return nil, base.ErrorWithCategory(
+	if err := os.MkdirAll(omegaupPath, 0755); err != nil {
+		return base.ErrorWithCategory(
 			ErrInternalGit,
 			errors.Wrapf(
 				err,
@@ -1807,57 +3072,66 @@ func InitRepository(
 		)
 	}
 
-	{
-		versionPath := path.Join(omegaupPath, "version")
-		f, err := os.Create(versionPath)
-		if err != nil {
-			return nil, base.ErrorWithCategory(
-				ErrInternalGit,
-				errors.Wrapf(
-					err,
-					"failed to create omegaUp repository version file at %s",
-					versionPath,
-				),
-			)
-		}
-		defer f.Close()
-		if _, err := f.WriteString("1\n"); err != nil {
-			return nil, base.ErrorWithCategory(
-				ErrInternalGit,
-				errors.Wrapf(
-					err,
-					"failed to write the omegaUp repository version file at %s",
-					versionPath,
-				),
-			)
-		}
+	versionPath := path.Join(omegaupPath, "version")
+	f, err := os.Create(versionPath)
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to create omegaUp repository version file at %s",
+				versionPath,
+			),
+		)
 	}
-
-	{
-		attributesPath := path.Join(repositoryPath, "info/attributes")
-		f, err := os.Create(attributesPath)
-		if err != nil {
-			return nil, base.ErrorWithCategory(
-				ErrInternalGit,
-				errors.Wrapf(
-					err,
-					"failed to create git attributes file at %s",
-					attributesPath,
-				),
-			)
-		}
-		defer f.Close()
-		if _, err := f.WriteString(GitAttributesContents); err != nil {
-			return nil, base.ErrorWithCategory(
-				ErrInternalGit,
-				errors.Wrapf(
-					err,
-					"failed to write git attributes file at %s",
-					attributesPath,
-				),
-			)
-		}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%d\n", version); err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to write the omegaUp repository version file at %s",
+				versionPath,
+			),
+		)
 	}
+	return nil
+}
 
-	return repo, nil
+// writeGitAttributes writes the info/attributes file of the repository.
+func writeGitAttributes(repositoryPath string) error {
+	attributesPath := path.Join(repositoryPath, "info/attributes")
+	if err := os.MkdirAll(path.Dir(attributesPath), 0755); err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to create git info directory at %s",
+				path.Dir(attributesPath),
+			),
+		)
+	}
+	f, err := os.Create(attributesPath)
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to create git attributes file at %s",
+				attributesPath,
+			),
+		)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(GitAttributesContents); err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to write git attributes file at %s",
+				attributesPath,
+			),
+		)
+	}
+	return nil
 }
@@ -0,0 +1,928 @@
+package gitserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	git "github.com/lhchavez/git2go/v29"
+	base "github.com/omegaup/go-base"
+	"github.com/omegaup/quark/common"
+	"github.com/pkg/errors"
+)
+
+var (
+	// kattisSubmissionVerdicts maps the directories of the Kattis submissions
+	// to the verdict they are expected to get. Directories that allow more
+	// than one verdict have no equivalent in tests/tests.json.
+	kattisSubmissionVerdicts = map[string]string{
+		"accepted":            "AC",
+		"wrong_answer":        "WA",
+		"time_limit_exceeded": "TLE",
+		"run_time_error":      "RTE",
+	}
+
+	// kattisValidatorLanguages maps the extensions of the output validator
+	// sources to the languages of the omegaUp validators.
+	kattisValidatorLanguages = map[string]string{
+		".c":    "c",
+		".cc":   "cpp",
+		".cpp":  "cpp",
+		".java": "java",
+		".py":   "py",
+	}
+
+	kattisStatementRegexp = regexp.MustCompile("^(?:problem_statement|statement)/problem(?:\\.([a-z]{2}))?\\.(md|tex)$")
+	kattisImageRegexp     = regexp.MustCompile("^(?:problem_statement|statement)/[^/]+\\.(gif|jpe?g|png)$")
+)
+
+// kattisYAML is a block mapping of a YAML document. Only the subset of YAML
+// that the Kattis problem package format uses for the settings that can be
+// converted is supported: nested block mappings of scalars. Sequences and
+// block scalars are skipped, and flow collections, anchors, aliases, tags and
+// complex keys are rejected, instead of being silently misread.
+type kattisYAML map[string]interface{}
+
+func (y kattisYAML) scalar(key string) string {
+	value, _ := y[key].(string)
+	return value
+}
+
+func (y kattisYAML) mapping(key string) kattisYAML {
+	value, _ := y[key].(kattisYAML)
+	return value
+}
+
+// stripYAMLComment removes the comment at the end of the line, if any.
+func stripYAMLComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func unquoteYAMLScalar(value string) (string, error) {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		return strconv.Unquote(value)
+	}
+	if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'"), nil
+	}
+	return value, nil
+}
+
+// isUnsupportedYAML returns whether the unquoted key or value uses YAML syntax
+// that parseKattisYAML does not understand.
+func isUnsupportedYAML(token string) bool {
+	if token == "" {
+		return false
+	}
+	if token == "<<" {
+		return true
+	}
+	switch token[0] {
+	case '{', '[', '&', '*', '!', '?', '%', '@', '`':
+		return true
+	}
+	return false
+}
+
+func parseKattisYAML(contents []byte) (kattisYAML, error) {
+	type frame struct {
+		indent  int
+		mapping kattisYAML
+	}
+	root := kattisYAML{}
+	stack := []frame{{indent: -1, mapping: root}}
+
+	// skipIndent is the indentation of the sequence item or block scalar whose
+	// contents are being skipped, or -1.
+	skipIndent := -1
+	for lineNumber, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimRight(stripYAMLComment(line), " \t\r")
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		indent := len(line) - len(trimmed)
+		if skipIndent != -1 && indent > skipIndent {
+			continue
+		}
+		skipIndent = -1
+		if trimmed == "-" || strings.HasPrefix(trimmed, "- ") {
+			skipIndent = indent
+			continue
+		}
+
+		for indent <= stack[len(stack)-1].indent {
+			stack = stack[:len(stack)-1]
+		}
+
+		var key, value string
+		if separator := strings.Index(trimmed, ": "); separator != -1 {
+			key, value = trimmed[:separator], strings.TrimSpace(trimmed[separator+2:])
+		} else if strings.HasSuffix(trimmed, ":") {
+			key = strings.TrimSuffix(trimmed, ":")
+		} else {
+			return nil, errors.Errorf("line %d: expected a key", lineNumber+1)
+		}
+		if isUnsupportedYAML(key) || isUnsupportedYAML(value) {
+			return nil, errors.Errorf("line %d: unsupported YAML syntax", lineNumber+1)
+		}
+		key, err := unquoteYAMLScalar(key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", lineNumber+1)
+		}
+
+		if value == "" {
+			child := kattisYAML{}
+			stack[len(stack)-1].mapping[key] = child
+			stack = append(stack, frame{indent: indent, mapping: child})
+			continue
+		}
+		if strings.HasPrefix(value, "|") || strings.HasPrefix(value, ">") {
+			skipIndent = indent
+			continue
+		}
+		if value, err = unquoteYAMLScalar(value); err != nil {
+			return nil, errors.Wrapf(err, "line %d", lineNumber+1)
+		}
+		stack[len(stack)-1].mapping[key] = value
+	}
+
+	return root, nil
+}
+
+// kattisConverter converts a Kattis package into the omegaUp layout.
+type kattisConverter struct {
+	*packageConverter
+
+	testdata map[string]kattisTestdata
+}
+
+// kattisTestdata are the settings of a directory of the test data, which are
+// inherited from the closest testdata.yaml that sets each of them.
+type kattisTestdata struct {
+	acceptScore string
+	graderFlags []string
+}
+
+// aggregatesByMin returns whether the score of the directory is the minimum
+// of the scores of its cases, instead of their sum.
+func (t kattisTestdata) aggregatesByMin() bool {
+	for _, flag := range t.graderFlags {
+		if flag == "min" {
+			return true
+		}
+	}
+	return false
+}
+
+// IsKattisPackage returns whether the .zip file is a Kattis problem package.
+func IsKattisPackage(zipReader *zip.Reader) bool {
+	_, ok := packageRoot(zipReader, "problem.yaml")
+	return ok
+}
+
+// ConvertKattisPackage converts a Kattis problem package into a .zip file
+// with the omegaUp problem layout. The sample test data becomes the examples,
+// the secret test data becomes the cases with the accept_score of their
+// directory as the weight and one group per directory whose grader_flags
+// aggregate the cases by their minimum score, the output validator becomes
+// the custom validator, and the submissions whose directory maps to a verdict
+// are added to tests/tests.json. The files that have no equivalent in omegaUp
+// are dropped with a warning.
+func ConvertKattisPackage(
+	ctx context.Context,
+	zipReader *zip.Reader,
+	log log15.Logger,
+) (*zip.Reader, error) {
+	pc, err := newPackageConverter(ctx, zipReader, "problem.yaml", ErrInvalidKattisPackage)
+	if err != nil {
+		// newPackageConverter already wrapped the error correctly.
+		return nil, err
+	}
+	c := &kattisConverter{
+		packageConverter: pc,
+		testdata:         make(map[string]kattisTestdata),
+	}
+
+	problemYAML, err := c.read("problem.yaml")
+	if err != nil {
+		// read already wrapped the error correctly.
+		return nil, err
+	}
+	problem, err := parseKattisYAML(problemYAML)
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInvalidKattisPackage,
+			errors.Wrap(
+				err,
+				"failed to parse problem.yaml",
+			),
+		)
+	}
+
+	settings := &common.ProblemSettings{
+		Limits: common.DefaultLimits,
+		Validator: common.ValidatorSettings{
+			Name: "token-caseless",
+		},
+	}
+	if err := c.convertLimits(problem, settings); err != nil {
+		// convertLimits already wrapped the error correctly.
+		return nil, err
+	}
+	if err := c.convertValidator(problem, settings); err != nil {
+		// convertValidator already wrapped the error correctly.
+		return nil, err
+	}
+	if err := c.convertTestData(); err != nil {
+		// convertTestData already wrapped the error correctly.
+		return nil, err
+	}
+	if err := c.convertStatements(); err != nil {
+		// convertStatements already wrapped the error correctly.
+		return nil, err
+	}
+	if err := c.convertSubmissions(); err != nil {
+		// convertSubmissions already wrapped the error correctly.
+		return nil, err
+	}
+
+	return c.finish(settings, log)
+}
+
+// convertLimits sets the time and memory limits. Older packages keep the
+// time limit in a separate .timelimit file.
+func (c *kattisConverter) convertLimits(
+	problem kattisYAML,
+	settings *common.ProblemSettings,
+) error {
+	limits := problem.mapping("limits")
+
+	timeLimit := limits.scalar("time_limit")
+	if timeLimit == "" {
+		contents, err := c.readOptional(".timelimit")
+		if err != nil {
+			// readOptional already wrapped the error correctly.
+			return err
+		}
+		timeLimit = strings.TrimSpace(string(contents))
+	}
+	if timeLimit != "" {
+		seconds, err := strconv.ParseFloat(timeLimit, 64)
+		if err != nil || seconds <= 0 {
+			return base.ErrorWithCategory(
+				ErrInvalidKattisPackage,
+				errors.Errorf(
+					"invalid time limit %q",
+					timeLimit,
+				),
+			)
+		}
+		settings.Limits.TimeLimit = base.Duration(time.Duration(seconds * float64(time.Second)))
+	}
+
+	if memory := limits.scalar("memory"); memory != "" {
+		mebibytes, err := strconv.ParseInt(memory, 10, 64)
+		if err != nil || mebibytes <= 0 {
+			return base.ErrorWithCategory(
+				ErrInvalidKattisPackage,
+				errors.Errorf(
+					"invalid memory limit %q",
+					memory,
+				),
+			)
+		}
+		settings.Limits.MemoryLimit = base.Byte(mebibytes) * base.Mebibyte
+	}
+
+	return nil
+}
+
+// convertValidator adds the output validator as the custom validator, or
+// picks the omegaUp validator that is closest to the flags of the default
+// Kattis validator.
+func (c *kattisConverter) convertValidator(
+	problem kattisYAML,
+	settings *common.ProblemSettings,
+) error {
+	custom := false
+	for _, validation := range strings.Fields(problem.scalar("validation")) {
+		if validation == "interactive" {
+			return base.ErrorWithCategory(
+				ErrInvalidKattisPackage,
+				errors.New("interactive Kattis problems are not supported"),
+			)
+		}
+		if validation == "custom" {
+			custom = true
+		}
+	}
+
+	if !custom {
+		caseSensitive, spaceChangeSensitive := false, false
+		flags := strings.Fields(problem.scalar("validator_flags"))
+		for i := 0; i < len(flags); i++ {
+			switch flags[i] {
+			case "case_sensitive":
+				caseSensitive = true
+			case "space_change_sensitive":
+				spaceChangeSensitive = true
+			case "float_tolerance", "float_absolute_tolerance", "float_relative_tolerance":
+				if i+1 == len(flags) {
+					return base.ErrorWithCategory(
+						ErrInvalidKattisPackage,
+						errors.Errorf("missing value for the %s validator flag", flags[i]),
+					)
+				}
+				tolerance, err := strconv.ParseFloat(flags[i+1], 64)
+				if err != nil {
+					return base.ErrorWithCategory(
+						ErrInvalidKattisPackage,
+						errors.Wrapf(err, "invalid value for the %s validator flag", flags[i]),
+					)
+				}
+				i++
+				settings.Validator.Name = "token-numeric"
+				settings.Validator.Tolerance = &tolerance
+			}
+		}
+		if settings.Validator.Name == "token-numeric" {
+			return nil
+		}
+		if caseSensitive && spaceChangeSensitive {
+			settings.Validator.Name = "literal"
+		} else if caseSensitive {
+			settings.Validator.Name = "token"
+		}
+		return nil
+	}
+
+	var sources []string
+	for _, filename := range c.sortedFiles() {
+		if !strings.HasPrefix(filename, "output_validators/") && !strings.HasPrefix(filename, "output_validator/") {
+			continue
+		}
+		if _, ok := kattisValidatorLanguages[path.Ext(filename)]; ok {
+			sources = append(sources, filename)
+		}
+	}
+	if len(sources) != 1 {
+		return base.ErrorWithCategory(
+			ErrInvalidKattisPackage,
+			errors.Errorf(
+				"custom validation needs exactly one output validator source, found %d",
+				len(sources),
+			),
+		)
+	}
+	contents, err := c.read(sources[0])
+	if err != nil {
+		// read already wrapped the error correctly.
+		return err
+	}
+
+	validatorPath := fmt.Sprintf("validator.%s", kattisValidatorLanguages[path.Ext(sources[0])])
+	c.contents[validatorPath] = contents
+	settings.Validator.Name = "custom"
+	addWarning(
+		c.ctx,
+		WarningConvertedFile,
+		validatorPath,
+		"the Kattis output validator is used as the validator and might need to be adapted to the omegaUp validator protocol",
+	)
+	return nil
+}
+
+// testdataSettings returns the settings of the directory of the test data.
+func (c *kattisConverter) testdataSettings(dir string) (kattisTestdata, error) {
+	if settings, ok := c.testdata[dir]; ok {
+		return settings, nil
+	}
+
+	settings := kattisTestdata{acceptScore: "1"}
+	if dir != "data/secret" {
+		var err error
+		if settings, err = c.testdataSettings(path.Dir(dir)); err != nil {
+			return kattisTestdata{}, err
+		}
+	}
+	contents, err := c.readOptional(path.Join(dir, "testdata.yaml"))
+	if err != nil {
+		// readOptional already wrapped the error correctly.
+		return kattisTestdata{}, err
+	}
+	if contents != nil {
+		testdata, err := parseKattisYAML(contents)
+		if err != nil {
+			return kattisTestdata{}, base.ErrorWithCategory(
+				ErrInvalidKattisPackage,
+				errors.Wrapf(
+					err,
+					"failed to parse %s/testdata.yaml",
+					dir,
+				),
+			)
+		}
+		if acceptScore := testdata.scalar("accept_score"); acceptScore != "" {
+			if _, err := base.ParseRational(acceptScore); err != nil {
+				return kattisTestdata{}, base.ErrorWithCategory(
+					ErrInvalidKattisPackage,
+					errors.Wrapf(
+						err,
+						"invalid accept_score in %s/testdata.yaml",
+						dir,
+					),
+				)
+			}
+			settings.acceptScore = acceptScore
+		}
+		if graderFlags := testdata.scalar("grader_flags"); graderFlags != "" {
+			settings.graderFlags = strings.Fields(graderFlags)
+		}
+	}
+
+	c.testdata[dir] = settings
+	return settings, nil
+}
+
+// convertTestData adds the sample test data as the examples, and the secret
+// test data as the cases along with a testplan with their weights. Groups in
+// omegaUp are all-or-nothing, so the cases in a subdirectory of data/secret
+// are only put in a group named after it if the subdirectory aggregates its
+// cases by their minimum score. Otherwise each case gets a group of its own,
+// which keeps the default Kattis aggregation of summing the scores.
+func (c *kattisConverter) convertTestData() error {
+	var testplan bytes.Buffer
+	for _, filename := range c.sortedFiles() {
+		if !strings.HasSuffix(filename, ".in") {
+			continue
+		}
+
+		var inputPath, outputPath, caseName, weight string
+		if strings.HasPrefix(filename, "data/sample/") {
+			name := strings.TrimSuffix(strings.TrimPrefix(filename, "data/sample/"), ".in")
+			name = strings.NewReplacer(".", "_", "/", "_").Replace(name)
+			inputPath = fmt.Sprintf("examples/%s.in", name)
+			outputPath = fmt.Sprintf("examples/%s.out", name)
+		} else if strings.HasPrefix(filename, "data/secret/") {
+			components := strings.Split(
+				strings.TrimSuffix(strings.TrimPrefix(filename, "data/secret/"), ".in"),
+				"/",
+			)
+			for i := range components {
+				components[i] = strings.ReplaceAll(components[i], ".", "_")
+			}
+			settings, err := c.testdataSettings(path.Dir(filename))
+			if err != nil {
+				// testdataSettings already wrapped the error correctly.
+				return err
+			}
+			weight = settings.acceptScore
+			caseName = strings.Join(components, "_")
+			if len(components) > 1 {
+				groupSettings, err := c.testdataSettings(path.Join("data/secret", components[0]))
+				if err != nil {
+					// testdataSettings already wrapped the error correctly.
+					return err
+				}
+				if groupSettings.aggregatesByMin() {
+					caseName = fmt.Sprintf("%s.%s", components[0], strings.Join(components[1:], "_"))
+				}
+			}
+			inputPath = fmt.Sprintf("cases/%s.in", caseName)
+			outputPath = fmt.Sprintf("cases/%s.out", caseName)
+		} else {
+			continue
+		}
+
+		input, err := c.read(filename)
+		if err != nil {
+			// read already wrapped the error correctly.
+			return err
+		}
+		answer, err := c.read(strings.TrimSuffix(filename, ".in") + ".ans")
+		if err != nil {
+			// read already wrapped the error correctly.
+			return err
+		}
+		c.contents[inputPath] = input
+		c.contents[outputPath] = answer
+		if caseName != "" {
+			fmt.Fprintf(&testplan, "%s %s\n", caseName, weight)
+		}
+	}
+	if testplan.Len() == 0 {
+		return base.ErrorWithCategory(
+			ErrInvalidKattisPackage,
+			errors.New("data/secret does not have any test cases"),
+		)
+	}
+	c.contents["testplan"] = testplan.Bytes()
+
+	return nil
+}
+
+// convertStatements adds the statements, preferring the Markdown ones. The
+// markup of the TeX statements is kept as-is.
+func (c *kattisConverter) convertStatements() error {
+	for _, filename := range c.sortedFiles() {
+		if kattisImageRegexp.MatchString(filename) {
+			imagePath := path.Join("statements", path.Base(filename))
+			contents, err := c.read(filename)
+			if err != nil {
+				// read already wrapped the error correctly.
+				return err
+			}
+			c.contents[imagePath] = contents
+			continue
+		}
+
+		match := kattisStatementRegexp.FindStringSubmatch(filename)
+		if match == nil {
+			continue
+		}
+		language := match[1]
+		if language == "" {
+			language = "en"
+		}
+		statementPath := fmt.Sprintf("statements/%s.markdown", language)
+		if _, ok := c.contents[statementPath]; ok && match[2] == "tex" {
+			continue
+		}
+		contents, err := c.read(filename)
+		if err != nil {
+			// read already wrapped the error correctly.
+			return err
+		}
+		c.contents[statementPath] = contents
+		if match[2] == "tex" {
+			addWarning(
+				c.ctx,
+				WarningConvertedFile,
+				statementPath,
+				"the statement was taken from the TeX statement and its markup was kept as-is",
+			)
+		}
+	}
+
+	return nil
+}
+
+// convertSubmissions adds the submissions whose directory maps to a single
+// verdict to tests/tests.json.
+func (c *kattisConverter) convertSubmissions() error {
+	var testsSettings common.TestsSettings
+	for _, filename := range c.sortedFiles() {
+		components := strings.Split(filename, "/")
+		if len(components) != 3 || components[0] != "submissions" {
+			continue
+		}
+		verdict, ok := kattisSubmissionVerdicts[components[1]]
+		if !ok {
+			addWarning(
+				c.ctx,
+				WarningSkippedFile,
+				filename,
+				fmt.Sprintf("submissions in %s have no equivalent verdict and were dropped", components[1]),
+			)
+			continue
+		}
+		solutionPath := path.Join("solutions", components[2])
+		if _, ok := c.contents[path.Join("tests", solutionPath)]; ok {
+			addWarning(
+				c.ctx,
+				WarningSkippedFile,
+				filename,
+				"another submission with the same name was already added",
+			)
+			continue
+		}
+
+		contents, err := c.read(filename)
+		if err != nil {
+			// read already wrapped the error correctly.
+			return err
+		}
+		c.contents[path.Join("tests", solutionPath)] = contents
+		testsSettings.Solutions = append(testsSettings.Solutions, common.SolutionSettings{
+			Filename: solutionPath,
+			Verdict:  verdict,
+		})
+	}
+	if len(testsSettings.Solutions) == 0 {
+		return nil
+	}
+
+	testsJSON, err := json.MarshalIndent(&testsSettings, "", "\t")
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrInternal,
+			errors.Wrap(
+				err,
+				"failed to marshal tests/tests.json",
+			),
+		)
+	}
+	c.contents["tests/tests.json"] = testsJSON
+	return nil
+}
+
+// formatKattisScore formats a case weight as a decimal number.
+func formatKattisScore(weight *big.Rat) string {
+	if weight.IsInt() {
+		return weight.Num().String()
+	}
+	f, _ := weight.Float64()
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// ExportKattisPackage writes a Kattis problem package with the contents of
+// the tree of the commit to w. The examples become the sample test data, the
+// cases become the secret test data with one directory per group that
+// aggregates its cases by their minimum score and the weights as the
+// accept_score of the directory, the custom validator becomes the output
+// validator, and the solutions in tests/tests.json with a verdict become the
+// submissions. Files with no equivalent in the Kattis format are
+// not exported. Since accept_score is set per directory, the export fails if
+// the cases of a directory have different weights.
+func ExportKattisPackage(
+	repo *git.Repository,
+	commitID *git.Oid,
+	problemName string,
+	w io.Writer,
+	log log15.Logger,
+) error {
+	commit, err := repo.LookupCommit(commitID)
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to lookup commit %s",
+				commitID,
+			),
+		)
+	}
+	defer commit.Free()
+
+	files, err := getAllFilesForCommit(repo, commitID)
+	if err != nil {
+		// getAllFilesForCommit already wrapped the error correctly.
+		return err
+	}
+	readFile := func(filename string) ([]byte, error) {
+		oid, ok := files[filename]
+		if !ok {
+			return nil, base.ErrorWithCategory(
+				ErrProblemBadLayout,
+				errors.Errorf(
+					"%s is missing",
+					filename,
+				),
+			)
+		}
+		blob, err := repo.LookupBlob(oid)
+		if err != nil {
+			return nil, base.ErrorWithCategory(
+				ErrInternalGit,
+				errors.Wrapf(
+					err,
+					"failed to lookup %s",
+					filename,
+				),
+			)
+		}
+		defer blob.Free()
+		return blob.Contents(), nil
+	}
+
+	settingsJSON, err := readFile("settings.json")
+	if err != nil {
+		// readFile already wrapped the error correctly.
+		return err
+	}
+	var settings common.ProblemSettings
+	if err := json.Unmarshal(settingsJSON, &settings); err != nil {
+		return base.ErrorWithCategory(
+			ErrJSONParseError,
+			errors.Wrap(
+				err,
+				"failed to parse settings.json",
+			),
+		)
+	}
+
+	contents := make(map[string][]byte)
+
+	var problemYAML bytes.Buffer
+	fmt.Fprintf(&problemYAML, "name: %s\n", strconv.Quote(problemName))
+	switch settings.Validator.Name {
+	case "custom":
+		problemYAML.WriteString("validation: custom\n")
+	case "token":
+		problemYAML.WriteString("validator_flags: case_sensitive\n")
+	case "literal":
+		problemYAML.WriteString("validator_flags: case_sensitive space_change_sensitive\n")
+	case "token-numeric":
+		tolerance := 1e-9
+		if settings.Validator.Tolerance != nil {
+			tolerance = *settings.Validator.Tolerance
+		}
+		fmt.Fprintf(&problemYAML, "validator_flags: float_tolerance %g\n", tolerance)
+	}
+	memoryLimit := (settings.Limits.MemoryLimit.Bytes() + base.Mebibyte.Bytes() - 1) / base.Mebibyte.Bytes()
+	fmt.Fprintf(
+		&problemYAML,
+		"limits:\n  time_limit: %s\n  memory: %d\n",
+		strconv.FormatFloat(time.Duration(settings.Limits.TimeLimit).Seconds(), 'f', -1, 64),
+		memoryLimit,
+	)
+	contents["problem.yaml"] = problemYAML.Bytes()
+
+	// Cases of groups with a single case of the same name go straight into
+	// data/secret, and share its testdata.yaml. The rest of the groups get a
+	// directory each, whose cases are aggregated by their minimum score so
+	// that they stay all-or-nothing.
+	one := big.NewRat(1, 1)
+	groupWeights := make(map[string]*big.Rat)
+	var topLevelWeight *big.Rat
+	uniformTopLevelWeight := true
+	for _, group := range settings.Cases {
+		topLevel := len(group.Cases) == 1 && group.Cases[0].Name == group.Name
+		uniformGroupWeight := true
+		for _, caseSettings := range group.Cases {
+			caseFilename := path.Join("data/secret", caseSettings.Name)
+			if !topLevel {
+				caseFilename = path.Join("data/secret", group.Name, strings.TrimPrefix(caseSettings.Name, group.Name+"."))
+			}
+			for _, extension := range []struct{ from, to string }{{".in", ".in"}, {".out", ".ans"}} {
+				caseContents, err := readFile(fmt.Sprintf("cases/%s%s", caseSettings.Name, extension.from))
+				if err != nil {
+					// readFile already wrapped the error correctly.
+					return err
+				}
+				contents[caseFilename+extension.to] = caseContents
+			}
+
+			weight := caseSettings.Weight
+			if weight == nil {
+				weight = one
+			}
+			if topLevel {
+				if topLevelWeight == nil {
+					topLevelWeight = weight
+				} else if topLevelWeight.Cmp(weight) != 0 {
+					uniformTopLevelWeight = false
+				}
+			} else if groupWeight, ok := groupWeights[group.Name]; !ok {
+				groupWeights[group.Name] = weight
+			} else if groupWeight.Cmp(weight) != 0 {
+				uniformGroupWeight = false
+			}
+		}
+		if !uniformGroupWeight {
+			return base.ErrorWithCategory(
+				ErrUnsupportedKattisExport,
+				errors.Errorf(
+					"the cases of group %s have different weights",
+					group.Name,
+				),
+			)
+		}
+	}
+	if !uniformTopLevelWeight {
+		return base.ErrorWithCategory(
+			ErrUnsupportedKattisExport,
+			errors.New("the cases of the single-case groups have different weights"),
+		)
+	}
+	inheritedWeight := one
+	if topLevelWeight != nil && topLevelWeight.Cmp(one) != 0 {
+		inheritedWeight = topLevelWeight
+		contents["data/secret/testdata.yaml"] = []byte(fmt.Sprintf("accept_score: %s\n", formatKattisScore(topLevelWeight)))
+	}
+	for groupName, weight := range groupWeights {
+		var testdataYAML bytes.Buffer
+		if weight.Cmp(inheritedWeight) != 0 {
+			fmt.Fprintf(&testdataYAML, "accept_score: %s\n", formatKattisScore(weight))
+		}
+		testdataYAML.WriteString("grader_flags: min\n")
+		contents[path.Join("data/secret", groupName, "testdata.yaml")] = testdataYAML.Bytes()
+	}
+
+	var filenames []string
+	for filename := range files {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	for _, filename := range filenames {
+		var kattisFilename string
+		switch {
+		case strings.HasPrefix(filename, "examples/") && strings.HasSuffix(filename, ".in"):
+			kattisFilename = path.Join("data/sample", path.Base(filename))
+		case strings.HasPrefix(filename, "examples/") && strings.HasSuffix(filename, ".out"):
+			kattisFilename = path.Join("data/sample", strings.TrimSuffix(path.Base(filename), ".out")+".ans")
+		case strings.HasPrefix(filename, "statements/") && strings.HasSuffix(filename, ".markdown"):
+			kattisFilename = fmt.Sprintf("problem_statement/problem.%s.md", strings.TrimSuffix(path.Base(filename), ".markdown"))
+		case strings.HasPrefix(filename, "statements/") && polygonImageRegexp.MatchString(filename):
+			kattisFilename = path.Join("problem_statement", path.Base(filename))
+		case settings.Validator.Name == "custom" && strings.HasPrefix(filename, "validator.") &&
+			!strings.Contains(strings.TrimPrefix(filename, "validator."), "."):
+			kattisFilename = path.Join("output_validators/validator", filename)
+		default:
+			continue
+		}
+		fileContents, err := readFile(filename)
+		if err != nil {
+			// readFile already wrapped the error correctly.
+			return err
+		}
+		contents[kattisFilename] = fileContents
+	}
+
+	if _, ok := files["tests/tests.json"]; ok {
+		testsJSON, err := readFile("tests/tests.json")
+		if err != nil {
+			// readFile already wrapped the error correctly.
+			return err
+		}
+		var testsSettings common.TestsSettings
+		if err := json.Unmarshal(testsJSON, &testsSettings); err != nil {
+			return base.ErrorWithCategory(
+				ErrJSONParseError,
+				errors.Wrap(
+					err,
+					"failed to parse tests/tests.json",
+				),
+			)
+		}
+		for _, solution := range testsSettings.Solutions {
+			submissionDirectory := ""
+			for directory, verdict := range kattisSubmissionVerdicts {
+				if verdict == solution.Verdict {
+					submissionDirectory = directory
+					break
+				}
+			}
+			if submissionDirectory == "" {
+				log.Warn("Skipping solution without an equivalent submission directory", "filename", solution.Filename)
+				continue
+			}
+			solutionContents, err := readFile(path.Join("tests", solution.Filename))
+			if err != nil {
+				// readFile already wrapped the error correctly.
+				return err
+			}
+			contents[path.Join("submissions", submissionDirectory, path.Base(solution.Filename))] = solutionContents
+		}
+	}
+
+	var kattisFilenames []string
+	for filename := range contents {
+		kattisFilenames = append(kattisFilenames, filename)
+	}
+	sort.Strings(kattisFilenames)
+
+	zipWriter := zip.NewWriter(w)
+	for _, filename := range kattisFilenames {
+		f, err := zipWriter.CreateHeader(&zip.FileHeader{
+			Name:     filename,
+			Method:   zip.Deflate,
+			Modified: commit.Committer().When,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to write header for %s", filename)
+		}
+		if _, err := f.Write(contents[filename]); err != nil {
+			return errors.Wrapf(err, "failed to write %s", filename)
+		}
+	}
+	if err := zipWriter.Close(); err != nil {
+		return errors.Wrap(err, "failed to finish the package")
+	}
+	return nil
+}
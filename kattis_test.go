@@ -0,0 +1,533 @@
+package gitserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	git "github.com/lhchavez/git2go/v29"
+	"github.com/omegaup/gitserver/gitservertest"
+	"github.com/omegaup/gitserver/request"
+	base "github.com/omegaup/go-base"
+	"github.com/omegaup/quark/common"
+)
+
+func readZipContents(t *testing.T, zipReader *zip.Reader) map[string]string {
+	t.Helper()
+	contents := make(map[string]string)
+	for _, file := range zipReader.File {
+		f, err := file.Open()
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", file.Name, err)
+		}
+		fileContents, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", file.Name, err)
+		}
+		contents[file.Name] = string(fileContents)
+	}
+	return contents
+}
+
+func readMasterContents(t *testing.T, repositoryPath string) map[string]string {
+	t.Helper()
+	repo, err := git.OpenRepository(repositoryPath)
+	if err != nil {
+		t.Fatalf("Failed to open repository: %v", err)
+	}
+	defer repo.Free()
+	masterRef, err := repo.References.Lookup("refs/heads/master")
+	if err != nil {
+		t.Fatalf("Failed to lookup master: %v", err)
+	}
+	defer masterRef.Free()
+
+	files, err := getAllFilesForCommit(repo, masterRef.Target())
+	if err != nil {
+		t.Fatalf("Failed to get the files of master: %v", err)
+	}
+	contents := make(map[string]string)
+	for filename, oid := range files {
+		blob, err := repo.LookupBlob(oid)
+		if err != nil {
+			t.Fatalf("Failed to lookup %s: %v", filename, err)
+		}
+		contents[filename] = string(blob.Contents())
+		blob.Free()
+	}
+	return contents
+}
+
+func exportKattis(t *testing.T, repositoryPath string) map[string]string {
+	t.Helper()
+	repo, err := git.OpenRepository(repositoryPath)
+	if err != nil {
+		t.Fatalf("Failed to open repository: %v", err)
+	}
+	defer repo.Free()
+	masterRef, err := repo.References.Lookup("refs/heads/master")
+	if err != nil {
+		t.Fatalf("Failed to lookup master: %v", err)
+	}
+	defer masterRef.Free()
+
+	var buf bytes.Buffer
+	if err := ExportKattisPackage(repo, masterRef.Target(), "sumas", &buf, base.StderrLog()); err != nil {
+		t.Fatalf("Failed to export the Kattis package: %v", err)
+	}
+	zipReader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("Failed to read the Kattis package: %v", err)
+	}
+	return readZipContents(t, zipReader)
+}
+
+func TestParseKattisYAML(t *testing.T) {
+	problem, err := parseKattisYAML([]byte(`# Problem configuration
+name: 'Sumas # de enteros'
+license: |
+  Some license
+  text: with a colon
+keywords:
+  - math
+  - key: value
+validation: "custom"
+limits:
+    time_limit: 2  # seconds
+    memory: 256
+source: NWERC
+`))
+	if err != nil {
+		t.Fatalf("Failed to parse the YAML document: %v", err)
+	}
+	expected := kattisYAML{
+		"name":       "Sumas # de enteros",
+		"keywords":   kattisYAML{},
+		"validation": "custom",
+		"limits": kattisYAML{
+			"time_limit": "2",
+			"memory":     "256",
+		},
+		"source": "NWERC",
+	}
+	if !reflect.DeepEqual(expected, problem) {
+		t.Errorf("Expected %v, got %v", expected, problem)
+	}
+
+	if _, err := parseKattisYAML([]byte("name\n")); err == nil {
+		t.Errorf("Expected an error for a line without a key")
+	}
+	for _, contents := range []string{
+		"limits: {memory: 512}\n",
+		"keywords: [graph, tree]\n",
+		"limits: &limits\n  memory: 512\n",
+		"validation: *limits\n",
+		"limits:\n  <<: *limits\n",
+		"name: !!str Hello\n",
+		"? name\n: Hello\n",
+	} {
+		if _, err := parseKattisYAML([]byte(contents)); err == nil {
+			t.Errorf("Expected an error for unsupported syntax in %q", contents)
+		}
+	}
+	if problem, err := parseKattisYAML([]byte("name: '{not a mapping}'\n")); err != nil {
+		t.Errorf("Failed to parse a quoted scalar: %v", err)
+	} else if problem.scalar("name") != "{not a mapping}" {
+		t.Errorf("Expected a quoted scalar, got %v", problem)
+	}
+}
+
+func TestConvertKattisPackage(t *testing.T) {
+	zipContents, err := gitservertest.CreateZip(
+		wrapReaders(map[string]string{
+			"sumas/problem.yaml": "name: Sumas\n" +
+				"validator_flags: float_tolerance 1e-6\n" +
+				"limits:\n  time_limit: 2.5\n  memory: 256\n",
+			"sumas/data/sample/1.in":                      "1 2\n",
+			"sumas/data/sample/1.ans":                     "3\n",
+			"sumas/data/secret/01.in":                     "2 2\n",
+			"sumas/data/secret/01.ans":                    "4\n",
+			"sumas/data/secret/group1/testdata.yaml":      "accept_score: 25\ngrader_flags: min\n",
+			"sumas/data/secret/group1/a.in":               "2 3\n",
+			"sumas/data/secret/group1/a.ans":              "5\n",
+			"sumas/data/secret/group1/nested/b.in":        "3 4\n",
+			"sumas/data/secret/group1/nested/b.ans":       "7\n",
+			"sumas/data/secret/group2/c.in":               "4 5\n",
+			"sumas/data/secret/group2/c.ans":              "9\n",
+			"sumas/problem_statement/problem.en.tex":      "Compute $a+b$.\n",
+			"sumas/problem_statement/problem.es.md":       "Calcula $a+b$.\n",
+			"sumas/problem_statement/figure.png":          "PNG",
+			"sumas/submissions/accepted/sol.cpp":          "int main() {}\n",
+			"sumas/submissions/wrong_answer/wa.py":        "print(0)\n",
+			"sumas/submissions/rejected/bad.cpp":          "int main() { return 1; }\n",
+			"sumas/input_validators/validate/validate.py": "exit(42)\n",
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create zip: %v", err)
+	}
+	zipReader, err := zip.NewReader(bytes.NewReader(zipContents), int64(len(zipContents)))
+	if err != nil {
+		t.Fatalf("Failed to read zip: %v", err)
+	}
+	if !IsKattisPackage(zipReader) {
+		t.Fatalf("Expected the .zip to be a Kattis package")
+	}
+
+	ctx := request.NewContext(context.Background(), &base.NoOpMetrics{})
+	convertedReader, err := ConvertKattisPackage(ctx, zipReader, base.StderrLog())
+	if err != nil {
+		t.Fatalf("Failed to convert the Kattis package: %v", err)
+	}
+	contents := readZipContents(t, convertedReader)
+
+	for filename, expected := range map[string]string{
+		"examples/1.in":            "1 2\n",
+		"examples/1.out":           "3\n",
+		"cases/01.in":              "2 2\n",
+		"cases/group1.a.out":       "5\n",
+		"cases/group1.nested_b.in": "3 4\n",
+		"cases/group2_c.out":       "9\n",
+		"testplan":                 "01 1\ngroup1.a 25\ngroup1.nested_b 25\ngroup2_c 1\n",
+		"statements/en.markdown":   "Compute $a+b$.\n",
+		"statements/es.markdown":   "Calcula $a+b$.\n",
+		"statements/figure.png":    "PNG",
+		"tests/solutions/sol.cpp":  "int main() {}\n",
+		"tests/solutions/wa.py":    "print(0)\n",
+	} {
+		if contents[filename] != expected {
+			t.Errorf("Expected %s to be %q, got %q", filename, expected, contents[filename])
+		}
+	}
+
+	var settings common.ProblemSettings
+	if err := json.Unmarshal([]byte(contents["settings.json"]), &settings); err != nil {
+		t.Fatalf("Failed to unmarshal settings.json: %v", err)
+	}
+	if settings.Limits.TimeLimit != base.Duration(2500*time.Millisecond) {
+		t.Errorf("Expected a time limit of 2.5s, got %v", settings.Limits.TimeLimit)
+	}
+	if settings.Limits.MemoryLimit != 256*base.Mebibyte {
+		t.Errorf("Expected a memory limit of 256MiB, got %v", settings.Limits.MemoryLimit)
+	}
+	if settings.Validator.Name != "token-numeric" || settings.Validator.Tolerance == nil || *settings.Validator.Tolerance != 1e-6 {
+		t.Errorf("Expected a token-numeric validator with a tolerance of 1e-6, got %v", settings.Validator)
+	}
+
+	var testsSettings common.TestsSettings
+	if err := json.Unmarshal([]byte(contents["tests/tests.json"]), &testsSettings); err != nil {
+		t.Fatalf("Failed to unmarshal tests/tests.json: %v", err)
+	}
+	verdicts := make(map[string]string)
+	for _, solution := range testsSettings.Solutions {
+		verdicts[solution.Filename] = solution.Verdict
+	}
+	expectedVerdicts := map[string]string{
+		"solutions/sol.cpp": "AC",
+		"solutions/wa.py":   "WA",
+	}
+	if !reflect.DeepEqual(expectedVerdicts, verdicts) {
+		t.Errorf("Expected verdicts %v, got %v", expectedVerdicts, verdicts)
+	}
+
+	warnings := make(map[string]string)
+	for _, warning := range request.FromContext(ctx).Warnings {
+		warnings[warning.Path] = warning.Code
+	}
+	expectedWarnings := map[string]string{
+		"statements/en.markdown":                WarningConvertedFile,
+		"submissions/rejected/bad.cpp":          WarningSkippedFile,
+		"input_validators/validate/validate.py": WarningSkippedFile,
+	}
+	if !reflect.DeepEqual(expectedWarnings, warnings) {
+		t.Errorf("Expected warnings %v, got %v", expectedWarnings, request.FromContext(ctx).Warnings)
+	}
+}
+
+func TestKattisRoundTrip(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+
+	log := base.StderrLog()
+	ts := httptest.NewServer(ZipHandler(
+		tmpDir,
+		NewGitProtocol(authorize, nil, true, OverallWallTimeHardLimit, fakeInteractiveSettingsCompiler, log),
+		&base.NoOpMetrics{},
+		log,
+	))
+	defer ts.Close()
+
+	for _, testCase := range []struct {
+		problemAlias    string
+		settingsJSON    string
+		extraContents   map[string]string
+		kattisValidator string
+	}{
+		{
+			problemAlias: "sumas",
+			settingsJSON: gitservertest.DefaultSettingsJSON,
+		},
+		{
+			problemAlias:    "sumas-validator",
+			settingsJSON:    gitservertest.CustomValidatorSettingsJSON,
+			extraContents:   map[string]string{"validator.cpp": "int main() {}\n"},
+			kattisValidator: "output_validators/validator/validator.cpp",
+		},
+	} {
+		t.Run(testCase.problemAlias, func(t *testing.T) {
+			contents := map[string]string{
+				"settings.json":          testCase.settingsJSON,
+				"testplan":               "0 1\n1.a 2\n1.b 2\n",
+				"cases/0.in":             "1 2\n",
+				"cases/0.out":            "3\n",
+				"cases/1.a.in":           "2 3\n",
+				"cases/1.a.out":          "5\n",
+				"cases/1.b.in":           "3 4\n",
+				"cases/1.b.out":          "7\n",
+				"examples/sample.in":     "1 2\n",
+				"examples/sample.out":    "3\n",
+				"statements/es.markdown": "Sumas\n",
+				"tests/tests.json": `{
+					"solutions": [
+						{"filename": "solutions/sum.py", "verdict": "AC"},
+						{"filename": "solutions/wrong.py", "verdict": "WA"}
+					]
+				}`,
+				"tests/solutions/sum.py":   "print(sum(map(int, input().split())))\n",
+				"tests/solutions/wrong.py": "print(0)\n",
+			}
+			for filename, fileContents := range testCase.extraContents {
+				contents[filename] = fileContents
+			}
+			zipContents, err := gitservertest.CreateZip(wrapReaders(contents))
+			if err != nil {
+				t.Fatalf("Failed to create zip: %v", err)
+			}
+			postZip(
+				t,
+				adminAuthorization,
+				testCase.problemAlias,
+				nil,
+				ZipMergeStrategyTheirs,
+				zipContents,
+				"initial commit",
+				true,  // create
+				false, // useMultipartFormData
+				ts,
+			)
+
+			// omegaUp -> Kattis.
+			kattisContents := exportKattis(t, path.Join(tmpDir, testCase.problemAlias))
+			expectedKattisContents := map[string]string{
+				"data/sample/sample.in":             "1 2\n",
+				"data/sample/sample.ans":            "3\n",
+				"data/secret/0.in":                  "1 2\n",
+				"data/secret/0.ans":                 "3\n",
+				"data/secret/1/a.in":                "2 3\n",
+				"data/secret/1/b.ans":               "7\n",
+				"data/secret/1/testdata.yaml":       "accept_score: 2\ngrader_flags: min\n",
+				"problem_statement/problem.es.md":   "Sumas\n",
+				"submissions/accepted/sum.py":       "print(sum(map(int, input().split())))\n",
+				"submissions/wrong_answer/wrong.py": "print(0)\n",
+			}
+			if testCase.kattisValidator != "" {
+				expectedKattisContents[testCase.kattisValidator] = "int main() {}\n"
+			}
+			for filename, expected := range expectedKattisContents {
+				if kattisContents[filename] != expected {
+					t.Errorf("Expected %s to be %q, got %q", filename, expected, kattisContents[filename])
+				}
+			}
+			problem, err := parseKattisYAML([]byte(kattisContents["problem.yaml"]))
+			if err != nil {
+				t.Fatalf("Failed to parse problem.yaml: %v", err)
+			}
+			if problem.scalar("name") != "sumas" ||
+				problem.mapping("limits").scalar("time_limit") != "1" ||
+				problem.mapping("limits").scalar("memory") != "32" {
+				t.Errorf("Unexpected problem.yaml: %q", kattisContents["problem.yaml"])
+			}
+
+			// Kattis -> omegaUp.
+			kattisZipContents, err := gitservertest.CreateZip(wrapReaders(kattisContents))
+			if err != nil {
+				t.Fatalf("Failed to create zip: %v", err)
+			}
+			importedAlias := testCase.problemAlias + "-kattis"
+			postZip(
+				t,
+				adminAuthorization,
+				importedAlias,
+				nil,
+				ZipMergeStrategyTheirs,
+				kattisZipContents,
+				"imported from Kattis",
+				true,  // create
+				false, // useMultipartFormData
+				ts,
+			)
+
+			originalContents := readMasterContents(t, path.Join(tmpDir, testCase.problemAlias))
+			importedContents := readMasterContents(t, path.Join(tmpDir, importedAlias))
+			for filename, originalFileContents := range originalContents {
+				importedFileContents, ok := importedContents[filename]
+				if !ok {
+					t.Errorf("Expected %s to survive the round trip", filename)
+					continue
+				}
+				switch filename {
+				case "settings.json", "settings.distrib.json", "tests/tests.json":
+					// These are compared below, since they are re-encoded.
+				default:
+					if originalFileContents != importedFileContents {
+						t.Errorf("Expected %s to be %q, got %q", filename, originalFileContents, importedFileContents)
+					}
+				}
+			}
+			for filename := range importedContents {
+				if _, ok := originalContents[filename]; !ok {
+					t.Errorf("Unexpected file %s after the round trip", filename)
+				}
+			}
+
+			var originalSettings, importedSettings common.ProblemSettings
+			if err := json.Unmarshal([]byte(originalContents["settings.json"]), &originalSettings); err != nil {
+				t.Fatalf("Failed to unmarshal settings.json: %v", err)
+			}
+			if err := json.Unmarshal([]byte(importedContents["settings.json"]), &importedSettings); err != nil {
+				t.Fatalf("Failed to unmarshal settings.json: %v", err)
+			}
+			weights := func(settings *common.ProblemSettings) map[string]string {
+				result := make(map[string]string)
+				for _, group := range settings.Cases {
+					for _, caseSettings := range group.Cases {
+						result[group.Name+"/"+caseSettings.Name] = caseSettings.Weight.RatString()
+					}
+				}
+				return result
+			}
+			if !reflect.DeepEqual(weights(&originalSettings), weights(&importedSettings)) {
+				t.Errorf("Expected cases %v, got %v", weights(&originalSettings), weights(&importedSettings))
+			}
+			if originalSettings.Validator.Name != importedSettings.Validator.Name {
+				t.Errorf("Expected validator %q, got %q", originalSettings.Validator.Name, importedSettings.Validator.Name)
+			}
+			if originalSettings.Limits.TimeLimit != importedSettings.Limits.TimeLimit ||
+				originalSettings.Limits.MemoryLimit != importedSettings.Limits.MemoryLimit {
+				t.Errorf("Expected limits %v, got %v", originalSettings.Limits, importedSettings.Limits)
+			}
+
+			verdicts := func(testsJSON string) map[string]string {
+				var testsSettings common.TestsSettings
+				if err := json.Unmarshal([]byte(testsJSON), &testsSettings); err != nil {
+					t.Fatalf("Failed to unmarshal tests/tests.json: %v", err)
+				}
+				result := make(map[string]string)
+				for _, solution := range testsSettings.Solutions {
+					result[solution.Filename] = solution.Verdict
+				}
+				return result
+			}
+			if !reflect.DeepEqual(verdicts(originalContents["tests/tests.json"]), verdicts(importedContents["tests/tests.json"])) {
+				t.Errorf(
+					"Expected solutions %v, got %v",
+					verdicts(originalContents["tests/tests.json"]),
+					verdicts(importedContents["tests/tests.json"]),
+				)
+			}
+
+			// Exporting the imported problem again produces the same package.
+			if reexportedContents := exportKattis(t, path.Join(tmpDir, importedAlias)); !reflect.DeepEqual(kattisContents, reexportedContents) {
+				t.Errorf("Expected the same Kattis package %v, got %v", kattisContents, reexportedContents)
+			}
+		})
+	}
+}
+
+func TestExportKattisNonUniformWeights(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+
+	log := base.StderrLog()
+	ts := httptest.NewServer(ZipHandler(
+		tmpDir,
+		NewGitProtocol(authorize, nil, true, OverallWallTimeHardLimit, fakeInteractiveSettingsCompiler, log),
+		&base.NoOpMetrics{},
+		log,
+	))
+	defer ts.Close()
+
+	for _, testCase := range []struct {
+		problemAlias string
+		testplan     string
+	}{
+		{"group-weights", "1.a 1\n1.b 2\n"},
+		{"single-case-weights", "0 1\n1 2\n"},
+	} {
+		t.Run(testCase.problemAlias, func(t *testing.T) {
+			contents := map[string]string{
+				"settings.json":          gitservertest.DefaultSettingsJSON,
+				"testplan":               testCase.testplan,
+				"statements/es.markdown": "Sumas\n",
+			}
+			for _, line := range strings.Split(strings.TrimSpace(testCase.testplan), "\n") {
+				caseName := strings.Fields(line)[0]
+				contents[fmt.Sprintf("cases/%s.in", caseName)] = "1 2\n"
+				contents[fmt.Sprintf("cases/%s.out", caseName)] = "3\n"
+			}
+			zipContents, err := gitservertest.CreateZip(wrapReaders(contents))
+			if err != nil {
+				t.Fatalf("Failed to create zip: %v", err)
+			}
+			postZip(
+				t,
+				adminAuthorization,
+				testCase.problemAlias,
+				nil,
+				ZipMergeStrategyTheirs,
+				zipContents,
+				"initial commit",
+				true,  // create
+				false, // useMultipartFormData
+				ts,
+			)
+
+			repo, err := git.OpenRepository(path.Join(tmpDir, testCase.problemAlias))
+			if err != nil {
+				t.Fatalf("Failed to open repository: %v", err)
+			}
+			defer repo.Free()
+			masterRef, err := repo.References.Lookup("refs/heads/master")
+			if err != nil {
+				t.Fatalf("Failed to lookup master: %v", err)
+			}
+			defer masterRef.Free()
+
+			var buf bytes.Buffer
+			if err := ExportKattisPackage(repo, masterRef.Target(), "sumas", &buf, log); err == nil {
+				t.Errorf("Expected the export to fail, since the weights cannot be represented")
+			}
+		})
+	}
+}
@@ -5,8 +5,10 @@ import (
 	"encoding/json"
 	"io"
 	"os/exec"
+	"time"
 
 	"github.com/inconshreveable/log15"
+	base "github.com/omegaup/go-base"
 	"github.com/omegaup/quark/common"
 	"github.com/pkg/errors"
 )
@@ -30,6 +32,10 @@ type LibinteractiveCompiler struct {
 	// A way to optionally override the path of libinteractive.jar.
 	LibinteractiveJarPath string
 	Log                   log15.Logger
+
+	// Metrics is optional, and records the time it takes to run
+	// libinteractive.
+	Metrics base.Metrics
 }
 
 // GetInteractiveSettings calls libinteractive.jar to produce the
@@ -39,6 +45,16 @@ func (c *LibinteractiveCompiler) GetInteractiveSettings(
 	moduleName string,
 	parentLang string,
 ) (*common.InteractiveSettings, error) {
+	if c.Metrics != nil {
+		start := time.Now()
+		defer func() {
+			c.Metrics.SummaryObserve(
+				"gitserver_libinteractive_compile_duration_seconds",
+				time.Since(start).Seconds(),
+			)
+		}()
+	}
+
 	libinteractiveJarPath := "/usr/share/java/libinteractive.jar"
 	if c.LibinteractiveJarPath != "" {
 		libinteractiveJarPath = c.LibinteractiveJarPath
@@ -0,0 +1,260 @@
+package gitserver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/omegaup/githttp"
+	base "github.com/omegaup/go-base"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultMaintenancePackThreshold is the default number of packfiles above
+	// which a repository is repacked.
+	DefaultMaintenancePackThreshold = 50
+
+	// DefaultMaintenancePruneGracePeriod is the default amount of time that
+	// unreachable objects are kept around before they are pruned, so that
+	// pushes that are being processed never lose their objects.
+	DefaultMaintenancePruneGracePeriod = 14 * 24 * time.Hour
+)
+
+// MaintenanceResult is the outcome of maintaining a single repository.
+type MaintenanceResult struct {
+	Repository  string  `json:"repository"`
+	PacksBefore int     `json:"packs_before"`
+	PacksAfter  int     `json:"packs_after"`
+	Skipped     bool    `json:"skipped,omitempty"`
+	Duration    float64 `json:"duration"`
+	Error       string  `json:"error,omitempty"`
+}
+
+// Maintainer periodically scans all the repositories and consolidates the
+// packfiles of the ones that have too many of them. Every push adds a new
+// packfile, so without maintenance the number of packfiles grows without
+// bound.
+type Maintainer struct {
+	// Interval is the amount of time between scans of the repositories.
+	Interval time.Duration
+
+	// PackThreshold is the number of packfiles above which a repository is
+	// repacked.
+	PackThreshold int
+
+	// PruneGracePeriod is the minimum age of the unreachable objects that are
+	// pruned.
+	PruneGracePeriod time.Duration
+
+	rootPath string
+	metrics  base.Metrics
+	log      log15.Logger
+	wg       sync.WaitGroup
+}
+
+// NewMaintainer returns a Maintainer for all the repositories under rootPath.
+func NewMaintainer(rootPath string, metrics base.Metrics, log log15.Logger) *Maintainer {
+	return &Maintainer{
+		Interval:         time.Hour,
+		PackThreshold:    DefaultMaintenancePackThreshold,
+		PruneGracePeriod: DefaultMaintenancePruneGracePeriod,
+		rootPath:         rootPath,
+		metrics:          metrics,
+		log:              log,
+	}
+}
+
+// Start starts scanning the repositories every Interval until the context is
+// cancelled.
+func (m *Maintainer) Start(ctx context.Context) {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ticker := time.NewTicker(m.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if _, err := m.Run(ctx); err != nil {
+				m.log.Error("Failed to run the repository maintenance", "err", err)
+			}
+		}
+	}()
+}
+
+// Wait waits for the maintenance to stop.
+func (m *Maintainer) Wait() {
+	m.wg.Wait()
+}
+
+// Run maintains all the repositories that are above the pack threshold once,
+// one at a time, and returns the result for each one of them.
+func (m *Maintainer) Run(ctx context.Context) ([]*MaintenanceResult, error) {
+	entries, err := ioutil.ReadDir(m.rootPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list repositories at %s", m.rootPath)
+	}
+
+	var results []*MaintenanceResult
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return results, ctx.Err()
+		}
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		repositoryPath := path.Join(m.rootPath, entry.Name())
+		packs, err := countPackfiles(repositoryPath)
+		if err != nil || packs <= m.PackThreshold {
+			continue
+		}
+
+		result, err := MaintainRepository(ctx, repositoryPath, m.PruneGracePeriod, m.log)
+		if result == nil {
+			result = &MaintenanceResult{Repository: repositoryPath, PacksBefore: packs}
+		}
+		m.metrics.SummaryObserve("gitserver_maintenance_duration_seconds", result.Duration)
+		if err != nil {
+			m.log.Error("Failed to maintain repository", "path", repositoryPath, "err", err)
+			m.metrics.CounterAdd("gitserver_maintenance_failures_total", 1)
+			result.Error = err.Error()
+		} else if result.Skipped {
+			m.metrics.CounterAdd("gitserver_maintenance_skipped_total", 1)
+		} else {
+			m.metrics.CounterAdd("gitserver_maintenance_repacks_total", 1)
+			m.metrics.CounterAdd(
+				"gitserver_maintenance_packs_removed_total",
+				float64(result.PacksBefore-result.PacksAfter),
+			)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// countPackfiles returns the number of packfiles in the repository.
+func countPackfiles(repositoryPath string) (int, error) {
+	if _, err := os.Stat(path.Join(repositoryPath, "objects")); err != nil {
+		// Not a bare git repository.
+		return 0, err
+	}
+	packs, err := filepath.Glob(path.Join(repositoryPath, "objects/pack/*.pack"))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to list packfiles")
+	}
+	return len(packs), nil
+}
+
+// runGit runs a git command against the repository.
+func runGit(ctx context.Context, repositoryPath string, args ...string) error {
+	cmd := exec.CommandContext(
+		ctx,
+		"git",
+		append([]string{"--git-dir", repositoryPath}, args...)...,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to run git %s: %s",
+				strings.Join(args, " "),
+				strings.TrimSpace(string(output)),
+			),
+		)
+	}
+	return nil
+}
+
+// writeMultiPackIndex writes the multi-pack-index of the repository, if it
+// has any packfiles.
+func writeMultiPackIndex(ctx context.Context, repositoryPath string) error {
+	packs, err := countPackfiles(repositoryPath)
+	if err != nil {
+		return err
+	}
+	if packs == 0 {
+		// Nothing to index.
+		return nil
+	}
+	return runGit(ctx, repositoryPath, "multi-pack-index", "write")
+}
+
+// MaintainRepository consolidates all the packfiles of the repository into a
+// single one, writes the multi-pack-index and prunes the unreachable objects
+// that are older than the grace period. The repository is locked exclusively
+// while this happens. If a push is in progress, the repository is skipped
+// instead of waiting for it, so that it is picked up in the next scan.
+func MaintainRepository(
+	ctx context.Context,
+	repositoryPath string,
+	pruneGracePeriod time.Duration,
+	log log15.Logger,
+) (*MaintenanceResult, error) {
+	start := time.Now()
+	result := &MaintenanceResult{Repository: repositoryPath}
+	defer func() {
+		result.Duration = time.Since(start).Seconds()
+	}()
+
+	var err error
+	if result.PacksBefore, err = countPackfiles(repositoryPath); err != nil {
+		return result, errors.Wrapf(err, "failed to count the packfiles of %s", repositoryPath)
+	}
+
+	lockfile := githttp.NewLockfile(repositoryPath)
+	if ok, err := lockfile.TryLock(); !ok {
+		log.Info("Repository is busy, skipping maintenance", "path", repositoryPath, "err", err)
+		result.Skipped = true
+		result.PacksAfter = result.PacksBefore
+		return result, nil
+	}
+	defer lockfile.Unlock()
+
+	log.Info("Repacking repository", "path", repositoryPath, "packs", result.PacksBefore)
+
+	// -A (instead of -a) keeps the unreachable objects as loose objects, so
+	// that they are only removed by the prune below once they are older than
+	// the grace period.
+	if err := runGit(ctx, repositoryPath, "repack", "-A", "-d", "-q"); err != nil {
+		// runGit already wrapped the error correctly.
+		return result, err
+	}
+	if err := writeMultiPackIndex(ctx, repositoryPath); err != nil {
+		// writeMultiPackIndex already wrapped the error correctly.
+		return result, err
+	}
+	if err := runGit(
+		ctx,
+		repositoryPath,
+		"prune",
+		fmt.Sprintf("--expire=%d.seconds.ago", int64(pruneGracePeriod.Seconds())),
+	); err != nil {
+		// runGit already wrapped the error correctly.
+		return result, err
+	}
+
+	if result.PacksAfter, err = countPackfiles(repositoryPath); err != nil {
+		return result, errors.Wrapf(err, "failed to count the packfiles of %s", repositoryPath)
+	}
+	log.Info(
+		"Repacked repository",
+		"path", repositoryPath,
+		"packs_before", result.PacksBefore,
+		"packs_after", result.PacksAfter,
+		"duration", time.Since(start),
+	)
+	return result, nil
+}
@@ -0,0 +1,147 @@
+package gitserver
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	git "github.com/lhchavez/git2go/v29"
+	"github.com/omegaup/githttp"
+	"github.com/omegaup/gitserver/gitservertest"
+	base "github.com/omegaup/go-base"
+)
+
+func TestMaintainer(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+
+	log := base.StderrLog()
+	ts := httptest.NewServer(GitHandler(
+		tmpDir,
+		NewGitProtocol(authorize, nil, true, OverallWallTimeHardLimit, fakeInteractiveSettingsCompiler, log),
+		&base.NoOpMetrics{},
+		log,
+	))
+	defer ts.Close()
+
+	problemAlias := "sumas"
+	repositoryPath := path.Join(tmpDir, problemAlias)
+
+	{
+		repo, err := InitRepository(repositoryPath)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
+
+	for _, statement := range []string{"Sumas", "Sumas enteras", "Sumas de enteros"} {
+		newOid, packContents := createCommit(
+			t,
+			tmpDir,
+			problemAlias,
+			getReference(t, problemAlias, "refs/heads/master", ts),
+			map[string]io.Reader{
+				"settings.json":          strings.NewReader(gitservertest.DefaultSettingsJSON),
+				"cases/0.in":             strings.NewReader("1 2"),
+				"cases/0.out":            strings.NewReader("3"),
+				"statements/es.markdown": strings.NewReader(statement),
+			},
+			"Update statement",
+			log,
+		)
+		push(
+			t,
+			tmpDir,
+			adminAuthorization,
+			problemAlias,
+			"refs/heads/master",
+			getReference(t, problemAlias, "refs/heads/master", ts),
+			newOid,
+			packContents,
+			[]githttp.PktLineResponse{
+				{Line: "unpack ok\n", Err: nil},
+				{Line: "ok refs/heads/master\n", Err: nil},
+			},
+			ts,
+		)
+	}
+
+	packs, err := countPackfiles(repositoryPath)
+	if err != nil {
+		t.Fatalf("Failed to count the packfiles: %v", err)
+	}
+	if packs < 3 {
+		t.Fatalf("Expected at least one packfile per push, got %d", packs)
+	}
+
+	maintainer := NewMaintainer(tmpDir, &base.NoOpMetrics{}, log)
+
+	// Repositories below the threshold are left alone.
+	maintainer.PackThreshold = packs
+	results, err := maintainer.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to run the maintenance: %v", err)
+	}
+	if len(results) != 0 {
+		t.Errorf("Expected no repositories to be maintained, got %v", results)
+	}
+
+	// Busy repositories are skipped.
+	lockfile := githttp.NewLockfile(repositoryPath)
+	if ok, err := lockfile.TryRLock(); !ok {
+		t.Fatalf("Failed to acquire the lockfile: %v", err)
+	}
+	result, err := MaintainRepository(context.Background(), repositoryPath, time.Hour, log)
+	lockfile.Unlock()
+	if err != nil {
+		t.Fatalf("Failed to maintain the repository: %v", err)
+	}
+	if !result.Skipped {
+		t.Errorf("Expected the busy repository to be skipped, got %v", result)
+	}
+
+	maintainer.PackThreshold = 1
+	results, err = maintainer.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to run the maintenance: %v", err)
+	}
+	if len(results) != 1 || results[0].Error != "" || results[0].Skipped {
+		t.Fatalf("Unexpected results %v", results)
+	}
+	if results[0].PacksBefore != packs || results[0].PacksAfter != 1 {
+		t.Errorf("Expected %d packfiles to be consolidated into one, got %v", packs, results[0])
+	}
+	if _, err := os.Stat(path.Join(repositoryPath, "objects/pack/multi-pack-index")); err != nil {
+		t.Errorf("Expected the multi-pack-index to be written: %v", err)
+	}
+
+	// All the history is still reachable.
+	repo, err := git.OpenRepository(repositoryPath)
+	if err != nil {
+		t.Fatalf("Failed to open repository: %v", err)
+	}
+	defer repo.Free()
+	for _, ref := range []string{"refs/heads/master", "refs/heads/public", "refs/heads/private"} {
+		commit, err := repo.LookupCommit(getReference(t, problemAlias, ref, ts))
+		if err != nil {
+			t.Errorf("Failed to lookup %s: %v", ref, err)
+			continue
+		}
+		if _, err := commit.Tree(); err != nil {
+			t.Errorf("Failed to lookup the tree of %s: %v", ref, err)
+		}
+		commit.Free()
+	}
+}
@@ -2,20 +2,143 @@ package gitserver
 
 import (
 	"net/http"
+	"regexp"
 
 	base "github.com/omegaup/go-base"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+const (
+	// MetricOutcomeOK is the outcome of a request that succeeded.
+	MetricOutcomeOK = "ok"
+
+	// MetricOutcomeRejected is the outcome of a request that was rejected.
+	MetricOutcomeRejected = "rejected"
+)
+
 var (
-	gauges = map[string]prometheus.Gauge{}
+	defaultObjectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
+
+	// errorCategoryRegexp matches the categories of the errors, which are
+	// always kebab-case.
+	errorCategoryRegexp = regexp.MustCompile("^[a-z][a-z0-9-]*$")
+
+	gauges = map[string]prometheus.Gauge{
+		"gitserver_requests_in_flight": prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "gitserver",
+			Name:      "requests_in_flight",
+			Help:      "Number of requests that are being served",
+		}),
+	}
+
+	counters = map[string]prometheus.Counter{
+		"gitserver_frontend_authorization_failures_total": prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "gitserver",
+			Subsystem: "frontend",
+			Name:      "authorization_failures_total",
+			Help:      "Number of failed authorization requests to the frontend",
+		}),
+		"gitserver_maintenance_repacks_total": prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "gitserver",
+			Subsystem: "maintenance",
+			Name:      "repacks_total",
+			Help:      "Number of repositories whose packfiles were consolidated",
+		}),
+		"gitserver_maintenance_failures_total": prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "gitserver",
+			Subsystem: "maintenance",
+			Name:      "failures_total",
+			Help:      "Number of repositories that failed to be maintained",
+		}),
+		"gitserver_maintenance_skipped_total": prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "gitserver",
+			Subsystem: "maintenance",
+			Name:      "skipped_total",
+			Help:      "Number of repositories that were skipped because they were busy",
+		}),
+		"gitserver_maintenance_packs_removed_total": prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "gitserver",
+			Subsystem: "maintenance",
+			Name:      "packs_removed_total",
+			Help:      "Number of packfiles removed by consolidating them",
+		}),
+	}
 
-	counters = map[string]prometheus.Counter{}
+	summaries = map[string]prometheus.Summary{
+		"gitserver_packfile_size_bytes": prometheus.NewSummary(prometheus.SummaryOpts{
+			Namespace:  "gitserver",
+			Name:       "packfile_size_bytes",
+			Help:       "Size of the pushed packfiles",
+			Objectives: defaultObjectives,
+		}),
+		"gitserver_packfile_objects": prometheus.NewSummary(prometheus.SummaryOpts{
+			Namespace:  "gitserver",
+			Name:       "packfile_objects",
+			Help:       "Number of objects in the pushed packfiles",
+			Objectives: defaultObjectives,
+		}),
+		"gitserver_libinteractive_compile_duration_seconds": prometheus.NewSummary(prometheus.SummaryOpts{
+			Namespace:  "gitserver",
+			Subsystem:  "libinteractive",
+			Name:       "compile_duration_seconds",
+			Help:       "Time spent converting .idl files with libinteractive",
+			Objectives: defaultObjectives,
+		}),
+		"gitserver_frontend_authorization_duration_seconds": prometheus.NewSummary(prometheus.SummaryOpts{
+			Namespace:  "gitserver",
+			Subsystem:  "frontend",
+			Name:       "authorization_duration_seconds",
+			Help:       "Time spent requesting the privileges of a user from the frontend",
+			Objectives: defaultObjectives,
+		}),
+		// Pushes acquire the lockfile inside githttp, so only the handlers that
+		// acquire it themselves are measured.
+		"gitserver_lock_wait_seconds": prometheus.NewSummary(prometheus.SummaryOpts{
+			Namespace:  "gitserver",
+			Name:       "lock_wait_seconds",
+			Help:       "Time spent waiting for the lockfile of a repository by .zip uploads and reviews",
+			Objectives: defaultObjectives,
+		}),
+		"gitserver_maintenance_duration_seconds": prometheus.NewSummary(prometheus.SummaryOpts{
+			Namespace:  "gitserver",
+			Subsystem:  "maintenance",
+			Name:       "duration_seconds",
+			Help:       "Time spent maintaining a repository",
+			Objectives: defaultObjectives,
+		}),
+	}
 
-	summaries = map[string]prometheus.Summary{}
+	summaryVecs = map[string]*prometheus.SummaryVec{
+		"gitserver_push_duration_seconds": prometheus.NewSummaryVec(
+			prometheus.SummaryOpts{
+				Namespace:  "gitserver",
+				Name:       "push_duration_seconds",
+				Help:       "Time spent serving a git push, by outcome and error category",
+				Objectives: defaultObjectives,
+			},
+			[]string{"outcome", "category"},
+		),
+		"gitserver_zip_upload_duration_seconds": prometheus.NewSummaryVec(
+			prometheus.SummaryOpts{
+				Namespace:  "gitserver",
+				Name:       "zip_upload_duration_seconds",
+				Help:       "Time spent serving a .zip upload, by outcome and error category",
+				Objectives: defaultObjectives,
+			},
+			[]string{"outcome", "category"},
+		),
+	}
 )
 
+// labeledMetrics is implemented by the metrics that can distinguish
+// observations by their labels. base.Metrics has no notion of labels, so
+// implementations that do not support them get the observation without
+// labels.
+type labeledMetrics interface {
+	SummaryObserveWithLabels(name string, value float64, labels map[string]string)
+}
+
 type prometheusMetrics struct {
 }
 
@@ -37,6 +160,66 @@ func (p *prometheusMetrics) SummaryObserve(name string, value float64) {
 	}
 }
 
+func (p *prometheusMetrics) SummaryObserveWithLabels(
+	name string,
+	value float64,
+	labels map[string]string,
+) {
+	if summaryVec, ok := summaryVecs[name]; ok {
+		summaryVec.With(prometheus.Labels(labels)).Observe(value)
+	}
+}
+
+// summaryObserveWithLabels records the observation with its labels if the
+// metrics support them.
+func summaryObserveWithLabels(
+	metrics base.Metrics,
+	name string,
+	value float64,
+	labels map[string]string,
+) {
+	if labeled, ok := metrics.(labeledMetrics); ok {
+		labeled.SummaryObserveWithLabels(name, value, labels)
+		return
+	}
+	metrics.SummaryObserve(name, value)
+}
+
+// outcomeLabels returns the labels of a request that finished with the error.
+// The category is the one that the error was wrapped with, so that the number
+// of distinct label values stays bounded.
+func outcomeLabels(err error) map[string]string {
+	if err == nil {
+		return map[string]string{"outcome": MetricOutcomeOK, "category": ""}
+	}
+	return map[string]string{
+		"outcome":  MetricOutcomeRejected,
+		"category": errorCategory(err),
+	}
+}
+
+// errorCategory returns the category of the error, which is the one of the
+// outermost error in the chain that was wrapped with
+// base.ErrorWithCategory. Sentinel errors that are used as categories
+// themselves are their own category. Errors without a category are reported
+// as internal.
+func errorCategory(err error) string {
+	for err != nil {
+		if categorized, ok := err.(interface{ Category() error }); ok {
+			return categorized.Category().Error()
+		}
+		cause, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		err = cause.Cause()
+	}
+	if err != nil && errorCategoryRegexp.MatchString(err.Error()) {
+		return err.Error()
+	}
+	return ErrInternal.Error()
+}
+
 // SetupMetrics sets up the metrics for the gitserver.
 func SetupMetrics() (base.Metrics, http.Handler) {
 	for _, gauge := range gauges {
@@ -48,6 +231,9 @@ func SetupMetrics() (base.Metrics, http.Handler) {
 	for _, summary := range summaries {
 		prometheus.MustRegister(summary)
 	}
+	for _, summaryVec := range summaryVecs {
+		prometheus.MustRegister(summaryVec)
+	}
 
 	return &prometheusMetrics{}, promhttp.Handler()
 }
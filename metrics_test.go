@@ -0,0 +1,179 @@
+package gitserver
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	git "github.com/lhchavez/git2go/v29"
+	"github.com/omegaup/githttp"
+	"github.com/omegaup/gitserver/gitservertest"
+	base "github.com/omegaup/go-base"
+	"github.com/pkg/errors"
+)
+
+type recordedObservation struct {
+	value  float64
+	labels map[string]string
+}
+
+type recordingMetrics struct {
+	sync.Mutex
+	observations map[string][]recordedObservation
+}
+
+func (m *recordingMetrics) record(name string, value float64, labels map[string]string) {
+	m.Lock()
+	defer m.Unlock()
+	if m.observations == nil {
+		m.observations = make(map[string][]recordedObservation)
+	}
+	m.observations[name] = append(m.observations[name], recordedObservation{value: value, labels: labels})
+}
+
+func (m *recordingMetrics) GaugeAdd(name string, value float64) {
+	m.record(name, value, nil)
+}
+
+func (m *recordingMetrics) CounterAdd(name string, value float64) {
+	m.record(name, value, nil)
+}
+
+func (m *recordingMetrics) SummaryObserve(name string, value float64) {
+	m.record(name, value, nil)
+}
+
+func (m *recordingMetrics) SummaryObserveWithLabels(name string, value float64, labels map[string]string) {
+	m.record(name, value, labels)
+}
+
+func TestErrorCategory(t *testing.T) {
+	for _, testCase := range []struct {
+		err      error
+		category string
+	}{
+		{base.ErrorWithCategory(ErrNotAReview, errors.New("not a review")), "not-a-review"},
+		{githttp.ErrForbidden, "forbidden"},
+		{errors.New("failed to open the repository: no such file"), "internal-error"},
+		{errors.Wrap(base.ErrorWithCategory(ErrNotAReview, errors.New("not a review")), "failed to review"), "not-a-review"},
+		{errors.Wrap(githttp.ErrForbidden, "failed to push"), "forbidden"},
+		{errors.New("not-a-review: looks like a category"), "internal-error"},
+	} {
+		if category := errorCategory(testCase.err); category != testCase.category {
+			t.Errorf("errorCategory(%v) = %q, want %q", testCase.err, category, testCase.category)
+		}
+	}
+}
+
+func TestPushMetrics(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+
+	log := base.StderrLog()
+	metrics := &recordingMetrics{}
+	ts := httptest.NewServer(GitHandler(
+		tmpDir,
+		NewGitProtocol(authorize, nil, false, OverallWallTimeHardLimit, fakeInteractiveSettingsCompiler, log),
+		metrics,
+		log,
+	))
+
+	problemAlias := "sumas"
+
+	{
+		repo, err := InitRepository(path.Join(tmpDir, problemAlias))
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
+
+	newOid, packContents := createCommit(
+		t,
+		tmpDir,
+		problemAlias,
+		&git.Oid{},
+		map[string]io.Reader{
+			"settings.json":          strings.NewReader(gitservertest.DefaultSettingsJSON),
+			"cases/0.in":             strings.NewReader("1 2"),
+			"cases/0.out":            strings.NewReader("3"),
+			"statements/es.markdown": strings.NewReader("Sumas"),
+		},
+		"Initial commit",
+		log,
+	)
+
+	// Direct pushes to master are not allowed.
+	push(
+		t,
+		tmpDir,
+		adminAuthorization,
+		problemAlias,
+		"refs/heads/master",
+		&git.Oid{}, newOid,
+		packContents,
+		[]githttp.PktLineResponse{
+			{Line: "unpack ok\n", Err: nil},
+			{Line: "ng refs/heads/master not-a-review\n", Err: nil},
+		},
+		ts,
+	)
+	configOid, configPackContents := createCommit(
+		t,
+		tmpDir,
+		problemAlias,
+		&git.Oid{},
+		map[string]io.Reader{
+			"config.json": strings.NewReader(`{"policy":{"allowDirectPushToMaster":true}}`),
+		},
+		"Allow direct pushes",
+		log,
+	)
+	push(
+		t,
+		tmpDir,
+		adminAuthorization,
+		problemAlias,
+		"refs/meta/config",
+		&git.Oid{}, configOid,
+		configPackContents,
+		[]githttp.PktLineResponse{
+			{Line: "unpack ok\n", Err: nil},
+			{Line: "ok refs/meta/config\n", Err: nil},
+		},
+		ts,
+	)
+
+	// Closing the server waits for the requests to finish, so all the
+	// observations have been recorded afterwards.
+	ts.Close()
+
+	metrics.Lock()
+	defer metrics.Unlock()
+	pushes := metrics.observations["gitserver_push_duration_seconds"]
+	if len(pushes) != 2 {
+		t.Fatalf("Expected two push observations, got %v", pushes)
+	}
+	if pushes[0].labels["outcome"] != MetricOutcomeRejected || pushes[0].labels["category"] != "not-a-review" {
+		t.Errorf("Unexpected labels for the rejected push: %v", pushes[0].labels)
+	}
+	if pushes[1].labels["outcome"] != MetricOutcomeOK || pushes[1].labels["category"] != "" {
+		t.Errorf("Unexpected labels for the successful push: %v", pushes[1].labels)
+	}
+	if objects := metrics.observations["gitserver_packfile_objects"]; len(objects) == 0 || objects[0].value == 0 {
+		t.Errorf("Expected the number of objects in the packfile to be recorded, got %v", objects)
+	}
+	if sizes := metrics.observations["gitserver_packfile_size_bytes"]; len(sizes) == 0 || sizes[0].value == 0 {
+		t.Errorf("Expected the size of the packfile to be recorded, got %v", sizes)
+	}
+}
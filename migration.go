@@ -0,0 +1,544 @@
+package gitserver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	git "github.com/lhchavez/git2go/v29"
+	"github.com/omegaup/githttp"
+	"github.com/omegaup/gitserver/request"
+	base "github.com/omegaup/go-base"
+	"github.com/pkg/errors"
+)
+
+const (
+	// CurrentRepositoryVersion is the version of the omegaUp repository format
+	// that InitRepository creates, and the one that MigrateRepository brings
+	// older repositories to.
+	CurrentRepositoryVersion = 4
+)
+
+// MigrationContext is what a RepositoryMigration gets to operate on. The
+// repository is locked exclusively while the migration runs.
+type MigrationContext struct {
+	Context                     context.Context
+	Repository                  *git.Repository
+	Lockfile                    *githttp.Lockfile
+	Protocol                    *githttp.GitProtocol
+	HardOverallWallTimeLimit    base.Duration
+	InteractiveSettingsCompiler InteractiveSettingsCompiler
+	Log                         log15.Logger
+
+	// Issues are the problems that the migrations found and cannot fix, such
+	// as a master commit that no longer passes validation. They do not make
+	// the migration fail, since running it again would not fix them either.
+	Issues []string
+}
+
+// A RepositoryMigration upgrades a repository from the previous version of the
+// format to Version.
+type RepositoryMigration struct {
+	Version     int
+	Description string
+	Migrate     func(migrationContext *MigrationContext) error
+}
+
+// RepositoryMigrations is the list of all the migrations, in order. Version 0
+// is used for the repositories that were created before the omegaup/version
+// file existed.
+var RepositoryMigrations = []RepositoryMigration{
+	{
+		Version:     1,
+		Description: "set the default git config",
+		Migrate:     migrateConfigDefaults,
+	},
+	{
+		Version:     2,
+		Description: "write info/attributes",
+		Migrate:     migrateGitAttributes,
+	},
+	{
+		Version:     3,
+		Description: "write the multi-pack-index",
+		Migrate:     migrateMultiPackIndex,
+	},
+	{
+		Version:     4,
+		Description: "regenerate settings.distrib.json",
+		Migrate:     migrateSettingsDistrib,
+	},
+}
+
+// MigrationResult is the outcome of migrating a single repository.
+type MigrationResult struct {
+	Repository  string   `json:"repository"`
+	FromVersion int      `json:"from_version"`
+	ToVersion   int      `json:"to_version"`
+	Migrations  []string `json:"migrations"`
+	DryRun      bool     `json:"dry_run,omitempty"`
+	Issues      []string `json:"issues,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// GetRepositoryVersion returns the version of the omegaUp repository format of
+// the repository. Repositories without an omegaup/version file are version 0.
+func GetRepositoryVersion(repositoryPath string) (int, error) {
+	versionPath := path.Join(repositoryPath, "omegaup", "version")
+	contents, err := ioutil.ReadFile(versionPath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to read the omegaUp repository version file at %s",
+				versionPath,
+			),
+		)
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return 0, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"invalid omegaUp repository version file at %s",
+				versionPath,
+			),
+		)
+	}
+	return version, nil
+}
+
+// MigrateRepository applies all the pending migrations to the repository, in
+// order. The version is written after every migration, so a repository whose
+// migration failed midway can be resumed later. In dry-run mode, the pending
+// migrations are only reported.
+func MigrateRepository(
+	ctx context.Context,
+	repositoryPath string,
+	protocol *githttp.GitProtocol,
+	interactiveSettingsCompiler InteractiveSettingsCompiler,
+	dryRun bool,
+	log log15.Logger,
+) (*MigrationResult, error) {
+	repo, err := git.OpenRepository(repositoryPath)
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to open repository at %s",
+				repositoryPath,
+			),
+		)
+	}
+	defer repo.Free()
+
+	lockfile := githttp.NewLockfile(repo.Path())
+	if dryRun {
+		if ok, err := lockfile.TryRLock(); !ok {
+			log.Info("Waiting for the lockfile", "path", repositoryPath, "err", err)
+			if err := lockfile.RLock(); err != nil {
+				return nil, errors.Wrap(err, "failed to acquire the lockfile")
+			}
+		}
+	} else {
+		if ok, err := lockfile.TryLock(); !ok {
+			log.Info("Waiting for the lockfile", "path", repositoryPath, "err", err)
+			if err := lockfile.Lock(); err != nil {
+				return nil, errors.Wrap(err, "failed to acquire the lockfile")
+			}
+		}
+	}
+	defer lockfile.Unlock()
+
+	version, err := GetRepositoryVersion(repositoryPath)
+	if err != nil {
+		// GetRepositoryVersion already wrapped the error correctly.
+		return nil, err
+	}
+	result := &MigrationResult{
+		Repository:  repositoryPath,
+		FromVersion: version,
+		ToVersion:   version,
+		Migrations:  []string{},
+		DryRun:      dryRun,
+	}
+	if version > CurrentRepositoryVersion {
+		return result, base.ErrorWithCategory(
+			ErrRepositoryVersionTooNew,
+			errors.Errorf(
+				"repository at %s has version %d, newer than %d",
+				repositoryPath,
+				version,
+				CurrentRepositoryVersion,
+			),
+		)
+	}
+
+	migrationContext := &MigrationContext{
+		Context:                     ctx,
+		Repository:                  repo,
+		Lockfile:                    lockfile,
+		Protocol:                    protocol,
+		HardOverallWallTimeLimit:    OverallWallTimeHardLimit,
+		InteractiveSettingsCompiler: interactiveSettingsCompiler,
+		Log:                         log,
+	}
+	if err := applyMigrations(migrationContext, result, dryRun); err != nil {
+		// applyMigrations already wrapped the error correctly.
+		return result, err
+	}
+	return result, nil
+}
+
+// applyMigrations applies the migrations that are newer than the version in
+// the result, and updates the result with them. The caller must hold the lock
+// of the repository.
+func applyMigrations(
+	migrationContext *MigrationContext,
+	result *MigrationResult,
+	dryRun bool,
+) error {
+	repositoryPath := result.Repository
+	for _, migration := range RepositoryMigrations {
+		if migration.Version <= result.FromVersion {
+			continue
+		}
+		if dryRun {
+			result.Migrations = append(result.Migrations, migration.Description)
+			result.ToVersion = migration.Version
+			continue
+		}
+		migrationContext.Log.Info(
+			"Applying migration",
+			"path", repositoryPath,
+			"version", migration.Version,
+			"description", migration.Description,
+		)
+		if err := migration.Migrate(migrationContext); err != nil {
+			return errors.Wrapf(
+				err,
+				"failed to migrate repository at %s to version %d",
+				repositoryPath,
+				migration.Version,
+			)
+		}
+		if err := WriteRepositoryVersion(repositoryPath, migration.Version); err != nil {
+			// WriteRepositoryVersion already wrapped the error correctly.
+			return err
+		}
+		result.Migrations = append(result.Migrations, migration.Description)
+		result.ToVersion = migration.Version
+		result.Issues = migrationContext.Issues
+	}
+	return nil
+}
+
+// MigrateAllRepositories applies all the pending migrations to every
+// repository under rootPath. Repositories that fail to migrate do not stop the
+// rest from being migrated, and have their error in the result.
+func MigrateAllRepositories(
+	ctx context.Context,
+	rootPath string,
+	protocol *githttp.GitProtocol,
+	interactiveSettingsCompiler InteractiveSettingsCompiler,
+	dryRun bool,
+	log log15.Logger,
+) ([]*MigrationResult, error) {
+	entries, err := ioutil.ReadDir(rootPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list repositories at %s", rootPath)
+	}
+
+	var results []*MigrationResult
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		repositoryPath := path.Join(rootPath, entry.Name())
+		if _, err := os.Stat(path.Join(repositoryPath, "objects")); err != nil {
+			// Not a bare git repository.
+			continue
+		}
+		result, err := MigrateRepository(
+			ctx,
+			repositoryPath,
+			protocol,
+			interactiveSettingsCompiler,
+			dryRun,
+			log,
+		)
+		if result == nil {
+			result = &MigrationResult{Repository: repositoryPath, Migrations: []string{}}
+		}
+		if err != nil {
+			log.Error("Failed to migrate repository", "path", repositoryPath, "err", err)
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func migrateConfigDefaults(migrationContext *MigrationContext) error {
+	return setRepositoryConfigDefaults(
+		migrationContext.Repository,
+		migrationContext.Repository.Path(),
+	)
+}
+
+func migrateGitAttributes(migrationContext *MigrationContext) error {
+	return writeGitAttributes(migrationContext.Repository.Path())
+}
+
+func migrateMultiPackIndex(migrationContext *MigrationContext) error {
+	return writeMultiPackIndex(migrationContext.Context, migrationContext.Repository.Path())
+}
+
+// migrateSettingsDistrib regenerates settings.distrib.json from the tip of
+// master, and if it changed, pushes a new commit to master with it. The push
+// goes through the protocol, so the public, protected and private branches
+// get the change too. Problems whose master no longer passes validation are
+// reported as issues and left as they are.
+func migrateSettingsDistrib(migrationContext *MigrationContext) error {
+	repo := migrationContext.Repository
+	masterRef, err := repo.References.Lookup("refs/heads/master")
+	if err != nil {
+		// The master branch has not been created yet.
+		return nil
+	}
+	defer masterRef.Free()
+
+	masterCommit, err := repo.LookupCommit(masterRef.Target())
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(err, "failed to lookup the master commit"),
+		)
+	}
+	defer masterCommit.Free()
+
+	staleFiles, err := getStaleGeneratedFiles(
+		repo,
+		masterCommit,
+		migrationContext.HardOverallWallTimeLimit,
+		migrationContext.InteractiveSettingsCompiler,
+		[]string{"settings.distrib.json"},
+		migrationContext.Log,
+	)
+	if err != nil {
+		if base.HasErrorCategory(err, ErrInternalGit) || base.HasErrorCategory(err, ErrInternal) {
+			// getStaleGeneratedFiles already wrapped the error correctly.
+			return err
+		}
+		migrationContext.Log.Warn(
+			"Master commit is not valid, not regenerating settings.distrib.json",
+			"path", repo.Path(),
+			"commit", masterCommit.Id(),
+			"err", err,
+		)
+		migrationContext.Issues = append(
+			migrationContext.Issues,
+			fmt.Sprintf(
+				"master commit %s is not valid, settings.distrib.json was not regenerated: %v",
+				masterCommit.Id(),
+				err,
+			),
+		)
+		return nil
+	}
+	if len(staleFiles) == 0 {
+		return nil
+	}
+	return pushMasterFiles(
+		migrationContext,
+		masterCommit,
+		staleFiles,
+		"Regenerate settings.distrib.json",
+	)
+}
+
+// getStaleGeneratedFiles runs the same validation as a push to master on the
+// commit, and returns the contents of the files among filenames that the
+// validation would have generated differently from what is in the commit.
+func getStaleGeneratedFiles(
+	repo *git.Repository,
+	commit *git.Commit,
+	hardOverallWallTimeLimit base.Duration,
+	interactiveSettingsCompiler InteractiveSettingsCompiler,
+	filenames []string,
+	log log15.Logger,
+) (map[string][]byte, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(err, "failed to lookup the tree of commit %s", commit.Id()),
+		)
+	}
+	defer tree.Free()
+
+	updatedFiles := make(map[string]io.Reader)
+	if err := validateProblem(
+		repo,
+		commit,
+		hardOverallWallTimeLimit,
+		interactiveSettingsCompiler,
+		updatedFiles,
+		log,
+	); err != nil {
+		// validateProblem already wrapped the error correctly.
+		return nil, err
+	}
+
+	staleFiles := make(map[string][]byte)
+	for _, filename := range filenames {
+		if updatedFiles[filename] == nil {
+			continue
+		}
+		contents, err := ioutil.ReadAll(updatedFiles[filename])
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read the regenerated %s", filename)
+		}
+		if entry, err := tree.EntryByPath(filename); err == nil {
+			blob, err := repo.LookupBlob(entry.Id)
+			if err != nil {
+				return nil, base.ErrorWithCategory(
+					ErrInternalGit,
+					errors.Wrapf(err, "failed to lookup %s", filename),
+				)
+			}
+			unchanged := bytes.Equal(blob.Contents(), contents)
+			blob.Free()
+			if unchanged {
+				continue
+			}
+		}
+		staleFiles[filename] = contents
+	}
+	return staleFiles, nil
+}
+
+// pushMasterFiles creates a commit on top of master with the files replaced,
+// and pushes it through the protocol as the system user, so that the split
+// branches are updated too. The policy and the approvals of the problem are
+// bypassed, since the push is not made on behalf of any user.
+func pushMasterFiles(
+	migrationContext *MigrationContext,
+	masterCommit *git.Commit,
+	files map[string][]byte,
+	commitMessage string,
+) error {
+	repo := migrationContext.Repository
+	masterTree, err := masterCommit.Tree()
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(err, "failed to lookup the master tree"),
+		)
+	}
+	defer masterTree.Free()
+
+	contents := make(map[string]io.Reader)
+	for filename, fileContents := range files {
+		contents[filename] = bytes.NewReader(fileContents)
+	}
+	updatedTree, err := githttp.BuildTree(repo, contents, migrationContext.Log)
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(err, "failed to build the tree"),
+		)
+	}
+	defer updatedTree.Free()
+
+	mergedTree, err := githttp.MergeTrees(repo, updatedTree, masterTree)
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(err, "failed to merge tree"),
+		)
+	}
+	defer mergedTree.Free()
+
+	signature := &git.Signature{
+		Name:  systemUsername,
+		Email: fmt.Sprintf("%s@omegaup", systemUsername),
+		When:  time.Now(),
+	}
+	newOid, err := repo.CreateCommit(
+		"",
+		signature,
+		signature,
+		commitMessage,
+		mergedTree,
+		masterCommit,
+	)
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(err, "failed to create commit"),
+		)
+	}
+
+	packfile, err := ioutil.TempFile("", "gitserver-packfile")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(packfile.Name())
+	defer packfile.Close()
+
+	if err := writeCommitPackfile(repo, newOid, []*git.Commit{masterCommit}, packfile); err != nil {
+		// writeCommitPackfile already wrapped the error correctly.
+		return err
+	}
+	packfile.Seek(0, 0)
+
+	ctx := request.NewContext(migrationContext.Context, nil)
+	requestContext := request.FromContext(ctx)
+	requestContext.Request.Username = systemUsername
+	requestContext.Request.ProblemName = path.Base(strings.TrimSuffix(repo.Path(), "/"))
+	requestContext.Request.IsAdmin = true
+	requestContext.Request.CanView = true
+	requestContext.Request.CanEdit = true
+	requestContext.Request.IsSystem = true
+
+	_, err, unpackErr := migrationContext.Protocol.PushPackfile(
+		ctx,
+		repo,
+		migrationContext.Lockfile,
+		githttp.AuthorizationAllowed,
+		[]*githttp.GitCommand{
+			{
+				Old:           masterCommit.Id(),
+				New:           newOid,
+				ReferenceName: "refs/heads/master",
+				Reference:     nil,
+			},
+		},
+		packfile,
+	)
+	if unpackErr != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(unpackErr, "failed to unpack the packfile"),
+		)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to push the regenerated files")
+	}
+	return nil
+}
@@ -0,0 +1,416 @@
+package gitserver
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	git "github.com/lhchavez/git2go/v29"
+	"github.com/omegaup/githttp"
+	"github.com/omegaup/gitserver/gitservertest"
+	base "github.com/omegaup/go-base"
+)
+
+func TestMigrateRepository(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+
+	log := base.StderrLog()
+	protocol := NewGitProtocol(authorize, nil, true, OverallWallTimeHardLimit, fakeInteractiveSettingsCompiler, log)
+	ts := httptest.NewServer(GitHandler(tmpDir, protocol, &base.NoOpMetrics{}, log))
+	defer ts.Close()
+
+	problemAlias := "sumas"
+	repositoryPath := path.Join(tmpDir, problemAlias)
+
+	{
+		repo, err := InitRepository(repositoryPath)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
+	if version, err := GetRepositoryVersion(repositoryPath); err != nil || version != CurrentRepositoryVersion {
+		t.Fatalf("Expected version %d, got %d (%v)", CurrentRepositoryVersion, version, err)
+	}
+
+	newOid, packContents := createCommit(
+		t,
+		tmpDir,
+		problemAlias,
+		&git.Oid{},
+		map[string]io.Reader{
+			"settings.json":          strings.NewReader(gitservertest.DefaultSettingsJSON),
+			"cases/0.in":             strings.NewReader("1 2"),
+			"cases/0.out":            strings.NewReader("3"),
+			"statements/es.markdown": strings.NewReader("Sumas"),
+		},
+		"Initial commit",
+		log,
+	)
+	push(
+		t,
+		tmpDir,
+		adminAuthorization,
+		problemAlias,
+		"refs/heads/master",
+		&git.Oid{}, newOid,
+		packContents,
+		[]githttp.PktLineResponse{
+			{Line: "unpack ok\n", Err: nil},
+			{Line: "ok refs/heads/master\n", Err: nil},
+		},
+		ts,
+	)
+
+	// Make the repository look like one that was created before the
+	// omegaup/version file existed, with a stale settings.distrib.json.
+	if err := os.Remove(path.Join(repositoryPath, "omegaup/version")); err != nil {
+		t.Fatalf("Failed to remove the version file: %v", err)
+	}
+	if err := os.Remove(path.Join(repositoryPath, "info/attributes")); err != nil {
+		t.Fatalf("Failed to remove the attributes file: %v", err)
+	}
+	var staleOid *git.Oid
+	{
+		repo, err := git.OpenRepository(repositoryPath)
+		if err != nil {
+			t.Fatalf("Failed to open repository: %v", err)
+		}
+		masterCommit, err := repo.LookupCommit(getReference(t, problemAlias, "refs/heads/master", ts))
+		if err != nil {
+			t.Fatalf("Failed to lookup the master commit: %v", err)
+		}
+		masterTree, err := masterCommit.Tree()
+		if err != nil {
+			t.Fatalf("Failed to lookup the master tree: %v", err)
+		}
+		treebuilder, err := repo.TreeBuilderFromTree(masterTree)
+		if err != nil {
+			t.Fatalf("Failed to create treebuilder: %v", err)
+		}
+		blobOid, err := repo.CreateBlobFromBuffer([]byte("{}"))
+		if err != nil {
+			t.Fatalf("Failed to create blob: %v", err)
+		}
+		if err := treebuilder.Insert("settings.distrib.json", blobOid, git.FilemodeBlob); err != nil {
+			t.Fatalf("Failed to insert blob: %v", err)
+		}
+		treeOid, err := treebuilder.Write()
+		if err != nil {
+			t.Fatalf("Failed to write tree: %v", err)
+		}
+		staleTree, err := repo.LookupTree(treeOid)
+		if err != nil {
+			t.Fatalf("Failed to lookup tree: %v", err)
+		}
+		signature := &git.Signature{Name: "author", Email: "author@omegaup.com", When: time.Now()}
+		staleOid, err = repo.CreateCommit(
+			"refs/heads/master",
+			signature,
+			signature,
+			"Stale settings.distrib.json",
+			staleTree,
+			masterCommit,
+		)
+		if err != nil {
+			t.Fatalf("Failed to create commit: %v", err)
+		}
+		staleTree.Free()
+		treebuilder.Free()
+		masterTree.Free()
+		masterCommit.Free()
+		repo.Free()
+	}
+
+	// A dry run reports the migrations without applying them.
+	result, err := MigrateRepository(context.Background(), repositoryPath, protocol, fakeInteractiveSettingsCompiler, true, log)
+	if err != nil {
+		t.Fatalf("Failed to migrate repository: %v", err)
+	}
+	if result.FromVersion != 0 || result.ToVersion != CurrentRepositoryVersion || len(result.Migrations) != len(RepositoryMigrations) {
+		t.Errorf("Unexpected dry-run result %v", result)
+	}
+	if version, err := GetRepositoryVersion(repositoryPath); err != nil || version != 0 {
+		t.Errorf("Expected version 0 after the dry run, got %d (%v)", version, err)
+	}
+
+	result, err = MigrateRepository(context.Background(), repositoryPath, protocol, fakeInteractiveSettingsCompiler, false, log)
+	if err != nil {
+		t.Fatalf("Failed to migrate repository: %v", err)
+	}
+	if result.ToVersion != CurrentRepositoryVersion || len(result.Migrations) != len(RepositoryMigrations) {
+		t.Errorf("Unexpected result %v", result)
+	}
+	if version, err := GetRepositoryVersion(repositoryPath); err != nil || version != CurrentRepositoryVersion {
+		t.Errorf("Expected version %d, got %d (%v)", CurrentRepositoryVersion, version, err)
+	}
+	if contents, err := ioutil.ReadFile(path.Join(repositoryPath, "info/attributes")); err != nil || string(contents) != GitAttributesContents {
+		t.Errorf("Unexpected attributes %q (%v)", string(contents), err)
+	}
+
+	// settings.distrib.json was regenerated in a new commit on top of the
+	// stale one.
+	{
+		repo, err := git.OpenRepository(repositoryPath)
+		if err != nil {
+			t.Fatalf("Failed to open repository: %v", err)
+		}
+		defer repo.Free()
+		masterCommit, err := repo.LookupCommit(getReference(t, problemAlias, "refs/heads/master", ts))
+		if err != nil {
+			t.Fatalf("Failed to lookup the master commit: %v", err)
+		}
+		defer masterCommit.Free()
+		if !masterCommit.ParentId(0).Equal(staleOid) {
+			t.Errorf("Expected master's parent to be %s, got %s", staleOid, masterCommit.ParentId(0))
+		}
+		masterTree, err := masterCommit.Tree()
+		if err != nil {
+			t.Fatalf("Failed to lookup the master tree: %v", err)
+		}
+		defer masterTree.Free()
+		entry, err := masterTree.EntryByPath("settings.distrib.json")
+		if err != nil {
+			t.Fatalf("Failed to find settings.distrib.json: %v", err)
+		}
+		blob, err := repo.LookupBlob(entry.Id)
+		if err != nil {
+			t.Fatalf("Failed to lookup settings.distrib.json: %v", err)
+		}
+		defer blob.Free()
+		if string(blob.Contents()) == "{}" {
+			t.Errorf("settings.distrib.json was not regenerated")
+		}
+	}
+
+	// Migrating an up-to-date repository is a no-op.
+	result, err = MigrateRepository(context.Background(), repositoryPath, protocol, fakeInteractiveSettingsCompiler, false, log)
+	if err != nil {
+		t.Fatalf("Failed to migrate repository: %v", err)
+	}
+	if len(result.Migrations) != 0 {
+		t.Errorf("Expected no migrations, got %v", result.Migrations)
+	}
+
+	// Repositories from the future are not touched.
+	if err := WriteRepositoryVersion(repositoryPath, CurrentRepositoryVersion+1); err != nil {
+		t.Fatalf("Failed to write the version file: %v", err)
+	}
+	if _, err := MigrateRepository(context.Background(), repositoryPath, protocol, fakeInteractiveSettingsCompiler, false, log); err == nil {
+		t.Errorf("Expected an error for a repository with a newer version")
+	}
+}
+
+// commitMasterFiles creates a commit on top of master with the files
+// replaced, without going through the validations of a push.
+func commitMasterFiles(t *testing.T, repositoryPath string, files map[string]string) *git.Oid {
+	t.Helper()
+	repo, err := git.OpenRepository(repositoryPath)
+	if err != nil {
+		t.Fatalf("Failed to open repository: %v", err)
+	}
+	defer repo.Free()
+	masterRef, err := repo.References.Lookup("refs/heads/master")
+	if err != nil {
+		t.Fatalf("Failed to lookup master: %v", err)
+	}
+	defer masterRef.Free()
+	masterCommit, err := repo.LookupCommit(masterRef.Target())
+	if err != nil {
+		t.Fatalf("Failed to lookup the master commit: %v", err)
+	}
+	defer masterCommit.Free()
+	masterTree, err := masterCommit.Tree()
+	if err != nil {
+		t.Fatalf("Failed to lookup the master tree: %v", err)
+	}
+	defer masterTree.Free()
+
+	contents := make(map[string]io.Reader)
+	for filename, fileContents := range files {
+		contents[filename] = strings.NewReader(fileContents)
+	}
+	updatedTree, err := githttp.BuildTree(repo, contents, base.StderrLog())
+	if err != nil {
+		t.Fatalf("Failed to build tree: %v", err)
+	}
+	defer updatedTree.Free()
+	mergedTree, err := githttp.MergeTrees(repo, updatedTree, masterTree)
+	if err != nil {
+		t.Fatalf("Failed to merge trees: %v", err)
+	}
+	defer mergedTree.Free()
+
+	signature := &git.Signature{Name: "author", Email: "author@omegaup.com", When: time.Now()}
+	newOid, err := repo.CreateCommit(
+		"refs/heads/master",
+		signature,
+		signature,
+		"Update files",
+		mergedTree,
+		masterCommit,
+	)
+	if err != nil {
+		t.Fatalf("Failed to create commit: %v", err)
+	}
+	return newOid
+}
+
+func TestMigrateRepositorySystemPush(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+
+	log := base.StderrLog()
+	protocol := NewGitProtocol(authorize, nil, true, OverallWallTimeHardLimit, fakeInteractiveSettingsCompiler, log)
+	ts := httptest.NewServer(GitHandler(tmpDir, protocol, &base.NoOpMetrics{}, log))
+	defer ts.Close()
+
+	problemAlias := "sumas"
+	repositoryPath := path.Join(tmpDir, problemAlias)
+
+	{
+		repo, err := InitRepository(repositoryPath)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
+
+	newOid, packContents := createCommit(
+		t,
+		tmpDir,
+		problemAlias,
+		&git.Oid{},
+		map[string]io.Reader{
+			"settings.json":          strings.NewReader(gitservertest.DefaultSettingsJSON),
+			"cases/0.in":             strings.NewReader("1 2"),
+			"cases/0.out":            strings.NewReader("3"),
+			"statements/es.markdown": strings.NewReader("Sumas"),
+		},
+		"Initial commit",
+		log,
+	)
+	push(
+		t,
+		tmpDir,
+		adminAuthorization,
+		problemAlias,
+		"refs/heads/master",
+		&git.Oid{}, newOid,
+		packContents,
+		[]githttp.PktLineResponse{
+			{Line: "unpack ok\n", Err: nil},
+			{Line: "ok refs/heads/master\n", Err: nil},
+		},
+		ts,
+	)
+
+	// The policy of the problem forbids direct pushes to master.
+	oldConfigOid := getReference(t, problemAlias, "refs/meta/config", ts)
+	configOid, configPackContents := createCommit(
+		t,
+		tmpDir,
+		problemAlias,
+		oldConfigOid,
+		map[string]io.Reader{
+			"config.json": strings.NewReader(`{"policy":{"allowDirectPushToMaster":false}}`),
+		},
+		"Update config",
+		log,
+	)
+	push(
+		t,
+		tmpDir,
+		adminAuthorization,
+		problemAlias,
+		"refs/meta/config",
+		oldConfigOid, configOid,
+		configPackContents,
+		[]githttp.PktLineResponse{
+			{Line: "unpack ok\n", Err: nil},
+			{Line: "ok refs/meta/config\n", Err: nil},
+		},
+		ts,
+	)
+
+	// The system push is not subject to the policy.
+	{
+		staleOid := commitMasterFiles(t, repositoryPath, map[string]string{
+			"settings.distrib.json": "{}",
+		})
+		if err := WriteRepositoryVersion(repositoryPath, CurrentRepositoryVersion-1); err != nil {
+			t.Fatalf("Failed to write the version file: %v", err)
+		}
+
+		result, err := MigrateRepository(context.Background(), repositoryPath, protocol, fakeInteractiveSettingsCompiler, false, log)
+		if err != nil {
+			t.Fatalf("Failed to migrate repository: %v", err)
+		}
+		if result.ToVersion != CurrentRepositoryVersion || len(result.Issues) != 0 {
+			t.Errorf("Unexpected result %v", result)
+		}
+
+		repo, err := git.OpenRepository(repositoryPath)
+		if err != nil {
+			t.Fatalf("Failed to open repository: %v", err)
+		}
+		defer repo.Free()
+		masterCommit, err := repo.LookupCommit(getReference(t, problemAlias, "refs/heads/master", ts))
+		if err != nil {
+			t.Fatalf("Failed to lookup the master commit: %v", err)
+		}
+		defer masterCommit.Free()
+		if !masterCommit.ParentId(0).Equal(staleOid) {
+			t.Errorf("Expected master's parent to be %s, got %s", staleOid, masterCommit.ParentId(0))
+		}
+	}
+
+	// A master that no longer passes validation is reported and left as it
+	// is, and the migration is not attempted again.
+	{
+		invalidOid := commitMasterFiles(t, repositoryPath, map[string]string{
+			"settings.distrib.json": "{}",
+			"cases/1.in":            "2 3",
+			"cases/1.out":           "5",
+		})
+		if err := WriteRepositoryVersion(repositoryPath, CurrentRepositoryVersion-1); err != nil {
+			t.Fatalf("Failed to write the version file: %v", err)
+		}
+
+		result, err := MigrateRepository(context.Background(), repositoryPath, protocol, fakeInteractiveSettingsCompiler, false, log)
+		if err != nil {
+			t.Fatalf("Failed to migrate repository: %v", err)
+		}
+		if result.ToVersion != CurrentRepositoryVersion || len(result.Issues) != 1 {
+			t.Errorf("Unexpected result %v", result)
+		}
+		if masterOid := getReference(t, problemAlias, "refs/heads/master", ts); !masterOid.Equal(invalidOid) {
+			t.Errorf("Expected master to be left at %s, got %s", invalidOid, masterOid)
+		}
+
+		result, err = MigrateRepository(context.Background(), repositoryPath, protocol, fakeInteractiveSettingsCompiler, false, log)
+		if err != nil {
+			t.Fatalf("Failed to migrate repository: %v", err)
+		}
+		if len(result.Migrations) != 0 {
+			t.Errorf("Expected no migrations, got %v", result.Migrations)
+		}
+	}
+}
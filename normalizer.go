@@ -4,8 +4,11 @@ import (
 	"bufio"
 	"bytes"
 	"io"
+	"io/ioutil"
+	"strings"
 	"unicode/utf8"
 
+	base "github.com/omegaup/go-base"
 	"github.com/pkg/errors"
 	"github.com/saintfish/chardet"
 	"golang.org/x/text/encoding/htmlindex"
@@ -78,24 +81,32 @@ func removeBOM(r io.Reader) (io.Reader, bool, error) {
 // ConvertMarkdownToUTF8 performs a best-effort detection of the encoding of
 // the supplied reader and returns a Reader that is UTF-8 encoded.
 func ConvertMarkdownToUTF8(r io.Reader) (io.Reader, error) {
+	utfReader, _, err := convertMarkdownToUTF8(r)
+	return utfReader, err
+}
+
+// convertMarkdownToUTF8 is the same as ConvertMarkdownToUTF8, but it also
+// returns the name of the encoding that had to be guessed, or an empty string
+// if the contents had a byte order mark or were already UTF-8 encoded.
+func convertMarkdownToUTF8(r io.Reader) (io.Reader, string, error) {
 	br, removed, err := removeBOM(r)
 	if err != nil {
 		// removeBOM already wrapped the error correctly.
-		return nil, err
+		return nil, "", err
 	}
 	if removed {
-		return NewLineEndingNormalizer(br), nil
+		return NewLineEndingNormalizer(br), "", nil
 	}
 
 	var buf bytes.Buffer
 	if _, err := io.Copy(&buf, br); err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	bytesReader := bytes.NewReader(buf.Bytes())
 
 	// Is it already valid UTF-8?
 	if utf8.Valid(buf.Bytes()) {
-		return NewLineEndingNormalizer(bytesReader), nil
+		return NewLineEndingNormalizer(bytesReader), "", nil
 	}
 
 	// There was no BOM and it wasn't valid UTF-8, so we'll need to detect the
@@ -106,11 +117,11 @@ func ConvertMarkdownToUTF8(r io.Reader) (io.Reader, error) {
 		if err == nil {
 			return NewLineEndingNormalizer(
 				transform.NewReader(bytesReader, unicode.BOMOverride(enc.NewDecoder())),
-			), nil
+			), result.Charset, nil
 		}
 	}
 
-	return NewLineEndingNormalizer(bytesReader), nil
+	return NewLineEndingNormalizer(bytesReader), "", nil
 }
 
 // NormalizeCase performs a best-effort conversion to UTF-8 and normalizes the
@@ -124,6 +135,71 @@ func NormalizeCase(r io.Reader) (io.Reader, error) {
 	return NewLineEndingNormalizer(br), nil
 }
 
+// needsNormalization returns whether the file at the provided path needs to
+// be passed through the normalizer before being committed.
+func needsNormalization(filename string) bool {
+	if strings.HasPrefix(filename, "examples/") ||
+		strings.HasPrefix(filename, "interactive/examples/") ||
+		strings.HasPrefix(filename, "cases/") {
+		return true
+	}
+	return (strings.HasPrefix(filename, "statements/") || strings.HasPrefix(filename, "solutions/")) &&
+		(strings.HasSuffix(filename, ".markdown") || strings.HasSuffix(filename, ".md"))
+}
+
+// normalizeFile returns a Reader with the normalized contents of the file at
+// the provided path: cases and examples have their line endings normalized,
+// and statements and solutions are converted to UTF-8. Files that do not need
+// normalization are returned as-is. It also returns the name of the encoding
+// of the file if it had to be guessed.
+func normalizeFile(filename string, r io.Reader) (io.Reader, string, error) {
+	if !needsNormalization(filename) {
+		return r, "", nil
+	}
+	if strings.HasPrefix(filename, "statements/") || strings.HasPrefix(filename, "solutions/") {
+		utfReader, encoding, err := convertMarkdownToUTF8(r)
+		if err != nil {
+			return nil, "", base.ErrorWithCategory(
+				ErrInvalidMarkup,
+				errors.Wrapf(
+					err,
+					"failed to convert %s to UTF-8",
+					filename,
+				),
+			)
+		}
+		return utfReader, encoding, nil
+	}
+	normalizedReader, err := NormalizeCase(r)
+	if err != nil {
+		// removeBOM already wrapped the error correctly.
+		return nil, "", err
+	}
+	return normalizedReader, "", nil
+}
+
+// normalizeContents is a convenience wrapper around normalizeFile for
+// contents that are already in memory.
+func normalizeContents(filename string, contents []byte) ([]byte, error) {
+	if !needsNormalization(filename) {
+		return contents, nil
+	}
+	r, _, err := normalizeFile(filename, bytes.NewReader(contents))
+	if err != nil {
+		// normalizeFile already wrapped the error correctly.
+		return nil, err
+	}
+	normalized, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(
+			err,
+			"failed to normalize %s",
+			filename,
+		)
+	}
+	return normalized, nil
+}
+
 // LineEndingNormalizer is an io.Reader that trims trailing whitespace and converts line endings to \n.
 type LineEndingNormalizer struct {
 	buf             bytes.Buffer
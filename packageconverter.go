@@ -0,0 +1,262 @@
+package gitserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/inconshreveable/log15"
+	base "github.com/omegaup/go-base"
+	"github.com/omegaup/quark/common"
+	"github.com/pkg/errors"
+)
+
+// packageConverter keeps track of the files of a problem package in another
+// format that have been converted into the omegaUp layout.
+type packageConverter struct {
+	ctx context.Context
+
+	// invalidPackage is the category of the errors for packages that cannot
+	// be converted.
+	invalidPackage error
+
+	files    map[string]*zip.File
+	used     map[string]bool
+	contents map[string][]byte
+}
+
+// packageRoot returns the directory of the .zip file that contains the
+// descriptor file of a problem package, if there is one. Only a descriptor at
+// the root of the upload counts, so every file must be inside its directory,
+// and descriptors that are next to the settings.json or the cases/ of an
+// omegaUp problem are ignored.
+func packageRoot(zipReader *zip.Reader, descriptor string) (string, bool) {
+	root := ""
+	rootDepth := -1
+	for _, file := range zipReader.File {
+		zipfilePath := path.Clean(file.Name)
+		if path.Base(zipfilePath) != descriptor {
+			continue
+		}
+		dir := path.Dir(zipfilePath)
+		depth := 0
+		if dir != "." {
+			depth = strings.Count(dir, "/") + 1
+		}
+		if rootDepth == -1 || depth < rootDepth {
+			root = dir
+			rootDepth = depth
+		}
+	}
+	if rootDepth == -1 {
+		return "", false
+	}
+	if root == "." {
+		root = ""
+	}
+
+	for _, file := range zipReader.File {
+		zipfilePath := path.Clean(file.Name)
+		if root != "" && zipfilePath != root && !strings.HasPrefix(zipfilePath, root+"/") {
+			return "", false
+		}
+		relativePath := strings.TrimPrefix(strings.TrimPrefix(zipfilePath, root), "/")
+		if relativePath == "settings.json" || relativePath == "cases" || strings.HasPrefix(relativePath, "cases/") {
+			return "", false
+		}
+	}
+	return root, true
+}
+
+// newPackageConverter returns a packageConverter for the package that is
+// rooted at the directory of its descriptor file.
+func newPackageConverter(
+	ctx context.Context,
+	zipReader *zip.Reader,
+	descriptor string,
+	invalidPackage error,
+) (*packageConverter, error) {
+	root, ok := packageRoot(zipReader, descriptor)
+	if !ok {
+		return nil, base.ErrorWithCategory(
+			invalidPackage,
+			errors.Errorf(
+				"%s is missing",
+				descriptor,
+			),
+		)
+	}
+
+	c := &packageConverter{
+		ctx:            ctx,
+		invalidPackage: invalidPackage,
+		files:          make(map[string]*zip.File),
+		used:           make(map[string]bool),
+		contents:       make(map[string][]byte),
+	}
+	for _, file := range zipReader.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		zipfilePath := path.Clean(file.Name)
+		if root != "" {
+			if !strings.HasPrefix(zipfilePath, root+"/") {
+				continue
+			}
+			zipfilePath = strings.TrimPrefix(zipfilePath, root+"/")
+		}
+		c.files[zipfilePath] = file
+	}
+	return c, nil
+}
+
+func (c *packageConverter) sortedFiles() []string {
+	filenames := make([]string, 0, len(c.files))
+	for filename := range c.files {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	return filenames
+}
+
+// readOptional returns the contents of a file of the package, or nil if it
+// does not exist.
+func (c *packageConverter) readOptional(filename string) ([]byte, error) {
+	file, ok := c.files[path.Clean(filename)]
+	if !ok {
+		return nil, nil
+	}
+	c.used[path.Clean(filename)] = true
+	f, err := file.Open()
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInvalidZipFilename,
+			errors.Wrapf(
+				err,
+				"failed to open file %s",
+				filename,
+			),
+		)
+	}
+	defer f.Close()
+	contents, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInvalidZipFilename,
+			errors.Wrapf(
+				err,
+				"failed to read file %s",
+				filename,
+			),
+		)
+	}
+	return contents, nil
+}
+
+// read returns the contents of a file of the package, which must exist.
+func (c *packageConverter) read(filename string) ([]byte, error) {
+	if _, ok := c.files[path.Clean(filename)]; !ok {
+		return nil, base.ErrorWithCategory(
+			c.invalidPackage,
+			errors.Errorf(
+				"%s is missing",
+				filename,
+			),
+		)
+	}
+	return c.readOptional(filename)
+}
+
+// finish adds the settings to the converted files, drops all the files of
+// the package that were not converted with a warning, and writes the
+// converted files into an uncompressed .zip file.
+func (c *packageConverter) finish(
+	settings *common.ProblemSettings,
+	log log15.Logger,
+) (*zip.Reader, error) {
+	settingsJSON, err := json.MarshalIndent(settings, "", "\t")
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternal,
+			errors.Wrap(
+				err,
+				"failed to marshal settings.json",
+			),
+		)
+	}
+	c.contents["settings.json"] = settingsJSON
+
+	for _, filename := range c.sortedFiles() {
+		if c.used[filename] {
+			continue
+		}
+		log.Info("Skipping package file", "path", filename)
+		addWarning(
+			c.ctx,
+			WarningSkippedFile,
+			filename,
+			"the file has no equivalent in omegaUp problems and was dropped",
+		)
+	}
+
+	filenames := make([]string, 0, len(c.contents))
+	for filename := range c.contents {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	for _, filename := range filenames {
+		w, err := zipWriter.CreateHeader(&zip.FileHeader{
+			Name:   filename,
+			Method: zip.Store,
+		})
+		if err != nil {
+			return nil, base.ErrorWithCategory(
+				ErrInternal,
+				errors.Wrapf(
+					err,
+					"failed to add %s to the converted .zip",
+					filename,
+				),
+			)
+		}
+		if _, err := w.Write(c.contents[filename]); err != nil {
+			return nil, base.ErrorWithCategory(
+				ErrInternal,
+				errors.Wrapf(
+					err,
+					"failed to write %s to the converted .zip",
+					filename,
+				),
+			)
+		}
+	}
+	if err := zipWriter.Close(); err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternal,
+			errors.Wrap(
+				err,
+				"failed to write the converted .zip",
+			),
+		)
+	}
+
+	zipReader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternal,
+			errors.Wrap(
+				err,
+				"failed to read the converted .zip",
+			),
+		)
+	}
+	return zipReader, nil
+}
@@ -0,0 +1,532 @@
+package gitserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	base "github.com/omegaup/go-base"
+	"github.com/omegaup/quark/common"
+	"github.com/pkg/errors"
+)
+
+var (
+	// polygonStatementLanguages maps the languages of the Polygon statements
+	// to the ones that omegaUp supports.
+	polygonStatementLanguages = map[string]polygonStatementLanguage{
+		"spanish":    {code: "es", input: "Entrada", output: "Salida", example: "Ejemplo", notes: "Notas"},
+		"english":    {code: "en", input: "Input", output: "Output", example: "Example", notes: "Notes"},
+		"portuguese": {code: "pt", input: "Entrada", output: "Saída", example: "Exemplo", notes: "Notas"},
+	}
+
+	// polygonSolutionVerdicts maps the tags of the Polygon solutions to the
+	// verdict they are expected to get. Tags that allow more than one verdict
+	// have no equivalent in tests/tests.json.
+	polygonSolutionVerdicts = map[string]string{
+		"main":                  "AC",
+		"accepted":              "AC",
+		"wrong-answer":          "WA",
+		"time-limit-exceeded":   "TLE",
+		"memory-limit-exceeded": "MLE",
+	}
+
+	// polygonStandardCheckers maps the standard testlib checkers of Polygon to
+	// the omegaUp validators that compare the outputs in the same way.
+	// Checkers that are not listed here are used as custom validators.
+	polygonStandardCheckers = map[string]polygonStandardChecker{
+		"std::fcmp.cpp":   {name: "token"},
+		"std::hcmp.cpp":   {name: "token"},
+		"std::lcmp.cpp":   {name: "token"},
+		"std::ncmp.cpp":   {name: "token"},
+		"std::wcmp.cpp":   {name: "token"},
+		"std::nyesno.cpp": {name: "token-caseless"},
+		"std::yesno.cpp":  {name: "token-caseless"},
+		"std::rcmp.cpp":   {name: "token-numeric", tolerance: 1.5e-6},
+		"std::rcmp4.cpp":  {name: "token-numeric", tolerance: 1e-4},
+		"std::rcmp6.cpp":  {name: "token-numeric", tolerance: 1e-6},
+		"std::rcmp9.cpp":  {name: "token-numeric", tolerance: 1e-9},
+	}
+
+	polygonImageRegexp         = regexp.MustCompile("\\.(gif|jpe?g|png)$")
+	polygonValidatorLangRegexp = regexp.MustCompile("^[a-z0-9]+$")
+)
+
+type polygonStatementLanguage struct {
+	code, input, output, example, notes string
+}
+
+type polygonStandardChecker struct {
+	name      string
+	tolerance float64
+}
+
+type polygonSource struct {
+	Path string `xml:"path,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type polygonStatement struct {
+	Language string `xml:"language,attr"`
+	Path     string `xml:"path,attr"`
+	Type     string `xml:"type,attr"`
+}
+
+type polygonTest struct {
+	Sample bool   `xml:"sample,attr"`
+	Points string `xml:"points,attr"`
+	Group  string `xml:"group,attr"`
+}
+
+type polygonGroup struct {
+	Name         string `xml:"name,attr"`
+	Points       string `xml:"points,attr"`
+	PointsPolicy string `xml:"points-policy,attr"`
+}
+
+type polygonTestset struct {
+	Name              string         `xml:"name,attr"`
+	TimeLimit         int64          `xml:"time-limit"`
+	MemoryLimit       int64          `xml:"memory-limit"`
+	InputPathPattern  string         `xml:"input-path-pattern"`
+	AnswerPathPattern string         `xml:"answer-path-pattern"`
+	Tests             []polygonTest  `xml:"tests>test"`
+	Groups            []polygonGroup `xml:"groups>group"`
+}
+
+type polygonJudging struct {
+	InputFile  string           `xml:"input-file,attr"`
+	OutputFile string           `xml:"output-file,attr"`
+	Testsets   []polygonTestset `xml:"testset"`
+}
+
+type polygonChecker struct {
+	Name   string        `xml:"name,attr"`
+	Source polygonSource `xml:"source"`
+}
+
+type polygonSolution struct {
+	Tag    string        `xml:"tag,attr"`
+	Source polygonSource `xml:"source"`
+}
+
+// polygonProblem is the subset of the problem.xml descriptor of a Polygon
+// package that can be converted into an omegaUp problem.
+type polygonProblem struct {
+	XMLName    xml.Name           `xml:"problem"`
+	Statements []polygonStatement `xml:"statements>statement"`
+	Judging    polygonJudging     `xml:"judging"`
+	Checker    *polygonChecker    `xml:"assets>checker"`
+	Interactor *polygonSource     `xml:"assets>interactor>source"`
+	Solutions  []polygonSolution  `xml:"assets>solutions>solution"`
+}
+
+type polygonSample struct {
+	input, output []byte
+}
+
+// polygonConverter converts a Polygon package into the omegaUp layout.
+type polygonConverter struct {
+	*packageConverter
+}
+
+// IsPolygonPackage returns whether the .zip file is a Polygon problem package.
+func IsPolygonPackage(zipReader *zip.Reader) bool {
+	_, ok := packageRoot(zipReader, "problem.xml")
+	return ok
+}
+
+// ConvertPolygonPackage converts a Polygon problem package into a .zip file
+// with the omegaUp problem layout. The tests of the main testset become the
+// cases along with a testplan with their points, the checker becomes the
+// equivalent omegaUp validator or the custom validator, the tagged solutions
+// are added to tests/tests.json, and the limits are written to settings.json.
+// The files that have no equivalent in omegaUp are dropped with a warning.
+// Interactive problems are rejected.
+func ConvertPolygonPackage(
+	ctx context.Context,
+	zipReader *zip.Reader,
+	log log15.Logger,
+) (*zip.Reader, error) {
+	pc, err := newPackageConverter(ctx, zipReader, "problem.xml", ErrInvalidPolygonPackage)
+	if err != nil {
+		// newPackageConverter already wrapped the error correctly.
+		return nil, err
+	}
+	c := &polygonConverter{pc}
+
+	problemXML, err := c.read("problem.xml")
+	if err != nil {
+		// read already wrapped the error correctly.
+		return nil, err
+	}
+	var problem polygonProblem
+	if err := xml.Unmarshal(problemXML, &problem); err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInvalidPolygonPackage,
+			errors.Wrap(
+				err,
+				"failed to parse problem.xml",
+			),
+		)
+	}
+	if problem.Interactor != nil {
+		// The interactor cannot be converted into an omegaUp interactive
+		// problem, and dropping it would result in a broken problem.
+		return nil, base.ErrorWithCategory(
+			ErrInvalidPolygonPackage,
+			errors.Errorf(
+				"interactive Polygon problems are not supported (interactor %s)",
+				problem.Interactor.Path,
+			),
+		)
+	}
+	if problem.Judging.InputFile != "" || problem.Judging.OutputFile != "" {
+		addWarning(
+			ctx,
+			WarningConvertedFile,
+			"problem.xml",
+			"the problem uses files for its input and output, but omegaUp problems use the standard input and output",
+		)
+	}
+
+	settings := &common.ProblemSettings{
+		Limits: common.DefaultLimits,
+		Validator: common.ValidatorSettings{
+			Name: "token",
+		},
+	}
+	samples, err := c.convertTests(&problem, settings)
+	if err != nil {
+		// convertTests already wrapped the error correctly.
+		return nil, err
+	}
+	if err := c.convertStatements(&problem, samples); err != nil {
+		// convertStatements already wrapped the error correctly.
+		return nil, err
+	}
+	if err := c.convertChecker(&problem, settings); err != nil {
+		// convertChecker already wrapped the error correctly.
+		return nil, err
+	}
+	if err := c.convertSolutions(&problem); err != nil {
+		// convertSolutions already wrapped the error correctly.
+		return nil, err
+	}
+
+	return c.finish(settings, log)
+}
+
+// convertTests adds the tests of the main testset as cases, along with a
+// testplan with their points, and sets the limits. Tests in groups that are
+// scored as a whole are put in an omegaUp group, and the points of the group
+// are assigned to its first case. It returns the sample tests.
+func (c *polygonConverter) convertTests(
+	problem *polygonProblem,
+	settings *common.ProblemSettings,
+) ([]polygonSample, error) {
+	if len(problem.Judging.Testsets) == 0 {
+		return nil, base.ErrorWithCategory(
+			ErrInvalidPolygonPackage,
+			errors.New("problem.xml does not have any testsets"),
+		)
+	}
+	testset := &problem.Judging.Testsets[0]
+	for i := range problem.Judging.Testsets {
+		if problem.Judging.Testsets[i].Name == "tests" {
+			testset = &problem.Judging.Testsets[i]
+			break
+		}
+	}
+	if len(testset.Tests) == 0 {
+		return nil, base.ErrorWithCategory(
+			ErrInvalidPolygonPackage,
+			errors.Errorf(
+				"testset %s does not have any tests",
+				testset.Name,
+			),
+		)
+	}
+
+	if testset.TimeLimit > 0 {
+		settings.Limits.TimeLimit = base.Duration(time.Duration(testset.TimeLimit) * time.Millisecond)
+	}
+	if testset.MemoryLimit > 0 {
+		settings.Limits.MemoryLimit = base.Byte(testset.MemoryLimit)
+	}
+
+	scored := false
+	groups := make(map[string]polygonGroup)
+	for _, group := range testset.Groups {
+		groups[group.Name] = group
+		if group.Points != "" {
+			scored = true
+		}
+	}
+	for _, test := range testset.Tests {
+		if test.Points != "" {
+			scored = true
+		}
+	}
+
+	width := len(strconv.Itoa(len(testset.Tests)))
+	if width < 2 {
+		width = 2
+	}
+	var samples []polygonSample
+	var testplan bytes.Buffer
+	weightedGroups := make(map[string]bool)
+	for i, test := range testset.Tests {
+		input, err := c.read(fmt.Sprintf(testset.InputPathPattern, i+1))
+		if err != nil {
+			// read already wrapped the error correctly.
+			return nil, err
+		}
+		answer, err := c.read(fmt.Sprintf(testset.AnswerPathPattern, i+1))
+		if err != nil {
+			// read already wrapped the error correctly.
+			return nil, err
+		}
+
+		caseName := fmt.Sprintf("%0*d", width, i+1)
+		weight := "1"
+		if scored {
+			weight = test.Points
+			if weight == "" {
+				weight = "0"
+			}
+		}
+		if group := groups[test.Group]; test.Group != "" && group.PointsPolicy != "each-test" {
+			caseName = fmt.Sprintf("%s.%s", strings.ReplaceAll(test.Group, ".", "_"), caseName)
+			if group.Points != "" {
+				if weightedGroups[test.Group] {
+					weight = "0"
+				} else {
+					weight = group.Points
+				}
+				weightedGroups[test.Group] = true
+			}
+		}
+		if _, err := base.ParseRational(weight); err != nil {
+			return nil, base.ErrorWithCategory(
+				ErrInvalidPolygonPackage,
+				errors.Wrapf(
+					err,
+					"invalid points for test %d",
+					i+1,
+				),
+			)
+		}
+
+		c.contents[fmt.Sprintf("cases/%s.in", caseName)] = input
+		c.contents[fmt.Sprintf("cases/%s.out", caseName)] = answer
+		fmt.Fprintf(&testplan, "%s %s\n", caseName, weight)
+		if test.Sample {
+			samples = append(samples, polygonSample{input: input, output: answer})
+		}
+	}
+	c.contents["testplan"] = testplan.Bytes()
+
+	return samples, nil
+}
+
+// convertStatements assembles a Markdown statement for each of the supported
+// languages out of the sections of the TeX statement, and adds the sample
+// tests as the examples. The TeX markup is kept as-is.
+func (c *polygonConverter) convertStatements(
+	problem *polygonProblem,
+	samples []polygonSample,
+) error {
+	for _, statement := range problem.Statements {
+		if statement.Type != "application/x-tex" {
+			continue
+		}
+		language, ok := polygonStatementLanguages[statement.Language]
+		if !ok {
+			continue
+		}
+		statementPath := fmt.Sprintf("statements/%s.markdown", language.code)
+		if _, ok := c.contents[statementPath]; ok {
+			continue
+		}
+
+		sectionsPath := path.Dir(statement.Path)
+		legend, err := c.readOptional(path.Join(sectionsPath, "legend.tex"))
+		if err != nil {
+			// readOptional already wrapped the error correctly.
+			return err
+		}
+		if legend == nil {
+			continue
+		}
+		c.used[path.Clean(statement.Path)] = true
+
+		var buf bytes.Buffer
+		buf.Write(bytes.TrimSpace(legend))
+		buf.WriteString("\n")
+		for _, section := range []struct {
+			filename, heading string
+		}{
+			{"input.tex", language.input},
+			{"output.tex", language.output},
+		} {
+			contents, err := c.readOptional(path.Join(sectionsPath, section.filename))
+			if err != nil {
+				// readOptional already wrapped the error correctly.
+				return err
+			}
+			if contents == nil {
+				continue
+			}
+			fmt.Fprintf(&buf, "\n# %s\n\n%s\n", section.heading, bytes.TrimSpace(contents))
+		}
+		if len(samples) != 0 {
+			fmt.Fprintf(&buf, "\n# %s\n\n", language.example)
+			for _, sample := range samples {
+				fmt.Fprintf(
+					&buf,
+					"||input\n%s\n||output\n%s\n",
+					bytes.TrimRight(sample.input, "\n"),
+					bytes.TrimRight(sample.output, "\n"),
+				)
+			}
+			buf.WriteString("||end\n")
+		}
+		notes, err := c.readOptional(path.Join(sectionsPath, "notes.tex"))
+		if err != nil {
+			// readOptional already wrapped the error correctly.
+			return err
+		}
+		if notes != nil {
+			fmt.Fprintf(&buf, "\n# %s\n\n%s\n", language.notes, bytes.TrimSpace(notes))
+		}
+
+		c.contents[statementPath] = buf.Bytes()
+		addWarning(
+			c.ctx,
+			WarningConvertedFile,
+			statementPath,
+			"the statement was assembled from the sections of the Polygon statement and its TeX markup was kept as-is",
+		)
+
+		for _, filename := range c.sortedFiles() {
+			if path.Dir(filename) != sectionsPath || !polygonImageRegexp.MatchString(filename) {
+				continue
+			}
+			imagePath := path.Join("statements", path.Base(filename))
+			if _, ok := c.contents[imagePath]; ok {
+				continue
+			}
+			contents, err := c.read(filename)
+			if err != nil {
+				// read already wrapped the error correctly.
+				return err
+			}
+			c.contents[imagePath] = contents
+		}
+	}
+
+	return nil
+}
+
+// convertChecker uses the omegaUp validator that is equivalent to the
+// checker if it is one of the standard testlib checkers, and adds it as the
+// custom validator otherwise.
+func (c *polygonConverter) convertChecker(
+	problem *polygonProblem,
+	settings *common.ProblemSettings,
+) error {
+	if problem.Checker == nil {
+		return nil
+	}
+	if standardChecker, ok := polygonStandardCheckers[problem.Checker.Name]; ok {
+		settings.Validator.Name = standardChecker.name
+		if standardChecker.tolerance != 0 {
+			tolerance := standardChecker.tolerance
+			settings.Validator.Tolerance = &tolerance
+		}
+		return nil
+	}
+	if problem.Checker.Source.Path == "" {
+		return nil
+	}
+	lang := strings.ToLower(strings.TrimPrefix(path.Ext(problem.Checker.Source.Path), "."))
+	if !polygonValidatorLangRegexp.MatchString(lang) {
+		return base.ErrorWithCategory(
+			ErrInvalidPolygonPackage,
+			errors.Errorf(
+				"unsupported checker %s",
+				problem.Checker.Source.Path,
+			),
+		)
+	}
+	contents, err := c.read(problem.Checker.Source.Path)
+	if err != nil {
+		// read already wrapped the error correctly.
+		return err
+	}
+
+	validatorPath := fmt.Sprintf("validator.%s", lang)
+	c.contents[validatorPath] = contents
+	settings.Validator.Name = "custom"
+	addWarning(
+		c.ctx,
+		WarningConvertedFile,
+		validatorPath,
+		"the Polygon checker is used as the validator and might need to be adapted to the omegaUp validator protocol",
+	)
+	return nil
+}
+
+// convertSolutions adds the solutions whose tags map to a single verdict to
+// tests/tests.json.
+func (c *polygonConverter) convertSolutions(problem *polygonProblem) error {
+	var testsSettings common.TestsSettings
+	for _, solution := range problem.Solutions {
+		verdict, ok := polygonSolutionVerdicts[solution.Tag]
+		if !ok {
+			addWarning(
+				c.ctx,
+				WarningSkippedFile,
+				solution.Source.Path,
+				fmt.Sprintf("solutions tagged %s have no equivalent verdict and were dropped", solution.Tag),
+			)
+			continue
+		}
+		contents, err := c.read(solution.Source.Path)
+		if err != nil {
+			// read already wrapped the error correctly.
+			return err
+		}
+		filename := path.Join("solutions", path.Base(solution.Source.Path))
+		c.contents[path.Join("tests", filename)] = contents
+		testsSettings.Solutions = append(testsSettings.Solutions, common.SolutionSettings{
+			Filename: filename,
+			Verdict:  verdict,
+		})
+	}
+	if len(testsSettings.Solutions) == 0 {
+		return nil
+	}
+
+	testsJSON, err := json.MarshalIndent(&testsSettings, "", "\t")
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrInternal,
+			errors.Wrap(
+				err,
+				"failed to marshal tests/tests.json",
+			),
+		)
+	}
+	c.contents["tests/tests.json"] = testsJSON
+	return nil
+}
@@ -0,0 +1,419 @@
+package gitserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	git "github.com/lhchavez/git2go/v29"
+	"github.com/omegaup/gitserver/gitservertest"
+	"github.com/omegaup/gitserver/request"
+	base "github.com/omegaup/go-base"
+	"github.com/omegaup/quark/common"
+)
+
+const polygonProblemXML = `<?xml version="1.0" encoding="utf-8" standalone="no"?>
+<problem revision="3" short-name="a-plus-b">
+    <names>
+        <name language="english" value="A+B"/>
+    </names>
+    <statements>
+        <statement charset="UTF-8" language="english" mathjax="true" path="statements/english/problem.tex" type="application/x-tex"/>
+        <statement language="english" path="statements/.pdf/english/problem.pdf" type="application/pdf"/>
+    </statements>
+    <judging cpu-name="Intel(R) Core(TM) i3-8100 CPU @ 3.60GHz" cpu-speed="3600" input-file="" output-file="">
+        <testset name="tests">
+            <time-limit>2000</time-limit>
+            <memory-limit>268435456</memory-limit>
+            <test-count>3</test-count>
+            <input-path-pattern>tests/%02d</input-path-pattern>
+            <answer-path-pattern>tests/%02d.a</answer-path-pattern>
+            <tests>
+                <test method="manual" sample="true" points="0" group="samples"/>
+                <test method="manual" points="0" group="1"/>
+                <test method="manual" points="0" group="1"/>
+            </tests>
+            <groups>
+                <group feedback-policy="complete" name="samples" points="0" points-policy="each-test"/>
+                <group feedback-policy="icpc" name="1" points="100" points-policy="complete-group"/>
+            </groups>
+        </testset>
+    </judging>
+    <files>
+        <resources>
+            <file path="files/testlib.h" type="h.g++"/>
+        </resources>
+    </files>
+    <assets>
+        <checker type="testlib">
+            <source path="files/check.cpp" type="cpp.g++17"/>
+        </checker>
+        <solutions>
+            <solution tag="main">
+                <source path="solutions/sol.cpp" type="cpp.g++17"/>
+            </solution>
+            <solution tag="wrong-answer">
+                <source path="solutions/wa.py" type="python.3"/>
+            </solution>
+            <solution tag="rejected">
+                <source path="solutions/bad.cpp" type="cpp.g++17"/>
+            </solution>
+        </solutions>
+    </assets>
+</problem>
+`
+
+func createPolygonZip(t *testing.T) []byte {
+	t.Helper()
+	zipContents, err := gitservertest.CreateZip(
+		wrapReaders(map[string]string{
+			"a-plus-b/problem.xml":                         polygonProblemXML,
+			"a-plus-b/statements/english/problem.tex":      "\\begin{problem}{A+B}\\end{problem}\n",
+			"a-plus-b/statements/english/legend.tex":       "Compute $a+b$.\n",
+			"a-plus-b/statements/english/input.tex":        "Two integers $a$ and $b$.\n",
+			"a-plus-b/statements/english/output.tex":       "Their sum.\n",
+			"a-plus-b/statements/english/sample.png":       "PNG",
+			"a-plus-b/statements/.pdf/english/problem.pdf": "PDF",
+			"a-plus-b/tests/01":                            "1 2\n",
+			"a-plus-b/tests/01.a":                          "3\n",
+			"a-plus-b/tests/02":                            "2 2\n",
+			"a-plus-b/tests/02.a":                          "4\n",
+			"a-plus-b/tests/03":                            "5 7\n",
+			"a-plus-b/tests/03.a":                          "12\n",
+			"a-plus-b/files/testlib.h":                     "// testlib\n",
+			"a-plus-b/files/check.cpp":                     "#include \"testlib.h\"\n",
+			"a-plus-b/solutions/sol.cpp":                   "int main() {}\n",
+			"a-plus-b/solutions/wa.py":                     "print(0)\n",
+			"a-plus-b/solutions/bad.cpp":                   "int main() { return 1; }\n",
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create zip: %v", err)
+	}
+	return zipContents
+}
+
+func TestIsPolygonPackage(t *testing.T) {
+	for _, testCase := range []struct {
+		contents map[string]string
+		polygon  bool
+	}{
+		{map[string]string{"a-plus-b/problem.xml": polygonProblemXML}, true},
+		{map[string]string{"problem.xml": polygonProblemXML, "tests/01": "1 2\n"}, true},
+		{map[string]string{"problem.xml": "", "settings.json": gitservertest.DefaultSettingsJSON}, false},
+		{map[string]string{"settings.json": gitservertest.DefaultSettingsJSON}, false},
+		// Descriptors that are not at the root of the upload are ignored.
+		{map[string]string{"statements/problem.xml": polygonProblemXML, "tests/01": "1 2\n"}, false},
+		{map[string]string{"problem.xml": polygonProblemXML, "cases/0.in": "1 2\n"}, false},
+	} {
+		zipContents, err := gitservertest.CreateZip(wrapReaders(testCase.contents))
+		if err != nil {
+			t.Fatalf("Failed to create zip: %v", err)
+		}
+		zipReader, err := zip.NewReader(bytes.NewReader(zipContents), int64(len(zipContents)))
+		if err != nil {
+			t.Fatalf("Failed to read zip: %v", err)
+		}
+		if polygon := IsPolygonPackage(zipReader); polygon != testCase.polygon {
+			t.Errorf("IsPolygonPackage(%v) = %v, want %v", testCase.contents, polygon, testCase.polygon)
+		}
+	}
+}
+
+func TestConvertPolygonPackage(t *testing.T) {
+	zipContents := createPolygonZip(t)
+	zipReader, err := zip.NewReader(bytes.NewReader(zipContents), int64(len(zipContents)))
+	if err != nil {
+		t.Fatalf("Failed to read zip: %v", err)
+	}
+
+	ctx := request.NewContext(context.Background(), &base.NoOpMetrics{})
+	convertedReader, err := ConvertPolygonPackage(ctx, zipReader, base.StderrLog())
+	if err != nil {
+		t.Fatalf("Failed to convert the Polygon package: %v", err)
+	}
+
+	contents := make(map[string]string)
+	for _, file := range convertedReader.File {
+		f, err := file.Open()
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", file.Name, err)
+		}
+		fileContents, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", file.Name, err)
+		}
+		contents[file.Name] = string(fileContents)
+	}
+
+	for filename, expected := range map[string]string{
+		"cases/01.in":    "1 2\n",
+		"cases/01.out":   "3\n",
+		"cases/1.02.in":  "2 2\n",
+		"cases/1.02.out": "4\n",
+		"cases/1.03.in":  "5 7\n",
+		"cases/1.03.out": "12\n",
+		"testplan":       "01 0\n1.02 100\n1.03 0\n",
+		"statements/en.markdown": "Compute $a+b$.\n" +
+			"\n# Input\n\nTwo integers $a$ and $b$.\n" +
+			"\n# Output\n\nTheir sum.\n" +
+			"\n# Example\n\n||input\n1 2\n||output\n3\n||end\n",
+		"statements/sample.png":   "PNG",
+		"validator.cpp":           "#include \"testlib.h\"\n",
+		"tests/solutions/sol.cpp": "int main() {}\n",
+		"tests/solutions/wa.py":   "print(0)\n",
+	} {
+		if contents[filename] != expected {
+			t.Errorf("Expected %s to be %q, got %q", filename, expected, contents[filename])
+		}
+	}
+	if _, ok := contents["tests/solutions/bad.cpp"]; ok {
+		t.Errorf("Expected the rejected solution to be dropped")
+	}
+
+	var settings common.ProblemSettings
+	if err := json.Unmarshal([]byte(contents["settings.json"]), &settings); err != nil {
+		t.Fatalf("Failed to unmarshal settings.json: %v", err)
+	}
+	if settings.Limits.TimeLimit != base.Duration(2*time.Second) {
+		t.Errorf("Expected a time limit of 2s, got %v", settings.Limits.TimeLimit)
+	}
+	if settings.Limits.MemoryLimit != 256*base.Mebibyte {
+		t.Errorf("Expected a memory limit of 256MiB, got %v", settings.Limits.MemoryLimit)
+	}
+	if settings.Validator.Name != "custom" {
+		t.Errorf("Expected a custom validator, got %q", settings.Validator.Name)
+	}
+
+	var testsSettings common.TestsSettings
+	if err := json.Unmarshal([]byte(contents["tests/tests.json"]), &testsSettings); err != nil {
+		t.Fatalf("Failed to unmarshal tests/tests.json: %v", err)
+	}
+	verdicts := make(map[string]string)
+	for _, solution := range testsSettings.Solutions {
+		verdicts[solution.Filename] = solution.Verdict
+	}
+	expectedVerdicts := map[string]string{
+		"solutions/sol.cpp": "AC",
+		"solutions/wa.py":   "WA",
+	}
+	if !reflect.DeepEqual(expectedVerdicts, verdicts) {
+		t.Errorf("Expected verdicts %v, got %v", expectedVerdicts, verdicts)
+	}
+
+	warnings := make(map[string]string)
+	for _, warning := range request.FromContext(ctx).Warnings {
+		warnings[warning.Path] = warning.Code
+	}
+	expectedWarnings := map[string]string{
+		"statements/en.markdown":              WarningConvertedFile,
+		"validator.cpp":                       WarningConvertedFile,
+		"solutions/bad.cpp":                   WarningSkippedFile,
+		"files/testlib.h":                     WarningSkippedFile,
+		"statements/.pdf/english/problem.pdf": WarningSkippedFile,
+	}
+	if !reflect.DeepEqual(expectedWarnings, warnings) {
+		t.Errorf("Expected warnings %v, got %v", expectedWarnings, request.FromContext(ctx).Warnings)
+	}
+}
+
+func TestConvertPolygonStandardChecker(t *testing.T) {
+	for _, testCase := range []struct {
+		checker   string
+		validator string
+		tolerance float64
+	}{
+		{"std::wcmp.cpp", "token", 0},
+		{"std::ncmp.cpp", "token", 0},
+		{"std::yesno.cpp", "token-caseless", 0},
+		{"std::rcmp6.cpp", "token-numeric", 1e-6},
+		{"std::uncmp.cpp", "custom", 0},
+	} {
+		zipContents, err := gitservertest.CreateZip(
+			wrapReaders(map[string]string{
+				"problem.xml": strings.Replace(
+					polygonProblemXML,
+					`<checker type="testlib">`,
+					fmt.Sprintf(`<checker name="%s" type="testlib">`, testCase.checker),
+					1,
+				),
+				"statements/english/problem.tex": "\\begin{problem}{A+B}\\end{problem}\n",
+				"statements/english/legend.tex":  "Compute $a+b$.\n",
+				"statements/english/input.tex":   "Two integers $a$ and $b$.\n",
+				"statements/english/output.tex":  "Their sum.\n",
+				"tests/01":                       "1 2\n",
+				"tests/01.a":                     "3\n",
+				"tests/02":                       "2 2\n",
+				"tests/02.a":                     "4\n",
+				"tests/03":                       "5 7\n",
+				"tests/03.a":                     "12\n",
+				"files/check.cpp":                "#include \"testlib.h\"\n",
+				"solutions/sol.cpp":              "int main() {}\n",
+				"solutions/wa.py":                "print(0)\n",
+				"solutions/bad.cpp":              "int main() { return 1; }\n",
+			}),
+		)
+		if err != nil {
+			t.Fatalf("Failed to create zip: %v", err)
+		}
+		zipReader, err := zip.NewReader(bytes.NewReader(zipContents), int64(len(zipContents)))
+		if err != nil {
+			t.Fatalf("Failed to read zip: %v", err)
+		}
+
+		ctx := request.NewContext(context.Background(), &base.NoOpMetrics{})
+		convertedReader, err := ConvertPolygonPackage(ctx, zipReader, base.StderrLog())
+		if err != nil {
+			t.Fatalf("Failed to convert the Polygon package with %s: %v", testCase.checker, err)
+		}
+		var settings common.ProblemSettings
+		hasValidator := false
+		for _, file := range convertedReader.File {
+			if strings.HasPrefix(file.Name, "validator.") {
+				hasValidator = true
+			}
+			if file.Name != "settings.json" {
+				continue
+			}
+			f, err := file.Open()
+			if err != nil {
+				t.Fatalf("Failed to open %s: %v", file.Name, err)
+			}
+			err = json.NewDecoder(f).Decode(&settings)
+			f.Close()
+			if err != nil {
+				t.Fatalf("Failed to unmarshal settings.json: %v", err)
+			}
+		}
+
+		if settings.Validator.Name != testCase.validator {
+			t.Errorf("%s: expected the %q validator, got %q", testCase.checker, testCase.validator, settings.Validator.Name)
+		}
+		if hasValidator != (testCase.validator == "custom") {
+			t.Errorf("%s: unexpected custom validator file", testCase.checker)
+		}
+		if testCase.tolerance != 0 &&
+			(settings.Validator.Tolerance == nil || *settings.Validator.Tolerance != testCase.tolerance) {
+			t.Errorf("%s: expected a tolerance of %v, got %v", testCase.checker, testCase.tolerance, settings.Validator.Tolerance)
+		}
+	}
+}
+
+func TestConvertPolygonInteractive(t *testing.T) {
+	zipContents, err := gitservertest.CreateZip(
+		wrapReaders(map[string]string{
+			"problem.xml": strings.Replace(
+				polygonProblemXML,
+				"<assets>",
+				"<assets>\n        <interactor>\n            <source path=\"files/interactor.cpp\" type=\"cpp.g++17\"/>\n        </interactor>",
+				1,
+			),
+			"statements/english/problem.tex": "\\begin{problem}{A+B}\\end{problem}\n",
+			"statements/english/legend.tex":  "Compute $a+b$.\n",
+			"tests/01":                       "1 2\n",
+			"tests/01.a":                     "3\n",
+			"files/check.cpp":                "#include \"testlib.h\"\n",
+			"files/interactor.cpp":           "#include \"testlib.h\"\n",
+			"solutions/sol.cpp":              "int main() {}\n",
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create zip: %v", err)
+	}
+	zipReader, err := zip.NewReader(bytes.NewReader(zipContents), int64(len(zipContents)))
+	if err != nil {
+		t.Fatalf("Failed to read zip: %v", err)
+	}
+
+	ctx := request.NewContext(context.Background(), &base.NoOpMetrics{})
+	_, err = ConvertPolygonPackage(ctx, zipReader, base.StderrLog())
+	if err == nil {
+		t.Fatalf("Expected the interactive Polygon package to be rejected")
+	}
+	if !base.HasErrorCategory(err, ErrInvalidPolygonPackage) {
+		t.Errorf("Expected %v, got %v", ErrInvalidPolygonPackage, err)
+	}
+}
+
+func TestPushPolygonZip(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+
+	log := base.StderrLog()
+	ts := httptest.NewServer(ZipHandler(
+		tmpDir,
+		NewGitProtocol(authorize, nil, true, OverallWallTimeHardLimit, fakeInteractiveSettingsCompiler, log),
+		&base.NoOpMetrics{},
+		log,
+	))
+	defer ts.Close()
+
+	problemAlias := "a-plus-b"
+
+	updateResult := postZip(
+		t,
+		adminAuthorization,
+		problemAlias,
+		nil,
+		ZipMergeStrategyTheirs,
+		createPolygonZip(t),
+		"initial commit",
+		true,  // create
+		false, // useMultipartFormData
+		ts,
+	)
+	if updateResult.Status != "ok" {
+		t.Fatalf("Failed to push the Polygon package: %v", updateResult)
+	}
+
+	repo, err := git.OpenRepository(path.Join(tmpDir, problemAlias))
+	if err != nil {
+		t.Fatalf("Failed to open repository: %v", err)
+	}
+	defer repo.Free()
+	masterRef, err := repo.References.Lookup("refs/heads/master")
+	if err != nil {
+		t.Fatalf("Failed to lookup master: %v", err)
+	}
+	defer masterRef.Free()
+
+	settingsJSON, err := readCommitFile(repo, masterRef.Target(), "settings.json")
+	if err != nil {
+		t.Fatalf("Failed to read settings.json: %v", err)
+	}
+	var settings common.ProblemSettings
+	if err := json.Unmarshal(settingsJSON, &settings); err != nil {
+		t.Fatalf("Failed to unmarshal settings.json: %v", err)
+	}
+	var groups []string
+	for _, group := range settings.Cases {
+		groups = append(groups, group.Name)
+	}
+	if expected := []string{"01", "1"}; !reflect.DeepEqual(expected, groups) {
+		t.Errorf("Expected groups %v, got %v", expected, groups)
+	}
+	if settings.Validator.Name != "custom" || settings.Validator.Lang == nil || *settings.Validator.Lang != "cpp" {
+		t.Errorf("Expected a custom C++ validator, got %v", settings.Validator)
+	}
+	for _, filename := range []string{"validator.cpp", "tests/tests.json", "statements/en.markdown"} {
+		if contents, err := readCommitFile(repo, masterRef.Target(), filename); err != nil || contents == nil {
+			t.Errorf("Expected %s to be in the tree: %v", filename, err)
+		}
+	}
+}
@@ -0,0 +1,1545 @@
+package gitserver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	git "github.com/lhchavez/git2go/v29"
+	"github.com/omegaup/githttp"
+	base "github.com/omegaup/go-base"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// PublishingStatePending means that the published commit has not been
+	// successfully published yet, and will be retried.
+	PublishingStatePending = "pending"
+
+	// PublishingStateOK means that the published commit was successfully
+	// published.
+	PublishingStateOK = "ok"
+
+	// PublishingStateFailed means that all attempts to publish the published
+	// commit failed.
+	PublishingStateFailed = "failed"
+
+	// publishingStatusFilename is the name of the file in the omegaup/
+	// directory of the repository where the publishing status is stored.
+	publishingStatusFilename = "publishing.json"
+
+	publishingQueueSize = 1024
+)
+
+// PublishingStatus is the status of the last publishing job of a problem.
+type PublishingStatus struct {
+	Commit    string    `json:"commit"`
+	State     string    `json:"state"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// PublishingTransport knows how to run git services in remote repositories.
+// ssh:// URLs are reached through SSH, and file:// URLs are reached by
+// running the local git binary if AllowLocal is set.
+type PublishingTransport struct {
+	// Signer is used to authenticate with SSH remotes.
+	Signer ssh.Signer
+
+	// HostKeyCallback is used to verify the host keys of SSH remotes. SSH
+	// remotes cannot be used without one.
+	HostKeyCallback ssh.HostKeyCallback
+
+	// AllowLocal allows file:// remotes. It is only meant for tests, since
+	// pushing to a local repository bypasses all the validations of the
+	// server.
+	AllowLocal bool
+
+	// Timeout is the maximum amount of time to wait for an SSH connection to
+	// be established.
+	Timeout time.Duration
+}
+
+// publishingSession is a git service that is running in a remote repository.
+type publishingSession struct {
+	stdin  io.WriteCloser
+	stdout io.Reader
+	stderr bytes.Buffer
+	wait   func() error
+	close  func()
+}
+
+// Wait closes the session's stdin and waits for the remote git service to
+// finish.
+func (s *publishingSession) Wait() error {
+	s.stdin.Close()
+	if err := s.wait(); err != nil {
+		return errors.Wrapf(err, "remote command failed: %s", strings.TrimSpace(s.stderr.String()))
+	}
+	return nil
+}
+
+// Close releases all the resources associated with the session.
+func (s *publishingSession) Close() {
+	s.stdin.Close()
+	s.close()
+}
+
+func (t *PublishingTransport) connect(
+	ctx context.Context,
+	remote *url.URL,
+	service string,
+) (*publishingSession, error) {
+	switch remote.Scheme {
+	case "file":
+		if !t.AllowLocal {
+			return nil, errors.New("local publishing remotes are not allowed")
+		}
+		return t.connectLocal(ctx, remote, service)
+	case "ssh":
+		return t.connectSSH(ctx, remote, service)
+	default:
+		return nil, errors.Errorf("unsupported publishing scheme %q", remote.Scheme)
+	}
+}
+
+func (t *PublishingTransport) connectLocal(
+	ctx context.Context,
+	remote *url.URL,
+	service string,
+) (*publishingSession, error) {
+	session := &publishingSession{}
+	cmd := exec.CommandContext(ctx, "git", strings.TrimPrefix(service, "git-"), remote.Path)
+	cmd.Stderr = &session.stderr
+	var err error
+	if session.stdin, err = cmd.StdinPipe(); err != nil {
+		return nil, errors.Wrap(err, "failed to create stdin pipe")
+	}
+	if session.stdout, err = cmd.StdoutPipe(); err != nil {
+		return nil, errors.Wrap(err, "failed to create stdout pipe")
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "failed to run %s", service)
+	}
+	waited := false
+	session.wait = func() error {
+		waited = true
+		return cmd.Wait()
+	}
+	session.close = func() {
+		if !waited {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+	}
+	return session, nil
+}
+
+// shellQuote quotes the argument so that the remote shell passes it verbatim
+// to the command. The path of the remote comes from refs/meta/config, so it
+// must not be able to run any other command.
+func shellQuote(argument string) string {
+	return "'" + strings.ReplaceAll(argument, "'", `'\''`) + "'"
+}
+
+func (t *PublishingTransport) connectSSH(
+	ctx context.Context,
+	remote *url.URL,
+	service string,
+) (*publishingSession, error) {
+	if t.Signer == nil {
+		return nil, errors.New("no SSH key configured for publishing")
+	}
+	if t.HostKeyCallback == nil {
+		return nil, errors.New("no known hosts configured for publishing")
+	}
+	timeout := t.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	address := remote.Host
+	if remote.Port() == "" {
+		address = net.JoinHostPort(remote.Hostname(), "22")
+	}
+	conn, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            remote.User.Username(),
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(t.Signer)},
+		HostKeyCallback: t.HostKeyCallback,
+		Timeout:         timeout,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to %s", address)
+	}
+
+	sshSession, err := conn.NewSession()
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to create SSH session")
+	}
+	session := &publishingSession{}
+	sshSession.Stderr = &session.stderr
+	if session.stdin, err = sshSession.StdinPipe(); err != nil {
+		sshSession.Close()
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to create stdin pipe")
+	}
+	if session.stdout, err = sshSession.StdoutPipe(); err != nil {
+		sshSession.Close()
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to create stdout pipe")
+	}
+	if err := sshSession.Start(fmt.Sprintf("%s %s", service, shellQuote(remote.Path))); err != nil {
+		sshSession.Close()
+		conn.Close()
+		return nil, errors.Wrapf(err, "failed to run %s", service)
+	}
+
+	// Closing the connection unblocks any pending reads or writes if the
+	// context is cancelled.
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	session.wait = sshSession.Wait
+	session.close = func() {
+		close(stop)
+		sshSession.Close()
+		conn.Close()
+	}
+	return session, nil
+}
+
+// readReportStatus reads the report-status response of a git-receive-pack
+// invocation, and returns an error if the reference was not updated.
+func readReportStatus(r io.Reader, referenceName string) error {
+	pr := githttp.NewPktLineReader(r)
+	updated := false
+	for {
+		line, err := pr.ReadPktLine()
+		if err == githttp.ErrFlush {
+			break
+		} else if err != nil {
+			return errors.Wrap(err, "failed to read the remote response")
+		}
+		status := strings.TrimSuffix(string(line), "\n")
+		if strings.HasPrefix(status, "unpack ") && status != "unpack ok" {
+			return base.ErrorWithCategory(
+				ErrPublishingRejected,
+				errors.Errorf("remote failed to unpack: %s", strings.TrimPrefix(status, "unpack ")),
+			)
+		}
+		if strings.HasPrefix(status, "ng "+referenceName+" ") {
+			return base.ErrorWithCategory(
+				ErrPublishingRejected,
+				errors.Errorf(
+					"remote rejected %s: %s",
+					referenceName,
+					strings.TrimPrefix(status, "ng "+referenceName+" "),
+				),
+			)
+		}
+		if status == "ok "+referenceName {
+			updated = true
+		}
+	}
+	if !updated {
+		return base.ErrorWithCategory(
+			ErrPublishingRejected,
+			errors.Errorf("remote did not update %s", referenceName),
+		)
+	}
+	return nil
+}
+
+// pushToRemote updates the reference in the remote repository so that it
+// points to newCommitID. If expectedOldOid is not nil, the push fails if the
+// remote reference no longer points to it. insertObjects is responsible for
+// adding all the objects that the remote needs to the packfile.
+func pushToRemote(
+	ctx context.Context,
+	repository *git.Repository,
+	transport *PublishingTransport,
+	remote *url.URL,
+	referenceName string,
+	expectedOldOid *git.Oid,
+	newCommitID *git.Oid,
+	insertObjects func(pb *git.Packbuilder, oldOid *git.Oid) error,
+	log log15.Logger,
+) error {
+	session, err := transport.connect(ctx, remote, "git-receive-pack")
+	if err != nil {
+		return errors.Wrapf(err, "failed to connect to %s", remote.String())
+	}
+	defer session.Close()
+
+	discovery, err := githttp.DiscoverReferences(session.stdout)
+	if err != nil {
+		return errors.Wrap(err, "failed to discover remote references")
+	}
+	var oldOid git.Oid
+	if oid, ok := discovery.References[referenceName]; ok {
+		oldOid = oid
+	}
+	log.Debug("Remote", "discovery", discovery, "ref", referenceName, "old", oldOid.String())
+
+	pw := githttp.NewPktLineWriter(session.stdin)
+	if expectedOldOid != nil && !expectedOldOid.Equal(&oldOid) {
+		pw.Flush()
+		session.Wait()
+		return base.ErrorWithCategory(
+			ErrPublishingRejected,
+			errors.Errorf(
+				"remote %s moved from %s to %s while publishing",
+				referenceName,
+				expectedOldOid,
+				oldOid.String(),
+			),
+		)
+	}
+	if oldOid.Equal(newCommitID) {
+		// The remote is already up to date. A flush tells the remote that there
+		// are no commands.
+		if err := pw.Flush(); err != nil {
+			return errors.Wrap(err, "failed to flush")
+		}
+		return session.Wait()
+	}
+
+	line := fmt.Sprintf(
+		"%s %s %s\x00agent=gohttp atomic ofs-delta report-status\n",
+		oldOid.String(),
+		newCommitID.String(),
+		referenceName,
+	)
+	if err := pw.WritePktLine([]byte(line)); err != nil {
+		return errors.Wrap(err, "failed to send the push command")
+	}
+	if err := pw.Flush(); err != nil {
+		return errors.Wrap(err, "failed to flush")
+	}
+
+	pb, err := repository.NewPackbuilder()
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(
+				err,
+				"failed to create packbuilder",
+			),
+		)
+	}
+	defer pb.Free()
+	if err := insertObjects(pb, &oldOid); err != nil {
+		return err
+	}
+	if err := pb.Write(session.stdin); err != nil {
+		return errors.Wrap(err, "failed to send the packfile")
+	}
+	session.stdin.Close()
+
+	if err := readReportStatus(session.stdout, referenceName); err != nil {
+		session.Wait()
+		return err
+	}
+	return session.Wait()
+}
+
+// openScratchRepository opens a separate instance of the repository whose new
+// objects are kept in memory, so that the commits that are generated for
+// publishing never make it to the original one.
+func openScratchRepository(repository *git.Repository) (*git.Repository, error) {
+	repo, err := git.OpenRepository(repository.Path())
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(
+				err,
+				"failed to open repository",
+			),
+		)
+	}
+
+	odb, err := repo.Odb()
+	if err != nil {
+		repo.Free()
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(
+				err,
+				"failed to open odb",
+			),
+		)
+	}
+	defer odb.Free()
+	if _, err := git.NewMempack(odb); err != nil {
+		repo.Free()
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(
+				err,
+				"failed to create mempack",
+			),
+		)
+	}
+	return repo, nil
+}
+
+// publicTree returns the id of the tree with the files of the commit that
+// belong in the public branch, which is the same as the tree of the public
+// split commit.
+func publicTree(
+	repository *git.Repository,
+	commitDescriptions []githttp.SplitCommitDescription,
+	commit *git.Commit,
+	log log15.Logger,
+) (*git.Oid, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to lookup tree for commit %s",
+				commit.Id(),
+			),
+		)
+	}
+	defer tree.Free()
+
+	treeIDs, err := splitTrees(repository, tree, commitDescriptions, log)
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to split the public tree of commit %s",
+				commit.Id(),
+			),
+		)
+	}
+	for i, description := range commitDescriptions {
+		if description.ReferenceName == "refs/heads/public" {
+			return treeIDs[i], nil
+		}
+	}
+
+	// Without a public branch, nothing is public.
+	emptyTree, err := githttp.SplitTree(tree, repository, nil, repository, log)
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(
+				err,
+				"failed to create an empty tree",
+			),
+		)
+	}
+	defer emptyTree.Free()
+	return emptyTree.Id(), nil
+}
+
+// publicHistory creates one commit for each commit in the history of master
+// up to commitID, with only the files that belong in the public branch, and
+// returns the last one. The commits only depend on the commits in master, so
+// publishing the same history twice produces the same commits.
+func publicHistory(
+	repository *git.Repository,
+	commitDescriptions []githttp.SplitCommitDescription,
+	commitID *git.Oid,
+	log log15.Logger,
+) (*git.Oid, error) {
+	commit, err := repository.LookupCommit(commitID)
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to lookup commit %s",
+				commitID,
+			),
+		)
+	}
+
+	// Each commit in master has the commits of the split branches as its last
+	// parents, and the previous commit in master as its first one.
+	var commits []*git.Commit
+	for commit != nil {
+		commits = append(commits, commit)
+		if commit.ParentCount() <= uint(len(commitDescriptions)) {
+			break
+		}
+		commit = commit.Parent(0)
+	}
+	defer func() {
+		for _, commit := range commits {
+			commit.Free()
+		}
+	}()
+
+	var parentCommits []*git.Commit
+	var publicCommitID *git.Oid
+	for i := len(commits) - 1; i >= 0; i-- {
+		treeID, err := publicTree(repository, commitDescriptions, commits[i], log)
+		if err != nil {
+			return nil, err
+		}
+		tree, err := repository.LookupTree(treeID)
+		if err != nil {
+			return nil, base.ErrorWithCategory(
+				ErrInternalGit,
+				errors.Wrapf(
+					err,
+					"failed to lookup tree %s",
+					treeID,
+				),
+			)
+		}
+		publicCommitID, err = repository.CreateCommit(
+			"",
+			commits[i].Author(),
+			commits[i].Committer(),
+			commits[i].Message(),
+			tree,
+			parentCommits...,
+		)
+		tree.Free()
+		for _, parentCommit := range parentCommits {
+			parentCommit.Free()
+		}
+		parentCommits = nil
+		if err != nil {
+			return nil, base.ErrorWithCategory(
+				ErrInternalGit,
+				errors.Wrap(
+					err,
+					"failed to create commit",
+				),
+			)
+		}
+		parentCommit, err := repository.LookupCommit(publicCommitID)
+		if err != nil {
+			return nil, base.ErrorWithCategory(
+				ErrInternalGit,
+				errors.Wrapf(
+					err,
+					"failed to lookup commit %s",
+					publicCommitID,
+				),
+			)
+		}
+		parentCommits = append(parentCommits, parentCommit)
+	}
+	for _, parentCommit := range parentCommits {
+		parentCommit.Free()
+	}
+	return publicCommitID, nil
+}
+
+// PublishMirror force-pushes the history of the commit to the branch of the
+// remote repository. Only the files that belong in the public branch are
+// published, so every commit is rewritten to contain just those.
+func PublishMirror(
+	ctx context.Context,
+	repository *git.Repository,
+	transport *PublishingTransport,
+	remote *url.URL,
+	branch string,
+	commitID *git.Oid,
+	log log15.Logger,
+) error {
+	repo, err := openScratchRepository(repository)
+	if err != nil {
+		// openScratchRepository already wrapped the error correctly.
+		return err
+	}
+	defer repo.Free()
+
+	commitDescriptions, err := GetCommitDescriptions(repo)
+	if err != nil {
+		// GetCommitDescriptions already wrapped the error correctly.
+		return err
+	}
+	publicCommitID, err := publicHistory(repo, commitDescriptions, commitID, log)
+	if err != nil {
+		// publicHistory already wrapped the error correctly.
+		return err
+	}
+
+	return pushToRemote(
+		ctx,
+		repo,
+		transport,
+		remote,
+		fmt.Sprintf("refs/heads/%s", branch),
+		nil,
+		publicCommitID,
+		func(pb *git.Packbuilder, oldOid *git.Oid) error {
+			walk, err := repo.Walk()
+			if err != nil {
+				return base.ErrorWithCategory(
+					ErrInternalGit,
+					errors.Wrap(
+						err,
+						"failed to create revwalk",
+					),
+				)
+			}
+			defer walk.Free()
+
+			if err := walk.Push(publicCommitID); err != nil {
+				return base.ErrorWithCategory(
+					ErrInternalGit,
+					errors.Wrapf(
+						err,
+						"failed to add commit %s",
+						publicCommitID,
+					),
+				)
+			}
+			// If the remote commit is known, there is no need to send anything
+			// that is reachable from it. Otherwise the whole history is sent.
+			if oldCommit, err := repo.LookupCommit(oldOid); err == nil {
+				oldCommit.Free()
+				if err := walk.Hide(oldOid); err != nil {
+					return base.ErrorWithCategory(
+						ErrInternalGit,
+						errors.Wrapf(
+							err,
+							"failed to hide commit %s",
+							oldOid,
+						),
+					)
+				}
+			}
+			if err := pb.InsertWalk(walk); err != nil {
+				return base.ErrorWithCategory(
+					ErrInternalGit,
+					errors.Wrap(
+						err,
+						"failed to insert walk into packbuilder",
+					),
+				)
+			}
+			return nil
+		},
+		log,
+	)
+}
+
+// fetchShallow fetches the tip of the branch of the remote repository, without
+// any history, and adds the objects to the repository's object database. It
+// returns nil if the branch does not exist in the remote.
+func fetchShallow(
+	ctx context.Context,
+	repository *git.Repository,
+	transport *PublishingTransport,
+	remote *url.URL,
+	referenceName string,
+	packDir string,
+	log log15.Logger,
+) (*git.Oid, error) {
+	session, err := transport.connect(ctx, remote, "git-upload-pack")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to %s", remote.String())
+	}
+	defer session.Close()
+
+	discovery, err := githttp.DiscoverReferences(session.stdout)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to discover remote references")
+	}
+	log.Debug("Remote", "discovery", discovery, "ref", referenceName)
+
+	pw := githttp.NewPktLineWriter(session.stdin)
+	oid, ok := discovery.References[referenceName]
+	if !ok {
+		// A flush tells the remote that nothing is wanted.
+		if err := pw.Flush(); err != nil {
+			return nil, errors.Wrap(err, "failed to flush")
+		}
+		return nil, session.Wait()
+	}
+	remoteOid := oid
+
+	for _, line := range []string{
+		fmt.Sprintf("want %s ofs-delta shallow agent=gohttp\n", remoteOid.String()),
+		"deepen 1\n",
+	} {
+		if err := pw.WritePktLine([]byte(line)); err != nil {
+			return nil, errors.Wrap(err, "failed to send the fetch negotiation")
+		}
+	}
+	if err := pw.Flush(); err != nil {
+		return nil, errors.Wrap(err, "failed to flush")
+	}
+
+	pr := githttp.NewPktLineReader(session.stdout)
+	for {
+		line, err := pr.ReadPktLine()
+		if err == githttp.ErrFlush {
+			break
+		} else if err != nil {
+			return nil, errors.Wrap(err, "failed to read the shallow negotiation")
+		}
+		log.Debug("Shallow", "line", string(line))
+	}
+	if err := pw.WritePktLine([]byte("done\n")); err != nil {
+		return nil, errors.Wrap(err, "failed to send the fetch negotiation")
+	}
+	session.stdin.Close()
+
+	line, err := pr.ReadPktLine()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the ACK/NAK response")
+	}
+	if string(line) != "NAK\n" {
+		return nil, errors.Errorf("unexpected response from the remote: %q", string(line))
+	}
+
+	odb, err := repository.Odb()
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(
+				err,
+				"failed to open odb",
+			),
+		)
+	}
+	defer odb.Free()
+
+	indexer, err := git.NewIndexer(packDir, odb, func(stats git.TransferProgress) git.ErrorCode {
+		return git.ErrorCode(0)
+	})
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(
+				err,
+				"failed to create indexer",
+			),
+		)
+	}
+	defer indexer.Free()
+	if _, err := io.Copy(indexer, session.stdout); err != nil {
+		return nil, errors.Wrap(err, "failed to receive the packfile")
+	}
+	packHash, err := indexer.Commit()
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(
+				err,
+				"failed to index the packfile",
+			),
+		)
+	}
+	if err := session.Wait(); err != nil {
+		return nil, err
+	}
+
+	backend, err := git.NewOdbBackendOnePack(path.Join(packDir, fmt.Sprintf("pack-%s.idx", packHash)))
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(
+				err,
+				"failed to create a packfile backend",
+			),
+		)
+	}
+	if err := odb.AddAlternate(backend, 1); err != nil {
+		backend.Free()
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(
+				err,
+				"failed to register the packfile backend",
+			),
+		)
+	}
+
+	return &remoteOid, nil
+}
+
+// replaceSubtree returns the id of a tree that has the same contents as
+// baseTree (which can be nil), except that the subtree at the provided path
+// is replaced with the provided tree.
+func replaceSubtree(
+	repository *git.Repository,
+	baseTree *git.Tree,
+	components []string,
+	subtreeID *git.Oid,
+) (*git.Oid, error) {
+	if len(components) == 0 {
+		return subtreeID, nil
+	}
+
+	var builder *git.TreeBuilder
+	var err error
+	var childTree *git.Tree
+	if baseTree == nil {
+		builder, err = repository.TreeBuilder()
+	} else {
+		builder, err = repository.TreeBuilderFromTree(baseTree)
+		if entry := baseTree.EntryByName(components[0]); entry != nil && entry.Type == git.ObjectTree {
+			childTree, err = repository.LookupTree(entry.Id)
+			if err != nil {
+				return nil, base.ErrorWithCategory(
+					ErrInternalGit,
+					errors.Wrapf(
+						err,
+						"failed to lookup tree %s",
+						entry.Id,
+					),
+				)
+			}
+			defer childTree.Free()
+		}
+	}
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(
+				err,
+				"failed to create tree builder",
+			),
+		)
+	}
+	defer builder.Free()
+
+	childTreeID, err := replaceSubtree(repository, childTree, components[1:], subtreeID)
+	if err != nil {
+		return nil, err
+	}
+	if err := builder.Insert(components[0], childTreeID, git.FilemodeTree); err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to insert %s into the tree",
+				components[0],
+			),
+		)
+	}
+	treeID, err := builder.Write()
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(
+				err,
+				"failed to write tree",
+			),
+		)
+	}
+	return treeID, nil
+}
+
+// PublishSubdirectory pushes a commit to the branch of the remote repository
+// that places the files of the commit that belong in the public branch in the
+// target subdirectory, leaving everything else in the remote branch untouched.
+func PublishSubdirectory(
+	ctx context.Context,
+	repository *git.Repository,
+	transport *PublishingTransport,
+	remote *url.URL,
+	branch string,
+	target string,
+	commitID *git.Oid,
+	log log15.Logger,
+) error {
+	// A separate instance of the repository is used, so that the objects from
+	// the remote and the new commit never make it to the original one.
+	repo, err := openScratchRepository(repository)
+	if err != nil {
+		// openScratchRepository already wrapped the error correctly.
+		return err
+	}
+	defer repo.Free()
+
+	commit, err := repo.LookupCommit(commitID)
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to lookup commit %s",
+				commitID,
+			),
+		)
+	}
+	defer commit.Free()
+
+	packDir, err := ioutil.TempDir("", "publishing")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary directory for packfile")
+	}
+	defer os.RemoveAll(packDir)
+
+	referenceName := fmt.Sprintf("refs/heads/%s", branch)
+	remoteOid, err := fetchShallow(ctx, repo, transport, remote, referenceName, packDir, log)
+	if err != nil {
+		return err
+	}
+
+	var parentCommits []*git.Commit
+	var baseTree *git.Tree
+	if remoteOid != nil {
+		remoteCommit, err := repo.LookupCommit(remoteOid)
+		if err != nil {
+			return base.ErrorWithCategory(
+				ErrInternalGit,
+				errors.Wrapf(
+					err,
+					"failed to lookup remote commit %s",
+					remoteOid,
+				),
+			)
+		}
+		defer remoteCommit.Free()
+		parentCommits = append(parentCommits, remoteCommit)
+
+		baseTree, err = remoteCommit.Tree()
+		if err != nil {
+			return base.ErrorWithCategory(
+				ErrInternalGit,
+				errors.Wrapf(
+					err,
+					"failed to lookup tree of remote commit %s",
+					remoteOid,
+				),
+			)
+		}
+		defer baseTree.Free()
+	}
+
+	commitDescriptions, err := GetCommitDescriptions(repo)
+	if err != nil {
+		// GetCommitDescriptions already wrapped the error correctly.
+		return err
+	}
+	publicTreeID, err := publicTree(repo, commitDescriptions, commit, log)
+	if err != nil {
+		// publicTree already wrapped the error correctly.
+		return err
+	}
+	treeID, err := replaceSubtree(repo, baseTree, strings.Split(strings.Trim(target, "/"), "/"), publicTreeID)
+	if err != nil {
+		return err
+	}
+	if baseTree != nil && baseTree.Id().Equal(treeID) {
+		log.Info("Remote subdirectory already up to date", "remote", remote.String(), "target", target)
+		return nil
+	}
+	tree, err := repo.LookupTree(treeID)
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to lookup tree %s",
+				treeID,
+			),
+		)
+	}
+	defer tree.Free()
+
+	newCommitID, err := repo.CreateCommit(
+		"",
+		commit.Author(),
+		commit.Committer(),
+		commit.Message(),
+		tree,
+		parentCommits...,
+	)
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(
+				err,
+				"failed to create commit",
+			),
+		)
+	}
+
+	expectedOldOid := remoteOid
+	if expectedOldOid == nil {
+		expectedOldOid = &git.Oid{}
+	}
+	return pushToRemote(
+		ctx,
+		repo,
+		transport,
+		remote,
+		referenceName,
+		expectedOldOid,
+		newCommitID,
+		func(pb *git.Packbuilder, oldOid *git.Oid) error {
+			// The history of the remote is not available locally, so only the
+			// new commit and its tree are sent.
+			if err := pb.InsertCommit(newCommitID); err != nil {
+				return base.ErrorWithCategory(
+					ErrInternalGit,
+					errors.Wrapf(
+						err,
+						"failed to insert commit %s into packbuilder",
+						newCommitID,
+					),
+				)
+			}
+			return nil
+		},
+		log,
+	)
+}
+
+// writeArchive writes the files to an archive in the provided format.
+func writeArchive(
+	repository *git.Repository,
+	w io.Writer,
+	format string,
+	entries []*git.TreeEntry,
+	filenames []string,
+	modTime time.Time,
+) error {
+	var zipWriter *zip.Writer
+	var gzipWriter *gzip.Writer
+	var tarWriter *tar.Writer
+	if format == "tar.gz" {
+		gzipWriter = gzip.NewWriter(w)
+		tarWriter = tar.NewWriter(gzipWriter)
+	} else {
+		zipWriter = zip.NewWriter(w)
+	}
+
+	for i, entry := range entries {
+		blob, err := repository.LookupBlob(entry.Id)
+		if err != nil {
+			return base.ErrorWithCategory(
+				ErrInternalGit,
+				errors.Wrapf(
+					err,
+					"failed to lookup blob for %s",
+					filenames[i],
+				),
+			)
+		}
+		contents := blob.Contents()
+		blob.Free()
+
+		mode := int64(0644)
+		if entry.Filemode == git.FilemodeBlobExecutable {
+			mode = 0755
+		}
+		if tarWriter != nil {
+			if err := tarWriter.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     filenames[i],
+				Size:     int64(len(contents)),
+				Mode:     mode,
+				ModTime:  modTime,
+			}); err != nil {
+				return errors.Wrapf(err, "failed to write header for %s", filenames[i])
+			}
+			if _, err := tarWriter.Write(contents); err != nil {
+				return errors.Wrapf(err, "failed to write %s", filenames[i])
+			}
+		} else {
+			header := &zip.FileHeader{
+				Name:     filenames[i],
+				Method:   zip.Deflate,
+				Modified: modTime,
+			}
+			header.SetMode(os.FileMode(mode))
+			f, err := zipWriter.CreateHeader(header)
+			if err != nil {
+				return errors.Wrapf(err, "failed to write header for %s", filenames[i])
+			}
+			if _, err := f.Write(contents); err != nil {
+				return errors.Wrapf(err, "failed to write %s", filenames[i])
+			}
+		}
+	}
+
+	if tarWriter != nil {
+		if err := tarWriter.Close(); err != nil {
+			return errors.Wrap(err, "failed to finish the archive")
+		}
+		if err := gzipWriter.Close(); err != nil {
+			return errors.Wrap(err, "failed to finish the archive")
+		}
+		return nil
+	}
+	if err := zipWriter.Close(); err != nil {
+		return errors.Wrap(err, "failed to finish the archive")
+	}
+	return nil
+}
+
+// PublishArchive writes an archive with the files of the commit that belong
+// in the public branch to the directory. The archive is named after the
+// problem and the commit, so existing archives are never overwritten. The
+// format can be either 'zip' or 'tar.gz'.
+func PublishArchive(
+	repository *git.Repository,
+	directory string,
+	format string,
+	problemName string,
+	commitID *git.Oid,
+	log log15.Logger,
+) error {
+	if format == "" {
+		format = "zip"
+	}
+	archivePath := path.Join(directory, fmt.Sprintf("%s-%s.%s", problemName, commitID, format))
+	if _, err := os.Stat(archivePath); err == nil {
+		log.Info("Archive already exists", "path", archivePath)
+		return nil
+	}
+
+	repo, err := openScratchRepository(repository)
+	if err != nil {
+		// openScratchRepository already wrapped the error correctly.
+		return err
+	}
+	defer repo.Free()
+
+	commit, err := repo.LookupCommit(commitID)
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to lookup commit %s",
+				commitID,
+			),
+		)
+	}
+	defer commit.Free()
+
+	commitDescriptions, err := GetCommitDescriptions(repo)
+	if err != nil {
+		// GetCommitDescriptions already wrapped the error correctly.
+		return err
+	}
+	publicTreeID, err := publicTree(repo, commitDescriptions, commit, log)
+	if err != nil {
+		// publicTree already wrapped the error correctly.
+		return err
+	}
+	tree, err := repo.LookupTree(publicTreeID)
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to lookup the public tree of commit %s",
+				commitID,
+			),
+		)
+	}
+	defer tree.Free()
+
+	var entries []*git.TreeEntry
+	var filenames []string
+	if err := tree.Walk(func(parent string, entry *git.TreeEntry) int {
+		filename := path.Join(parent, entry.Name)
+		if entry.Type == git.ObjectBlob {
+			entries = append(entries, entry)
+			filenames = append(filenames, filename)
+		}
+		return 0
+	}); err != nil {
+		return base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to walk tree for commit %s",
+				commitID,
+			),
+		)
+	}
+
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return errors.Wrapf(err, "failed to create archive directory %s", directory)
+	}
+	f, err := ioutil.TempFile(directory, path.Base(archivePath))
+	if err != nil {
+		return errors.Wrap(err, "failed to create the archive")
+	}
+	defer os.Remove(f.Name())
+	if err := writeArchive(repo, f, format, entries, filenames, commit.Committer().When); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "failed to write the archive")
+	}
+	if err := os.Rename(f.Name(), archivePath); err != nil {
+		return errors.Wrap(err, "failed to write the archive")
+	}
+	log.Info("Wrote archive", "path", archivePath)
+	return nil
+}
+
+// Publish publishes the commit to the target described by the publishing
+// config. Archives are written to a directory within archiveRoot.
+func Publish(
+	ctx context.Context,
+	repository *git.Repository,
+	transport *PublishingTransport,
+	archiveRoot string,
+	config *PublishingConfig,
+	commitID *git.Oid,
+	log log15.Logger,
+) error {
+	if config.Mode == "archive" {
+		if archiveRoot == "" {
+			return errors.New("archive publishing is not enabled in this server")
+		}
+		return PublishArchive(
+			repository,
+			path.Join(archiveRoot, path.Clean(config.Directory)),
+			config.Format,
+			path.Base(repository.Path()),
+			commitID,
+			log,
+		)
+	}
+
+	remote, err := url.Parse(config.Repository)
+	if err != nil {
+		return base.ErrorWithCategory(
+			ErrConfigRepositoryNotAbsoluteURL,
+			err,
+		)
+	}
+	branch := config.Branch
+	if branch == "" {
+		branch = "master"
+	}
+	switch config.Mode {
+	case "mirror":
+		return PublishMirror(ctx, repository, transport, remote, branch, commitID, log)
+	case "subdirectory":
+		return PublishSubdirectory(ctx, repository, transport, remote, branch, config.Target, commitID, log)
+	default:
+		return ErrConfigInvalidPublishingMode
+	}
+}
+
+// GetPublishingStatus returns the status of the last publishing job of the
+// repository. It returns nil if the repository has never been published.
+func GetPublishingStatus(repositoryPath string) (*PublishingStatus, error) {
+	contents, err := ioutil.ReadFile(path.Join(repositoryPath, "omegaup", publishingStatusFilename))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to read the publishing status")
+	}
+	var status PublishingStatus
+	if err := json.Unmarshal(contents, &status); err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrJSONParseError,
+			errors.Wrap(
+				err,
+				publishingStatusFilename,
+			),
+		)
+	}
+	return &status, nil
+}
+
+func writePublishingStatus(repositoryPath string, status *PublishingStatus) error {
+	contents, err := json.Marshal(status)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal the publishing status")
+	}
+	statusPath := path.Join(repositoryPath, "omegaup", publishingStatusFilename)
+	f, err := ioutil.TempFile(path.Dir(statusPath), publishingStatusFilename)
+	if err != nil {
+		return errors.Wrap(err, "failed to create the publishing status")
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(contents); err != nil {
+		f.Close()
+		return errors.Wrap(err, "failed to write the publishing status")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "failed to write the publishing status")
+	}
+	if err := os.Rename(f.Name(), statusPath); err != nil {
+		return errors.Wrap(err, "failed to write the publishing status")
+	}
+	return nil
+}
+
+// Publisher is a pool of workers that push the published branch of problems
+// to the remote repositories configured in their refs/meta/config whenever it
+// moves.
+type Publisher struct {
+	// MaxAttempts is the number of times publishing a commit is attempted
+	// before giving up.
+	MaxAttempts int
+
+	// InitialBackoff is the amount of time to wait after the first failed
+	// attempt. It doubles after every failed attempt.
+	InitialBackoff time.Duration
+
+	// MaxBackoff is the maximum amount of time to wait between attempts.
+	MaxBackoff time.Duration
+
+	// ArchiveRoot is the directory where 'archive' publishing targets are
+	// written to. If empty, 'archive' targets fail.
+	ArchiveRoot string
+
+	rootPath  string
+	transport *PublishingTransport
+	log       log15.Logger
+
+	queue  chan string
+	mu     sync.Mutex
+	queued map[string]bool
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewPublisher returns a new Publisher for the repositories in rootPath.
+func NewPublisher(
+	rootPath string,
+	transport *PublishingTransport,
+	log log15.Logger,
+) *Publisher {
+	return &Publisher{
+		MaxAttempts:    5,
+		InitialBackoff: 10 * time.Second,
+		MaxBackoff:     10 * time.Minute,
+		rootPath:       rootPath,
+		transport:      transport,
+		log:            log,
+		queue:          make(chan string, publishingQueueSize),
+		queued:         make(map[string]bool),
+	}
+}
+
+// Start starts the workers. They stop when the context is cancelled or when
+// Close is called.
+func (p *Publisher) Start(ctx context.Context, workers int) {
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case problemName, ok := <-p.queue:
+					if !ok {
+						return
+					}
+					p.mu.Lock()
+					delete(p.queued, problemName)
+					p.mu.Unlock()
+					p.process(ctx, problemName)
+				}
+			}
+		}()
+	}
+}
+
+// Close stops accepting new notifications and waits for the workers to finish
+// processing the ones that are already queued.
+func (p *Publisher) Close() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+// Notify queues the problem for publishing. It is cheap to call this after
+// every update to the repository, since problems whose published branch has
+// already been published are skipped.
+func (p *Publisher) Notify(problemName string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || p.queued[problemName] {
+		return
+	}
+	select {
+	case p.queue <- problemName:
+		p.queued[problemName] = true
+	default:
+		p.log.Error("Publishing queue is full, dropping notification", "problem", problemName)
+	}
+}
+
+// ResumePending queues all the problems whose last publishing job had not
+// finished, for instance because the server was restarted.
+func (p *Publisher) ResumePending() error {
+	entries, err := ioutil.ReadDir(p.rootPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to list %s", p.rootPath)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		status, err := GetPublishingStatus(path.Join(p.rootPath, entry.Name()))
+		if err != nil {
+			p.log.Error("Failed to read the publishing status", "problem", entry.Name(), "err", err)
+			continue
+		}
+		if status != nil && status.State == PublishingStatePending {
+			p.Notify(entry.Name())
+		}
+	}
+	return nil
+}
+
+// process publishes the problem, retrying with exponential backoff.
+func (p *Publisher) process(ctx context.Context, problemName string) {
+	repositoryPath := path.Join(p.rootPath, problemName)
+	backoff := p.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		commitID, err := p.publish(ctx, repositoryPath)
+		if commitID == "" && err == nil {
+			// Nothing to do.
+			return
+		}
+
+		status := &PublishingStatus{
+			Commit:    commitID,
+			State:     PublishingStateOK,
+			Attempts:  attempt,
+			UpdatedAt: time.Now().UTC(),
+		}
+		if err != nil {
+			p.log.Error(
+				"Failed to publish",
+				"problem", problemName,
+				"commit", commitID,
+				"attempt", attempt,
+				"err", err,
+			)
+			status.Error = err.Error()
+			if attempt >= p.MaxAttempts && ctx.Err() == nil {
+				status.State = PublishingStateFailed
+			} else {
+				// If the context was cancelled, the job is left pending so that
+				// it can be resumed later.
+				status.State = PublishingStatePending
+			}
+		} else {
+			p.log.Info("Published", "problem", problemName, "commit", commitID)
+		}
+		if err := writePublishingStatus(repositoryPath, status); err != nil {
+			p.log.Error("Failed to write the publishing status", "problem", problemName, "err", err)
+		}
+		if status.State != PublishingStatePending {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+// publish makes one attempt to publish the published branch of the
+// repository. It returns the commit that was published, or an empty string if
+// there is nothing to publish.
+func (p *Publisher) publish(ctx context.Context, repositoryPath string) (string, error) {
+	repository, err := git.OpenRepository(repositoryPath)
+	if err != nil {
+		return "", base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(
+				err,
+				"failed to open repository",
+			),
+		)
+	}
+	defer repository.Free()
+
+	// The lock is only held while reading the configuration, since the
+	// objects reachable from the published branch are never removed.
+	lockfile := githttp.NewLockfile(repository.Path())
+	if err := lockfile.RLock(); err != nil {
+		return "", errors.Wrap(err, "failed to acquire the lockfile")
+	}
+	publishedRef, err := repository.References.Lookup("refs/heads/published")
+	if err != nil {
+		// Nothing has been published yet.
+		lockfile.Unlock()
+		return "", nil
+	}
+	commitID := publishedRef.Target()
+	publishedRef.Free()
+	metaConfig, err := getMetaConfig(repository)
+	lockfile.Unlock()
+	if err != nil {
+		return commitID.String(), err
+	}
+	if len(metaConfig.Publishing) == 0 {
+		return "", nil
+	}
+
+	status, err := GetPublishingStatus(repositoryPath)
+	if err != nil {
+		return commitID.String(), err
+	}
+	if status != nil && status.Commit == commitID.String() && status.State == PublishingStateOK {
+		return "", nil
+	}
+
+	// All targets are attempted even if some of them fail. Publishing is
+	// idempotent, so the targets that succeeded are skipped when retrying.
+	var failures []string
+	for i := range metaConfig.Publishing {
+		if err := Publish(
+			ctx,
+			repository,
+			p.transport,
+			p.ArchiveRoot,
+			&metaConfig.Publishing[i],
+			commitID,
+			p.log,
+		); err != nil {
+			failures = append(failures, fmt.Sprintf("publishing[%d]: %v", i, err))
+		}
+	}
+	if len(failures) != 0 {
+		return commitID.String(), errors.New(strings.Join(failures, "; "))
+	}
+	return commitID.String(), nil
+}
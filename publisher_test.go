@@ -0,0 +1,754 @@
+package gitserver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	git "github.com/lhchavez/git2go/v29"
+	"github.com/omegaup/githttp"
+	"github.com/omegaup/gitserver/gitservertest"
+	base "github.com/omegaup/go-base"
+)
+
+// setupPublishedProblem creates a problem with the provided publishing config,
+// and publishes its first commit. The config is written directly into the
+// repository, since file:// remotes cannot be pushed to refs/meta/config.
+func setupPublishedProblem(
+	t *testing.T,
+	tmpDir string,
+	problemAlias string,
+	publishingConfig string,
+	log log15.Logger,
+	ts *httptest.Server,
+) *git.Oid {
+	return setupPublishedProblemWithContents(
+		t,
+		tmpDir,
+		problemAlias,
+		publishingConfig,
+		map[string]io.Reader{
+			"settings.json":          strings.NewReader(gitservertest.DefaultSettingsJSON),
+			"cases/0.in":             strings.NewReader("1 2"),
+			"cases/0.out":            strings.NewReader("3"),
+			"statements/es.markdown": strings.NewReader("Sumas"),
+		},
+		log,
+		ts,
+	)
+}
+
+// setupPublishedProblemWithContents is like setupPublishedProblem, but the
+// first commit has the provided contents.
+func setupPublishedProblemWithContents(
+	t *testing.T,
+	tmpDir string,
+	problemAlias string,
+	publishingConfig string,
+	contents map[string]io.Reader,
+	log log15.Logger,
+	ts *httptest.Server,
+) *git.Oid {
+	repo, err := InitRepository(path.Join(tmpDir, problemAlias))
+	if err != nil {
+		t.Fatalf("Failed to initialize git repository: %v", err)
+	}
+	defer repo.Free()
+
+	{
+		tree, err := githttp.BuildTree(
+			repo,
+			map[string]io.Reader{
+				"config.json": strings.NewReader(fmt.Sprintf(`{"publishing":%s}`, publishingConfig)),
+			},
+			log,
+		)
+		if err != nil {
+			t.Fatalf("Failed to build tree: %v", err)
+		}
+		defer tree.Free()
+
+		signature := &git.Signature{
+			Name:  "author",
+			Email: "author@test.test",
+			When:  time.Unix(0, 0).In(time.UTC),
+		}
+		if _, err := repo.CreateCommit(
+			"refs/meta/config",
+			signature,
+			signature,
+			"Initial commit",
+			tree,
+		); err != nil {
+			t.Fatalf("Failed to create commit: %v", err)
+		}
+	}
+
+	newOid, packContents := createCommit(
+		t,
+		tmpDir,
+		problemAlias,
+		&git.Oid{},
+		contents,
+		"Initial commit",
+		log,
+	)
+	push(
+		t,
+		tmpDir,
+		adminAuthorization,
+		problemAlias,
+		"refs/heads/master",
+		&git.Oid{}, newOid,
+		packContents,
+		[]githttp.PktLineResponse{
+			{Line: "unpack ok\n", Err: nil},
+			{Line: "ok refs/heads/master\n", Err: nil},
+		},
+		ts,
+	)
+	push(
+		t,
+		tmpDir,
+		adminAuthorization,
+		problemAlias,
+		"refs/heads/published",
+		&git.Oid{}, newOid,
+		githttp.EmptyPackfile,
+		[]githttp.PktLineResponse{
+			{Line: "unpack ok\n", Err: nil},
+			{Line: "ok refs/heads/published\n", Err: nil},
+		},
+		ts,
+	)
+
+	return newOid
+}
+
+func getRemoteReference(t *testing.T, remotePath string, refName string) *git.Oid {
+	repo, err := git.OpenRepository(remotePath)
+	if err != nil {
+		t.Fatalf("Failed to open remote repository: %v", err)
+	}
+	defer repo.Free()
+
+	ref, err := repo.References.Lookup(refName)
+	if err != nil {
+		t.Fatalf("Failed to lookup remote reference %s: %v", refName, err)
+	}
+	defer ref.Free()
+
+	return ref.Target()
+}
+
+func assertPublishingStatus(
+	t *testing.T,
+	repositoryPath string,
+	expectedCommit *git.Oid,
+	expectedState string,
+	expectedAttempts int,
+) {
+	t.Helper()
+
+	status, err := GetPublishingStatus(repositoryPath)
+	if err != nil {
+		t.Fatalf("Failed to get the publishing status: %v", err)
+	}
+	if status == nil {
+		t.Fatalf("Missing publishing status")
+	}
+	if status.Commit != expectedCommit.String() ||
+		status.State != expectedState ||
+		status.Attempts != expectedAttempts {
+		t.Errorf(
+			"Unexpected publishing status %+v, expected commit %s, state %s, attempts %d",
+			status,
+			expectedCommit,
+			expectedState,
+			expectedAttempts,
+		)
+	}
+}
+
+// assertRemoteTree checks that the tree of the remote commit has all the
+// present files and none of the absent ones, and returns the commit's parents.
+func assertRemoteTree(
+	t *testing.T,
+	remotePath string,
+	commitID *git.Oid,
+	present []string,
+	absent []string,
+) []*git.Oid {
+	t.Helper()
+
+	repo, err := git.OpenRepository(remotePath)
+	if err != nil {
+		t.Fatalf("Failed to open remote repository: %v", err)
+	}
+	defer repo.Free()
+
+	commit, err := repo.LookupCommit(commitID)
+	if err != nil {
+		t.Fatalf("Failed to lookup remote commit: %v", err)
+	}
+	defer commit.Free()
+
+	tree, err := commit.Tree()
+	if err != nil {
+		t.Fatalf("Failed to lookup remote tree: %v", err)
+	}
+	defer tree.Free()
+	for _, filename := range present {
+		if _, err := tree.EntryByPath(filename); err != nil {
+			t.Errorf("Failed to find %s in the remote: %v", filename, err)
+		}
+	}
+	for _, filename := range absent {
+		if _, err := tree.EntryByPath(filename); err == nil {
+			t.Errorf("Unexpected %s in the remote", filename)
+		}
+	}
+
+	var parents []*git.Oid
+	for i := uint(0); i < commit.ParentCount(); i++ {
+		parents = append(parents, commit.ParentId(i))
+	}
+	return parents
+}
+
+func TestPublishMirror(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+	remoteDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(remoteDir)
+	}
+
+	log := base.StderrLog()
+	ts := httptest.NewServer(GitHandler(
+		tmpDir,
+		NewGitProtocol(authorize, nil, true, OverallWallTimeHardLimit, fakeInteractiveSettingsCompiler, log),
+		&base.NoOpMetrics{},
+		log,
+	))
+	defer ts.Close()
+
+	remotePath := path.Join(remoteDir, "remote.git")
+	{
+		remoteRepo, err := git.InitRepository(remotePath, true)
+		if err != nil {
+			t.Fatalf("Failed to initialize remote repository: %v", err)
+		}
+		remoteRepo.Free()
+	}
+
+	problemAlias := "sumas"
+	publishedOid := setupPublishedProblem(
+		t,
+		tmpDir,
+		problemAlias,
+		fmt.Sprintf(`{"mode":"mirror","repository":"file://%s","branch":"main"}`, remotePath),
+		log,
+		ts,
+	)
+
+	publisher := NewPublisher(tmpDir, &PublishingTransport{AllowLocal: true}, log)
+	publisher.Start(context.Background(), 1)
+	publisher.Notify(problemAlias)
+	publisher.Close()
+
+	// Only the public files are published.
+	firstRemoteOid := getRemoteReference(t, remotePath, "refs/heads/main")
+	if parents := assertRemoteTree(
+		t,
+		remotePath,
+		firstRemoteOid,
+		[]string{"statements/es.markdown"},
+		[]string{"settings.json", "cases/0.in", "cases/0.out"},
+	); len(parents) != 0 {
+		t.Errorf("Remote commit %s has parents %v, expected none", firstRemoteOid, parents)
+	}
+	assertPublishingStatus(t, path.Join(tmpDir, problemAlias), publishedOid, PublishingStateOK, 1)
+
+	// Move the published branch forward.
+	newOid, packContents := createCommit(
+		t,
+		tmpDir,
+		problemAlias,
+		publishedOid,
+		map[string]io.Reader{
+			"settings.json":          strings.NewReader(gitservertest.DefaultSettingsJSON),
+			"cases/0.in":             strings.NewReader("1 2"),
+			"cases/0.out":            strings.NewReader("3"),
+			"statements/es.markdown": strings.NewReader("Sumas 2"),
+		},
+		"Second commit",
+		log,
+	)
+	push(
+		t,
+		tmpDir,
+		adminAuthorization,
+		problemAlias,
+		"refs/heads/master",
+		publishedOid, newOid,
+		packContents,
+		[]githttp.PktLineResponse{
+			{Line: "unpack ok\n", Err: nil},
+			{Line: "ok refs/heads/master\n", Err: nil},
+		},
+		ts,
+	)
+	push(
+		t,
+		tmpDir,
+		adminAuthorization,
+		problemAlias,
+		"refs/heads/published",
+		publishedOid, newOid,
+		githttp.EmptyPackfile,
+		[]githttp.PktLineResponse{
+			{Line: "unpack ok\n", Err: nil},
+			{Line: "ok refs/heads/published\n", Err: nil},
+		},
+		ts,
+	)
+
+	publisher = NewPublisher(tmpDir, &PublishingTransport{AllowLocal: true}, log)
+	publisher.process(context.Background(), problemAlias)
+	secondRemoteOid := getRemoteReference(t, remotePath, "refs/heads/main")
+	if parents := assertRemoteTree(
+		t,
+		remotePath,
+		secondRemoteOid,
+		[]string{"statements/es.markdown"},
+		[]string{"settings.json", "cases/0.in", "cases/0.out"},
+	); len(parents) != 1 || !parents[0].Equal(firstRemoteOid) {
+		t.Errorf("Remote commit %s has parents %v, expected [%s]", secondRemoteOid, parents, firstRemoteOid)
+	}
+	assertPublishingStatus(t, path.Join(tmpDir, problemAlias), newOid, PublishingStateOK, 1)
+}
+
+func TestPublishSubdirectory(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+	remoteDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(remoteDir)
+	}
+
+	log := base.StderrLog()
+	ts := httptest.NewServer(GitHandler(
+		tmpDir,
+		NewGitProtocol(authorize, nil, true, OverallWallTimeHardLimit, fakeInteractiveSettingsCompiler, log),
+		&base.NoOpMetrics{},
+		log,
+	))
+	defer ts.Close()
+
+	// The remote already has some contents that should be preserved.
+	remotePath := path.Join(remoteDir, "remote.git")
+	var initialRemoteOid *git.Oid
+	{
+		remoteRepo, err := git.InitRepository(remotePath, true)
+		if err != nil {
+			t.Fatalf("Failed to initialize remote repository: %v", err)
+		}
+		defer remoteRepo.Free()
+
+		tree, err := githttp.BuildTree(
+			remoteRepo,
+			map[string]io.Reader{
+				"README.md":         strings.NewReader("Problems"),
+				"problems/other/ok": strings.NewReader("ok"),
+			},
+			log,
+		)
+		if err != nil {
+			t.Fatalf("Failed to build tree: %v", err)
+		}
+		defer tree.Free()
+
+		signature := &git.Signature{
+			Name:  "author",
+			Email: "author@test.test",
+			When:  time.Unix(0, 0).In(time.UTC),
+		}
+		initialRemoteOid, err = remoteRepo.CreateCommit(
+			"refs/heads/master",
+			signature,
+			signature,
+			"Initial commit",
+			tree,
+		)
+		if err != nil {
+			t.Fatalf("Failed to create commit: %v", err)
+		}
+	}
+
+	problemAlias := "sumas"
+	publishedOid := setupPublishedProblem(
+		t,
+		tmpDir,
+		problemAlias,
+		fmt.Sprintf(`{"mode":"subdirectory","repository":"file://%s","target":"problems/sumas"}`, remotePath),
+		log,
+		ts,
+	)
+
+	publisher := NewPublisher(tmpDir, &PublishingTransport{AllowLocal: true}, log)
+	publisher.process(context.Background(), problemAlias)
+	assertPublishingStatus(t, path.Join(tmpDir, problemAlias), publishedOid, PublishingStateOK, 1)
+
+	remoteOid := getRemoteReference(t, remotePath, "refs/heads/master")
+	if parents := assertRemoteTree(
+		t,
+		remotePath,
+		remoteOid,
+		[]string{
+			"README.md",
+			"problems/other/ok",
+			"problems/sumas/statements/es.markdown",
+		},
+		[]string{
+			"problems/sumas/settings.json",
+			"problems/sumas/cases/0.in",
+		},
+	); len(parents) != 1 || !parents[0].Equal(initialRemoteOid) {
+		t.Errorf("Remote commit %s is not a child of %s", remoteOid, initialRemoteOid)
+	}
+
+	// Publishing the same commit again does not create a new commit.
+	{
+		repo, err := git.OpenRepository(path.Join(tmpDir, problemAlias))
+		if err != nil {
+			t.Fatalf("Failed to open repository: %v", err)
+		}
+		defer repo.Free()
+
+		if err := Publish(
+			context.Background(),
+			repo,
+			&PublishingTransport{AllowLocal: true},
+			"",
+			&PublishingConfig{
+				Mode:       "subdirectory",
+				Repository: fmt.Sprintf("file://%s", remotePath),
+				Target:     "problems/sumas",
+			},
+			publishedOid,
+			log,
+		); err != nil {
+			t.Fatalf("Failed to publish: %v", err)
+		}
+		if newRemoteOid := getRemoteReference(t, remotePath, "refs/heads/master"); !newRemoteOid.Equal(remoteOid) {
+			t.Errorf("Remote refs/heads/master = %s, expected %s", newRemoteOid, remoteOid)
+		}
+	}
+}
+
+func TestPublishRetries(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+
+	log := base.StderrLog()
+	ts := httptest.NewServer(GitHandler(
+		tmpDir,
+		NewGitProtocol(authorize, nil, true, OverallWallTimeHardLimit, fakeInteractiveSettingsCompiler, log),
+		&base.NoOpMetrics{},
+		log,
+	))
+	defer ts.Close()
+
+	problemAlias := "sumas"
+	publishedOid := setupPublishedProblem(
+		t,
+		tmpDir,
+		problemAlias,
+		fmt.Sprintf(`{"mode":"mirror","repository":"file://%s"}`, path.Join(tmpDir, "missing.git")),
+		log,
+		ts,
+	)
+
+	publisher := NewPublisher(tmpDir, &PublishingTransport{AllowLocal: true}, log)
+	publisher.MaxAttempts = 3
+	publisher.InitialBackoff = time.Millisecond
+	publisher.process(context.Background(), problemAlias)
+	assertPublishingStatus(t, path.Join(tmpDir, problemAlias), publishedOid, PublishingStateFailed, 3)
+
+	// A cancelled job stays pending, so that it can be resumed.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	publisher.process(ctx, problemAlias)
+	assertPublishingStatus(t, path.Join(tmpDir, problemAlias), publishedOid, PublishingStatePending, 1)
+}
+
+func TestPublishArchive(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+	archiveRoot, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(archiveRoot)
+	}
+
+	log := base.StderrLog()
+	ts := httptest.NewServer(GitHandler(
+		tmpDir,
+		NewGitProtocol(authorize, nil, true, OverallWallTimeHardLimit, fakeInteractiveSettingsCompiler, log),
+		&base.NoOpMetrics{},
+		log,
+	))
+	defer ts.Close()
+
+	problemAlias := "sumas"
+	publishedOid := setupPublishedProblem(
+		t,
+		tmpDir,
+		problemAlias,
+		`[{"mode":"archive","directory":"internal"},{"mode":"archive","directory":"internal","format":"tar.gz"}]`,
+		log,
+		ts,
+	)
+
+	publisher := NewPublisher(tmpDir, &PublishingTransport{}, log)
+	publisher.ArchiveRoot = archiveRoot
+	publisher.process(context.Background(), problemAlias)
+	assertPublishingStatus(t, path.Join(tmpDir, problemAlias), publishedOid, PublishingStateOK, 1)
+
+	// Only the files in the public branch are archived.
+	assertArchivedFiles := func(filenames []string) {
+		t.Helper()
+
+		archived := make(map[string]bool)
+		for _, filename := range filenames {
+			archived[filename] = true
+		}
+		if !archived["statements/es.markdown"] {
+			t.Errorf("Expected statements/es.markdown to be archived, got %v", filenames)
+		}
+		for _, filename := range []string{"settings.json", "cases/0.in", "cases/0.out"} {
+			if archived[filename] {
+				t.Errorf("Expected %s to not be archived, got %v", filename, filenames)
+			}
+		}
+	}
+
+	{
+		z, err := zip.OpenReader(path.Join(archiveRoot, "internal", fmt.Sprintf("sumas-%s.zip", publishedOid)))
+		if err != nil {
+			t.Fatalf("Failed to open the zip archive: %v", err)
+		}
+		defer z.Close()
+
+		var filenames []string
+		for _, f := range z.File {
+			filenames = append(filenames, f.Name)
+		}
+		assertArchivedFiles(filenames)
+	}
+
+	{
+		f, err := os.Open(path.Join(archiveRoot, "internal", fmt.Sprintf("sumas-%s.tar.gz", publishedOid)))
+		if err != nil {
+			t.Fatalf("Failed to open the tarball: %v", err)
+		}
+		defer f.Close()
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("Failed to open the tarball: %v", err)
+		}
+		defer gz.Close()
+
+		var filenames []string
+		tr := tar.NewReader(gz)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("Failed to read the tarball: %v", err)
+			}
+			filenames = append(filenames, header.Name)
+		}
+		assertArchivedFiles(filenames)
+	}
+
+	// Archives are disabled if there is no archive root.
+	publisher = NewPublisher(tmpDir, &PublishingTransport{}, log)
+	publisher.MaxAttempts = 1
+	if err := os.Remove(path.Join(tmpDir, problemAlias, "omegaup", "publishing.json")); err != nil {
+		t.Fatalf("Failed to remove the publishing status: %v", err)
+	}
+	publisher.process(context.Background(), problemAlias)
+	assertPublishingStatus(t, path.Join(tmpDir, problemAlias), publishedOid, PublishingStateFailed, 1)
+}
+
+func TestPublishInteractive(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+	remoteDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(remoteDir)
+	}
+
+	log := base.StderrLog()
+	ts := httptest.NewServer(GitHandler(
+		tmpDir,
+		NewGitProtocol(authorize, nil, true, OverallWallTimeHardLimit, interactiveSettingsCompiler, log),
+		&base.NoOpMetrics{},
+		log,
+	))
+	defer ts.Close()
+
+	mirrorPath := path.Join(remoteDir, "mirror.git")
+	subdirectoryPath := path.Join(remoteDir, "subdirectory.git")
+	for _, remotePath := range []string{mirrorPath, subdirectoryPath} {
+		remoteRepo, err := git.InitRepository(remotePath, true)
+		if err != nil {
+			t.Fatalf("Failed to initialize remote repository: %v", err)
+		}
+		remoteRepo.Free()
+	}
+
+	problemAlias := "sumas"
+	publishedOid := setupPublishedProblemWithContents(
+		t,
+		tmpDir,
+		problemAlias,
+		fmt.Sprintf(
+			`[{"mode":"mirror","repository":"file://%s","branch":"main"},{"mode":"subdirectory","repository":"file://%s","target":"problems/sumas"},{"mode":"archive","directory":"internal"}]`,
+			mirrorPath,
+			subdirectoryPath,
+		),
+		interactiveProblemContents("Sumas"),
+		log,
+		ts,
+	)
+
+	publisher := NewPublisher(tmpDir, &PublishingTransport{AllowLocal: true}, log)
+	publisher.ArchiveRoot = remoteDir
+	publisher.process(context.Background(), problemAlias)
+	assertPublishingStatus(t, path.Join(tmpDir, problemAlias), publishedOid, PublishingStateOK, 1)
+
+	// The public files within interactive/ are published, and the private ones
+	// are not.
+	publicFiles := []string{
+		"statements/es.markdown",
+		"interactive/Main.distrib.cpp",
+		"interactive/examples/sample.in",
+		"interactive/examples/sample.out",
+	}
+	privateFiles := []string{
+		"settings.json",
+		"cases/0.in",
+		"interactive/Main.cpp",
+		"interactive/sums.idl",
+	}
+	assertRemoteTree(
+		t,
+		mirrorPath,
+		getRemoteReference(t, mirrorPath, "refs/heads/main"),
+		publicFiles,
+		privateFiles,
+	)
+	var subdirectoryPublicFiles, subdirectoryPrivateFiles []string
+	for _, filename := range publicFiles {
+		subdirectoryPublicFiles = append(subdirectoryPublicFiles, path.Join("problems/sumas", filename))
+	}
+	for _, filename := range privateFiles {
+		subdirectoryPrivateFiles = append(subdirectoryPrivateFiles, path.Join("problems/sumas", filename))
+	}
+	assertRemoteTree(
+		t,
+		subdirectoryPath,
+		getRemoteReference(t, subdirectoryPath, "refs/heads/master"),
+		subdirectoryPublicFiles,
+		subdirectoryPrivateFiles,
+	)
+
+	z, err := zip.OpenReader(path.Join(remoteDir, "internal", fmt.Sprintf("sumas-%s.zip", publishedOid)))
+	if err != nil {
+		t.Fatalf("Failed to open the zip archive: %v", err)
+	}
+	defer z.Close()
+	archived := make(map[string]bool)
+	for _, f := range z.File {
+		archived[f.Name] = true
+	}
+	for _, filename := range publicFiles {
+		if !archived[filename] {
+			t.Errorf("Expected %s to be archived, got %v", filename, archived)
+		}
+	}
+	for _, filename := range privateFiles {
+		if archived[filename] {
+			t.Errorf("Expected %s to not be archived, got %v", filename, archived)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	for _, argument := range []string{
+		"/srv/git/problems.git",
+		"/srv/git/it's.git",
+		"/srv/git/'; touch /tmp/pwned; echo '.git",
+		"$(touch /tmp/pwned)`id`\\\"",
+	} {
+		output, err := exec.Command("sh", "-c", "printf %s "+shellQuote(argument)).Output()
+		if err != nil {
+			t.Fatalf("Failed to run the shell for %q: %v", argument, err)
+		}
+		if string(output) != argument {
+			t.Errorf("Expected the shell to receive %q, got %q", argument, string(output))
+		}
+	}
+}
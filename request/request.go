@@ -4,6 +4,7 @@ import (
 	"context"
 	"io"
 
+	"github.com/omegaup/githttp"
 	base "github.com/omegaup/go-base"
 )
 
@@ -22,18 +23,51 @@ type Request struct {
 	CanEdit     bool
 	HasSolved   bool
 	ReviewRef   string
+	AuthMethod  string
+	RemoteAddr  string
+
+	// IsSystem is set for the requests that the server makes on its own, such
+	// as migrations, which are not subject to the policy of the problem.
+	IsSystem bool
+}
+
+// Warning is a problem that was found while processing the request that did
+// not prevent it from succeeding, such as a file that was dropped or
+// rewritten.
+type Warning struct {
+	Code    string `json:"code"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
 }
 
 // Context stores a few variables that are request-specific.
 type Context struct {
-	Request      Request
-	UpdatedFiles map[string]io.Reader
-	Metrics      base.Metrics
+	Request         Request
+	UpdatedFiles    map[string]io.Reader
+	NormalizedFiles []string
+	Metrics         base.Metrics
+
+	// UpdatedRefs are the references that the request attempted to update,
+	// after any preprocessing was done.
+	UpdatedRefs []githttp.UpdatedRef
+
+	// Err is the first error that caused the request to be rejected, if any.
+	Err error
+
+	// Warnings are all the warnings that were found while processing the
+	// request. They are reported in the response of .zip uploads, and as
+	// progress messages to git clients that ask for the side-band capability.
+	Warnings []Warning
 }
 
 // NewContext wraps the supplied context and associates a git
-// protocol-specific context value to it.
+// protocol-specific context value to it. If the supplied context already has
+// one, it is reused, so that handlers that wrap other handlers can inspect it
+// once the request is done.
 func NewContext(ctx context.Context, metrics base.Metrics) context.Context {
+	if FromContext(ctx) != nil {
+		return ctx
+	}
 	if metrics == nil {
 		metrics = &base.NoOpMetrics{}
 	}
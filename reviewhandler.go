@@ -0,0 +1,746 @@
+package gitserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/inconshreveable/log15"
+	git "github.com/lhchavez/git2go/v29"
+	"github.com/omegaup/githttp"
+	"github.com/omegaup/gitserver/request"
+	base "github.com/omegaup/go-base"
+	"github.com/pkg/errors"
+)
+
+// ReviewThread is a top-level comment in a code review, together with all the
+// replies to it.
+type ReviewThread struct {
+	Commit   string     `json:"commit"`
+	Filename string     `json:"filename"`
+	Resolved bool       `json:"resolved"`
+	Comments []*Comment `json:"comments"`
+}
+
+// ReviewFileSummary is the number of comments and unresolved threads that a
+// file has in the review of a commit.
+type ReviewFileSummary struct {
+	Commit            string `json:"commit"`
+	Filename          string `json:"filename"`
+	Comments          int    `json:"comments"`
+	UnresolvedThreads int    `json:"unresolvedThreads"`
+}
+
+// ReviewResult represents the contents of refs/meta/review.
+type ReviewResult struct {
+	Iterations []*LedgerIteration   `json:"iterations"`
+	Threads    []*ReviewThread      `json:"threads"`
+	Files      []*ReviewFileSummary `json:"files"`
+}
+
+// readReviewFile returns the non-empty lines of the file with the provided
+// name in the review tree. A missing file has no lines.
+func readReviewFile(
+	repository *git.Repository,
+	reviewTree *git.Tree,
+	name string,
+) ([]string, error) {
+	treeEntry := reviewTree.EntryByName(name)
+	if treeEntry == nil {
+		return nil, nil
+	}
+	blob, err := repository.LookupBlob(treeEntry.Id)
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to lookup the blob for %s",
+				name,
+			),
+		)
+	}
+	defer blob.Free()
+
+	var lines []string
+	for _, line := range strings.Split(string(blob.Contents()), "\n") {
+		if line == "" {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// readReviewLedger returns all the iterations in the review ledger.
+func readReviewLedger(
+	repository *git.Repository,
+	reviewTree *git.Tree,
+) ([]*LedgerIteration, error) {
+	lines, err := readReviewFile(repository, reviewTree, "ledger")
+	if err != nil {
+		// readReviewFile already wrapped the error correctly.
+		return nil, err
+	}
+
+	iterations := make([]*LedgerIteration, 0, len(lines))
+	for _, line := range lines {
+		var ledgerIteration LedgerIteration
+		if err := json.Unmarshal([]byte(line), &ledgerIteration); err != nil {
+			return nil, base.ErrorWithCategory(
+				ErrReviewBadLayout,
+				errors.Wrap(
+					err,
+					"malformed ledger entry",
+				),
+			)
+		}
+		iterations = append(iterations, &ledgerIteration)
+	}
+	return iterations, nil
+}
+
+// readReviewComments returns all the comments made for the provided commit.
+func readReviewComments(
+	repository *git.Repository,
+	reviewTree *git.Tree,
+	commitID string,
+) ([]*Comment, error) {
+	lines, err := readReviewFile(repository, reviewTree, commitID)
+	if err != nil {
+		// readReviewFile already wrapped the error correctly.
+		return nil, err
+	}
+
+	comments := make([]*Comment, 0, len(lines))
+	for _, line := range lines {
+		var comment Comment
+		if err := json.Unmarshal([]byte(line), &comment); err != nil {
+			return nil, base.ErrorWithCategory(
+				ErrReviewBadLayout,
+				errors.Wrapf(
+					err,
+					"malformed comment in %s",
+					commitID,
+				),
+			)
+		}
+		comments = append(comments, &comment)
+	}
+	return comments, nil
+}
+
+// buildReviewThreads groups the comments for a commit into threads, in the
+// order in which the threads were started. A thread is resolved if its last
+// comment was marked as done.
+func buildReviewThreads(commitID string, comments []*Comment) []*ReviewThread {
+	var threads []*ReviewThread
+	threadsByUUID := make(map[string]*ReviewThread)
+	for _, comment := range comments {
+		var thread *ReviewThread
+		if comment.ParentUUID != nil {
+			thread = threadsByUUID[*comment.ParentUUID]
+		}
+		if thread == nil {
+			thread = &ReviewThread{
+				Commit:   commitID,
+				Filename: comment.Filename,
+			}
+			threads = append(threads, thread)
+		}
+		thread.Comments = append(thread.Comments, comment)
+		thread.Resolved = comment.Done
+		threadsByUUID[comment.UUID] = thread
+	}
+	return threads
+}
+
+// GetReview returns the iterations, comment threads, and per-file comment
+// counts stored in refs/meta/review.
+func GetReview(repository *git.Repository) (*ReviewResult, error) {
+	result := &ReviewResult{
+		Iterations: make([]*LedgerIteration, 0),
+		Threads:    make([]*ReviewThread, 0),
+		Files:      make([]*ReviewFileSummary, 0),
+	}
+
+	ref, err := repository.References.Lookup("refs/meta/review")
+	if err != nil {
+		if git.IsErrorCode(err, git.ErrNotFound) {
+			return result, nil
+		}
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(
+				err,
+				"failed to lookup refs/meta/review",
+			),
+		)
+	}
+	defer ref.Free()
+
+	reviewCommit, err := repository.LookupCommit(ref.Target())
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to lookup commit %s",
+				ref.Target(),
+			),
+		)
+	}
+	defer reviewCommit.Free()
+
+	reviewTree, err := reviewCommit.Tree()
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to get tree for review commit %s",
+				reviewCommit.Id(),
+			),
+		)
+	}
+	defer reviewTree.Free()
+
+	result.Iterations, err = readReviewLedger(repository, reviewTree)
+	if err != nil {
+		// readReviewLedger already wrapped the error correctly.
+		return nil, err
+	}
+
+	for i := uint64(0); i < reviewTree.EntryCount(); i++ {
+		commitID := reviewTree.EntryByIndex(i).Name
+		if commitID == "ledger" {
+			continue
+		}
+
+		comments, err := readReviewComments(repository, reviewTree, commitID)
+		if err != nil {
+			// readReviewComments already wrapped the error correctly.
+			return nil, err
+		}
+		threads := buildReviewThreads(commitID, comments)
+		result.Threads = append(result.Threads, threads...)
+
+		files := make(map[string]*ReviewFileSummary)
+		for _, thread := range threads {
+			file, ok := files[thread.Filename]
+			if !ok {
+				file = &ReviewFileSummary{
+					Commit:   commitID,
+					Filename: thread.Filename,
+				}
+				files[thread.Filename] = file
+				result.Files = append(result.Files, file)
+			}
+			file.Comments += len(thread.Comments)
+			if !thread.Resolved {
+				file.UnresolvedThreads++
+			}
+		}
+	}
+	sort.SliceStable(result.Files, func(i, j int) bool {
+		if result.Files[i].Commit != result.Files[j].Commit {
+			return result.Files[i].Commit < result.Files[j].Commit
+		}
+		return result.Files[i].Filename < result.Files[j].Filename
+	})
+
+	return result, nil
+}
+
+// suggestionReplacement is a replacement suggestion that has been resolved to
+// byte offsets within the contents of a file.
+type suggestionReplacement struct {
+	start, end int
+	text       string
+}
+
+// rangeOffsets returns the byte offsets in contents that correspond to the
+// (already validated) range.
+func rangeOffsets(contents []byte, commentRange *Range) (int, int) {
+	lineOffsets := []int{0}
+	for i, c := range contents {
+		if c == '\n' {
+			lineOffsets = append(lineOffsets, i+1)
+		}
+	}
+	offset := func(line, col int) int {
+		o := lineOffsets[line]
+		for ; col > 0; col-- {
+			_, size := utf8.DecodeRune(contents[o:])
+			o += size
+		}
+		return o
+	}
+	return offset(commentRange.LineStart, commentRange.ColStart),
+		offset(commentRange.LineEnd, commentRange.ColEnd)
+}
+
+// ApplySuggestions creates a new commit on top of the commit that is being
+// reviewed in which the replacement suggestions in refs/meta/review with the
+// provided UUIDs have been applied, and pushes it as a new change under
+// refs/changes/*.
+func ApplySuggestions(
+	ctx context.Context,
+	repo *git.Repository,
+	lockfile *githttp.Lockfile,
+	authorizationLevel githttp.AuthorizationLevel,
+	authorUsername string,
+	commentUUIDs []string,
+	commitMessage string,
+	protocol *githttp.GitProtocol,
+	log log15.Logger,
+) (*UpdateResult, error) {
+	if len(commentUUIDs) == 0 {
+		return nil, base.ErrorWithCategory(
+			githttp.ErrBadRequest,
+			errors.New("no comments to apply"),
+		)
+	}
+
+	reviewResult, err := GetReview(repo)
+	if err != nil {
+		// GetReview already wrapped the error correctly.
+		return nil, err
+	}
+
+	pendingUUIDs := make(map[string]struct{})
+	for _, commentUUID := range commentUUIDs {
+		pendingUUIDs[commentUUID] = struct{}{}
+	}
+	var baseCommitID string
+	suggestions := make(map[string][]*Comment)
+	for _, thread := range reviewResult.Threads {
+		for _, comment := range thread.Comments {
+			if _, ok := pendingUUIDs[comment.UUID]; !ok {
+				continue
+			}
+			delete(pendingUUIDs, comment.UUID)
+			if !comment.ReplacementSuggestion || comment.Range == nil {
+				return nil, base.ErrorWithCategory(
+					githttp.ErrBadRequest,
+					errors.Errorf(
+						"comment %s is not a replacement suggestion",
+						comment.UUID,
+					),
+				)
+			}
+			if baseCommitID != "" && baseCommitID != thread.Commit {
+				return nil, base.ErrorWithCategory(
+					githttp.ErrBadRequest,
+					errors.New("all comments must belong to the same commit"),
+				)
+			}
+			baseCommitID = thread.Commit
+			suggestions[comment.Filename] = append(suggestions[comment.Filename], comment)
+		}
+	}
+	if len(pendingUUIDs) != 0 {
+		var missingUUIDs []string
+		for commentUUID := range pendingUUIDs {
+			missingUUIDs = append(missingUUIDs, commentUUID)
+		}
+		sort.Strings(missingUUIDs)
+		return nil, base.ErrorWithCategory(
+			githttp.ErrBadRequest,
+			errors.Errorf(
+				"comments not found: %s",
+				strings.Join(missingUUIDs, ", "),
+			),
+		)
+	}
+
+	baseCommitOid, err := git.NewOid(baseCommitID)
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrReviewBadLayout,
+			errors.Wrapf(
+				err,
+				"invalid filename %s, should be a git commit id",
+				baseCommitID,
+			),
+		)
+	}
+	baseCommit, err := repo.LookupCommit(baseCommitOid)
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to lookup commit %s",
+				baseCommitID,
+			),
+		)
+	}
+	defer baseCommit.Free()
+	baseTree, err := baseCommit.Tree()
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to get tree for commit %s",
+				baseCommitID,
+			),
+		)
+	}
+	defer baseTree.Free()
+
+	cleanup, err := addTemporaryObjectBackend(repo)
+	if err != nil {
+		// addTemporaryObjectBackend already wrapped the error correctly.
+		return nil, err
+	}
+	defer cleanup()
+
+	updatedFiles := make(map[string]io.Reader)
+	for filename, comments := range suggestions {
+		treeEntry, err := baseTree.EntryByPath(filename)
+		if err != nil {
+			return nil, base.ErrorWithCategory(
+				ErrReviewBadLayout,
+				errors.Wrapf(
+					err,
+					"file '%s' not found in %s",
+					filename,
+					baseCommitID,
+				),
+			)
+		}
+		blob, err := repo.LookupBlob(treeEntry.Id)
+		if err != nil {
+			return nil, base.ErrorWithCategory(
+				ErrInternalGit,
+				errors.Wrapf(
+					err,
+					"failed to lookup file %s",
+					filename,
+				),
+			)
+		}
+		contents := append([]byte{}, blob.Contents()...)
+		blob.Free()
+
+		replacements := make([]suggestionReplacement, 0, len(comments))
+		for _, comment := range comments {
+			if err := validateCommentRange(repo, treeEntry, comment.Range); err != nil {
+				return nil, base.ErrorWithCategory(
+					ErrReviewBadLayout,
+					errors.Wrapf(
+						err,
+						"invalid range for '%s' in comment %s",
+						filename,
+						comment.UUID,
+					),
+				)
+			}
+			start, end := rangeOffsets(contents, comment.Range)
+			replacements = append(replacements, suggestionReplacement{
+				start: start,
+				end:   end,
+				text:  comment.Message,
+			})
+		}
+		sort.Slice(replacements, func(i, j int) bool {
+			return replacements[i].start < replacements[j].start
+		})
+		for i := 1; i < len(replacements); i++ {
+			if replacements[i-1].end > replacements[i].start {
+				return nil, base.ErrorWithCategory(
+					githttp.ErrBadRequest,
+					errors.Errorf(
+						"overlapping suggestions for '%s'",
+						filename,
+					),
+				)
+			}
+		}
+		for i := len(replacements) - 1; i >= 0; i-- {
+			replacement := replacements[i]
+			var buf bytes.Buffer
+			buf.Write(contents[:replacement.start])
+			buf.WriteString(replacement.text)
+			buf.Write(contents[replacement.end:])
+			contents = buf.Bytes()
+		}
+		updatedFiles[filename] = bytes.NewReader(contents)
+	}
+
+	updatedTree, err := githttp.BuildTree(repo, updatedFiles, log)
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(
+				err,
+				"failed to build tree for the suggestions",
+			),
+		)
+	}
+	defer updatedTree.Free()
+
+	mergedTree, err := githttp.MergeTrees(repo, updatedTree, baseTree)
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(
+				err,
+				"failed to merge tree",
+			),
+		)
+	}
+	defer mergedTree.Free()
+
+	signature := &git.Signature{
+		Name:  authorUsername,
+		Email: fmt.Sprintf("%s@omegaup", authorUsername),
+		When:  time.Now(),
+	}
+	newOid, err := repo.CreateCommit(
+		"",
+		signature,
+		signature,
+		commitMessage,
+		mergedTree,
+		baseCommit,
+	)
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(
+				err,
+				"failed to create commit",
+			),
+		)
+	}
+
+	packfile, err := ioutil.TempFile("", "gitserver-packfile")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(packfile.Name())
+
+	if err := writeCommitPackfile(repo, newOid, []*git.Commit{baseCommit}, packfile); err != nil {
+		// writeCommitPackfile already wrapped the error correctly.
+		return nil, err
+	}
+
+	packfile.Seek(0, 0)
+	updatedRefs, err, unpackErr := protocol.PushPackfile(
+		ctx,
+		repo,
+		lockfile,
+		authorizationLevel,
+		[]*githttp.GitCommand{
+			{
+				Old:           &git.Oid{},
+				New:           newOid,
+				ReferenceName: fmt.Sprintf("refs/changes/%s", newOid.String()),
+				Reference:     nil,
+			},
+		},
+		packfile,
+	)
+	auditAppliedRefs(ctx, repo, request.FromContext(ctx).UpdatedRefs, log)
+	if unpackErr != nil {
+		return nil, base.ErrorWithCategory(
+			githttp.ErrBadRequest,
+			errors.Wrap(
+				err,
+				"failed to push suggestions",
+			),
+		)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	updatedFilesList, err := GetUpdatedFiles(repo, updatedRefs)
+	if err != nil {
+		return nil, errors.Wrap(
+			err,
+			"failed to get list of updated files",
+		)
+	}
+
+	return &UpdateResult{
+		Status:       "ok",
+		UpdatedRefs:  updatedRefs,
+		UpdatedFiles: updatedFilesList,
+	}, nil
+}
+
+type reviewHandler struct {
+	rootPath string
+	protocol *githttp.GitProtocol
+	metrics  base.Metrics
+	log      log15.Logger
+}
+
+// applySuggestionsRequest is the body of a git-apply-suggestions request.
+type applySuggestionsRequest struct {
+	Comments []string `json:"comments"`
+	Message  string   `json:"message"`
+}
+
+func (h *reviewHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	splitPath := strings.SplitN(r.URL.Path[1:], "/", 2)
+	if len(splitPath) != 2 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	repositoryName := splitPath[0]
+	if strings.HasPrefix(repositoryName, ".") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if splitPath[1] == "git-review" {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+	} else if splitPath[1] == "git-apply-suggestions" {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	ctx := request.NewContext(r.Context(), h.metrics)
+	requestContext := request.FromContext(ctx)
+	requestContext.Request.RemoteAddr = r.RemoteAddr
+
+	repositoryPath := path.Join(h.rootPath, repositoryName)
+	h.log.Info(
+		"Request",
+		"Method", r.Method,
+		"path", repositoryPath,
+	)
+	if _, err := os.Stat(repositoryPath); os.IsNotExist(err) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	level, username := h.protocol.AuthCallback(ctx, w, r, repositoryName, githttp.OperationPull)
+	if level == githttp.AuthorizationDenied {
+		return
+	}
+	if !requestContext.Request.CanEdit && !requestContext.Request.HasSolved {
+		h.log.Error(
+			"cannot access the review due to not having permissions",
+			"request", requestContext.Request,
+		)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	repo, err := git.OpenRepository(repositoryPath)
+	if err != nil {
+		h.log.Error("failed to open repository", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer repo.Free()
+
+	lockfile := githttp.NewLockfile(repo.Path())
+	lockStart := time.Now()
+	if ok, err := lockfile.TryRLock(); !ok {
+		h.log.Info("Waiting for the lockfile", "err", err)
+		if err := lockfile.RLock(); err != nil {
+			h.log.Crit("Failed to acquire the lockfile", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	defer lockfile.Unlock()
+	h.metrics.SummaryObserve("gitserver_lock_wait_seconds", time.Since(lockStart).Seconds())
+
+	if splitPath[1] == "git-review" {
+		reviewResult, err := GetReview(repo)
+		if err != nil {
+			h.log.Error("failed to read the review", "path", repositoryPath, "err", err)
+			githttp.WriteHeader(w, err, false)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "\t")
+		encoder.Encode(reviewResult)
+		return
+	}
+
+	var applyRequest applySuggestionsRequest
+	if err := json.NewDecoder(r.Body).Decode(&applyRequest); err != nil {
+		h.log.Error("invalid request", "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if applyRequest.Message == "" {
+		h.log.Error("Missing 'message' field")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	updateResult, err := ApplySuggestions(
+		ctx,
+		repo,
+		lockfile,
+		level,
+		username,
+		applyRequest.Comments,
+		applyRequest.Message,
+		h.protocol,
+		h.log,
+	)
+	if err != nil {
+		h.log.Error("push failed", "path", repositoryPath, "err", err)
+		cause := githttp.WriteHeader(w, err, false)
+
+		updateResult = &UpdateResult{
+			Status: "error",
+			Error:  cause.Error(),
+		}
+	} else {
+		h.log.Info("push successful", "path", repositoryPath, "result", updateResult)
+		w.WriteHeader(http.StatusOK)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "\t")
+	encoder.Encode(&updateResult)
+}
+
+// ReviewHandler is the HTTP handler that allows reading the code reviews
+// stored in refs/meta/review, and applying the replacement suggestions in them
+// as new changes.
+func ReviewHandler(
+	rootPath string,
+	protocol *githttp.GitProtocol,
+	metrics base.Metrics,
+	log log15.Logger,
+) http.Handler {
+	return &reviewHandler{
+		rootPath: rootPath,
+		protocol: protocol,
+		metrics:  metrics,
+		log:      log,
+	}
+}
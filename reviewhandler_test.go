@@ -0,0 +1,436 @@
+package gitserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	git "github.com/lhchavez/git2go/v29"
+	"github.com/omegaup/githttp"
+	"github.com/omegaup/gitserver/gitservertest"
+	base "github.com/omegaup/go-base"
+)
+
+func getReview(
+	t *testing.T,
+	authorization string,
+	problemAlias string,
+	ts *httptest.Server,
+) (int, *ReviewResult) {
+	req, err := http.NewRequest("GET", ts.URL+"/"+problemAlias+"/git-review", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", authorization)
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Failed to get review: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return res.StatusCode, nil
+	}
+
+	var reviewResult ReviewResult
+	if err := json.NewDecoder(res.Body).Decode(&reviewResult); err != nil {
+		t.Fatalf("Failed to unmarshal reviewResult: %v", err)
+	}
+	return res.StatusCode, &reviewResult
+}
+
+func TestReviewHandler(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+
+	log := base.StderrLog()
+	protocol := NewGitProtocol(authorize, nil, false, OverallWallTimeHardLimit, fakeInteractiveSettingsCompiler, log)
+	ts := httptest.NewServer(GitHandler(
+		tmpDir,
+		protocol,
+		&base.NoOpMetrics{},
+		log,
+	))
+	defer ts.Close()
+	reviewTs := httptest.NewServer(ReviewHandler(
+		tmpDir,
+		protocol,
+		&base.NoOpMetrics{},
+		log,
+	))
+	defer reviewTs.Close()
+
+	problemAlias := "sumas"
+
+	{
+		repo, err := InitRepository(path.Join(tmpDir, problemAlias))
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
+
+	if status, _ := getReview(t, userAuthorization, problemAlias, reviewTs); status != http.StatusForbidden {
+		t.Errorf("Expected status %d, got %d", http.StatusForbidden, status)
+	}
+	if status, _ := getReview(t, editorAuthorization, "missing", reviewTs); status != http.StatusNotFound {
+		t.Errorf("Expected status %d, got %d", http.StatusNotFound, status)
+	}
+	if status, reviewResult := getReview(t, editorAuthorization, problemAlias, reviewTs); status != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, status)
+	} else if len(reviewResult.Iterations) != 0 || len(reviewResult.Threads) != 0 || len(reviewResult.Files) != 0 {
+		t.Errorf("Expected empty review, got %v", reviewResult)
+	}
+
+	{
+		newOid, packContents := createCommit(
+			t,
+			tmpDir,
+			problemAlias,
+			&git.Oid{},
+			map[string]io.Reader{
+				"settings.json":          strings.NewReader(gitservertest.DefaultSettingsJSON),
+				"cases/0.in":             strings.NewReader("1 2"),
+				"cases/0.out":            strings.NewReader("3"),
+				"statements/es.markdown": strings.NewReader("Sumas"),
+			},
+			"Initial commit",
+			log,
+		)
+		push(
+			t,
+			tmpDir,
+			editorAuthorization,
+			problemAlias,
+			"refs/changes/initial",
+			&git.Oid{}, newOid,
+			packContents,
+			[]githttp.PktLineResponse{
+				{Line: "unpack ok\n", Err: nil},
+				{Line: "ok refs/changes/initial\n", Err: nil},
+			},
+			ts,
+		)
+	}
+	reviewCommitHash := getReference(t, problemAlias, "refs/changes/initial", ts).String()
+
+	ledgerDate := time.Now().Unix()
+	{
+		newOid, packContents := createCommit(
+			t,
+			tmpDir,
+			problemAlias,
+			&git.Oid{},
+			map[string]io.Reader{
+				"ledger": strings.NewReader(fmt.Sprintf(
+					"{\"uuid\":\"00000000-0000-0000-0000-000000000000\",\"author\":\"editor\",\"commit\":%q,\"date\":%d,\"summary\":\"Good!\",\"vote\":\"approve\"}\n",
+					reviewCommitHash,
+					ledgerDate,
+				)),
+				reviewCommitHash: strings.NewReader(
+					"{\"author\":\"editor\",\"date\":0,\"done\":false,\"filename\":\"cases/0.in\",\"iterationUuid\":\"00000000-0000-0000-0000-000000000000\",\"message\":\"Why?\",\"uuid\":\"00000000-0000-0000-0000-000000000001\"}\n" +
+						"{\"author\":\"editor\",\"date\":0,\"done\":true,\"filename\":\"cases/0.in\",\"iterationUuid\":\"00000000-0000-0000-0000-000000000000\",\"message\":\"Because\",\"uuid\":\"00000000-0000-0000-0000-000000000002\",\"parentUuid\":\"00000000-0000-0000-0000-000000000001\"}\n" +
+						"{\"author\":\"editor\",\"date\":0,\"done\":false,\"filename\":\"statements/es.markdown\",\"iterationUuid\":\"00000000-0000-0000-0000-000000000000\",\"message\":\"Typo\",\"uuid\":\"00000000-0000-0000-0000-000000000003\"}\n",
+				),
+			},
+			"Review\n\nIteration: 00000000-0000-0000-0000-000000000000",
+			log,
+		)
+		push(
+			t,
+			tmpDir,
+			editorAuthorization,
+			problemAlias,
+			"refs/meta/review",
+			&git.Oid{}, newOid,
+			packContents,
+			[]githttp.PktLineResponse{
+				{Line: "unpack ok\n", Err: nil},
+				{Line: "ok refs/meta/review\n", Err: nil},
+			},
+			ts,
+		)
+	}
+
+	status, reviewResult := getReview(t, editorAuthorization, problemAlias, reviewTs)
+	if status != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, status)
+	}
+
+	if len(reviewResult.Iterations) != 1 {
+		t.Fatalf("Expected 1 iteration, got %v", reviewResult.Iterations)
+	}
+	if expectedIteration := (LedgerIteration{
+		Author:  "editor",
+		Commit:  reviewCommitHash,
+		Date:    ledgerDate,
+		Summary: "Good!",
+		UUID:    "00000000-0000-0000-0000-000000000000",
+		Vote:    "approve",
+	}); expectedIteration != *reviewResult.Iterations[0] {
+		t.Errorf("Expected iteration %v, got %v", expectedIteration, *reviewResult.Iterations[0])
+	}
+
+	if len(reviewResult.Threads) != 2 {
+		t.Fatalf("Expected 2 threads, got %v", reviewResult.Threads)
+	}
+	for i, expectedThread := range []struct {
+		filename     string
+		resolved     bool
+		commentUUIDs []string
+	}{
+		{
+			"cases/0.in",
+			true,
+			[]string{"00000000-0000-0000-0000-000000000001", "00000000-0000-0000-0000-000000000002"},
+		},
+		{
+			"statements/es.markdown",
+			false,
+			[]string{"00000000-0000-0000-0000-000000000003"},
+		},
+	} {
+		thread := reviewResult.Threads[i]
+		var commentUUIDs []string
+		for _, comment := range thread.Comments {
+			commentUUIDs = append(commentUUIDs, comment.UUID)
+		}
+		if thread.Commit != reviewCommitHash ||
+			thread.Filename != expectedThread.filename ||
+			thread.Resolved != expectedThread.resolved ||
+			!reflect.DeepEqual(commentUUIDs, expectedThread.commentUUIDs) {
+			t.Errorf("thread %d: expected %v, got %v (%v)", i, expectedThread, *thread, commentUUIDs)
+		}
+	}
+
+	expectedFiles := []*ReviewFileSummary{
+		{
+			Commit:            reviewCommitHash,
+			Filename:          "cases/0.in",
+			Comments:          2,
+			UnresolvedThreads: 0,
+		},
+		{
+			Commit:            reviewCommitHash,
+			Filename:          "statements/es.markdown",
+			Comments:          1,
+			UnresolvedThreads: 1,
+		},
+	}
+	if !reflect.DeepEqual(expectedFiles, reviewResult.Files) {
+		t.Errorf("Expected files %v, got %v", expectedFiles, reviewResult.Files)
+	}
+}
+
+func postSuggestions(
+	t *testing.T,
+	authorization string,
+	problemAlias string,
+	commentUUIDs []string,
+	ts *httptest.Server,
+) (int, *UpdateResult) {
+	body, err := json.Marshal(&applySuggestionsRequest{
+		Comments: commentUUIDs,
+		Message:  "Apply suggestions",
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal request: %v", err)
+	}
+	req, err := http.NewRequest("POST", ts.URL+"/"+problemAlias+"/git-apply-suggestions", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", authorization)
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Failed to apply suggestions: %v", err)
+	}
+	defer res.Body.Close()
+
+	var updateResult UpdateResult
+	if err := json.NewDecoder(res.Body).Decode(&updateResult); err != nil && res.StatusCode == http.StatusOK {
+		t.Fatalf("Failed to unmarshal updateResult: %v", err)
+	}
+	return res.StatusCode, &updateResult
+}
+
+func TestApplySuggestions(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+
+	log := base.StderrLog()
+	protocol := NewGitProtocol(authorize, nil, false, OverallWallTimeHardLimit, fakeInteractiveSettingsCompiler, log)
+	ts := httptest.NewServer(GitHandler(
+		tmpDir,
+		protocol,
+		&base.NoOpMetrics{},
+		log,
+	))
+	defer ts.Close()
+	reviewTs := httptest.NewServer(ReviewHandler(
+		tmpDir,
+		protocol,
+		&base.NoOpMetrics{},
+		log,
+	))
+	defer reviewTs.Close()
+
+	problemAlias := "sumas"
+
+	repo, err := InitRepository(path.Join(tmpDir, problemAlias))
+	if err != nil {
+		t.Fatalf("Failed to initialize git repository: %v", err)
+	}
+	defer repo.Free()
+
+	{
+		newOid, packContents := createCommit(
+			t,
+			tmpDir,
+			problemAlias,
+			&git.Oid{},
+			map[string]io.Reader{
+				"settings.json":          strings.NewReader(gitservertest.DefaultSettingsJSON),
+				"cases/0.in":             strings.NewReader("1 2"),
+				"cases/0.out":            strings.NewReader("3"),
+				"statements/es.markdown": strings.NewReader("Sumas de dos\nnumeros\n"),
+			},
+			"Initial commit",
+			log,
+		)
+		push(
+			t,
+			tmpDir,
+			editorAuthorization,
+			problemAlias,
+			"refs/changes/initial",
+			&git.Oid{}, newOid,
+			packContents,
+			[]githttp.PktLineResponse{
+				{Line: "unpack ok\n", Err: nil},
+				{Line: "ok refs/changes/initial\n", Err: nil},
+			},
+			ts,
+		)
+	}
+	reviewCommitHash := getReference(t, problemAlias, "refs/changes/initial", ts).String()
+
+	{
+		newOid, packContents := createCommit(
+			t,
+			tmpDir,
+			problemAlias,
+			&git.Oid{},
+			map[string]io.Reader{
+				"ledger": strings.NewReader(fmt.Sprintf(
+					"{\"uuid\":\"00000000-0000-0000-0000-000000000000\",\"author\":\"editor\",\"commit\":%q,\"date\":%d,\"summary\":\"Typos\"}\n",
+					reviewCommitHash,
+					time.Now().Unix(),
+				)),
+				reviewCommitHash: strings.NewReader(
+					"{\"author\":\"editor\",\"date\":0,\"done\":false,\"filename\":\"statements/es.markdown\",\"iterationUuid\":\"00000000-0000-0000-0000-000000000000\",\"message\":\"de tres\",\"uuid\":\"00000000-0000-0000-0000-000000000001\",\"replacementSuggestion\":true,\"range\":{\"lineStart\":0,\"lineEnd\":0,\"colStart\":6,\"colEnd\":12}}\n" +
+						"{\"author\":\"editor\",\"date\":0,\"done\":false,\"filename\":\"statements/es.markdown\",\"iterationUuid\":\"00000000-0000-0000-0000-000000000000\",\"message\":\"números\",\"uuid\":\"00000000-0000-0000-0000-000000000002\",\"replacementSuggestion\":true,\"range\":{\"lineStart\":1,\"lineEnd\":1,\"colStart\":0,\"colEnd\":7}}\n" +
+						"{\"author\":\"editor\",\"date\":0,\"done\":false,\"filename\":\"statements/es.markdown\",\"iterationUuid\":\"00000000-0000-0000-0000-000000000000\",\"message\":\"Nice\",\"uuid\":\"00000000-0000-0000-0000-000000000003\"}\n",
+				),
+			},
+			"Review\n\nIteration: 00000000-0000-0000-0000-000000000000",
+			log,
+		)
+		push(
+			t,
+			tmpDir,
+			editorAuthorization,
+			problemAlias,
+			"refs/meta/review",
+			&git.Oid{}, newOid,
+			packContents,
+			[]githttp.PktLineResponse{
+				{Line: "unpack ok\n", Err: nil},
+				{Line: "ok refs/meta/review\n", Err: nil},
+			},
+			ts,
+		)
+	}
+
+	if status, _ := postSuggestions(
+		t,
+		userAuthorization,
+		problemAlias,
+		[]string{"00000000-0000-0000-0000-000000000001"},
+		reviewTs,
+	); status != http.StatusForbidden {
+		t.Errorf("Expected status %d, got %d", http.StatusForbidden, status)
+	}
+	if status, updateResult := postSuggestions(
+		t,
+		editorAuthorization,
+		problemAlias,
+		[]string{"00000000-0000-0000-0000-000000000003"},
+		reviewTs,
+	); status != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d: %v", http.StatusBadRequest, status, updateResult)
+	}
+
+	status, updateResult := postSuggestions(
+		t,
+		editorAuthorization,
+		problemAlias,
+		[]string{"00000000-0000-0000-0000-000000000001", "00000000-0000-0000-0000-000000000002"},
+		reviewTs,
+	)
+	if status != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %v", http.StatusOK, status, updateResult)
+	}
+	if len(updateResult.UpdatedRefs) != 1 || !strings.HasPrefix(updateResult.UpdatedRefs[0].Name, "refs/changes/") {
+		t.Fatalf("Expected a new change, got %v", updateResult.UpdatedRefs)
+	}
+
+	newOid, err := git.NewOid(updateResult.UpdatedRefs[0].To)
+	if err != nil {
+		t.Fatalf("Failed to parse the new commit id: %v", err)
+	}
+	newCommit, err := repo.LookupCommit(newOid)
+	if err != nil {
+		t.Fatalf("Failed to lookup commit: %v", err)
+	}
+	defer newCommit.Free()
+	if newCommit.ParentId(0).String() != reviewCommitHash {
+		t.Errorf("Expected parent %s, got %s", reviewCommitHash, newCommit.ParentId(0))
+	}
+	newTree, err := newCommit.Tree()
+	if err != nil {
+		t.Fatalf("Failed to lookup tree: %v", err)
+	}
+	defer newTree.Free()
+	entry, err := newTree.EntryByPath("statements/es.markdown")
+	if err != nil {
+		t.Fatalf("Failed to find the statement: %v", err)
+	}
+	blob, err := repo.LookupBlob(entry.Id)
+	if err != nil {
+		t.Fatalf("Failed to lookup the statement: %v", err)
+	}
+	defer blob.Free()
+	if expected, got := "Sumas de tres\nnúmeros\n", string(blob.Contents()); expected != got {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
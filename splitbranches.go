@@ -0,0 +1,331 @@
+package gitserver
+
+import (
+	"path"
+
+	"github.com/inconshreveable/log15"
+	git "github.com/lhchavez/git2go/v29"
+	"github.com/omegaup/githttp"
+	base "github.com/omegaup/go-base"
+	"github.com/pkg/errors"
+)
+
+// SplitCommitMapping is the result of regenerating the split commits of a
+// single commit in master.
+type SplitCommitMapping struct {
+	MasterCommitID string `json:"master_commit_id"`
+
+	// OriginalCommitIDs maps each split reference to the commit that was
+	// generated for it when the master commit was pushed.
+	OriginalCommitIDs map[string]string `json:"original_commit_ids,omitempty"`
+
+	// NewCommitIDs maps each split reference to the regenerated commit. It is
+	// empty in verify-only mode.
+	NewCommitIDs map[string]string `json:"new_commit_ids,omitempty"`
+
+	// NewTreeIDs maps each split reference to the regenerated tree.
+	NewTreeIDs map[string]string `json:"new_tree_ids"`
+
+	// Drift is the list of split references whose original tree is not the
+	// same as the regenerated one.
+	Drift []string `json:"drift,omitempty"`
+}
+
+// SplitBranchesReport is the result of regenerating the split branches of a
+// repository.
+type SplitBranchesReport struct {
+	// CommitMapping maps each original split commit to its regenerated one.
+	CommitMapping map[string]string     `json:"commit_mapping,omitempty"`
+	Commits       []*SplitCommitMapping `json:"commits"`
+	Drift         bool                  `json:"drift"`
+	VerifyOnly    bool                  `json:"verify_only,omitempty"`
+	UpdatedRefs   []githttp.UpdatedRef  `json:"updated_refs,omitempty"`
+}
+
+// splitTrees returns the trees of the split branches of the tree, one for
+// each description. It mirrors githttp.SplitCommit: every path in the tree is
+// considered, each path goes to the first description that matches it, and
+// the trees are built with githttp.SplitTree. This way the trees are the same
+// as the ones of the split commits that are created when master is pushed.
+func splitTrees(
+	repository *git.Repository,
+	tree *git.Tree,
+	descriptions []githttp.SplitCommitDescription,
+	log log15.Logger,
+) ([]*git.Oid, error) {
+	treePaths := make([][]string, len(descriptions))
+	if err := tree.Walk(func(parent string, entry *git.TreeEntry) int {
+		entryPath := path.Join(parent, entry.Name)
+		for i := range descriptions {
+			if descriptions[i].ContainsPath(entryPath) {
+				treePaths[i] = append(treePaths[i], entryPath)
+				break
+			}
+		}
+		return 0
+	}); err != nil {
+		return nil, errors.Wrapf(err, "failed to walk tree %s", tree.Id())
+	}
+
+	treeIDs := make([]*git.Oid, len(descriptions))
+	for i := range descriptions {
+		splitTree, err := githttp.SplitTree(tree, repository, treePaths[i], repository, log)
+		if err != nil {
+			return nil, errors.Wrapf(
+				err,
+				"failed to split tree %s for %s",
+				tree.Id(),
+				descriptions[i].ReferenceName,
+			)
+		}
+		treeIDs[i] = splitTree.Id()
+		splitTree.Free()
+	}
+	return treeIDs, nil
+}
+
+// masterHistory returns the commits in master, oldest first. Each commit in
+// master has the commits of the split branches as its last parents, in the
+// order of the descriptions, and the previous commit in master as its first
+// one.
+func masterHistory(
+	repository *git.Repository,
+	descriptions []githttp.SplitCommitDescription,
+) ([]*git.Commit, error) {
+	masterRef, err := repository.References.Lookup("refs/heads/master")
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(err, "failed to lookup master"),
+		)
+	}
+	defer masterRef.Free()
+
+	commit, err := repository.LookupCommit(masterRef.Target())
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(err, "failed to lookup the master commit"),
+		)
+	}
+
+	var commits []*git.Commit
+	for {
+		commits = append(commits, commit)
+		if commit.ParentCount() <= uint(len(descriptions)) {
+			// First commit in master.
+			break
+		}
+		commit = commit.Parent(0)
+		if commit == nil {
+			break
+		}
+	}
+
+	for i, j := 0, len(commits)-1; i < j; i, j = i+1, j-1 {
+		commits[i], commits[j] = commits[j], commits[i]
+	}
+	return commits, nil
+}
+
+// RebuildSplitBranches replays the history of master and regenerates the
+// split branches (refs/heads/public, refs/heads/protected and
+// refs/heads/private by default) from it, so that changes to the descriptions
+// are applied to existing repositories. Master itself is not rewritten. In
+// verify-only mode nothing is written and the report only lists the commits
+// whose split trees drifted from what the descriptions say.
+func RebuildSplitBranches(
+	repositoryPath string,
+	descriptions []githttp.SplitCommitDescription,
+	verifyOnly bool,
+	log log15.Logger,
+) (*SplitBranchesReport, error) {
+	repository, err := git.OpenRepository(repositoryPath)
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to open repository at %s",
+				repositoryPath,
+			),
+		)
+	}
+	defer repository.Free()
+
+	lockfile := githttp.NewLockfile(repository.Path())
+	if verifyOnly {
+		if ok, err := lockfile.TryRLock(); !ok {
+			log.Info("Waiting for the lockfile", "path", repositoryPath, "err", err)
+			if err := lockfile.RLock(); err != nil {
+				return nil, errors.Wrap(err, "failed to acquire the lockfile")
+			}
+		}
+	} else {
+		if ok, err := lockfile.TryLock(); !ok {
+			log.Info("Waiting for the lockfile", "path", repositoryPath, "err", err)
+			if err := lockfile.Lock(); err != nil {
+				return nil, errors.Wrap(err, "failed to acquire the lockfile")
+			}
+		}
+	}
+	defer lockfile.Unlock()
+
+	commits, err := masterHistory(repository, descriptions)
+	if err != nil {
+		// masterHistory already wrapped the error correctly.
+		return nil, err
+	}
+	defer func() {
+		for _, commit := range commits {
+			commit.Free()
+		}
+	}()
+
+	report := &SplitBranchesReport{
+		CommitMapping: make(map[string]string),
+		Commits:       []*SplitCommitMapping{},
+		VerifyOnly:    verifyOnly,
+	}
+	parents := make([]*git.Oid, len(descriptions))
+	for _, commit := range commits {
+		tree, err := commit.Tree()
+		if err != nil {
+			return nil, base.ErrorWithCategory(
+				ErrInternalGit,
+				errors.Wrapf(err, "failed to get the tree of commit %s", commit.Id()),
+			)
+		}
+
+		mapping := &SplitCommitMapping{
+			MasterCommitID:    commit.Id().String(),
+			OriginalCommitIDs: make(map[string]string),
+			NewTreeIDs:        make(map[string]string),
+		}
+		if !verifyOnly {
+			mapping.NewCommitIDs = make(map[string]string)
+		}
+		newTreeIDs, err := splitTrees(repository, tree, descriptions, log)
+		if err != nil {
+			tree.Free()
+			return nil, base.ErrorWithCategory(
+				ErrInternalGit,
+				errors.Wrapf(
+					err,
+					"failed to split the tree of commit %s",
+					commit.Id(),
+				),
+			)
+		}
+		firstSplitParent := int(commit.ParentCount()) - len(descriptions)
+		for i, description := range descriptions {
+			newTreeID := newTreeIDs[i]
+			mapping.NewTreeIDs[description.ReferenceName] = newTreeID.String()
+
+			var originalCommitID *git.Oid
+			if firstSplitParent >= 0 {
+				originalCommitID = commit.ParentId(uint(firstSplitParent + i))
+				mapping.OriginalCommitIDs[description.ReferenceName] = originalCommitID.String()
+				originalCommit, err := repository.LookupCommit(originalCommitID)
+				if err != nil {
+					tree.Free()
+					return nil, base.ErrorWithCategory(
+						ErrInternalGit,
+						errors.Wrapf(err, "failed to lookup commit %s", originalCommitID),
+					)
+				}
+				if !originalCommit.TreeId().Equal(newTreeID) {
+					mapping.Drift = append(mapping.Drift, description.ReferenceName)
+				}
+				originalCommit.Free()
+			} else {
+				mapping.Drift = append(mapping.Drift, description.ReferenceName)
+			}
+
+			if verifyOnly {
+				continue
+			}
+
+			var commitParents []*git.Oid
+			if parents[i] != nil {
+				commitParents = append(commitParents, parents[i])
+			}
+			newCommitID, err := repository.CreateCommitFromIds(
+				"",
+				commit.Author(),
+				commit.Committer(),
+				commit.Message(),
+				newTreeID,
+				commitParents...,
+			)
+			if err != nil {
+				tree.Free()
+				return nil, base.ErrorWithCategory(
+					ErrInternalGit,
+					errors.Wrapf(
+						err,
+						"failed to create the %s commit for %s",
+						description.ReferenceName,
+						commit.Id(),
+					),
+				)
+			}
+			parents[i] = newCommitID
+			mapping.NewCommitIDs[description.ReferenceName] = newCommitID.String()
+			if originalCommitID != nil {
+				report.CommitMapping[originalCommitID.String()] = newCommitID.String()
+			}
+		}
+		tree.Free()
+
+		if len(mapping.Drift) != 0 {
+			report.Drift = true
+		}
+		report.Commits = append(report.Commits, mapping)
+	}
+
+	if verifyOnly {
+		return report, nil
+	}
+
+	for i, description := range descriptions {
+		if parents[i] == nil {
+			continue
+		}
+		updatedRef := githttp.UpdatedRef{
+			Name: description.ReferenceName,
+			From: (&git.Oid{}).String(),
+			To:   parents[i].String(),
+		}
+		if oldRef, err := repository.References.Lookup(description.ReferenceName); err == nil {
+			updatedRef.From = oldRef.Target().String()
+			oldRef.Free()
+		}
+		if updatedRef.From == updatedRef.To {
+			continue
+		}
+		ref, err := repository.References.Create(
+			description.ReferenceName,
+			parents[i],
+			true,
+			"rebuild split branch",
+		)
+		if err != nil {
+			return report, base.ErrorWithCategory(
+				ErrInternalGit,
+				errors.Wrapf(err, "failed to update %s", description.ReferenceName),
+			)
+		}
+		ref.Free()
+		log.Info(
+			"Rebuilt split branch",
+			"path", repositoryPath,
+			"ref", description.ReferenceName,
+			"from", updatedRef.From,
+			"to", updatedRef.To,
+		)
+		report.UpdatedRefs = append(report.UpdatedRefs, updatedRef)
+	}
+
+	return report, nil
+}
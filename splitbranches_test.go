@@ -0,0 +1,287 @@
+package gitserver
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"testing"
+
+	git "github.com/lhchavez/git2go/v29"
+	"github.com/omegaup/githttp"
+	"github.com/omegaup/gitserver/gitservertest"
+	base "github.com/omegaup/go-base"
+)
+
+func TestRebuildSplitBranches(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+
+	log := base.StderrLog()
+	ts := httptest.NewServer(GitHandler(
+		tmpDir,
+		NewGitProtocol(authorize, nil, true, OverallWallTimeHardLimit, fakeInteractiveSettingsCompiler, log),
+		&base.NoOpMetrics{},
+		log,
+	))
+	defer ts.Close()
+
+	problemAlias := "sumas"
+	repositoryPath := path.Join(tmpDir, problemAlias)
+
+	{
+		repo, err := InitRepository(repositoryPath)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
+
+	for _, statement := range []string{"Sumas", "Sumas enteras"} {
+		newOid, packContents := createCommit(
+			t,
+			tmpDir,
+			problemAlias,
+			getReference(t, problemAlias, "refs/heads/master", ts),
+			map[string]io.Reader{
+				"settings.json":          strings.NewReader(gitservertest.DefaultSettingsJSON),
+				"cases/0.in":             strings.NewReader("1 2"),
+				"cases/0.out":            strings.NewReader("3"),
+				"statements/es.markdown": strings.NewReader(statement),
+			},
+			"Update statement",
+			log,
+		)
+		push(
+			t,
+			tmpDir,
+			adminAuthorization,
+			problemAlias,
+			"refs/heads/master",
+			getReference(t, problemAlias, "refs/heads/master", ts),
+			newOid,
+			packContents,
+			[]githttp.PktLineResponse{
+				{Line: "unpack ok\n", Err: nil},
+				{Line: "ok refs/heads/master\n", Err: nil},
+			},
+			ts,
+		)
+	}
+
+	// The branches were split with the default descriptions, so there is no
+	// drift.
+	report, err := RebuildSplitBranches(repositoryPath, DefaultCommitDescriptions, true, log)
+	if err != nil {
+		t.Fatalf("Failed to verify the split branches: %v", err)
+	}
+	if report.Drift || len(report.Commits) != 2 {
+		t.Errorf("Unexpected report %v", report)
+	}
+
+	// Make the cases public.
+	descriptions := make([]githttp.SplitCommitDescription, len(DefaultCommitDescriptions))
+	copy(descriptions, DefaultCommitDescriptions)
+	descriptions[0].PathRegexps = append(
+		[]*regexp.Regexp{regexp.MustCompile("^cases(/[^/]+\\.(in|out))?$")},
+		DefaultCommitDescriptions[0].PathRegexps...,
+	)
+
+	originalPublicOid := getReference(t, problemAlias, "refs/heads/public", ts)
+	report, err = RebuildSplitBranches(repositoryPath, descriptions, true, log)
+	if err != nil {
+		t.Fatalf("Failed to verify the split branches: %v", err)
+	}
+	if !report.Drift {
+		t.Errorf("Expected drift, got %v", report)
+	}
+	for _, mapping := range report.Commits {
+		if len(mapping.Drift) != 1 || mapping.Drift[0] != "refs/heads/public" {
+			t.Errorf("Unexpected drift for %s: %v", mapping.MasterCommitID, mapping.Drift)
+		}
+	}
+	if !getReference(t, problemAlias, "refs/heads/public", ts).Equal(originalPublicOid) {
+		t.Errorf("Verifying should not update the public branch")
+	}
+
+	report, err = RebuildSplitBranches(repositoryPath, descriptions, false, log)
+	if err != nil {
+		t.Fatalf("Failed to rebuild the split branches: %v", err)
+	}
+	var publicUpdatedRef *githttp.UpdatedRef
+	for i, updatedRef := range report.UpdatedRefs {
+		if updatedRef.Name == "refs/heads/public" {
+			publicUpdatedRef = &report.UpdatedRefs[i]
+		}
+	}
+	if publicUpdatedRef == nil {
+		t.Fatalf("Expected refs/heads/public to be updated, got %v", report.UpdatedRefs)
+	}
+	if newPublic, ok := report.CommitMapping[originalPublicOid.String()]; !ok || newPublic != publicUpdatedRef.To {
+		t.Errorf("Expected %s to be mapped to %s, got %v", originalPublicOid, publicUpdatedRef.To, report.CommitMapping)
+	}
+
+	repo, err := git.OpenRepository(repositoryPath)
+	if err != nil {
+		t.Fatalf("Failed to open repository: %v", err)
+	}
+	defer repo.Free()
+	publicCommit, err := repo.LookupCommit(getReference(t, problemAlias, "refs/heads/public", ts))
+	if err != nil {
+		t.Fatalf("Failed to lookup the public commit: %v", err)
+	}
+	defer publicCommit.Free()
+	if publicCommit.ParentCount() != 1 {
+		t.Errorf("Expected the rebuilt public branch to keep its history, got %d parents", publicCommit.ParentCount())
+	}
+	publicTree, err := publicCommit.Tree()
+	if err != nil {
+		t.Fatalf("Failed to lookup the public tree: %v", err)
+	}
+	defer publicTree.Free()
+	if _, err := publicTree.EntryByPath("cases/0.in"); err != nil {
+		t.Errorf("Expected cases/0.in in the public branch: %v", err)
+	}
+	if _, err := publicTree.EntryByPath("settings.json"); err == nil {
+		t.Errorf("Did not expect settings.json in the public branch")
+	}
+}
+
+func TestRebuildSplitBranchesInteractive(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+
+	log := base.StderrLog()
+	ts := httptest.NewServer(GitHandler(
+		tmpDir,
+		NewGitProtocol(authorize, nil, true, OverallWallTimeHardLimit, interactiveSettingsCompiler, log),
+		&base.NoOpMetrics{},
+		log,
+	))
+	defer ts.Close()
+
+	problemAlias := "sumas"
+	repositoryPath := path.Join(tmpDir, problemAlias)
+
+	{
+		repo, err := InitRepository(repositoryPath)
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
+
+	for _, statement := range []string{"Sumas", "Sumas enteras"} {
+		newOid, packContents := createCommit(
+			t,
+			tmpDir,
+			problemAlias,
+			getReference(t, problemAlias, "refs/heads/master", ts),
+			interactiveProblemContents(statement),
+			"Update statement",
+			log,
+		)
+		push(
+			t,
+			tmpDir,
+			adminAuthorization,
+			problemAlias,
+			"refs/heads/master",
+			getReference(t, problemAlias, "refs/heads/master", ts),
+			newOid,
+			packContents,
+			[]githttp.PktLineResponse{
+				{Line: "unpack ok\n", Err: nil},
+				{Line: "ok refs/heads/master\n", Err: nil},
+			},
+			ts,
+		)
+	}
+
+	originalTreeIDs := make(map[string]*git.Oid)
+	{
+		repo, err := git.OpenRepository(repositoryPath)
+		if err != nil {
+			t.Fatalf("Failed to open repository: %v", err)
+		}
+		for _, description := range DefaultCommitDescriptions {
+			commit, err := repo.LookupCommit(getReference(t, problemAlias, description.ReferenceName, ts))
+			if err != nil {
+				t.Fatalf("Failed to lookup %s: %v", description.ReferenceName, err)
+			}
+			originalTreeIDs[description.ReferenceName] = commit.TreeId()
+			commit.Free()
+		}
+		repo.Free()
+	}
+
+	report, err := RebuildSplitBranches(repositoryPath, DefaultCommitDescriptions, true, log)
+	if err != nil {
+		t.Fatalf("Failed to verify the split branches: %v", err)
+	}
+	if report.Drift || len(report.Commits) != 2 {
+		t.Errorf("Unexpected report %v", report)
+	}
+
+	// Rebuilding produces exactly the same trees that were split when master
+	// was pushed.
+	if _, err := RebuildSplitBranches(repositoryPath, DefaultCommitDescriptions, false, log); err != nil {
+		t.Fatalf("Failed to rebuild the split branches: %v", err)
+	}
+	repo, err := git.OpenRepository(repositoryPath)
+	if err != nil {
+		t.Fatalf("Failed to open repository: %v", err)
+	}
+	defer repo.Free()
+	for _, description := range DefaultCommitDescriptions {
+		commit, err := repo.LookupCommit(getReference(t, problemAlias, description.ReferenceName, ts))
+		if err != nil {
+			t.Fatalf("Failed to lookup %s: %v", description.ReferenceName, err)
+		}
+		if !commit.TreeId().Equal(originalTreeIDs[description.ReferenceName]) {
+			t.Errorf(
+				"Expected %s to have tree %s, got %s",
+				description.ReferenceName,
+				originalTreeIDs[description.ReferenceName],
+				commit.TreeId(),
+			)
+		}
+		commit.Free()
+	}
+
+	publicCommit, err := repo.LookupCommit(getReference(t, problemAlias, "refs/heads/public", ts))
+	if err != nil {
+		t.Fatalf("Failed to lookup the public commit: %v", err)
+	}
+	defer publicCommit.Free()
+	publicTree, err := publicCommit.Tree()
+	if err != nil {
+		t.Fatalf("Failed to lookup the public tree: %v", err)
+	}
+	defer publicTree.Free()
+	for _, filename := range []string{
+		"interactive/Main.distrib.cpp",
+		"interactive/examples/sample.in",
+		"interactive/examples/sample.out",
+	} {
+		if _, err := publicTree.EntryByPath(filename); err != nil {
+			t.Errorf("Expected %s in the public branch: %v", filename, err)
+		}
+	}
+	if _, err := publicTree.EntryByPath("interactive/Main.cpp"); err == nil {
+		t.Errorf("Did not expect interactive/Main.cpp in the public branch")
+	}
+}
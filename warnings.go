@@ -0,0 +1,257 @@
+package gitserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/omegaup/gitserver/request"
+)
+
+const (
+	// WarningSkippedFile is the code of the warning for a file that is not
+	// part of any of the split branches, and was therefore dropped.
+	WarningSkippedFile = "skipped-file"
+
+	// WarningOverwrittenFile is the code of the warning for a file whose
+	// contents were replaced by the ones the server always uses.
+	WarningOverwrittenFile = "overwritten-file"
+
+	// WarningConvertedEncoding is the code of the warning for a file whose
+	// encoding had to be guessed to convert it to UTF-8.
+	WarningConvertedEncoding = "converted-encoding"
+
+	// WarningNormalizedFile is the code of the warning for a file whose
+	// contents were normalized.
+	WarningNormalizedFile = "normalized-file"
+
+	// WarningGeneratedFile is the code of the warning for a file that was not
+	// provided and was generated by the server.
+	WarningGeneratedFile = "generated-file"
+
+	// WarningConvertedFile is the code of the warning for a file that was
+	// converted from another problem format and might need to be reviewed.
+	WarningConvertedFile = "converted-file"
+
+	// sideBandCapability is the capability that git clients use to ask for
+	// progress messages, which is how the warnings of a push are shown.
+	sideBandCapability = "side-band-64k"
+
+	// maxPktLineLength is the largest pkt-line allowed by the git protocol,
+	// including the 4-byte length.
+	maxPktLineLength = 65520
+)
+
+// addWarning records a warning in the request associated with the context.
+// Repeated warnings for the same file are only recorded once, since the same
+// file can go through several of the stages of the request.
+func addWarning(ctx context.Context, code, path, message string) {
+	requestContext := request.FromContext(ctx)
+	if requestContext == nil {
+		return
+	}
+	for _, warning := range requestContext.Warnings {
+		if warning.Code == code && warning.Path == path {
+			return
+		}
+	}
+	requestContext.Warnings = append(requestContext.Warnings, request.Warning{
+		Code:    code,
+		Path:    path,
+		Message: message,
+	})
+}
+
+// readPktLine returns the length of the first pkt-line in buf, or zero if it
+// is not complete yet. Flush-pkts have a length of 4.
+func readPktLine(buf []byte) (int, error) {
+	if len(buf) < 4 {
+		return 0, nil
+	}
+	length, err := strconv.ParseUint(string(buf[:4]), 16, 16)
+	if err != nil {
+		return 0, err
+	}
+	if length == 0 {
+		return 4, nil
+	}
+	if length < 4 {
+		return 0, fmt.Errorf("invalid pkt-line length %d", length)
+	}
+	if uint64(len(buf)) < length {
+		return 0, nil
+	}
+	return int(length), nil
+}
+
+// sideBandAdvertisementWriter is an http.ResponseWriter for the reference
+// advertisement of git-receive-pack. githttp does not advertise the
+// side-band capability, so it is added to the capabilities of the first
+// reference, so that git clients ask for it.
+type sideBandAdvertisementWriter struct {
+	http.ResponseWriter
+	buf  []byte
+	done bool
+}
+
+func (w *sideBandAdvertisementWriter) Write(p []byte) (int, error) {
+	if w.done {
+		return w.ResponseWriter.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	for !w.done {
+		length, err := readPktLine(w.buf)
+		if err != nil {
+			// Not a pkt-line stream, so just get out of the way.
+			w.done = true
+			break
+		}
+		if length == 0 {
+			break
+		}
+		line := w.buf[:length]
+		if nul := bytes.IndexByte(line, 0); length > 4 && nul != -1 {
+			capabilities := bytes.TrimSuffix(line[nul+1:], []byte("\n"))
+			payload := fmt.Sprintf(
+				"%s\x00%s %s\n",
+				line[4:nul],
+				capabilities,
+				sideBandCapability,
+			)
+			if _, err := fmt.Fprintf(w.ResponseWriter, "%04x%s", len(payload)+4, payload); err != nil {
+				return 0, err
+			}
+			w.done = true
+		} else if _, err := w.ResponseWriter.Write(line); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[length:]
+	}
+	if w.done {
+		if err := w.Close(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush sends any buffered data to the client.
+func (w *sideBandAdvertisementWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close writes whatever was still buffered.
+func (w *sideBandAdvertisementWriter) Close() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.ResponseWriter.Write(w.buf)
+	w.buf = nil
+	return err
+}
+
+// requestsSideBand returns whether the first command of a git-receive-pack
+// request asks for the side-band capability. The reader is only peeked, so
+// it can still be consumed afterwards.
+func requestsSideBand(br *bufio.Reader) bool {
+	header, err := br.Peek(4)
+	if err != nil {
+		return false
+	}
+	length, err := strconv.ParseUint(string(header), 16, 16)
+	if err != nil || length <= 4 {
+		return false
+	}
+	line, err := br.Peek(int(length))
+	if err != nil {
+		return false
+	}
+	nul := bytes.IndexByte(line, 0)
+	if nul == -1 {
+		return false
+	}
+	for _, capability := range bytes.Fields(line[nul+1:]) {
+		if string(capability) == sideBandCapability {
+			return true
+		}
+	}
+	return false
+}
+
+// sideBandWarningWriter is an http.ResponseWriter for git-receive-pack
+// responses of clients that asked for the side-band capability. The report
+// written by githttp is buffered until the push is done, since that is when
+// all the warnings are known. Then the warnings are sent as progress
+// messages, followed by the report in the data band.
+type sideBandWarningWriter struct {
+	http.ResponseWriter
+	requestContext *request.Context
+	statusCode     int
+	buf            bytes.Buffer
+}
+
+// WriteHeader records the status code of the response. Responses with an
+// error are not pkt-line streams, so they are sent as-is.
+func (w *sideBandWarningWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+}
+
+func (w *sideBandWarningWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+// Flush is a no-op, since the response can only be sent once the push is
+// done.
+func (w *sideBandWarningWriter) Flush() {
+}
+
+// Close sends the response to the client.
+func (w *sideBandWarningWriter) Close() error {
+	if w.statusCode != 0 && w.statusCode != http.StatusOK {
+		w.ResponseWriter.WriteHeader(w.statusCode)
+		_, err := w.ResponseWriter.Write(w.buf.Bytes())
+		return err
+	}
+	if w.buf.Len() == 0 {
+		// The client did not ask for a report, so there is nothing to wrap.
+		return nil
+	}
+	for _, warning := range w.requestContext.Warnings {
+		message := fmt.Sprintf("warning: %s", warning.Code)
+		if warning.Path != "" {
+			message += fmt.Sprintf(": %s", warning.Path)
+		}
+		message += fmt.Sprintf(": %s\n", warning.Message)
+		if err := w.writeBand(2, []byte(message)); err != nil {
+			return err
+		}
+	}
+	if err := w.writeBand(1, w.buf.Bytes()); err != nil {
+		return err
+	}
+	_, err := w.ResponseWriter.Write([]byte("0000"))
+	return err
+}
+
+// writeBand sends the payload in the band, split in as many pkt-lines as
+// needed. The band number and the length take five bytes.
+func (w *sideBandWarningWriter) writeBand(band byte, payload []byte) error {
+	for len(payload) > 0 {
+		chunk := payload
+		if len(chunk) > maxPktLineLength-5 {
+			chunk = chunk[:maxPktLineLength-5]
+		}
+		if _, err := fmt.Fprintf(w.ResponseWriter, "%04x%c%s", len(chunk)+5, band, chunk); err != nil {
+			return err
+		}
+		payload = payload[len(chunk):]
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package gitserver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/omegaup/gitserver/request"
+	base "github.com/omegaup/go-base"
+)
+
+func TestAddWarning(t *testing.T) {
+	ctx := request.NewContext(context.Background(), &base.NoOpMetrics{})
+	addWarning(ctx, WarningSkippedFile, "notes.txt", "dropped")
+	addWarning(ctx, WarningSkippedFile, "notes.txt", "dropped again")
+	addWarning(ctx, WarningNormalizedFile, "notes.txt", "normalized")
+
+	warnings := request.FromContext(ctx).Warnings
+	if len(warnings) != 2 {
+		t.Errorf("Expected repeated warnings to be recorded once, got %v", warnings)
+	}
+
+	// Contexts without a request are ignored.
+	addWarning(context.Background(), WarningSkippedFile, "notes.txt", "dropped")
+}
+
+func TestRequestsSideBand(t *testing.T) {
+	pktLine := func(payload string) string {
+		return fmt.Sprintf("%04x%s", len(payload)+4, payload)
+	}
+	command := "0000000000000000000000000000000000000000 0123456789012345678901234567890123456789 refs/heads/master"
+	for _, testCase := range []struct {
+		body     string
+		sideBand bool
+	}{
+		{pktLine(command+"\x00report-status side-band-64k agent=git/2.30.0\n") + "0000", true},
+		{pktLine(command+"\x00report-status side-band\n") + "0000", false},
+		{pktLine(command+"\x00report-status\n") + "0000", false},
+		{pktLine(command+"\n") + "0000", false},
+		{"0000", false},
+		{"", false},
+	} {
+		br := bufio.NewReaderSize(strings.NewReader(testCase.body), maxPktLineLength)
+		if sideBand := requestsSideBand(br); sideBand != testCase.sideBand {
+			t.Errorf("requestsSideBand(%q) = %v, want %v", testCase.body, sideBand, testCase.sideBand)
+		}
+		// The body must not have been consumed.
+		if buffered := br.Buffered(); buffered != len(testCase.body) {
+			t.Errorf("Expected %d bytes to be buffered, got %d", len(testCase.body), buffered)
+		}
+	}
+}
+
+func TestSideBandAdvertisementWriter(t *testing.T) {
+	pktLine := func(payload string) string {
+		return fmt.Sprintf("%04x%s", len(payload)+4, payload)
+	}
+	oid := "0123456789012345678901234567890123456789"
+	advertisement := pktLine("# service=git-receive-pack\n") + "0000" +
+		pktLine(oid+" refs/heads/master\x00agent=gohttp report-status\n") +
+		pktLine(oid+" refs/heads/public\n") + "0000"
+
+	recorder := httptest.NewRecorder()
+	w := &sideBandAdvertisementWriter{ResponseWriter: recorder}
+	// Write the advertisement in small pieces to make sure that the
+	// pkt-lines are reassembled correctly.
+	for i := 0; i < len(advertisement); i += 3 {
+		end := i + 3
+		if end > len(advertisement) {
+			end = len(advertisement)
+		}
+		if _, err := w.Write([]byte(advertisement[i:end])); err != nil {
+			t.Fatalf("Failed to write the advertisement: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close the writer: %v", err)
+	}
+
+	expected := pktLine("# service=git-receive-pack\n") + "0000" +
+		pktLine(oid+" refs/heads/master\x00agent=gohttp report-status side-band-64k\n") +
+		pktLine(oid+" refs/heads/public\n") + "0000"
+	if recorder.Body.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, recorder.Body.String())
+	}
+}
+
+func TestSideBandWarningWriter(t *testing.T) {
+	ctx := request.NewContext(context.Background(), &base.NoOpMetrics{})
+	requestContext := request.FromContext(ctx)
+
+	recorder := httptest.NewRecorder()
+	w := &sideBandWarningWriter{
+		ResponseWriter: recorder,
+		requestContext: requestContext,
+	}
+	report := "000eunpack ok\n" + "0019ok refs/heads/master\n" + "0000"
+	if _, err := w.Write([]byte(report)); err != nil {
+		t.Fatalf("Failed to write the response: %v", err)
+	}
+	// The warnings are only known once the push is done.
+	addWarning(ctx, WarningSkippedFile, "notes.txt", "the file was dropped")
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close the writer: %v", err)
+	}
+
+	warning := "warning: skipped-file: notes.txt: the file was dropped\n"
+	expected := fmt.Sprintf("%04x\x02%s", len(warning)+5, warning) +
+		fmt.Sprintf("%04x\x01%s", len(report)+5, report) +
+		"0000"
+	if recorder.Body.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, recorder.Body.String())
+	}
+
+	// Errors are sent as-is.
+	recorder = httptest.NewRecorder()
+	w = &sideBandWarningWriter{
+		ResponseWriter: recorder,
+		requestContext: requestContext,
+	}
+	w.WriteHeader(http.StatusForbidden)
+	if _, err := w.Write([]byte("forbidden")); err != nil {
+		t.Fatalf("Failed to write the response: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close the writer: %v", err)
+	}
+	if recorder.Code != http.StatusForbidden || recorder.Body.String() != "forbidden" {
+		t.Errorf("Expected a forbidden response, got %d %q", recorder.Code, recorder.Body.String())
+	}
+}
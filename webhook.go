@@ -0,0 +1,596 @@
+package gitserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	git "github.com/lhchavez/git2go/v29"
+	"github.com/omegaup/githttp"
+	"github.com/omegaup/gitserver/request"
+	base "github.com/omegaup/go-base"
+	"github.com/pkg/errors"
+)
+
+const (
+	// WebhookSignatureHeader is the HTTP header that contains the HMAC-SHA256
+	// signature of the webhook payload, keyed with the webhook's secret.
+	WebhookSignatureHeader = "X-Omegaup-Signature"
+
+	// WebhookDeliveryHeader is the HTTP header that contains a unique
+	// identifier of the webhook delivery. It is preserved across retries.
+	WebhookDeliveryHeader = "X-Omegaup-Delivery"
+
+	// failedWebhooksDirectory is the subdirectory of the queue where the
+	// deliveries that exhausted all their attempts are moved to.
+	failedWebhooksDirectory = "failed"
+)
+
+// WebhookConfig is an endpoint that is notified after references are updated.
+//
+// The secret of the webhooks of a problem is stored in plain text in its
+// refs/meta/config, so anyone that can edit the problem can read it. Receivers
+// should use a secret that is specific to the problem and not reuse it
+// anywhere else.
+type WebhookConfig struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+}
+
+// WebhookEvent is the payload of the webhook that is sent after references
+// of a problem are updated.
+type WebhookEvent struct {
+	Problem      string               `json:"problem"`
+	Username     string               `json:"username"`
+	ReviewRef    string               `json:"review_ref,omitempty"`
+	UpdatedRefs  []githttp.UpdatedRef `json:"updated_refs"`
+	UpdatedFiles []UpdatedFile        `json:"updated_files"`
+}
+
+// webhookDelivery is a pending webhook delivery, as stored in the queue.
+type webhookDelivery struct {
+	URL         string          `json:"url"`
+	Signature   string          `json:"signature"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"nextAttempt"`
+	LastError   string          `json:"lastError,omitempty"`
+
+	// Global is whether the delivery is for one of the webhooks of the server
+	// configuration, which are trusted to be delivered to private addresses.
+	Global bool `json:"global,omitempty"`
+}
+
+// privateNetworks are the address ranges that the webhooks of a problem are
+// not allowed to be delivered to, so that they cannot be used to reach
+// services that are only available from the server. Besides the private
+// networks, this includes the ranges that are reserved for special purposes,
+// which are never the address of a legitimate public receiver.
+var privateNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.0.0.0/24",
+		"192.0.2.0/24",
+		"192.88.99.0/24",
+		"192.168.0.0/16",
+		"198.18.0.0/15",
+		"198.51.100.0/24",
+		"203.0.113.0/24",
+		"224.0.0.0/4",
+		"240.0.0.0/4",
+		"::/96",
+		"64:ff9b:1::/48",
+		"100::/64",
+		"2001::/23",
+		"2001:db8::/32",
+		"fc00::/7",
+		"fe80::/10",
+		"ff00::/8",
+	} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// nat64Network is the well-known prefix of the IPv6 addresses that translate
+// to the IPv4 address in their last four bytes.
+var nat64Network = func() *net.IPNet {
+	_, network, err := net.ParseCIDR("64:ff9b::/96")
+	if err != nil {
+		panic(err)
+	}
+	return network
+}()
+
+// isPrivateAddress returns whether the IP address is in one of the private
+// networks. IPv4-mapped and NAT64 addresses are checked with the IPv4 address
+// they translate to.
+func isPrivateAddress(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	} else if len(ip) == net.IPv6len && nat64Network.Contains(ip) {
+		ip = ip[12:]
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// SignWebhookPayload returns the value of the signature header for the
+// payload.
+func SignWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookQueue is a durable queue of webhook deliveries. Every delivery is a
+// file in the queue directory, so deliveries that were pending when the
+// server stopped are retried when it starts again.
+type WebhookQueue struct {
+	// MaxAttempts is the number of times a delivery is attempted before it is
+	// moved to the failed/ subdirectory of the queue.
+	MaxAttempts int
+
+	// InitialBackoff is the amount of time to wait after the first failed
+	// attempt. It doubles after every failed attempt.
+	InitialBackoff time.Duration
+
+	// MaxBackoff is the maximum amount of time to wait between attempts.
+	MaxBackoff time.Duration
+
+	// PollInterval is the amount of time between scans of the queue directory
+	// for deliveries that are ready to be retried.
+	PollInterval time.Duration
+
+	// AllowPrivateAddresses allows the webhooks of a problem to be delivered
+	// to loopback, link-local and private addresses. The global webhooks are
+	// always allowed to. This should only be set in tests.
+	AllowPrivateAddresses bool
+
+	queuePath        string
+	webhooks         []WebhookConfig
+	client           *http.Client
+	restrictedClient *http.Client
+	log              log15.Logger
+
+	wakeup   chan struct{}
+	mu       sync.Mutex
+	inflight map[string]bool
+	wg       sync.WaitGroup
+}
+
+// NewWebhookQueue returns a new WebhookQueue that stores its deliveries in
+// queuePath. The global webhooks are notified of updates to all problems, in
+// addition to the ones configured in each problem's refs/meta/config.
+func NewWebhookQueue(
+	queuePath string,
+	webhooks []WebhookConfig,
+	log log15.Logger,
+) (*WebhookQueue, error) {
+	if err := os.MkdirAll(path.Join(queuePath, failedWebhooksDirectory), 0755); err != nil {
+		return nil, errors.Wrapf(err, "failed to create the webhook queue at %s", queuePath)
+	}
+	q := &WebhookQueue{
+		MaxAttempts:    10,
+		InitialBackoff: 10 * time.Second,
+		MaxBackoff:     time.Hour,
+		PollInterval:   5 * time.Second,
+		queuePath:      queuePath,
+		webhooks:       webhooks,
+		client:         &http.Client{Timeout: 30 * time.Second},
+		log:            log,
+		wakeup:         make(chan struct{}, 1),
+		inflight:       make(map[string]bool),
+	}
+	// The address is checked when connecting, after it has been resolved, so
+	// that redirects and DNS names that resolve to private addresses are also
+	// rejected. No proxy is used so that the check applies to the receiver.
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: q.checkAddress,
+	}
+	q.restrictedClient = &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+	return q, nil
+}
+
+// checkAddress rejects the connections of the webhooks of a problem to
+// private addresses.
+func (q *WebhookQueue) checkAddress(network, address string, c syscall.RawConn) error {
+	if q.AllowPrivateAddresses {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return errors.Wrapf(err, "invalid address %s", address)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errors.Errorf("invalid address %s", address)
+	}
+	if isPrivateAddress(ip) || ip.IsMulticast() {
+		return errors.Errorf("address %s is not allowed", address)
+	}
+	return nil
+}
+
+// Enqueue stores one delivery of the event for each of the global webhooks
+// and each of the webhooks of the problem.
+func (q *WebhookQueue) Enqueue(repository *git.Repository, event *WebhookEvent) error {
+	webhooks := q.webhooks
+	metaConfig, err := getMetaConfig(repository)
+	if err != nil {
+		// getMetaConfig already wrapped the error correctly.
+		return err
+	}
+	globalWebhooks := len(webhooks)
+	webhooks = append(webhooks[:len(webhooks):len(webhooks)], metaConfig.Webhooks...)
+	if len(webhooks) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal the webhook event")
+	}
+	now := time.Now()
+	for i, webhook := range webhooks {
+		// Only the signature is stored, so that the secret never makes it to
+		// the queue.
+		if err := q.write(newQueueID(now), &webhookDelivery{
+			URL:         webhook.URL,
+			Signature:   SignWebhookPayload(webhook.Secret, payload),
+			Payload:     payload,
+			NextAttempt: now,
+			Global:      i < globalWebhooks,
+		}); err != nil {
+			return err
+		}
+	}
+
+	select {
+	case q.wakeup <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// newQueueID returns a unique identifier for an entry of one of the durable
+// queues. Identifiers sort in the order in which the entries were enqueued.
+func newQueueID(now time.Time) string {
+	var suffix [8]byte
+	rand.Read(suffix[:])
+	return fmt.Sprintf("%020d-%s", now.UnixNano(), hex.EncodeToString(suffix[:]))
+}
+
+func (q *WebhookQueue) write(id string, delivery *webhookDelivery) error {
+	contents, err := json.Marshal(delivery)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal the webhook delivery")
+	}
+	f, err := ioutil.TempFile(q.queuePath, ".tmp-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create the webhook delivery")
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(contents); err != nil {
+		f.Close()
+		return errors.Wrap(err, "failed to write the webhook delivery")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "failed to write the webhook delivery")
+	}
+	if err := os.Rename(f.Name(), path.Join(q.queuePath, id+".json")); err != nil {
+		return errors.Wrap(err, "failed to write the webhook delivery")
+	}
+	return nil
+}
+
+func (q *WebhookQueue) read(id string) (*webhookDelivery, error) {
+	contents, err := ioutil.ReadFile(path.Join(q.queuePath, id+".json"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the webhook delivery")
+	}
+	var delivery webhookDelivery
+	if err := json.Unmarshal(contents, &delivery); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal the webhook delivery")
+	}
+	return &delivery, nil
+}
+
+// Start starts the workers that deliver the webhooks. They stop when the
+// context is cancelled.
+func (q *WebhookQueue) Start(ctx context.Context, workers int) {
+	deliveries := make(chan string)
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			for id := range deliveries {
+				q.deliver(ctx, id)
+				q.mu.Lock()
+				delete(q.inflight, id)
+				q.mu.Unlock()
+			}
+		}()
+	}
+
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		defer close(deliveries)
+		ticker := time.NewTicker(q.PollInterval)
+		defer ticker.Stop()
+		for {
+			for _, id := range q.ready() {
+				select {
+				case deliveries <- id:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-q.wakeup:
+			}
+		}
+	}()
+}
+
+// Wait waits for all the workers to stop.
+func (q *WebhookQueue) Wait() {
+	q.wg.Wait()
+}
+
+// ready returns the deliveries that are due and are not being delivered
+// already, and marks them as in flight.
+func (q *WebhookQueue) ready() []string {
+	entries, err := ioutil.ReadDir(q.queuePath)
+	if err != nil {
+		q.log.Error("Failed to list the webhook queue", "err", err)
+		return nil
+	}
+	now := time.Now()
+	var ids []string
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		if q.inflight[id] {
+			continue
+		}
+		delivery, err := q.read(id)
+		if err != nil {
+			q.log.Error("Failed to read a webhook delivery", "id", id, "err", err)
+			continue
+		}
+		if delivery.NextAttempt.After(now) {
+			continue
+		}
+		q.inflight[id] = true
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// deliver makes one attempt to deliver the webhook, and either removes it
+// from the queue or schedules the next attempt.
+func (q *WebhookQueue) deliver(ctx context.Context, id string) {
+	delivery, err := q.read(id)
+	if err != nil {
+		q.log.Error("Failed to read a webhook delivery", "id", id, "err", err)
+		return
+	}
+
+	err = q.post(ctx, id, delivery)
+	if err == nil {
+		q.log.Info("Delivered webhook", "id", id, "url", delivery.URL)
+		if err := os.Remove(path.Join(q.queuePath, id+".json")); err != nil {
+			q.log.Error("Failed to remove a webhook delivery", "id", id, "err", err)
+		}
+		return
+	}
+	if ctx.Err() != nil {
+		// The server is shutting down. The attempt is not counted.
+		return
+	}
+
+	delivery.Attempts++
+	delivery.LastError = err.Error()
+	q.log.Error(
+		"Failed to deliver webhook",
+		"id", id,
+		"url", delivery.URL,
+		"attempt", delivery.Attempts,
+		"err", err,
+	)
+	if delivery.Attempts >= q.MaxAttempts {
+		if err := q.write(path.Join(failedWebhooksDirectory, id), delivery); err != nil {
+			q.log.Error("Failed to write a failed webhook delivery", "id", id, "err", err)
+			return
+		}
+		if err := os.Remove(path.Join(q.queuePath, id+".json")); err != nil {
+			q.log.Error("Failed to remove a webhook delivery", "id", id, "err", err)
+		}
+		return
+	}
+
+	backoff := q.InitialBackoff
+	for i := 1; i < delivery.Attempts && backoff < q.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > q.MaxBackoff {
+		backoff = q.MaxBackoff
+	}
+	delivery.NextAttempt = time.Now().Add(backoff)
+	if err := q.write(id, delivery); err != nil {
+		q.log.Error("Failed to update a webhook delivery", "id", id, "err", err)
+	}
+}
+
+func (q *WebhookQueue) post(ctx context.Context, id string, delivery *webhookDelivery) error {
+	req, err := http.NewRequest("POST", delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return errors.Wrap(err, "failed to create the request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, delivery.Signature)
+	req.Header.Set(WebhookDeliveryHeader, id)
+	client := q.restrictedClient
+	if delivery.Global {
+		client = q.client
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to send the request")
+	}
+	defer res.Body.Close()
+	ioutil.ReadAll(res.Body)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return errors.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// appliedRefs returns the subset of the references that currently point to
+// the commit they were updated to. Pushes can be rejected after they were
+// preprocessed, so this is how the successful updates are found.
+func appliedRefs(repository *git.Repository, updatedRefs []githttp.UpdatedRef) []githttp.UpdatedRef {
+	var result []githttp.UpdatedRef
+	for _, updatedRef := range updatedRefs {
+		ref, err := repository.References.Lookup(updatedRef.Name)
+		if err != nil {
+			continue
+		}
+		if ref.Target().String() == updatedRef.To {
+			result = append(result, updatedRef)
+		}
+		ref.Free()
+	}
+	return result
+}
+
+type webhookHandler struct {
+	rootPath string
+	handler  http.Handler
+	queue    *WebhookQueue
+	metrics  base.Metrics
+	log      log15.Logger
+}
+
+func (h *webhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := request.NewContext(r.Context(), h.metrics)
+	h.handler.ServeHTTP(w, r.WithContext(ctx))
+
+	splitPath := strings.SplitN(r.URL.Path[1:], "/", 2)
+	h.queue.EnqueueRequest(ctx, h.rootPath, splitPath[0], h.log)
+}
+
+// EnqueueRequest enqueues the webhooks for all the references that the request
+// associated with the context updated in the repository, if any.
+func (q *WebhookQueue) EnqueueRequest(
+	ctx context.Context,
+	rootPath string,
+	repositoryName string,
+	log log15.Logger,
+) {
+	requestContext := request.FromContext(ctx)
+	if len(requestContext.UpdatedRefs) == 0 {
+		return
+	}
+
+	repository, err := git.OpenRepository(path.Join(rootPath, repositoryName))
+	if err != nil {
+		log.Error("Failed to open repository", "repository", repositoryName, "err", err)
+		return
+	}
+	defer repository.Free()
+
+	updatedRefs := appliedRefs(repository, requestContext.UpdatedRefs)
+	if len(updatedRefs) == 0 {
+		return
+	}
+	// Only updates to master have updated files.
+	updatedFiles := []UpdatedFile{}
+	for _, updatedRef := range updatedRefs {
+		if updatedRef.Name != "refs/heads/master" {
+			continue
+		}
+		if updatedFiles, err = GetUpdatedFiles(repository, updatedRefs); err != nil {
+			log.Error("Failed to get the updated files", "repository", repositoryName, "err", err)
+			return
+		}
+		break
+	}
+	if err := q.Enqueue(repository, &WebhookEvent{
+		Problem:      repositoryName,
+		Username:     requestContext.Request.Username,
+		ReviewRef:    requestContext.Request.ReviewRef,
+		UpdatedRefs:  updatedRefs,
+		UpdatedFiles: updatedFiles,
+	}); err != nil {
+		log.Error("Failed to enqueue webhooks", "repository", repositoryName, "err", err)
+	}
+}
+
+// WebhookHandler wraps one of the handlers of the omegaUp git server so that
+// webhooks are enqueued after every successful reference update. The
+// deliveries happen in the background, so the wrapped handler is never
+// blocked by a slow receiver.
+func WebhookHandler(
+	rootPath string,
+	handler http.Handler,
+	queue *WebhookQueue,
+	metrics base.Metrics,
+	log log15.Logger,
+) http.Handler {
+	return &webhookHandler{
+		rootPath: rootPath,
+		handler:  handler,
+		queue:    queue,
+		metrics:  metrics,
+		log:      log,
+	}
+}
@@ -0,0 +1,389 @@
+package gitserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	git "github.com/lhchavez/git2go/v29"
+	"github.com/omegaup/githttp"
+	"github.com/omegaup/gitserver/gitservertest"
+	base "github.com/omegaup/go-base"
+)
+
+func TestWebhooks(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+
+	// The receiver fails the first delivery, so that it is retried.
+	var mu sync.Mutex
+	var receivedEvents []WebhookEvent
+	var deliveryIDs []string
+	attempts := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("Failed to read the webhook body: %v", err)
+		}
+		if expected, got := SignWebhookPayload("s3cr3t", body), r.Header.Get(WebhookSignatureHeader); expected != got {
+			t.Errorf("Signature mismatch. expected %q, got %q", expected, got)
+		}
+		deliveryIDs = append(deliveryIDs, r.Header.Get(WebhookDeliveryHeader))
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var event WebhookEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("Failed to unmarshal the webhook event: %v", err)
+		}
+		receivedEvents = append(receivedEvents, event)
+	}))
+	defer receiver.Close()
+
+	log := base.StderrLog()
+	queue, err := NewWebhookQueue(path.Join(tmpDir, "webhooks"), nil, log)
+	if err != nil {
+		t.Fatalf("Failed to create the webhook queue: %v", err)
+	}
+	queue.InitialBackoff = 0
+	queue.AllowPrivateAddresses = true
+	ts := httptest.NewServer(WebhookHandler(
+		tmpDir,
+		GitHandler(
+			tmpDir,
+			NewGitProtocol(authorize, nil, true, OverallWallTimeHardLimit, fakeInteractiveSettingsCompiler, log),
+			&base.NoOpMetrics{},
+			log,
+		),
+		queue,
+		&base.NoOpMetrics{},
+		log,
+	))
+	defer ts.Close()
+
+	problemAlias := "sumas"
+
+	{
+		repo, err := InitRepository(path.Join(tmpDir, problemAlias))
+		if err != nil {
+			t.Fatalf("Failed to initialize git repository: %v", err)
+		}
+		repo.Free()
+	}
+
+	pushConfig := func(contents string, status string) {
+		newOid, packContents := createCommit(
+			t,
+			tmpDir,
+			problemAlias,
+			getReference(t, problemAlias, "refs/meta/config", ts),
+			map[string]io.Reader{
+				"config.json": strings.NewReader(contents),
+			},
+			"Update config",
+			log,
+		)
+		push(
+			t,
+			tmpDir,
+			adminAuthorization,
+			problemAlias,
+			"refs/meta/config",
+			getReference(t, problemAlias, "refs/meta/config", ts),
+			newOid,
+			packContents,
+			[]githttp.PktLineResponse{
+				{Line: "unpack ok\n", Err: nil},
+				{Line: status, Err: nil},
+			},
+			ts,
+		)
+	}
+
+	// Invalid webhooks.
+	pushConfig(
+		`{"webhooks":[{"url":"ftp://example.com","secret":"s3cr3t"}]}`,
+		"ng refs/meta/config config-invalid-webhook: webhooks[0]: invalid url 'ftp://example.com'\n",
+	)
+	pushConfig(
+		fmt.Sprintf(`{"webhooks":[{"url":"%s"}]}`, receiver.URL),
+		"ng refs/meta/config config-invalid-webhook: webhooks[0]: missing secret\n",
+	)
+
+	pushConfig(
+		fmt.Sprintf(`{"webhooks":[{"url":"%s","secret":"s3cr3t"}]}`, receiver.URL),
+		"ok refs/meta/config\n",
+	)
+	// The config update itself enqueues a delivery. Drain it so that only the
+	// master update remains.
+	for i := 0; i < 2; i++ {
+		for _, id := range queue.ready() {
+			queue.deliver(context.Background(), id)
+			delete(queue.inflight, id)
+		}
+	}
+	mu.Lock()
+	attempts = 0
+	receivedEvents = nil
+	deliveryIDs = nil
+	mu.Unlock()
+
+	// A rejected push does not enqueue anything.
+	{
+		newOid, packContents := createCommit(
+			t,
+			tmpDir,
+			problemAlias,
+			&git.Oid{},
+			map[string]io.Reader{
+				"settings.json": strings.NewReader(gitservertest.DefaultSettingsJSON),
+			},
+			"Invalid commit",
+			log,
+		)
+		push(
+			t,
+			tmpDir,
+			adminAuthorization,
+			problemAlias,
+			"refs/heads/arbitrarybranchname",
+			&git.Oid{}, newOid,
+			packContents,
+			[]githttp.PktLineResponse{
+				{Line: "unpack ok\n", Err: nil},
+				{Line: "ng refs/heads/arbitrarybranchname invalid-ref\n", Err: nil},
+			},
+			ts,
+		)
+		if ids := queue.ready(); len(ids) != 0 {
+			t.Fatalf("Expected no pending deliveries, got %v", ids)
+		}
+	}
+
+	newOid, packContents := createCommit(
+		t,
+		tmpDir,
+		problemAlias,
+		&git.Oid{},
+		map[string]io.Reader{
+			"settings.json":          strings.NewReader(gitservertest.DefaultSettingsJSON),
+			"cases/0.in":             strings.NewReader("1 2"),
+			"cases/0.out":            strings.NewReader("3"),
+			"statements/es.markdown": strings.NewReader("Sumas"),
+		},
+		"Initial commit",
+		log,
+	)
+	push(
+		t,
+		tmpDir,
+		adminAuthorization,
+		problemAlias,
+		"refs/heads/master",
+		&git.Oid{}, newOid,
+		packContents,
+		[]githttp.PktLineResponse{
+			{Line: "unpack ok\n", Err: nil},
+			{Line: "ok refs/heads/master\n", Err: nil},
+		},
+		ts,
+	)
+
+	// The first attempt fails, and the delivery stays in the queue until the
+	// next one.
+	ids := queue.ready()
+	if len(ids) != 1 {
+		t.Fatalf("Expected one pending delivery, got %v", ids)
+	}
+	queue.deliver(context.Background(), ids[0])
+	delete(queue.inflight, ids[0])
+	delivery, err := queue.read(ids[0])
+	if err != nil {
+		t.Fatalf("Failed to read the pending delivery: %v", err)
+	}
+	if delivery.Attempts != 1 {
+		t.Errorf("Expected one attempt, got %d", delivery.Attempts)
+	}
+
+	// A new queue over the same directory picks up the pending delivery.
+	queue, err = NewWebhookQueue(path.Join(tmpDir, "webhooks"), nil, log)
+	if err != nil {
+		t.Fatalf("Failed to create the webhook queue: %v", err)
+	}
+	queue.AllowPrivateAddresses = true
+	ids = queue.ready()
+	if len(ids) != 1 {
+		t.Fatalf("Expected one pending delivery, got %v", ids)
+	}
+	queue.deliver(context.Background(), ids[0])
+	if _, err := os.Stat(path.Join(tmpDir, "webhooks", ids[0]+".json")); !os.IsNotExist(err) {
+		t.Errorf("Expected the delivery to be removed from the queue, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(deliveryIDs) != 2 || deliveryIDs[0] != deliveryIDs[1] {
+		t.Errorf("Expected the same delivery ID across retries, got %v", deliveryIDs)
+	}
+	if len(receivedEvents) != 1 {
+		t.Fatalf("Expected one event, got %v", receivedEvents)
+	}
+	event := receivedEvents[0]
+	if event.Problem != problemAlias || event.Username != "admin" {
+		t.Errorf("Unexpected event %v", event)
+	}
+	if len(event.UpdatedRefs) != 1 ||
+		event.UpdatedRefs[0].Name != "refs/heads/master" ||
+		event.UpdatedRefs[0].To != newOid.String() {
+		t.Errorf("Unexpected updated refs %v", event.UpdatedRefs)
+	}
+	if len(event.UpdatedFiles) == 0 {
+		t.Errorf("Expected updated files, got none")
+	}
+}
+
+func TestWebhookPrivateAddresses(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "webhook_test")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+
+	var mu sync.Mutex
+	received := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		received++
+	}))
+	defer receiver.Close()
+
+	queue, err := NewWebhookQueue(path.Join(tmpDir, "webhooks"), nil, base.StderrLog())
+	if err != nil {
+		t.Fatalf("Failed to create the webhook queue: %v", err)
+	}
+
+	// The webhooks of a problem cannot reach the loopback address.
+	if err := queue.write("problem", &webhookDelivery{
+		URL:         receiver.URL,
+		Payload:     []byte("{}"),
+		NextAttempt: time.Now(),
+	}); err != nil {
+		t.Fatalf("Failed to write the delivery: %v", err)
+	}
+	queue.deliver(context.Background(), "problem")
+	delivery, err := queue.read("problem")
+	if err != nil {
+		t.Fatalf("Failed to read the pending delivery: %v", err)
+	}
+	if delivery.Attempts != 1 || !strings.Contains(delivery.LastError, "is not allowed") {
+		t.Errorf("Expected the delivery to be rejected, got %v", delivery)
+	}
+
+	// The global webhooks can.
+	if err := queue.write("global", &webhookDelivery{
+		URL:         receiver.URL,
+		Payload:     []byte("{}"),
+		NextAttempt: time.Now(),
+		Global:      true,
+	}); err != nil {
+		t.Fatalf("Failed to write the delivery: %v", err)
+	}
+	queue.deliver(context.Background(), "global")
+	if _, err := os.Stat(path.Join(tmpDir, "webhooks", "global.json")); !os.IsNotExist(err) {
+		t.Errorf("Expected the delivery to be removed from the queue, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if received != 1 {
+		t.Errorf("Expected exactly one delivery, got %d", received)
+	}
+}
+
+func TestIsPrivateAddress(t *testing.T) {
+	for _, testCase := range []struct {
+		address string
+		private bool
+	}{
+		{"0.0.0.0", true},
+		{"10.1.2.3", true},
+		{"100.64.0.1", true},
+		{"100.127.255.254", true},
+		{"127.0.0.1", true},
+		{"169.254.169.254", true},
+		{"172.16.0.1", true},
+		{"172.31.255.254", true},
+		{"192.0.0.8", true},
+		{"192.0.2.1", true},
+		{"192.88.99.1", true},
+		{"192.168.1.1", true},
+		{"198.18.0.1", true},
+		{"198.19.255.254", true},
+		{"198.51.100.1", true},
+		{"203.0.113.1", true},
+		{"224.0.0.1", true},
+		{"255.255.255.255", true},
+		{"::", true},
+		{"::1", true},
+		// IPv4-compatible addresses.
+		{"::7f00:1", true},
+		// IPv4-mapped addresses.
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:10.0.0.1", true},
+		{"::ffff:100.64.0.1", true},
+		{"::ffff:198.18.0.1", true},
+		// NAT64 addresses.
+		{"64:ff9b::a9fe:a9fe", true},
+		{"64:ff9b::7f00:1", true},
+		{"64:ff9b:1::1", true},
+		{"100::1", true},
+		{"2001::1", true},
+		{"2001:db8::1", true},
+		{"fc00::1", true},
+		{"fd12:3456::1", true},
+		{"fe80::1", true},
+		{"ff02::1", true},
+
+		{"8.8.8.8", false},
+		{"100.63.255.255", false},
+		{"100.128.0.0", false},
+		{"172.32.0.1", false},
+		{"192.0.1.1", false},
+		{"198.17.255.255", false},
+		{"198.20.0.1", false},
+		{"::ffff:8.8.8.8", false},
+		{"64:ff9b::808:808", false},
+		{"2606:4700::1111", false},
+	} {
+		ip := net.ParseIP(testCase.address)
+		if ip == nil {
+			t.Fatalf("Failed to parse %s", testCase.address)
+		}
+		if private := isPrivateAddress(ip); private != testCase.private {
+			t.Errorf("isPrivateAddress(%s) = %v, want %v", testCase.address, private, testCase.private)
+		}
+	}
+}
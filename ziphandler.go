@@ -194,6 +194,24 @@ type UpdateResult struct {
 	Error        string               `json:"error,omitempty"`
 	UpdatedRefs  []githttp.UpdatedRef `json:"updated_refs,omitempty"`
 	UpdatedFiles []UpdatedFile        `json:"updated_files"`
+
+	// NormalizedFiles are the paths of the files whose contents were rewritten
+	// by the normalizer when they were pushed.
+	NormalizedFiles []string `json:"normalized_files,omitempty"`
+
+	// DryRun is true if the update was not actually applied to the
+	// repository.
+	DryRun bool `json:"dry_run,omitempty"`
+
+	// Warnings are the files that were dropped, rewritten or generated while
+	// processing the update.
+	Warnings []request.Warning `json:"warnings,omitempty"`
+
+	// Settings and DistribSettings are the contents of settings.json and
+	// settings.distrib.json that the update would have produced. They are only
+	// reported for dry runs.
+	Settings        json.RawMessage `json:"settings,omitempty"`
+	DistribSettings json.RawMessage `json:"distrib_settings,omitempty"`
 }
 
 func getAllFilesForCommit(
@@ -486,20 +504,11 @@ func parseTestplan(
 	return nil
 }
 
-// CreatePackfile creates a packfile that contains a commit that contains the
-// specified contents plus a subset of the parent commit's tree, depending of
-// the value of zipMergeStrategy.
-func CreatePackfile(
-	contents map[string]io.Reader,
-	settings *common.ProblemSettings,
-	zipMergeStrategy ZipMergeStrategy,
-	repo *git.Repository,
-	parent *git.Oid,
-	author, committer *git.Signature,
-	commitMessage string,
-	w io.Writer,
-	log log15.Logger,
-) (*git.Oid, error) {
+// addTemporaryObjectBackend registers a loose object backend in a temporary
+// directory with the highest priority in the repository's object database, so
+// that any new objects are not written to the repository itself. The returned
+// function must be called to release the resources.
+func addTemporaryObjectBackend(repo *git.Repository) (func(), error) {
 	odb, err := repo.Odb()
 	if err != nil {
 		return nil, base.ErrorWithCategory(
@@ -510,19 +519,23 @@ func CreatePackfile(
 			),
 		)
 	}
-	defer odb.Free()
 
 	looseObjectsDir, err := ioutil.TempDir("", fmt.Sprintf("loose_objects_%s", path.Base(repo.Path())))
 	if err != nil {
+		odb.Free()
 		return nil, errors.Wrap(
 			err,
 			"failed to create temporary directory for loose objects",
 		)
 	}
-	defer os.RemoveAll(looseObjectsDir)
+	cleanup := func() {
+		os.RemoveAll(looseObjectsDir)
+		odb.Free()
+	}
 
 	looseObjectsBackend, err := git.NewOdbBackendLoose(looseObjectsDir, -1, false, 0, 0)
 	if err != nil {
+		cleanup()
 		return nil, base.ErrorWithCategory(
 			ErrInternalGit,
 			errors.Wrap(
@@ -533,6 +546,7 @@ func CreatePackfile(
 	}
 	if err := odb.AddBackend(looseObjectsBackend, 999); err != nil {
 		looseObjectsBackend.Free()
+		cleanup()
 		return nil, base.ErrorWithCategory(
 			ErrInternalGit,
 			errors.Wrap(
@@ -542,6 +556,31 @@ func CreatePackfile(
 		)
 	}
 
+	return cleanup, nil
+}
+
+// CreatePackfile creates a packfile that contains a commit that contains the
+// specified contents plus a subset of the parent commit's tree, depending of
+// the value of zipMergeStrategy.
+func CreatePackfile(
+	ctx context.Context,
+	contents map[string]io.Reader,
+	settings *common.ProblemSettings,
+	zipMergeStrategy ZipMergeStrategy,
+	repo *git.Repository,
+	parent *git.Oid,
+	author, committer *git.Signature,
+	commitMessage string,
+	w io.Writer,
+	log log15.Logger,
+) (*git.Oid, error) {
+	cleanup, err := addTemporaryObjectBackend(repo)
+	if err != nil {
+		// addTemporaryObjectBackend already wrapped the error correctly.
+		return nil, err
+	}
+	defer cleanup()
+
 	// trees will contain a map of top-level entries (strings) to a map of full
 	// pathnames to io.Readers. This will be used to create individual trees that
 	// will then be spliced using a git.TreeBuilder.
@@ -549,7 +588,15 @@ func CreatePackfile(
 	topLevelEntries := make(map[string]*git.Oid)
 
 	// .gitattributes is always overwritten.
-	delete(contents, ".gitattributes")
+	if _, ok := contents[".gitattributes"]; ok {
+		addWarning(
+			ctx,
+			WarningOverwrittenFile,
+			".gitattributes",
+			"the file was replaced by the one that all problems use",
+		)
+		delete(contents, ".gitattributes")
+	}
 
 	if zipMergeStrategy != ZipMergeStrategyOurs &&
 		zipMergeStrategy != ZipMergeStrategyRecursiveTheirs {
@@ -631,6 +678,12 @@ func CreatePackfile(
 		}
 		filename = strings.TrimSuffix(filename, ".in") + ".out"
 		if _, ok := contents[filename]; !ok {
+			addWarning(
+				ctx,
+				WarningGeneratedFile,
+				filename,
+				"an empty output file was generated for the interactive example",
+			)
 			contents[filename] = bytes.NewReader([]byte{})
 		}
 	}
@@ -640,28 +693,20 @@ func CreatePackfile(
 			// we move the libinteractive examples to the examples/ directory.
 			filename = strings.TrimPrefix(filename, "interactive/")
 		}
-		if strings.HasPrefix(filename, "examples/") || strings.HasPrefix(filename, "cases/") {
-			normalizedReader, err := NormalizeCase(r)
-			if err != nil {
-				// removeBOM already wrapped the error correctly.
-				return nil, err
-			}
-			r = normalizedReader
-		} else if (strings.HasPrefix(filename, "statements/") || strings.HasPrefix(filename, "solutions/")) &&
-			(strings.HasSuffix(filename, ".markdown") || strings.HasSuffix(filename, ".md")) {
-			utfReader, err := ConvertMarkdownToUTF8(r)
-			if err != nil {
-				return nil, base.ErrorWithCategory(
-					ErrInvalidMarkup,
-					errors.Wrapf(
-						err,
-						"failed to convert %s to UTF-8",
-						filename,
-					),
-				)
-			}
-			r = utfReader
+		normalizedReader, encoding, err := normalizeFile(filename, r)
+		if err != nil {
+			// normalizeFile already wrapped the error correctly.
+			return nil, err
 		}
+		if encoding != "" {
+			addWarning(
+				ctx,
+				WarningConvertedEncoding,
+				filename,
+				fmt.Sprintf("the file was converted to UTF-8 from its guessed encoding, %s", encoding),
+			)
+		}
+		r = normalizedReader
 
 		if !strings.Contains(filename, "/") {
 			blobContents, err := ioutil.ReadAll(r)
@@ -929,9 +974,25 @@ func CreatePackfile(
 		)
 	}
 
+	if err := writeCommitPackfile(repo, newCommitID, parentCommits, w); err != nil {
+		// writeCommitPackfile already wrapped the error correctly.
+		return nil, err
+	}
+
+	return newCommitID, nil
+}
+
+// writeCommitPackfile writes a packfile to w that contains all the objects
+// that are reachable from newCommitID, but not from any of the parent commits.
+func writeCommitPackfile(
+	repo *git.Repository,
+	newCommitID *git.Oid,
+	parentCommits []*git.Commit,
+	w io.Writer,
+) error {
 	walk, err := repo.Walk()
 	if err != nil {
-		return nil, base.ErrorWithCategory(
+		return base.ErrorWithCategory(
 			ErrInternalGit,
 			errors.Wrap(
 				err,
@@ -943,7 +1004,7 @@ func CreatePackfile(
 
 	for _, parentCommit := range parentCommits {
 		if err := walk.Hide(parentCommit.Id()); err != nil {
-			return nil, base.ErrorWithCategory(
+			return base.ErrorWithCategory(
 				ErrInternalGit,
 				errors.Wrapf(
 					err,
@@ -953,7 +1014,7 @@ func CreatePackfile(
 		}
 	}
 	if err := walk.Push(newCommitID); err != nil {
-		return nil, base.ErrorWithCategory(
+		return base.ErrorWithCategory(
 			ErrInternalGit,
 			errors.Wrapf(
 				err,
@@ -964,7 +1025,7 @@ func CreatePackfile(
 
 	pb, err := repo.NewPackbuilder()
 	if err != nil {
-		return nil, base.ErrorWithCategory(
+		return base.ErrorWithCategory(
 			ErrInternalGit,
 			errors.Wrap(
 				err,
@@ -975,7 +1036,7 @@ func CreatePackfile(
 	defer pb.Free()
 
 	if err := pb.InsertWalk(walk); err != nil {
-		return nil, base.ErrorWithCategory(
+		return base.ErrorWithCategory(
 			ErrInternalGit,
 			errors.Wrap(
 				err,
@@ -985,7 +1046,7 @@ func CreatePackfile(
 	}
 
 	if err := pb.Write(w); err != nil {
-		return nil, base.ErrorWithCategory(
+		return base.ErrorWithCategory(
 			ErrInternalGit,
 			errors.Wrap(
 				err,
@@ -994,7 +1055,7 @@ func CreatePackfile(
 		)
 	}
 
-	return newCommitID, nil
+	return nil
 }
 
 func getUpdatedProblemSettings(
@@ -1067,8 +1128,10 @@ func getUpdatedProblemSettings(
 }
 
 // ConvertZipToPackfile receives a .zip file from the caller and converts it
-// into a git packfile that can be used to update the repository.
+// into a git packfile that can be used to update the repository. Polygon and
+// Kattis packages are also accepted.
 func ConvertZipToPackfile(
+	ctx context.Context,
 	zipReader *zip.Reader,
 	settings *common.ProblemSettings,
 	zipMergeStrategy ZipMergeStrategy,
@@ -1080,9 +1143,32 @@ func ConvertZipToPackfile(
 	w io.Writer,
 	log log15.Logger,
 ) (*git.Oid, error) {
+	if zipMergeStrategy != ZipMergeStrategyOurs {
+		// Polygon and Kattis packages are converted into the omegaUp layout
+		// first. An explicit settings object still takes precedence over the
+		// limits in the package.
+		var err error
+		if IsPolygonPackage(zipReader) {
+			zipReader, err = ConvertPolygonPackage(ctx, zipReader, log)
+		} else if IsKattisPackage(zipReader) {
+			zipReader, err = ConvertKattisPackage(ctx, zipReader, log)
+		}
+		if err != nil {
+			// ConvertPolygonPackage and ConvertKattisPackage already wrapped the
+			// error correctly.
+			return nil, err
+		}
+	}
+
 	contents := make(map[string]io.Reader)
 	longestPrefix := getLongestPathPrefix(zipReader)
 
+	commitDescriptions, err := GetCommitDescriptions(repo)
+	if err != nil {
+		// GetCommitDescriptions already wrapped the error correctly.
+		return nil, err
+	}
+
 	inCases := make(map[string]struct{})
 	outCases := make(map[string]struct{})
 
@@ -1107,7 +1193,7 @@ func ConvertZipToPackfile(
 
 			isValidFile := false
 			trimmedZipfilePath := strings.Join(components[len(longestPrefix):], "/")
-			for _, description := range DefaultCommitDescriptions {
+			for _, description := range commitDescriptions {
 				if description.ContainsPath(trimmedZipfilePath) {
 					isValidFile = true
 					break
@@ -1122,6 +1208,12 @@ func ConvertZipToPackfile(
 
 			if !isValidFile {
 				log.Info("Skipping file", "path", zipfilePath)
+				addWarning(
+					ctx,
+					WarningSkippedFile,
+					trimmedZipfilePath,
+					"the file is not part of any of the problem's branches and was dropped",
+				)
 			}
 
 			zipFile, err := file.Open()
@@ -1171,6 +1263,7 @@ func ConvertZipToPackfile(
 		}
 
 		return CreatePackfile(
+			ctx,
 			contents,
 			settings,
 			zipMergeStrategy,
@@ -1219,6 +1312,7 @@ func ConvertZipToPackfile(
 	)
 
 	return CreatePackfile(
+		ctx,
 		contents,
 		settings,
 		zipMergeStrategy,
@@ -1281,6 +1375,7 @@ func PushZip(
 	defer os.Remove(packfile.Name())
 
 	newOid, err := ConvertZipToPackfile(
+		ctx,
 		zipReader,
 		problemSettings,
 		zipMergeStrategy,
@@ -1316,6 +1411,7 @@ func PushZip(
 		},
 		packfile,
 	)
+	auditAppliedRefs(ctx, repo, request.FromContext(ctx).UpdatedRefs, log)
 
 	if unpackErr != nil {
 		return nil, base.ErrorWithCategory(
@@ -1383,20 +1479,399 @@ func PushZip(
 	}
 
 	return &UpdateResult{
-		Status:       "ok",
-		UpdatedRefs:  updatedRefs,
-		UpdatedFiles: updatedFiles,
+		Status:          "ok",
+		UpdatedRefs:     updatedRefs,
+		UpdatedFiles:    updatedFiles,
+		NormalizedFiles: request.FromContext(ctx).NormalizedFiles,
+		Warnings:        request.FromContext(ctx).Warnings,
 	}, nil
 }
 
+// createScratchRepository creates a repository in dir that borrows all the
+// objects from repo through its alternates and has a copy of all of its
+// references. Anything that is pushed into it is never visible from repo.
+func createScratchRepository(repo *git.Repository, dir string) (*git.Repository, error) {
+	scratchRepo, err := InitRepository(dir)
+	if err != nil {
+		// InitRepository already wrapped the error correctly.
+		return nil, err
+	}
+	scratchRepo.Free()
+
+	objectsPath, err := filepath.Abs(path.Join(repo.Path(), "objects"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get the path of the objects")
+	}
+	if err := os.MkdirAll(path.Join(dir, "objects/info"), 0755); err != nil {
+		return nil, errors.Wrap(err, "failed to create the objects/info directory")
+	}
+	if err := ioutil.WriteFile(
+		path.Join(dir, "objects/info/alternates"),
+		[]byte(objectsPath+"\n"),
+		0644,
+	); err != nil {
+		return nil, errors.Wrap(err, "failed to write the alternates")
+	}
+
+	scratchRepo, err = git.OpenRepository(dir)
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to open the scratch repository at %s",
+				dir,
+			),
+		)
+	}
+
+	it, err := repo.NewReferenceIterator()
+	if err != nil {
+		scratchRepo.Free()
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrap(
+				err,
+				"failed to iterate over the references",
+			),
+		)
+	}
+	defer it.Free()
+
+	for {
+		ref, err := it.Next()
+		if err != nil {
+			if git.IsErrorCode(err, git.ErrIterOver) {
+				break
+			}
+			scratchRepo.Free()
+			return nil, base.ErrorWithCategory(
+				ErrInternalGit,
+				errors.Wrap(
+					err,
+					"failed to iterate over the references",
+				),
+			)
+		}
+		if ref.Type() != git.ReferenceOid {
+			ref.Free()
+			continue
+		}
+		scratchRef, err := scratchRepo.References.Create(ref.Name(), ref.Target(), true, "")
+		if err != nil {
+			scratchRepo.Free()
+			name := ref.Name()
+			ref.Free()
+			return nil, base.ErrorWithCategory(
+				ErrInternalGit,
+				errors.Wrapf(
+					err,
+					"failed to copy reference %s",
+					name,
+				),
+			)
+		}
+		scratchRef.Free()
+		ref.Free()
+	}
+
+	return scratchRepo, nil
+}
+
+// readCommitFile returns the contents of the file in the commit, or nil if the
+// commit does not contain it.
+func readCommitFile(repo *git.Repository, commitID *git.Oid, filename string) ([]byte, error) {
+	commit, err := repo.LookupCommit(commitID)
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to lookup commit %s",
+				commitID,
+			),
+		)
+	}
+	defer commit.Free()
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to lookup the tree of commit %s",
+				commitID,
+			),
+		)
+	}
+	defer tree.Free()
+
+	entry, err := tree.EntryByPath(filename)
+	if err != nil {
+		return nil, nil
+	}
+	blob, err := repo.LookupBlob(entry.Id)
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			ErrInternalGit,
+			errors.Wrapf(
+				err,
+				"failed to lookup %s",
+				filename,
+			),
+		)
+	}
+	defer blob.Free()
+
+	return append([]byte{}, blob.Contents()...), nil
+}
+
+// DryRunZip does the same as PushZip, including all the validations and the
+// regeneration of the settings, but against a throwaway copy of the
+// repository, so that none of its references are modified. The result also
+// contains the settings.json and settings.distrib.json that the push would
+// have produced.
+func DryRunZip(
+	ctx context.Context,
+	zipReader *zip.Reader,
+	authorizationLevel githttp.AuthorizationLevel,
+	repo *git.Repository,
+	authorUsername string,
+	commitMessage string,
+	problemSettings *common.ProblemSettings,
+	zipMergeStrategy ZipMergeStrategy,
+	acceptsSubmissions bool,
+	updatePublished bool,
+	protocol *githttp.GitProtocol,
+	log log15.Logger,
+) (*UpdateResult, error) {
+	scratchDir, err := ioutil.TempDir("", "gitserver-dry-run")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create the scratch directory")
+	}
+	defer os.RemoveAll(scratchDir)
+
+	scratchRepo, err := createScratchRepository(repo, scratchDir)
+	if err != nil {
+		// createScratchRepository already wrapped the error correctly.
+		return nil, err
+	}
+	defer scratchRepo.Free()
+
+	lockfile := githttp.NewLockfile(scratchRepo.Path())
+	if err := lockfile.RLock(); err != nil {
+		return nil, errors.Wrap(err, "failed to acquire the scratch lockfile")
+	}
+	defer lockfile.Unlock()
+
+	updateResult, err := PushZip(
+		ctx,
+		zipReader,
+		authorizationLevel,
+		scratchRepo,
+		lockfile,
+		authorUsername,
+		commitMessage,
+		problemSettings,
+		zipMergeStrategy,
+		acceptsSubmissions,
+		updatePublished,
+		protocol,
+		log,
+	)
+	if err != nil {
+		// PushZip already wrapped the error correctly.
+		return nil, err
+	}
+	updateResult.DryRun = true
+
+	for _, ref := range updateResult.UpdatedRefs {
+		if ref.Name != "refs/heads/master" {
+			continue
+		}
+		masterOid, err := git.NewOid(ref.To)
+		if err != nil {
+			return nil, errors.Wrap(
+				err,
+				"failed to parse the updated ID",
+			)
+		}
+		if updateResult.Settings, err = readCommitFile(scratchRepo, masterOid, "settings.json"); err != nil {
+			// readCommitFile already wrapped the error correctly.
+			return nil, err
+		}
+		if updateResult.DistribSettings, err = readCommitFile(scratchRepo, masterOid, "settings.distrib.json"); err != nil {
+			// readCommitFile already wrapped the error correctly.
+			return nil, err
+		}
+	}
+
+	return updateResult, nil
+}
+
+// ZipUploadOptions are the parameters of a .zip upload, other than the .zip
+// file itself.
+type ZipUploadOptions struct {
+	CommitMessage      string                  `json:"message"`
+	Settings           *common.ProblemSettings `json:"settings,omitempty"`
+	MergeStrategy      ZipMergeStrategy        `json:"merge_strategy"`
+	AcceptsSubmissions bool                    `json:"accepts_submissions"`
+	UpdatePublished    bool                    `json:"update_published"`
+}
+
+// pushZipUpload pushes the .zip upload into the repository at repositoryPath,
+// creating the repository first if the request asks for it. Dry runs are never
+// recorded in the audit log, nor do they create the repository.
+func pushZipUpload(
+	ctx context.Context,
+	repositoryPath string,
+	zipReader *zip.Reader,
+	level githttp.AuthorizationLevel,
+	username string,
+	options *ZipUploadOptions,
+	dryRun bool,
+	protocol *githttp.GitProtocol,
+	metrics base.Metrics,
+	log log15.Logger,
+) (*UpdateResult, error) {
+	requestContext := request.FromContext(ctx)
+
+	var repo *git.Repository
+	commitCallback := func() error { return nil }
+	if requestContext.Request.Create {
+		dir, err := ioutil.TempDir(filepath.Dir(repositoryPath), "repository")
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create temporary directory")
+		}
+		defer os.RemoveAll(dir)
+
+		if err := os.Chmod(dir, 0755); err != nil {
+			return nil, errors.Wrap(err, "failed to chmod temporary directory")
+		}
+
+		repo, err = InitRepository(dir)
+		if err != nil {
+			// InitRepository already wrapped the error correctly.
+			return nil, err
+		}
+		commitCallback = func() error {
+			return os.Rename(dir, repositoryPath)
+		}
+	} else {
+		var err error
+		repo, err = git.OpenRepository(repositoryPath)
+		if err != nil {
+			return nil, base.ErrorWithCategory(
+				ErrInternalGit,
+				errors.Wrapf(
+					err,
+					"failed to open repository %s",
+					repositoryPath,
+				),
+			)
+		}
+	}
+	defer repo.Free()
+
+	lockfile := githttp.NewLockfile(repo.Path())
+	lockStart := time.Now()
+	if ok, err := lockfile.TryRLock(); !ok {
+		log.Info("Waiting for the lockfile", "err", err)
+		if err := lockfile.RLock(); err != nil {
+			return nil, base.ErrorWithCategory(
+				ErrInternal,
+				errors.Wrap(
+					err,
+					"failed to acquire the lockfile",
+				),
+			)
+		}
+	}
+	defer lockfile.Unlock()
+	metrics.SummaryObserve("gitserver_lock_wait_seconds", time.Since(lockStart).Seconds())
+
+	if dryRun {
+		return DryRunZip(
+			ctx,
+			zipReader,
+			level,
+			repo,
+			username,
+			options.CommitMessage,
+			options.Settings,
+			options.MergeStrategy,
+			options.AcceptsSubmissions,
+			options.UpdatePublished,
+			protocol,
+			log,
+		)
+	}
+
+	updateResult, err := PushZip(
+		ctx,
+		zipReader,
+		level,
+		repo,
+		lockfile,
+		username,
+		options.CommitMessage,
+		options.Settings,
+		options.MergeStrategy,
+		options.AcceptsSubmissions,
+		options.UpdatePublished,
+		protocol,
+		log,
+	)
+	auditEntry := NewAuditEntry(ctx, AuditOperationUploadZip)
+	auditEntry.MergeStrategy = options.MergeStrategy.String()
+	if err != nil {
+		auditEntry.Result = AuditResultRejected
+		auditEntry.Error = err.Error()
+	} else {
+		auditEntry.Result = AuditResultOK
+		for _, updatedRef := range updateResult.UpdatedRefs {
+			if updatedRef.Name != "refs/heads/master" {
+				continue
+			}
+			auditEntry.ReferenceName = updatedRef.Name
+			auditEntry.OldOid = updatedRef.From
+			auditEntry.NewOid = updatedRef.To
+		}
+	}
+	// The audit log is written before commitCallback runs, since newly-created
+	// repositories are moved into place by it.
+	if err := AppendAuditLog(repo.Path(), auditEntry); err != nil {
+		log.Error("Failed to write the audit log", "path", repositoryPath, "err", err)
+	}
+	if err != nil {
+		// PushZip already wrapped the error correctly.
+		return nil, err
+	}
+	if err := commitCallback(); err != nil {
+		log.Info("push successful, but commit failed", "path", repositoryPath, "result", updateResult, "err", err)
+		return nil, base.ErrorWithCategory(
+			ErrInternal,
+			errors.Wrapf(
+				err,
+				"failed to move the new repository into %s",
+				repositoryPath,
+			),
+		)
+	}
+	return updateResult, nil
+}
+
 type zipUploadHandler struct {
-	rootPath string
-	protocol *githttp.GitProtocol
-	metrics  base.Metrics
-	log      log15.Logger
+	rootPath    string
+	protocol    *githttp.GitProtocol
+	importQueue *ZipImportQueue
+	metrics     base.Metrics
+	log         log15.Logger
 }
 
 func (h *zipUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
 	splitPath := strings.SplitN(r.URL.Path[1:], "/", 2)
 	if len(splitPath) != 2 {
 		w.WriteHeader(http.StatusNotFound)
@@ -1407,6 +1882,10 @@ func (h *zipUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	if strings.HasPrefix(splitPath[1], "git-upload-zip/") && h.importQueue != nil {
+		h.serveImportJob(w, r, repositoryName, strings.TrimPrefix(splitPath[1], "git-upload-zip/"))
+		return
+	}
 	if splitPath[1] != "git-upload-zip" {
 		w.WriteHeader(http.StatusNotFound)
 		return
@@ -1451,13 +1930,18 @@ func (h *zipUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	commitMessage := paramValue("message")
-	if commitMessage == "" {
+	options := &ZipUploadOptions{
+		CommitMessage: paramValue("message"),
+		AcceptsSubmissions: (paramValue("acceptsSubmissions") == "" ||
+			paramValue("acceptsSubmissions") == "true"),
+		UpdatePublished: (paramValue("updatePublished") == "" ||
+			paramValue("updatePublished") == "true"),
+	}
+	if options.CommitMessage == "" {
 		h.log.Error("Missing 'message' field")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	var problemSettings *common.ProblemSettings
 	if paramValue("settings") != "" {
 		var unmarshaledSettings common.ProblemSettings
 		if err := json.Unmarshal([]byte(paramValue("settings")), &unmarshaledSettings); err != nil {
@@ -1465,22 +1949,28 @@ func (h *zipUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		problemSettings = &unmarshaledSettings
+		options.Settings = &unmarshaledSettings
 	}
-	acceptsSubmissions := (paramValue("acceptsSubmissions") == "" ||
-		paramValue("acceptsSubmissions") == "true")
-	updatePublished := (paramValue("updatePublished") == "" ||
-		paramValue("updatePublished") == "true")
-	zipMergeStrategy, err := ParseZipMergeStrategy(paramValue("mergeStrategy"))
+	dryRun := paramValue("dryRun") == "true"
+	// Dry runs are always synchronous, since their result is never stored.
+	async := paramValue("async") == "true" && !dryRun
+	var err error
+	options.MergeStrategy, err = ParseZipMergeStrategy(paramValue("mergeStrategy"))
 	if err != nil {
 		h.log.Error("invalid merge strategy", "mergeStrategy", paramValue("mergeStrategy"))
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if async && h.importQueue == nil {
+		h.log.Error("asynchronous imports are not enabled")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
 	ctx := request.NewContext(r.Context(), h.metrics)
 	requestContext := request.FromContext(ctx)
 	requestContext.Request.Create = r.URL.Query().Get("create") != ""
+	requestContext.Request.RemoteAddr = r.RemoteAddr
 
 	repositoryPath := path.Join(h.rootPath, repositoryName)
 	h.log.Info(
@@ -1488,6 +1978,8 @@ func (h *zipUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		"Method", r.Method,
 		"path", repositoryPath,
 		"create", requestContext.Request.Create,
+		"dryRun", dryRun,
+		"async", async,
 	)
 	if _, err := os.Stat(repositoryPath); os.IsNotExist(err) != requestContext.Request.Create {
 		if requestContext.Request.Create {
@@ -1505,12 +1997,20 @@ func (h *zipUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tempfile, err := ioutil.TempFile("", "gitserver-zip")
+	var tempfile *os.File
+	if async {
+		// The upload is stored directly in the queue, so that it does not need
+		// to be copied again once it is enqueued.
+		tempfile, err = h.importQueue.tempFile()
+	} else {
+		tempfile, err = ioutil.TempFile("", "gitserver-zip")
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	defer os.Remove(tempfile.Name())
+	defer tempfile.Close()
 
 	zipSize, err := io.Copy(tempfile, &io.LimitedReader{R: requestZip, N: maxAllowedZipSize.Bytes()})
 	if err != nil {
@@ -1539,83 +2039,62 @@ func (h *zipUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var repo *git.Repository
-	commitCallback := func() error { return nil }
-	if requestContext.Request.Create {
-		dir, err := ioutil.TempDir(filepath.Dir(repositoryPath), "repository")
-		if err != nil {
-			h.log.Error("Failed to create temporary directory", "err", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		defer os.RemoveAll(dir)
-
-		if err := os.Chmod(dir, 0755); err != nil {
-			h.log.Error("Failed to chmod temporary directory", "err", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		repo, err = InitRepository(dir)
-		if err != nil {
-			h.log.Error("failed to init repository", "err", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		commitCallback = func() error {
-			return os.Rename(dir, repositoryPath)
-		}
-	} else {
-		repo, err = git.OpenRepository(repositoryPath)
+	if async {
+		job, err := h.importQueue.Enqueue(
+			repositoryName,
+			tempfile.Name(),
+			level,
+			username,
+			&requestContext.Request,
+			options,
+		)
 		if err != nil {
-			h.log.Error("failed to open repository", "err", err)
+			h.log.Error("failed to enqueue the import job", "path", repositoryPath, "err", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-	}
-	defer repo.Free()
+		h.log.Info("import job enqueued", "path", repositoryPath, "job", job.ID)
 
-	lockfile := githttp.NewLockfile(repo.Path())
-	if ok, err := lockfile.TryRLock(); !ok {
-		h.log.Info("Waiting for the lockfile", "err", err)
-		if err := lockfile.RLock(); err != nil {
-			h.log.Crit("Failed to acquire the lockfile", "err", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "\t")
+		encoder.Encode(job)
+		return
 	}
-	defer lockfile.Unlock()
 
-	updateResult, err := PushZip(
+	updateResult, err := pushZipUpload(
 		ctx,
+		repositoryPath,
 		&zipReader.Reader,
 		level,
-		repo,
-		lockfile,
 		username,
-		commitMessage,
-		problemSettings,
-		zipMergeStrategy,
-		acceptsSubmissions,
-		updatePublished,
+		options,
+		dryRun,
 		h.protocol,
+		h.metrics,
 		h.log,
 	)
+	if !dryRun {
+		summaryObserveWithLabels(
+			h.metrics,
+			"gitserver_zip_upload_duration_seconds",
+			time.Since(start).Seconds(),
+			outcomeLabels(err),
+		)
+	}
 	if err != nil {
-		h.log.Error("push failed", "path", repositoryPath, "err", err)
+		h.log.Error("push failed", "path", repositoryPath, "dryRun", dryRun, "err", err)
 		cause := githttp.WriteHeader(w, err, false)
 
 		updateResult = &UpdateResult{
-			Status: "error",
-			Error:  cause.Error(),
+			Status:   "error",
+			Error:    cause.Error(),
+			Warnings: requestContext.Warnings,
+			DryRun:   dryRun,
 		}
 	} else {
-		if err := commitCallback(); err != nil {
-			h.log.Info("push successful, but commit failed", "path", repositoryPath, "result", updateResult, "err", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		h.log.Info("push successful", "path", repositoryPath, "result", updateResult)
+		h.log.Info("push successful", "path", repositoryPath, "dryRun", dryRun, "result", updateResult)
 		w.WriteHeader(http.StatusOK)
 	}
 
@@ -1624,17 +2103,76 @@ func (h *zipUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	encoder.Encode(&updateResult)
 }
 
+// serveImportJob reports the status of an asynchronous .zip import.
+func (h *zipUploadHandler) serveImportJob(
+	w http.ResponseWriter,
+	r *http.Request,
+	repositoryName string,
+	jobID string,
+) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := request.NewContext(r.Context(), h.metrics)
+	requestContext := request.FromContext(ctx)
+	requestContext.Request.RemoteAddr = r.RemoteAddr
+
+	level, username := h.protocol.AuthCallback(ctx, w, r, repositoryName, githttp.OperationPull)
+	if level == githttp.AuthorizationDenied {
+		return
+	}
+
+	job, err := h.importQueue.Get(jobID)
+	if err != nil || job.Repository != repositoryName {
+		h.log.Error("import job not found", "repository", repositoryName, "job", jobID, "err", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if username != job.Username && !requestContext.Request.IsAdmin {
+		h.log.Error(
+			"cannot access the import job due to not having permissions",
+			"job", jobID,
+			"request", requestContext.Request,
+		)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "\t")
+	encoder.Encode(job)
+}
+
 // ZipHandler is the HTTP handler that allows uploading .zip files.
 func ZipHandler(
 	rootPath string,
 	protocol *githttp.GitProtocol,
 	metrics base.Metrics,
 	log log15.Logger,
+) http.Handler {
+	return AsyncZipHandler(rootPath, protocol, nil, metrics, log)
+}
+
+// AsyncZipHandler is the same as ZipHandler, but it also allows uploading
+// .zip files asynchronously with the async=true parameter. The uploads are
+// imported by the workers of the import queue, and their status can be
+// polled with a GET request to git-upload-zip/<job id>.
+func AsyncZipHandler(
+	rootPath string,
+	protocol *githttp.GitProtocol,
+	importQueue *ZipImportQueue,
+	metrics base.Metrics,
+	log log15.Logger,
 ) http.Handler {
 	return &zipUploadHandler{
-		rootPath: rootPath,
-		protocol: protocol,
-		metrics:  metrics,
-		log:      log,
+		rootPath:    rootPath,
+		protocol:    protocol,
+		importQueue: importQueue,
+		metrics:     metrics,
+		log:         log,
 	}
 }
@@ -3,6 +3,7 @@ package gitserver
 import (
 	"archive/zip"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -184,6 +185,223 @@ func TestPushZip(t *testing.T) {
 	}
 }
 
+func TestDryRunZip(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+
+	log := base.StderrLog()
+	ts := httptest.NewServer(ZipHandler(
+		tmpDir,
+		NewGitProtocol(authorize, nil, true, OverallWallTimeHardLimit, fakeInteractiveSettingsCompiler, log),
+		&base.NoOpMetrics{},
+		log,
+	))
+	defer ts.Close()
+
+	problemAlias := "sumas"
+
+	{
+		zipContents, err := gitservertest.CreateZip(
+			map[string]io.Reader{
+				"settings.json":          strings.NewReader(gitservertest.DefaultSettingsJSON),
+				"cases/0.in":             strings.NewReader("1 2\n"),
+				"cases/0.out":            strings.NewReader("3\n"),
+				"statements/es.markdown": strings.NewReader("Sumas\n"),
+			},
+		)
+		if err != nil {
+			t.Fatalf("Failed to create zip: %v", err)
+		}
+		postZip(
+			t,
+			adminAuthorization,
+			problemAlias,
+			nil,
+			ZipMergeStrategyTheirs,
+			zipContents,
+			"initial commit",
+			true, // create
+			true, // useMultipartFormData
+			ts,
+		)
+	}
+
+	repo, err := git.OpenRepository(path.Join(tmpDir, problemAlias))
+	if err != nil {
+		t.Fatalf("Failed to open repository: %v", err)
+	}
+	defer repo.Free()
+	masterRef, err := repo.References.Lookup("refs/heads/master")
+	if err != nil {
+		t.Fatalf("Failed to lookup master: %v", err)
+	}
+	originalMasterOid := masterRef.Target()
+	masterRef.Free()
+
+	dryRun := func(contents map[string]io.Reader) (int, *UpdateResult) {
+		zipContents, err := gitservertest.CreateZip(contents)
+		if err != nil {
+			t.Fatalf("Failed to create zip: %v", err)
+		}
+		pushURL, err := url.Parse(ts.URL + "/" + problemAlias + "/git-upload-zip")
+		if err != nil {
+			t.Fatalf("Failed to parse URL: %v", err)
+		}
+		query := url.Values{}
+		query.Set("message", "dry run")
+		query.Set("mergeStrategy", ZipMergeStrategyTheirs.String())
+		query.Set("dryRun", "true")
+		pushURL.RawQuery = query.Encode()
+		req := &http.Request{
+			URL:    pushURL,
+			Method: "POST",
+			Body:   ioutil.NopCloser(bytes.NewReader(zipContents)),
+			Header: map[string][]string{
+				"Authorization": {adminAuthorization},
+				"Content-Type":  {"application/zip"},
+			},
+		}
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Failed to upload zip: %v", err)
+		}
+		defer res.Body.Close()
+
+		var updateResult UpdateResult
+		if err := json.NewDecoder(res.Body).Decode(&updateResult); err != nil {
+			t.Fatalf("Failed to unmarshal updateResult: %v", err)
+		}
+		return res.StatusCode, &updateResult
+	}
+
+	statusCode, updateResult := dryRun(map[string]io.Reader{
+		"settings.json":          strings.NewReader(gitservertest.DefaultSettingsJSON),
+		"cases/0.in":             strings.NewReader("1 2\n"),
+		"cases/0.out":            strings.NewReader("3\n"),
+		"statements/es.markdown": strings.NewReader("Sumas de enteros\n"),
+	})
+	if statusCode != http.StatusOK {
+		t.Fatalf("Unexpected status %d for the dry run: %v", statusCode, updateResult)
+	}
+	if !updateResult.DryRun || updateResult.Status != "ok" {
+		t.Errorf("Unexpected result %v", updateResult)
+	}
+	expectedUpdatedFiles := []UpdatedFile{
+		{Path: "statements/es.markdown", Type: "modified"},
+	}
+	if !reflect.DeepEqual(expectedUpdatedFiles, updateResult.UpdatedFiles) {
+		t.Errorf("Expected updated files %v, got %v", expectedUpdatedFiles, updateResult.UpdatedFiles)
+	}
+	var settings common.ProblemSettings
+	if err := json.Unmarshal(updateResult.Settings, &settings); err != nil {
+		t.Errorf("Failed to unmarshal the settings %q: %v", string(updateResult.Settings), err)
+	}
+	if len(updateResult.DistribSettings) == 0 {
+		t.Errorf("Expected the distributable settings to be reported")
+	}
+
+	// The dry run did not touch the repository.
+	masterRef, err = repo.References.Lookup("refs/heads/master")
+	if err != nil {
+		t.Fatalf("Failed to lookup master: %v", err)
+	}
+	if !masterRef.Target().Equal(originalMasterOid) {
+		t.Errorf("Expected master to remain at %s, got %s", originalMasterOid, masterRef.Target())
+	}
+	masterRef.Free()
+	for _, updatedRef := range updateResult.UpdatedRefs {
+		if updatedRef.Name != "refs/heads/master" {
+			continue
+		}
+		newOid, err := git.NewOid(updatedRef.To)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", updatedRef.To, err)
+		}
+		if commit, err := repo.LookupCommit(newOid); err == nil {
+			commit.Free()
+			t.Errorf("Expected the dry run commit %s to not be written into the repository", newOid)
+		}
+	}
+
+	// Errors are reported with their category.
+	statusCode, updateResult = dryRun(map[string]io.Reader{
+		"settings.json":          strings.NewReader("{"),
+		"cases/0.in":             strings.NewReader("1 2\n"),
+		"cases/0.out":            strings.NewReader("3\n"),
+		"statements/es.markdown": strings.NewReader("Sumas\n"),
+	})
+	if statusCode == http.StatusOK || updateResult.Status != "error" || updateResult.Error == "" || !updateResult.DryRun {
+		t.Errorf("Unexpected result for the invalid dry run: %d %v", statusCode, updateResult)
+	}
+}
+
+func TestPushZipWarnings(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+
+	log := base.StderrLog()
+	ts := httptest.NewServer(ZipHandler(
+		tmpDir,
+		NewGitProtocol(authorize, nil, true, OverallWallTimeHardLimit, fakeInteractiveSettingsCompiler, log),
+		&base.NoOpMetrics{},
+		log,
+	))
+	defer ts.Close()
+
+	zipContents, err := gitservertest.CreateZip(
+		map[string]io.Reader{
+			"settings.json":          strings.NewReader(gitservertest.DefaultSettingsJSON),
+			"cases/0.in":             strings.NewReader("1 2\n"),
+			"cases/0.out":            strings.NewReader("3\n"),
+			"statements/es.markdown": strings.NewReader("Sumas\n"),
+			"statements/en.markdown": bytes.NewReader([]byte{0x50, 0x6F, 0x6B, 0xE9, 0x6D, 0x6F, 0x6E}),
+			".gitattributes":         strings.NewReader("* -text\n"),
+			"notes.txt":              strings.NewReader("Do not forget the tests\n"),
+		},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create zip: %v", err)
+	}
+	updateResult := postZip(
+		t,
+		adminAuthorization,
+		"sumas",
+		nil,
+		ZipMergeStrategyTheirs,
+		zipContents,
+		"initial commit",
+		true, // create
+		true, // useMultipartFormData
+		ts,
+	)
+
+	warnings := make(map[string]string)
+	for _, warning := range updateResult.Warnings {
+		if warning.Message == "" {
+			t.Errorf("Missing message for warning %v", warning)
+		}
+		warnings[warning.Path] = warning.Code
+	}
+	expectedWarnings := map[string]string{
+		"notes.txt":              WarningSkippedFile,
+		".gitattributes":         WarningOverwrittenFile,
+		"statements/en.markdown": WarningConvertedEncoding,
+	}
+	if !reflect.DeepEqual(expectedWarnings, warnings) {
+		t.Errorf("Expected warnings %v, got %v", expectedWarnings, updateResult.Warnings)
+	}
+}
+
 func TestConvertZip(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", t.Name())
 	if err != nil {
@@ -225,6 +443,7 @@ func TestConvertZip(t *testing.T) {
 	commitMessage := "Initial commit"
 
 	zipOid, err := ConvertZipToPackfile(
+		context.Background(),
 		zipReader,
 		nil,
 		ZipMergeStrategyTheirs,
@@ -312,6 +531,7 @@ func TestTestplan(t *testing.T) {
 		commitMessage := "Initial commit"
 
 		_, err = ConvertZipToPackfile(
+			context.Background(),
 			zipReader,
 			nil,
 			ZipMergeStrategyTheirs,
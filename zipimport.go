@@ -0,0 +1,526 @@
+package gitserver
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	git "github.com/lhchavez/git2go/v29"
+	"github.com/omegaup/githttp"
+	"github.com/omegaup/gitserver/request"
+	base "github.com/omegaup/go-base"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ZipImportJobStateQueued is the state of an import job that has not
+	// started running yet.
+	ZipImportJobStateQueued = "queued"
+
+	// ZipImportJobStateRunning is the state of an import job that is being
+	// imported.
+	ZipImportJobStateRunning = "running"
+
+	// ZipImportJobStateDone is the state of an import job that finished. The
+	// result of the job tells whether it succeeded.
+	ZipImportJobStateDone = "done"
+
+	// zipImportJobTrailer is the trailer of the commit message that records
+	// which import job created the commit.
+	zipImportJobTrailer = "Zip-Import-Job"
+)
+
+var (
+	// zipImportJobIDRegexp matches the identifiers returned by newQueueID.
+	zipImportJobIDRegexp = regexp.MustCompile("^[0-9]{20}-[0-9a-f]{16}$")
+)
+
+// ZipImportJobStatus is the status of an asynchronous .zip import.
+type ZipImportJobStatus struct {
+	ID         string        `json:"id"`
+	Repository string        `json:"repository"`
+	Username   string        `json:"username"`
+	State      string        `json:"state"`
+	CreatedAt  time.Time     `json:"created_at"`
+	UpdatedAt  time.Time     `json:"updated_at"`
+	Result     *UpdateResult `json:"result,omitempty"`
+}
+
+// zipImportJob is an import job, as stored in the queue. It has everything
+// that is needed to run it after the server restarts.
+type zipImportJob struct {
+	ZipImportJobStatus
+	AuthorizationLevel githttp.AuthorizationLevel `json:"authorization_level"`
+	Request            request.Request            `json:"request"`
+	Options            ZipUploadOptions           `json:"options"`
+
+	// MasterOid is the commit that master pointed to when the job started
+	// running. If the server stops while the job is running, it is used to
+	// find out whether the job was already pushed.
+	MasterOid string `json:"master_oid,omitempty"`
+}
+
+// ZipImportQueue is a durable queue of .zip uploads that are imported in the
+// background by a bounded number of workers. Every job is stored in the queue
+// directory along with its .zip file, so jobs that were pending when the
+// server stopped are imported when it starts again. The jobs of a repository
+// are imported one at a time, in the order in which they were enqueued. Finished jobs are kept
+// around for Retention so that their result can be queried.
+type ZipImportQueue struct {
+	// PollInterval is the amount of time between scans of the queue directory
+	// for jobs that are ready to run.
+	PollInterval time.Duration
+
+	// Retention is the amount of time that finished jobs are kept.
+	Retention time.Duration
+
+	// Webhooks, if set, get notified of the references that the jobs update.
+	Webhooks *WebhookQueue
+
+	// Publisher, if set, gets notified of the repositories that the jobs
+	// update.
+	Publisher *Publisher
+
+	queuePath string
+	rootPath  string
+	protocol  *githttp.GitProtocol
+	metrics   base.Metrics
+	log       log15.Logger
+
+	wakeup chan struct{}
+	mu     sync.Mutex
+	// inflight maps the jobs that are running to their repository.
+	inflight map[string]string
+	wg       sync.WaitGroup
+}
+
+// NewZipImportQueue returns a new ZipImportQueue that stores its jobs in
+// queuePath and imports them into the repositories in rootPath.
+func NewZipImportQueue(
+	queuePath string,
+	rootPath string,
+	protocol *githttp.GitProtocol,
+	metrics base.Metrics,
+	log log15.Logger,
+) (*ZipImportQueue, error) {
+	if err := os.MkdirAll(queuePath, 0755); err != nil {
+		return nil, errors.Wrapf(err, "failed to create the import queue at %s", queuePath)
+	}
+	return &ZipImportQueue{
+		PollInterval: 5 * time.Second,
+		Retention:    7 * 24 * time.Hour,
+		queuePath:    queuePath,
+		rootPath:     rootPath,
+		protocol:     protocol,
+		metrics:      metrics,
+		log:          log,
+		wakeup:       make(chan struct{}, 1),
+		inflight:     make(map[string]string),
+	}, nil
+}
+
+// tempFile creates a temporary file in the queue directory, which can be
+// enqueued without copying it.
+func (q *ZipImportQueue) tempFile() (*os.File, error) {
+	f, err := ioutil.TempFile(q.queuePath, ".tmp-")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create the import job file")
+	}
+	return f, nil
+}
+
+// Enqueue stores a job that imports the .zip file at zipPath into the
+// repository. The .zip file is moved into the queue, so it must be in the same
+// filesystem.
+func (q *ZipImportQueue) Enqueue(
+	repositoryName string,
+	zipPath string,
+	level githttp.AuthorizationLevel,
+	username string,
+	req *request.Request,
+	options *ZipUploadOptions,
+) (*ZipImportJobStatus, error) {
+	now := time.Now()
+	job := &zipImportJob{
+		ZipImportJobStatus: ZipImportJobStatus{
+			ID:         newQueueID(now),
+			Repository: repositoryName,
+			Username:   username,
+			State:      ZipImportJobStateQueued,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		},
+		AuthorizationLevel: level,
+		Request:            *req,
+		Options:            *options,
+	}
+	if err := os.Rename(zipPath, q.zipPath(job.ID)); err != nil {
+		return nil, errors.Wrap(err, "failed to store the .zip file of the import job")
+	}
+	if err := q.write(job); err != nil {
+		os.Remove(q.zipPath(job.ID))
+		return nil, err
+	}
+
+	select {
+	case q.wakeup <- struct{}{}:
+	default:
+	}
+	return &job.ZipImportJobStatus, nil
+}
+
+// Get returns the status of the job.
+func (q *ZipImportQueue) Get(id string) (*ZipImportJobStatus, error) {
+	if !zipImportJobIDRegexp.MatchString(id) {
+		return nil, errors.Errorf("invalid import job id %q", id)
+	}
+	job, err := q.read(id)
+	if err != nil {
+		return nil, err
+	}
+	return &job.ZipImportJobStatus, nil
+}
+
+func (q *ZipImportQueue) zipPath(id string) string {
+	return path.Join(q.queuePath, id+".zip")
+}
+
+func (q *ZipImportQueue) write(job *zipImportJob) error {
+	contents, err := json.Marshal(job)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal the import job")
+	}
+	f, err := q.tempFile()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(contents); err != nil {
+		f.Close()
+		return errors.Wrap(err, "failed to write the import job")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "failed to write the import job")
+	}
+	if err := os.Rename(f.Name(), path.Join(q.queuePath, job.ID+".json")); err != nil {
+		return errors.Wrap(err, "failed to write the import job")
+	}
+	return nil
+}
+
+func (q *ZipImportQueue) read(id string) (*zipImportJob, error) {
+	contents, err := ioutil.ReadFile(path.Join(q.queuePath, id+".json"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the import job")
+	}
+	var job zipImportJob
+	if err := json.Unmarshal(contents, &job); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal the import job")
+	}
+	return &job, nil
+}
+
+// Start starts the workers that import the .zip files. They stop when the
+// context is cancelled.
+func (q *ZipImportQueue) Start(ctx context.Context, workers int) {
+	jobs := make(chan string)
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			for id := range jobs {
+				q.run(ctx, id)
+				q.mu.Lock()
+				delete(q.inflight, id)
+				q.mu.Unlock()
+				// The next job of the repository might be ready now.
+				select {
+				case q.wakeup <- struct{}{}:
+				default:
+				}
+			}
+		}()
+	}
+
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		defer close(jobs)
+		ticker := time.NewTicker(q.PollInterval)
+		defer ticker.Stop()
+		for {
+			for _, id := range q.ready() {
+				select {
+				case jobs <- id:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-q.wakeup:
+			}
+		}
+	}()
+}
+
+// Wait waits for all the workers to stop.
+func (q *ZipImportQueue) Wait() {
+	q.wg.Wait()
+}
+
+// ready returns the oldest job that has not finished of each of the
+// repositories that are not running a job already, and marks them as in
+// flight. Jobs that were running when the server stopped are checked and run
+// again. Finished jobs that are older than the retention period are removed.
+func (q *ZipImportQueue) ready() []string {
+	entries, err := ioutil.ReadDir(q.queuePath)
+	if err != nil {
+		q.log.Error("Failed to list the import queue", "err", err)
+		return nil
+	}
+	now := time.Now()
+	var ids []string
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	busy := make(map[string]bool)
+	for _, repository := range q.inflight {
+		busy[repository] = true
+	}
+	// The entries are sorted by name, and the identifiers sort in the order in
+	// which the jobs were enqueued.
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		if _, ok := q.inflight[id]; ok {
+			continue
+		}
+		job, err := q.read(id)
+		if err != nil {
+			q.log.Error("Failed to read an import job", "id", id, "err", err)
+			continue
+		}
+		if job.State == ZipImportJobStateDone {
+			if now.Sub(job.UpdatedAt) > q.Retention {
+				if err := os.Remove(path.Join(q.queuePath, id+".json")); err != nil {
+					q.log.Error("Failed to remove an import job", "id", id, "err", err)
+				}
+			}
+			continue
+		}
+		if busy[job.Repository] {
+			continue
+		}
+		busy[job.Repository] = true
+		q.inflight[id] = job.Repository
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// run imports the .zip file of the job and stores its result.
+func (q *ZipImportQueue) run(ctx context.Context, id string) {
+	job, err := q.read(id)
+	if err != nil {
+		q.log.Error("Failed to read an import job", "id", id, "err", err)
+		return
+	}
+
+	requestCtx := request.NewContext(ctx, q.metrics)
+	requestContext := request.FromContext(requestCtx)
+	requestContext.Request = job.Request
+
+	var updateResult *UpdateResult
+	if job.State == ZipImportJobStateRunning {
+		// The server stopped while the job was running, so it might have
+		// been pushed already.
+		updateResult = q.findPushedJob(job)
+	}
+	if updateResult != nil {
+		q.log.Info("import job was already pushed", "id", id, "repository", job.Repository, "result", updateResult)
+		requestContext.UpdatedRefs = updateResult.UpdatedRefs
+	} else {
+		job.State = ZipImportJobStateRunning
+		job.UpdatedAt = time.Now()
+		job.MasterOid = q.masterOid(job.Repository).String()
+		if err := q.write(job); err != nil {
+			q.log.Error("Failed to update an import job", "id", id, "err", err)
+			return
+		}
+
+		start := time.Now()
+		updateResult, err = q.importZip(requestCtx, job)
+		if ctx.Err() != nil {
+			// The server is shutting down. The job stays running, so that it
+			// is checked and run again once the server starts.
+			return
+		}
+		summaryObserveWithLabels(
+			q.metrics,
+			"gitserver_zip_upload_duration_seconds",
+			time.Since(start).Seconds(),
+			outcomeLabels(err),
+		)
+		if err != nil {
+			q.log.Error("import job failed", "id", id, "repository", job.Repository, "err", err)
+			updateResult = &UpdateResult{
+				Status:   "error",
+				Error:    err.Error(),
+				Warnings: requestContext.Warnings,
+			}
+		} else {
+			q.log.Info("import job successful", "id", id, "repository", job.Repository, "result", updateResult)
+		}
+	}
+
+	job.State = ZipImportJobStateDone
+	job.UpdatedAt = time.Now()
+	job.Result = updateResult
+	if err := q.write(job); err != nil {
+		q.log.Error("Failed to update an import job", "id", id, "err", err)
+		return
+	}
+	if err := os.Remove(q.zipPath(id)); err != nil && !os.IsNotExist(err) {
+		q.log.Error("Failed to remove the .zip file of an import job", "id", id, "err", err)
+	}
+
+	if q.Webhooks != nil {
+		q.Webhooks.EnqueueRequest(requestCtx, q.rootPath, job.Repository, q.log)
+	}
+	if q.Publisher != nil && err == nil {
+		q.Publisher.Notify(job.Repository)
+	}
+}
+
+// masterOid returns the commit that master of the repository points to, or
+// the zero oid if the repository or master do not exist yet.
+func (q *ZipImportQueue) masterOid(repositoryName string) *git.Oid {
+	repository, err := git.OpenRepository(path.Join(q.rootPath, repositoryName))
+	if err != nil {
+		return &git.Oid{}
+	}
+	defer repository.Free()
+	masterRef, err := repository.References.Lookup("refs/heads/master")
+	if err != nil {
+		return &git.Oid{}
+	}
+	defer masterRef.Free()
+	return masterRef.Target()
+}
+
+// zipImportCommitMessage returns the commit message of the job, with the
+// trailer that identifies it.
+func zipImportCommitMessage(job *zipImportJob) string {
+	return fmt.Sprintf(
+		"%s\n\n%s: %s\n",
+		strings.TrimRight(job.Options.CommitMessage, "\n"),
+		zipImportJobTrailer,
+		job.ID,
+	)
+}
+
+// hasZipImportJobTrailer returns whether the commit message has the trailer
+// of the job.
+func hasZipImportJobTrailer(message string, job *zipImportJob) bool {
+	trailer := fmt.Sprintf("%s: %s", zipImportJobTrailer, job.ID)
+	for _, line := range strings.Split(message, "\n") {
+		if line == trailer {
+			return true
+		}
+	}
+	return false
+}
+
+// findPushedJob returns the result of a job that was running when the server
+// stopped if its commit already made it to master, or nil if it needs to be
+// run again. The commit is one of the commits that were added to master
+// after the job started running, with the trailer of the job.
+func (q *ZipImportQueue) findPushedJob(job *zipImportJob) *UpdateResult {
+	if job.MasterOid == "" {
+		return nil
+	}
+	startOid, err := git.NewOid(job.MasterOid)
+	if err != nil {
+		return nil
+	}
+	repository, err := git.OpenRepository(path.Join(q.rootPath, job.Repository))
+	if err != nil {
+		return nil
+	}
+	defer repository.Free()
+	masterRef, err := repository.References.Lookup("refs/heads/master")
+	if err != nil {
+		return nil
+	}
+	defer masterRef.Free()
+
+	commit, err := repository.LookupCommit(masterRef.Target())
+	if err != nil {
+		return nil
+	}
+	for commit != nil && !commit.Id().Equal(startOid) {
+		if hasZipImportJobTrailer(commit.Message(), job) {
+			result := &UpdateResult{
+				Status: "ok",
+				UpdatedRefs: []githttp.UpdatedRef{
+					{
+						Name: "refs/heads/master",
+						From: startOid.String(),
+						To:   commit.Id().String(),
+					},
+				},
+			}
+			commit.Free()
+			return result
+		}
+		parent := commit.Parent(0)
+		commit.Free()
+		commit = parent
+	}
+	if commit != nil {
+		commit.Free()
+	}
+	return nil
+}
+
+func (q *ZipImportQueue) importZip(ctx context.Context, job *zipImportJob) (*UpdateResult, error) {
+	zipReader, err := zip.OpenReader(q.zipPath(job.ID))
+	if err != nil {
+		return nil, base.ErrorWithCategory(
+			githttp.ErrBadRequest,
+			errors.Wrap(
+				err,
+				"failed to read zip",
+			),
+		)
+	}
+	defer zipReader.Close()
+
+	options := job.Options
+	options.CommitMessage = zipImportCommitMessage(job)
+	return pushZipUpload(
+		ctx,
+		path.Join(q.rootPath, job.Repository),
+		&zipReader.Reader,
+		job.AuthorizationLevel,
+		job.Username,
+		&options,
+		false,
+		q.protocol,
+		q.metrics,
+		q.log,
+	)
+}
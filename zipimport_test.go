@@ -0,0 +1,350 @@
+package gitserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	git "github.com/lhchavez/git2go/v29"
+	"github.com/omegaup/githttp"
+	"github.com/omegaup/gitserver/gitservertest"
+	base "github.com/omegaup/go-base"
+)
+
+func getImportJob(
+	t *testing.T,
+	authorization string,
+	problemAlias string,
+	jobID string,
+	ts *httptest.Server,
+) (int, *ZipImportJobStatus) {
+	t.Helper()
+	statusURL, err := url.Parse(ts.URL + "/" + problemAlias + "/git-upload-zip/" + jobID)
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %v", err)
+	}
+	req := &http.Request{
+		URL:    statusURL,
+		Method: "GET",
+		Header: map[string][]string{
+			"Authorization": {authorization},
+		},
+	}
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Failed to get the import job: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return res.StatusCode, nil
+	}
+
+	var job ZipImportJobStatus
+	if err := json.NewDecoder(res.Body).Decode(&job); err != nil {
+		t.Fatalf("Failed to unmarshal the import job: %v", err)
+	}
+	return res.StatusCode, &job
+}
+
+func TestZipImportQueue(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+
+	log := base.StderrLog()
+	rootPath := path.Join(tmpDir, "repositories")
+	queuePath := path.Join(tmpDir, "queue")
+	if err := os.MkdirAll(rootPath, 0755); err != nil {
+		t.Fatalf("Failed to create the root directory: %v", err)
+	}
+	protocol := NewGitProtocol(authorize, nil, true, OverallWallTimeHardLimit, fakeInteractiveSettingsCompiler, log)
+
+	queue, err := NewZipImportQueue(queuePath, rootPath, protocol, &base.NoOpMetrics{}, log)
+	if err != nil {
+		t.Fatalf("Failed to create the import queue: %v", err)
+	}
+	ts := httptest.NewServer(AsyncZipHandler(rootPath, protocol, queue, &base.NoOpMetrics{}, log))
+	defer ts.Close()
+
+	problemAlias := "sumas"
+
+	zipContents, err := gitservertest.CreateZip(
+		map[string]io.Reader{
+			"settings.json":          strings.NewReader(gitservertest.DefaultSettingsJSON),
+			"cases/0.in":             strings.NewReader("1 2\n"),
+			"cases/0.out":            strings.NewReader("3\n"),
+			"statements/es.markdown": strings.NewReader("Sumas\n"),
+		},
+	)
+	if err != nil {
+		t.Fatalf("Failed to create zip: %v", err)
+	}
+	pushURL, err := url.Parse(ts.URL + "/" + problemAlias + "/git-upload-zip")
+	if err != nil {
+		t.Fatalf("Failed to parse URL: %v", err)
+	}
+	query := url.Values{}
+	query.Set("message", "initial commit")
+	query.Set("mergeStrategy", ZipMergeStrategyTheirs.String())
+	query.Set("async", "true")
+	query.Set("create", "1")
+	pushURL.RawQuery = query.Encode()
+	res, err := ts.Client().Do(&http.Request{
+		URL:    pushURL,
+		Method: "POST",
+		Body:   ioutil.NopCloser(bytes.NewReader(zipContents)),
+		Header: map[string][]string{
+			"Authorization": {adminAuthorization},
+			"Content-Type":  {"application/zip"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to upload zip: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected status %d, got %d", http.StatusAccepted, res.StatusCode)
+	}
+	var enqueuedJob ZipImportJobStatus
+	if err := json.NewDecoder(res.Body).Decode(&enqueuedJob); err != nil {
+		t.Fatalf("Failed to unmarshal the import job: %v", err)
+	}
+	if enqueuedJob.State != ZipImportJobStateQueued || enqueuedJob.Repository != problemAlias {
+		t.Fatalf("Unexpected import job %v", enqueuedJob)
+	}
+
+	// The workers have not been started, so nothing has been imported yet.
+	if _, err := os.Stat(path.Join(rootPath, problemAlias)); !os.IsNotExist(err) {
+		t.Errorf("Expected the repository to not exist yet: %v", err)
+	}
+	if status, job := getImportJob(t, adminAuthorization, problemAlias, enqueuedJob.ID, ts); status != http.StatusOK || job.State != ZipImportJobStateQueued {
+		t.Errorf("Unexpected import job %d %v", status, job)
+	}
+	if status, _ := getImportJob(t, userAuthorization, problemAlias, enqueuedJob.ID, ts); status != http.StatusForbidden {
+		t.Errorf("Expected status %d for another user, got %d", http.StatusForbidden, status)
+	}
+	if status, _ := getImportJob(t, adminAuthorization, problemAlias, "../queue", ts); status != http.StatusNotFound {
+		t.Errorf("Expected status %d for an invalid job, got %d", http.StatusNotFound, status)
+	}
+
+	// Jobs survive a restart of the queue.
+	restartedQueue, err := NewZipImportQueue(queuePath, rootPath, protocol, &base.NoOpMetrics{}, log)
+	if err != nil {
+		t.Fatalf("Failed to create the import queue: %v", err)
+	}
+	restartedQueue.PollInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	restartedQueue.Start(ctx, 2)
+	defer func() {
+		cancel()
+		restartedQueue.Wait()
+	}()
+
+	var job *ZipImportJobStatus
+	for deadline := time.Now().Add(30 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if job, err = restartedQueue.Get(enqueuedJob.ID); err != nil {
+			t.Fatalf("Failed to get the import job: %v", err)
+		}
+		if job.State == ZipImportJobStateDone {
+			break
+		}
+	}
+	if job.State != ZipImportJobStateDone {
+		t.Fatalf("Import job did not finish: %v", job)
+	}
+	if job.Result == nil || job.Result.Status != "ok" {
+		t.Fatalf("Unexpected result for the import job: %v", job.Result)
+	}
+	if _, err := os.Stat(path.Join(rootPath, problemAlias)); err != nil {
+		t.Errorf("Expected the repository to be created: %v", err)
+	}
+	if _, err := os.Stat(path.Join(queuePath, enqueuedJob.ID+".zip")); !os.IsNotExist(err) {
+		t.Errorf("Expected the .zip file of the finished job to be removed: %v", err)
+	}
+
+	// A job that was interrupted after it was pushed is not pushed again.
+	masterOid := restartedQueue.masterOid(problemAlias)
+	{
+		interruptedJob, err := restartedQueue.read(enqueuedJob.ID)
+		if err != nil {
+			t.Fatalf("Failed to read the import job: %v", err)
+		}
+		interruptedJob.State = ZipImportJobStateRunning
+		interruptedJob.Result = nil
+		if err := restartedQueue.write(interruptedJob); err != nil {
+			t.Fatalf("Failed to write the import job: %v", err)
+		}
+		select {
+		case restartedQueue.wakeup <- struct{}{}:
+		default:
+		}
+	}
+	for deadline := time.Now().Add(30 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if job, err = restartedQueue.Get(enqueuedJob.ID); err != nil {
+			t.Fatalf("Failed to get the import job: %v", err)
+		}
+		if job.State == ZipImportJobStateDone {
+			break
+		}
+	}
+	if job.State != ZipImportJobStateDone || job.Result == nil || job.Result.Status != "ok" {
+		t.Fatalf("Unexpected interrupted import job: %v %v", job, job.Result)
+	}
+	if len(job.Result.UpdatedRefs) != 1 || job.Result.UpdatedRefs[0].To != masterOid.String() {
+		t.Errorf("Unexpected updated refs %v", job.Result.UpdatedRefs)
+	}
+	if newMasterOid := restartedQueue.masterOid(problemAlias); !newMasterOid.Equal(masterOid) {
+		t.Errorf("Expected master to stay at %s, got %s", masterOid, newMasterOid)
+	}
+}
+
+func TestZipImportQueueOrder(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+
+	log := base.StderrLog()
+	queue, err := NewZipImportQueue(path.Join(tmpDir, "queue"), tmpDir, nil, &base.NoOpMetrics{}, log)
+	if err != nil {
+		t.Fatalf("Failed to create the import queue: %v", err)
+	}
+	now := time.Now()
+	var ids []string
+	for i, repository := range []string{"sumas", "restas", "sumas"} {
+		id := newQueueID(now.Add(time.Duration(i) * time.Second))
+		if err := queue.write(&zipImportJob{
+			ZipImportJobStatus: ZipImportJobStatus{
+				ID:         id,
+				Repository: repository,
+				State:      ZipImportJobStateQueued,
+				CreatedAt:  now,
+				UpdatedAt:  now,
+			},
+		}); err != nil {
+			t.Fatalf("Failed to write the import job: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	// Only the oldest job of each repository is ready.
+	if ready := queue.ready(); len(ready) != 2 || ready[0] != ids[0] || ready[1] != ids[1] {
+		t.Errorf("Expected %v to be ready, got %v", ids[:2], ready)
+	}
+	if ready := queue.ready(); len(ready) != 0 {
+		t.Errorf("Expected no jobs to be ready while the others run, got %v", ready)
+	}
+
+	// Once the first job of a repository is done, the next one is ready.
+	job, err := queue.read(ids[0])
+	if err != nil {
+		t.Fatalf("Failed to read the import job: %v", err)
+	}
+	job.State = ZipImportJobStateDone
+	if err := queue.write(job); err != nil {
+		t.Fatalf("Failed to write the import job: %v", err)
+	}
+	delete(queue.inflight, ids[0])
+	if ready := queue.ready(); len(ready) != 1 || ready[0] != ids[2] {
+		t.Errorf("Expected %v to be ready, got %v", ids[2:], ready)
+	}
+}
+
+func TestFindPushedJob(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if os.Getenv("PRESERVE") == "" {
+		defer os.RemoveAll(tmpDir)
+	}
+
+	log := base.StderrLog()
+	problemAlias := "sumas"
+	repo, err := InitRepository(path.Join(tmpDir, problemAlias))
+	if err != nil {
+		t.Fatalf("Failed to initialize git repository: %v", err)
+	}
+	defer repo.Free()
+
+	commitToMaster := func(message string) *git.Oid {
+		tree, err := githttp.BuildTree(
+			repo,
+			map[string]io.Reader{"statements/es.markdown": strings.NewReader(message)},
+			log,
+		)
+		if err != nil {
+			t.Fatalf("Failed to build tree: %v", err)
+		}
+		defer tree.Free()
+		var parents []*git.Commit
+		if masterRef, err := repo.References.Lookup("refs/heads/master"); err == nil {
+			parent, err := repo.LookupCommit(masterRef.Target())
+			masterRef.Free()
+			if err != nil {
+				t.Fatalf("Failed to lookup the master commit: %v", err)
+			}
+			defer parent.Free()
+			parents = append(parents, parent)
+		}
+		signature := &git.Signature{Name: "admin", Email: "admin@omegaup.com", When: time.Now()}
+		oid, err := repo.CreateCommit("refs/heads/master", signature, signature, message, tree, parents...)
+		if err != nil {
+			t.Fatalf("Failed to create commit: %v", err)
+		}
+		return oid
+	}
+
+	job := &zipImportJob{
+		ZipImportJobStatus: ZipImportJobStatus{
+			ID:         "00000000000000000001-0123456789abcdef",
+			Repository: problemAlias,
+			Username:   "admin",
+		},
+		Options: ZipUploadOptions{CommitMessage: "update statement"},
+	}
+	job.MasterOid = commitToMaster("initial commit").String()
+	queue := &ZipImportQueue{rootPath: tmpDir, log: log}
+
+	// A commit by the same user with the same message is not the commit of
+	// the job.
+	commitToMaster("update statement")
+	if result := queue.findPushedJob(job); result != nil {
+		t.Errorf("Expected the job to not be found, got %v", result)
+	}
+	otherJob := *job
+	otherJob.ID = "00000000000000000002-0123456789abcdef"
+	commitToMaster(zipImportCommitMessage(&otherJob))
+	if result := queue.findPushedJob(job); result != nil {
+		t.Errorf("Expected the job to not be found, got %v", result)
+	}
+
+	jobOid := commitToMaster(zipImportCommitMessage(job))
+	commitToMaster("a later commit")
+	result := queue.findPushedJob(job)
+	if result == nil {
+		t.Fatalf("Expected the job to be found")
+	}
+	if len(result.UpdatedRefs) != 1 ||
+		result.UpdatedRefs[0].From != job.MasterOid ||
+		result.UpdatedRefs[0].To != jobOid.String() {
+		t.Errorf("Unexpected updated refs %v", result.UpdatedRefs)
+	}
+}